@@ -1,6 +1,8 @@
 package acme
 
 import (
+	"context"
+	"encoding/base64"
 	"encoding/json"
 	"time"
 
@@ -8,16 +10,19 @@ import (
 	"github.com/smallstep/certificates/authority/provisioner"
 	"github.com/smallstep/cli/jose"
 	"github.com/smallstep/nosql"
+	"github.com/smallstep/nosql/database"
 )
 
 // Account is a subset of the internal account type containing only those
 // attributes required for responses in the ACME protocol.
 type Account struct {
-	Contact []string         `json:"contact,omitempty"`
-	Status  string           `json:"status"`
-	Orders  string           `json:"orders"`
-	ID      string           `json:"-"`
-	Key     *jose.JSONWebKey `json:"-"`
+	Contact              []string         `json:"contact,omitempty"`
+	Status               string           `json:"status"`
+	Orders               string           `json:"orders"`
+	TermsOfServiceAgreed bool             `json:"termsOfServiceAgreed,omitempty"`
+	ID                   string           `json:"-"`
+	Key                  *jose.JSONWebKey `json:"-"`
+	TermsOfService       string           `json:"-"`
 }
 
 // ToLog enables response logging.
@@ -46,73 +51,97 @@ func (a *Account) IsValid() bool {
 
 // AccountOptions are the options needed to create a new ACME account.
 type AccountOptions struct {
-	Key     *jose.JSONWebKey
-	Contact []string
+	Key                    *jose.JSONWebKey
+	Contact                []string
+	TermsOfServiceAgreed   bool
+	ExternalAccountBinding []byte
+	// ProvisionerID is the ID of the provisioner the account is created
+	// through.
+	ProvisionerID string
 }
 
 // account represents an ACME account.
 type account struct {
-	ID          string           `json:"id"`
-	Created     time.Time        `json:"created"`
-	Deactivated time.Time        `json:"deactivated"`
-	Key         *jose.JSONWebKey `json:"key"`
-	Contact     []string         `json:"contact,omitempty"`
-	Status      string           `json:"status"`
+	ID                string           `json:"id"`
+	Created           time.Time        `json:"created"`
+	Deactivated       time.Time        `json:"deactivated"`
+	Key               *jose.JSONWebKey `json:"key"`
+	Contact           []string         `json:"contact,omitempty"`
+	Status            string           `json:"status"`
+	TermsOfService    string           `json:"termsOfService,omitempty"`
+	ExternalAccountID string           `json:"externalAccountID,omitempty"`
+	ProvisionerID     string           `json:"provisionerID,omitempty"`
 }
 
-// newAccount returns a new acme account type.
-func newAccount(db nosql.DB, ops AccountOptions) (*account, error) {
+// newAccount returns a new acme account type. The terms of service and
+// external account ID are the ones the account has agreed to and been bound
+// to respectively, if any.
+func newAccount(db nosql.DB, ops AccountOptions, tos, eabID string) (*account, error) {
 	id, err := randID()
 	if err != nil {
 		return nil, err
 	}
 
 	a := &account{
-		ID:      id,
-		Key:     ops.Key,
-		Contact: ops.Contact,
-		Status:  "valid",
-		Created: clock.Now(),
+		ID:                id,
+		Key:               ops.Key,
+		Contact:           ops.Contact,
+		Status:            "valid",
+		Created:           clock.Now(),
+		TermsOfService:    tos,
+		ExternalAccountID: eabID,
+		ProvisionerID:     ops.ProvisionerID,
 	}
 	return a, a.saveNew(db)
 }
 
 // toACME converts the internal Account type into the public acmeAccount
 // type for presentation in the ACME protocol.
-func (a *account) toACME(db nosql.DB, dir *directory, p provisioner.Interface) (*Account, error) {
+func (a *account) toACME(ctx context.Context, db nosql.DB, dir *directory, p provisioner.Interface) (*Account, error) {
 	return &Account{
-		Status:  a.Status,
-		Contact: a.Contact,
-		Orders:  dir.getLink(OrdersByAccountLink, URLSafeProvisionerName(p), true, a.ID),
-		Key:     a.Key,
-		ID:      a.ID,
+		Status:               a.Status,
+		Contact:              a.Contact,
+		Orders:               dir.getLink(ctx, OrdersByAccountLink, URLSafeProvisionerName(p), true, a.ID),
+		TermsOfServiceAgreed: a.TermsOfService != "",
+		Key:                  a.Key,
+		ID:                   a.ID,
+		TermsOfService:       a.TermsOfService,
 	}, nil
 }
 
-// save writes the Account to the DB.
-// If the account is new then the necessary indices will be created.
-// Else, the account in the DB will be updated.
+// saveNew stores a new account together with its "account ID by key ID"
+// index entry and, for the accounts bound to an external account, its
+// "account ID by external account key ID" entry. An external account key
+// binds a single account.
 func (a *account) saveNew(db nosql.DB) error {
 	kid, err := keyToID(a.Key)
 	if err != nil {
 		return err
 	}
-	kidB := []byte(kid)
-
-	// Set the jwkID -> acme account ID index
-	_, swapped, err := db.CmpAndSwap(accountByKeyIDTable, kidB, nil, []byte(a.ID))
-	switch {
-	case err != nil:
-		return ServerInternalErr(errors.Wrap(err, "error setting key-id to account-id index"))
-	case !swapped:
-		return ServerInternalErr(errors.Errorf("key-id to account-id index already exists"))
-	default:
-		if err = a.save(db, nil); err != nil {
-			db.Del(accountByKeyIDTable, kidB)
-			return err
+	var eabKey string
+	if len(a.ExternalAccountID) > 0 {
+		eabKey = accountKeyIndex(a.ProvisionerID, a.ExternalAccountID)
+		switch _, err := db.Get(accountByEABKeyIDTable, []byte(eabKey)); {
+		case err == nil:
+			return UnauthorizedErr(errors.Errorf("external account %s is already "+
+				"bound to an account", a.ExternalAccountID))
+		case !nosql.IsErrNotFound(err):
+			return ServerInternalErr(errors.Wrapf(err, "error loading external account %s", a.ExternalAccountID))
 		}
-		return nil
 	}
+
+	tx := new(database.Tx)
+	if err := txInsert(tx, accountTable, a.ID, a); err != nil {
+		return err
+	}
+	txInsertBytes(tx, accountByKeyIDTable, accountKeyIndex(a.ProvisionerID, kid), []byte(a.ID))
+	if len(eabKey) > 0 {
+		txInsertBytes(tx, accountByEABKeyIDTable, eabKey, []byte(a.ID))
+	}
+	if err := commitInserts(db, tx); err != nil {
+		return Wrap(err, "error storing account")
+	}
+	return nil
 }
 
 func (a *account) save(db nosql.DB, old *account) error {
@@ -156,6 +185,17 @@ func (a *account) update(db nosql.DB, contact []string) (*account, error) {
 	return &b, nil
 }
 
+// agreeToTermsOfService records that the account agreed to the given terms
+// of service.
+func (a *account) agreeToTermsOfService(db nosql.DB, tos string) (*account, error) {
+	b := *a
+	b.TermsOfService = tos
+	if err := b.save(db, a); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
 // deactivate deactivates the acme account.
 func (a *account) deactivate(db nosql.DB) (*account, error) {
 	b := *a
@@ -184,9 +224,22 @@ func getAccountByID(db nosql.DB, id string) (*account, error) {
 	return a, nil
 }
 
-// getAccountByKeyID retrieves Id associated with the given Kid.
-func getAccountByKeyID(db nosql.DB, kid string) (*account, error) {
-	id, err := db.Get(accountByKeyIDTable, []byte(kid))
+// accountKeyIndex returns the key of the account with the given key ID in
+// the "account ID by key ID" index: the key ID scoped by the ID of the
+// provisioner of the account. Accounts without provisioner ID are indexed
+// by the key ID alone. Key IDs are base64url encoded, so the keys cannot
+// collide.
+func accountKeyIndex(provID, kid string) string {
+	if provID == "" {
+		return kid
+	}
+	return provID + "/" + kid
+}
+
+// getAccountByKeyID retrieves the account of the given provisioner with the
+// given Kid.
+func getAccountByKeyID(db nosql.DB, provID, kid string) (*account, error) {
+	id, err := db.Get(accountByKeyIDTable, []byte(accountKeyIndex(provID, kid)))
 	if err != nil {
 		if nosql.IsErrNotFound(err) {
 			return nil, MalformedErr(errors.Wrapf(err, "account with key id %s not found", kid))
@@ -212,3 +265,57 @@ func getOrderIDsByAccount(db nosql.DB, id string) ([]string, error) {
 	}
 	return orderIDs, nil
 }
+
+// verifyExternalAccountBinding verifies the external account binding of a
+// new-account request (RFC 8555, section 7.3.4) and returns the key
+// identifier of the external account.
+func verifyExternalAccountBinding(eab []byte, jwk *jose.JSONWebKey, url string, keys map[string]string) (string, error) {
+	jws, err := jose.ParseJWS(string(eab))
+	if err != nil {
+		return "", MalformedErr(errors.Wrap(err, "error parsing externalAccountBinding"))
+	}
+	if len(jws.Signatures) != 1 {
+		return "", MalformedErr(errors.New("externalAccountBinding must contain exactly one signature"))
+	}
+	hdr := jws.Signatures[0].Protected
+	switch hdr.Algorithm {
+	case jose.HS256, jose.HS384, jose.HS512:
+	default:
+		return "", MalformedErr(errors.Errorf("unsuitable externalAccountBinding algorithm: %s", hdr.Algorithm))
+	}
+	if len(hdr.Nonce) > 0 {
+		return "", MalformedErr(errors.New("externalAccountBinding must not contain a nonce"))
+	}
+	if u, _ := hdr.ExtraHeaders["url"].(string); u != url {
+		return "", MalformedErr(errors.Errorf("url header in externalAccountBinding (%s) "+
+			"does not match request url (%s)", u, url))
+	}
+	key, ok := keys[hdr.KeyID]
+	if !ok {
+		return "", UnauthorizedErr(errors.Errorf("external account %s not found", hdr.KeyID))
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(key)
+	if err != nil {
+		return "", ServerInternalErr(errors.Wrapf(err, "error decoding MAC key of external account %s", hdr.KeyID))
+	}
+	payload, err := jws.Verify(mac)
+	if err != nil {
+		return "", UnauthorizedErr(errors.Wrap(err, "error verifying externalAccountBinding"))
+	}
+	var bound jose.JSONWebKey
+	if err := json.Unmarshal(payload, &bound); err != nil {
+		return "", MalformedErr(errors.Wrap(err, "error unmarshaling externalAccountBinding payload"))
+	}
+	boundID, err := keyToID(&bound)
+	if err != nil {
+		return "", err
+	}
+	accID, err := keyToID(jwk)
+	if err != nil {
+		return "", err
+	}
+	if boundID != accID {
+		return "", UnauthorizedErr(errors.New("externalAccountBinding does not match account key"))
+	}
+	return hdr.KeyID, nil
+}
@@ -0,0 +1,165 @@
+package acme
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/url"
+	"testing"
+
+	"github.com/smallstep/certificates/authority/provisioner"
+	"github.com/smallstep/cli/jose"
+)
+
+// newTestAccountKey returns the public key of a new account key.
+func newTestAccountKey(t *testing.T) *jose.JSONWebKey {
+	t.Helper()
+	jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := jwk.Public()
+	return &pub
+}
+
+// newTestEAB returns an external account binding of the account key, signed
+// with the key of the external account, usually a MAC key.
+func newTestEAB(t *testing.T, alg jose.SignatureAlgorithm, kid string, signingKey interface{}, rawurl string, key *jose.JSONWebKey, nonce string) []byte {
+	t.Helper()
+	opts := new(jose.SignerOptions).WithHeader("kid", kid).WithHeader("url", rawurl)
+	if nonce != "" {
+		opts = opts.WithHeader("nonce", nonce)
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: alg, Key: signingKey}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jws, err := signer.Sign(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []byte(jws.FullSerialize())
+}
+
+// newTestDirectory returns the directory of an authority served at
+// https://ca.example.com/acme.
+func newTestDirectory(t *testing.T) *directory {
+	t.Helper()
+	base, err := url.Parse("https://ca.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newDirectory(base, "acme")
+}
+
+func TestTermsOfService(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+	opts := &ProvisionerOptions{Meta: &Meta{TermsOfService: "https://ca.example.com/tos/v1"}}
+	a := &Authority{db: db, dir: newTestDirectory(t), provOpts: map[string]*ProvisionerOptions{"acme": opts}}
+	p := &provisioner.ACME{Type: "ACME", Name: "acme"}
+	ctx := context.Background()
+
+	if _, err := a.NewAccount(ctx, p, AccountOptions{Key: newTestAccountKey(t)}); err == nil {
+		t.Fatal("NewAccount() without agreeing to the terms of service error = nil")
+	}
+	acc, err := a.NewAccount(ctx, p, AccountOptions{Key: newTestAccountKey(t), TermsOfServiceAgreed: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !acc.TermsOfServiceAgreed || acc.TermsOfService != "https://ca.example.com/tos/v1" {
+		t.Errorf("NewAccount() terms of service = %v, %q", acc.TermsOfServiceAgreed, acc.TermsOfService)
+	}
+	if err := a.CheckTermsOfService(p, acc); err != nil {
+		t.Errorf("CheckTermsOfService() error = %v", err)
+	}
+
+	// New terms of service require a new agreement.
+	opts.Meta.TermsOfService = "https://ca.example.com/tos/v2"
+	err = a.CheckTermsOfService(p, acc)
+	e, ok := err.(*Error)
+	if !ok || e.Type != userActionRequiredErr || e.Instance != "https://ca.example.com/tos/v2" {
+		t.Fatalf("CheckTermsOfService() of changed terms error = %v, want userActionRequired", err)
+	}
+	if acc, err = a.AgreeToTermsOfService(ctx, p, acc.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.CheckTermsOfService(p, acc); err != nil {
+		t.Errorf("CheckTermsOfService() after agreeing error = %v", err)
+	}
+	if acc, err = a.GetAccount(ctx, p, acc.ID); err != nil {
+		t.Fatal(err)
+	}
+	if acc.TermsOfService != "https://ca.example.com/tos/v2" {
+		t.Errorf("stored terms of service = %q, want v2", acc.TermsOfService)
+	}
+
+	// Without terms of service, all accounts pass.
+	opts.Meta.TermsOfService = ""
+	if err := a.CheckTermsOfService(p, &Account{ID: "acc1"}); err != nil {
+		t.Errorf("CheckTermsOfService() without terms error = %v", err)
+	}
+}
+
+func TestExternalAccountBinding(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+	mac := []byte("0123456789abcdef0123456789abcdef")
+	a := &Authority{db: db, dir: newTestDirectory(t), provOpts: map[string]*ProvisionerOptions{"acme": {
+		Meta:                &Meta{ExternalAccountRequired: true},
+		ExternalAccountKeys: map[string]string{"kid1": base64.RawURLEncoding.EncodeToString(mac)},
+	}}}
+	p := &provisioner.ACME{Type: "ACME", Name: "acme"}
+	ctx := context.Background()
+	newAccountURL := "https://ca.example.com/acme/acme/new-account"
+	key, other := newTestAccountKey(t), newTestAccountKey(t)
+	ecKey, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		eab  []byte
+		typ  ProbType
+	}{
+		{"missing", nil, externalAccountRequiredErr},
+		{"not a jws", []byte("eab"), malformedErr},
+		{"unsuitable algorithm", newTestEAB(t, jose.ES256, "kid1", ecKey.Key, newAccountURL, key, ""), malformedErr},
+		{"nonce", newTestEAB(t, jose.HS256, "kid1", mac, newAccountURL, key, "nonce"), malformedErr},
+		{"other url", newTestEAB(t, jose.HS256, "kid1", mac, "https://ca.example.com/acme/other/new-account", key, ""), malformedErr},
+		{"unknown key identifier", newTestEAB(t, jose.HS256, "kid2", mac, newAccountURL, key, ""), unauthorizedErr},
+		{"wrong mac key", newTestEAB(t, jose.HS256, "kid1", []byte("fedcba9876543210fedcba9876543210"), newAccountURL, key, ""), unauthorizedErr},
+		{"other account key", newTestEAB(t, jose.HS256, "kid1", mac, newAccountURL, other, ""), unauthorizedErr},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := a.NewAccount(ctx, p, AccountOptions{Key: key, ExternalAccountBinding: tt.eab})
+			if e, ok := err.(*Error); !ok || e.Type != tt.typ {
+				t.Errorf("NewAccount() error = %v, want %s", err, tt.typ)
+			}
+		})
+	}
+
+	acc, err := a.NewAccount(ctx, p, AccountOptions{Key: key, ExternalAccountBinding: newTestEAB(t, jose.HS256, "kid1", mac, newAccountURL, key, "")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec, err := a.GetAccountRecord(acc.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.ExternalAccountID != "kid1" {
+		t.Errorf("external account ID = %q, want kid1", rec.ExternalAccountID)
+	}
+
+	// An external account key binds a single account.
+	_, err = a.NewAccount(ctx, p, AccountOptions{Key: other, ExternalAccountBinding: newTestEAB(t, jose.HS256, "kid1", mac, newAccountURL, other, "")})
+	if e, ok := err.(*Error); !ok || e.Type != unauthorizedErr {
+		t.Errorf("NewAccount() with a used external account key error = %v, want unauthorized", err)
+	}
+}
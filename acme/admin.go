@@ -0,0 +1,552 @@
+package acme
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-ocf/step-ca/kvdb"
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/authority"
+	"github.com/smallstep/nosql/database"
+)
+
+// Pagination limits of the admin list operations.
+const (
+	DefaultAdminListLimit = 20
+	MaxAdminListLimit     = 100
+)
+
+// AdminInterface is the interface of the operations available to the CA
+// operators through the admin API.
+type AdminInterface interface {
+	ListAccounts(AccountFilter, string, int) ([]*AccountRecord, string, error)
+	GetAccountRecord(string) (*AccountRecord, error)
+	DeactivateAccountRecord(string) (*AccountRecord, error)
+	ListOrders(OrderFilter, string, int) ([]*OrderRecord, string, error)
+	GetOrderRecord(string) (*OrderRecord, error)
+	ListCertificates(CertificateFilter, string, int) ([]*CertificateRecord, string, error)
+	GetCertificateRecord(string) (*CertificateRecord, error)
+	GetCertificateRecordBySerial(string) (*CertificateRecord, error)
+	RevokeCertificate(string, string, int) (*CertificateRecord, error)
+	ScheduleCertificateRevocation(string, time.Time, string, int) (*CertificateRecord, error)
+}
+
+// AccountRecord is the admin view of an ACME account.
+type AccountRecord struct {
+	ID                string     `json:"id"`
+	Status            string     `json:"status"`
+	Contact           []string   `json:"contact,omitempty"`
+	KeyID             string     `json:"keyID"`
+	Created           time.Time  `json:"created"`
+	Deactivated       *time.Time `json:"deactivated,omitempty"`
+	TermsOfService    string     `json:"termsOfService,omitempty"`
+	ExternalAccountID string     `json:"externalAccountID,omitempty"`
+	ProvisionerID     string     `json:"provisionerID,omitempty"`
+}
+
+// AccountFilter selects the accounts to list. Empty fields match all.
+type AccountFilter struct {
+	Status  string
+	Contact string
+}
+
+// OrderRecord is the admin view of an ACME order.
+type OrderRecord struct {
+	ID             string       `json:"id"`
+	AccountID      string       `json:"accountID"`
+	Status         string       `json:"status"`
+	Identifiers    []Identifier `json:"identifiers"`
+	Created        time.Time    `json:"created"`
+	Expires        time.Time    `json:"expires"`
+	Authorizations []string     `json:"authorizations"`
+	Certificate    string       `json:"certificate,omitempty"`
+	Error          *AError      `json:"error,omitempty"`
+	ProvisionerID  string       `json:"provisionerID,omitempty"`
+}
+
+// OrderFilter selects the orders to list. Empty fields match all.
+type OrderFilter struct {
+	AccountID  string
+	Status     string
+	Identifier string
+}
+
+// CertificateRecord is the admin view of a certificate issued over ACME.
+type CertificateRecord struct {
+	ID               string     `json:"id"`
+	AccountID        string     `json:"accountID"`
+	OrderID          string     `json:"orderID"`
+	Serial           string     `json:"serial"`
+	Subject          string     `json:"subject"`
+	DNSNames         []string   `json:"dnsNames,omitempty"`
+	NotBefore        time.Time  `json:"notBefore"`
+	NotAfter         time.Time  `json:"notAfter"`
+	Created          time.Time  `json:"created"`
+	RevokeAt         *time.Time `json:"revokeAt,omitempty"`
+	Revoked          *time.Time `json:"revoked,omitempty"`
+	RevocationReason string     `json:"revocationReason,omitempty"`
+	ProvisionerID    string     `json:"provisionerID,omitempty"`
+}
+
+// CertificateFilter selects the certificates to list. Empty fields match all.
+type CertificateFilter struct {
+	AccountID string
+	OrderID   string
+	DNSName   string
+}
+
+func (a *account) toRecord() *AccountRecord {
+	var kid string
+	if a.Key != nil {
+		// The thumbprint can only fail on unsupported keys, that cannot be
+		// stored in the first place.
+		kid, _ = keyToID(a.Key)
+	}
+	rec := &AccountRecord{
+		ID:                a.ID,
+		Status:            a.Status,
+		Contact:           a.Contact,
+		KeyID:             kid,
+		Created:           a.Created,
+		TermsOfService:    a.TermsOfService,
+		ExternalAccountID: a.ExternalAccountID,
+		ProvisionerID:     a.ProvisionerID,
+	}
+	if !a.Deactivated.IsZero() {
+		deactivated := a.Deactivated
+		rec.Deactivated = &deactivated
+	}
+	return rec
+}
+
+func (o *order) toRecord() *OrderRecord {
+	return &OrderRecord{
+		ID:             o.ID,
+		AccountID:      o.AccountID,
+		Status:         o.Status,
+		Identifiers:    o.Identifiers,
+		Created:        o.Created,
+		Expires:        o.Expires,
+		Authorizations: o.Authorizations,
+		Certificate:    o.Certificate,
+		Error:          o.Error,
+		ProvisionerID:  o.ProvisionerID,
+	}
+}
+
+func (c *certificate) toRecord() (*CertificateRecord, error) {
+	leaf, err := c.leaf()
+	if err != nil {
+		return nil, err
+	}
+	rec := &CertificateRecord{
+		ID:               c.ID,
+		AccountID:        c.AccountID,
+		OrderID:          c.OrderID,
+		Serial:           leaf.SerialNumber.String(),
+		Subject:          leaf.Subject.String(),
+		DNSNames:         leaf.DNSNames,
+		NotBefore:        leaf.NotBefore,
+		NotAfter:         leaf.NotAfter,
+		Created:          c.Created,
+		RevocationReason: c.RevocationReason,
+		ProvisionerID:    c.ProvisionerID,
+	}
+	if at, ok := c.revokeAt(); ok {
+		rec.RevokeAt = &at
+	}
+	if at, ok := c.revoked(); ok {
+		rec.Revoked = &at
+	}
+	return rec, nil
+}
+
+// adminListLimit returns the page size of a list operation.
+func adminListLimit(limit int) int {
+	switch {
+	case limit <= 0:
+		return DefaultAdminListLimit
+	case limit > MaxAdminListLimit:
+		return MaxAdminListLimit
+	default:
+		return limit
+	}
+}
+
+// listTable calls fn, in key order, for the entries of the table with a key
+// after the cursor, until fn has accepted limit entries. It returns the
+// cursor of the next page, empty if there are no more entries. The table is
+// read in ranges of a page.
+func (a *Authority) listTable(table []byte, cursor string, limit int, fn func(*database.Entry) (bool, error)) (string, error) {
+	limit = adminListLimit(limit)
+	var n int
+	for {
+		entries, err := kvdb.ListRange(a.db, table, nil, []byte(cursor), limit+1)
+		if err != nil {
+			if database.IsErrNotFound(err) {
+				return "", nil
+			}
+			return "", ServerInternalErr(errors.Wrapf(err, "error listing %s", table))
+		}
+		for _, e := range entries {
+			if n == limit {
+				// There is at least one more entry; the page ends at the
+				// last accepted one.
+				return cursor, nil
+			}
+			ok, err := fn(e)
+			if err != nil {
+				return "", err
+			}
+			if ok {
+				n++
+			}
+			cursor = string(e.Key)
+		}
+		if len(entries) <= limit {
+			return "", nil
+		}
+	}
+}
+
+// listIDs is listTable for the IDs of a secondary index.
+func listIDs(ids []string, cursor string, limit int, fn func(string) (bool, error)) (string, error) {
+	limit = adminListLimit(limit)
+	sort.Strings(ids)
+	var n int
+	for _, id := range ids {
+		if len(cursor) > 0 && id <= cursor {
+			continue
+		}
+		if n == limit {
+			return cursor, nil
+		}
+		ok, err := fn(id)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			n++
+		}
+		cursor = id
+	}
+	return "", nil
+}
+
+// ListAccounts returns a page of the accounts matching the filter.
+func (a *Authority) ListAccounts(f AccountFilter, cursor string, limit int) ([]*AccountRecord, string, error) {
+	var records []*AccountRecord
+	next, err := a.listTable(accountTable, cursor, limit, func(e *database.Entry) (bool, error) {
+		acc := new(account)
+		if err := json.Unmarshal(e.Value, acc); err != nil {
+			return false, ServerInternalErr(errors.Wrap(err, "error unmarshaling account"))
+		}
+		if len(f.Status) > 0 && acc.Status != f.Status {
+			return false, nil
+		}
+		if len(f.Contact) > 0 && !containsFold(acc.Contact, f.Contact) {
+			return false, nil
+		}
+		records = append(records, acc.toRecord())
+		return true, nil
+	})
+	return records, next, err
+}
+
+// GetAccountRecord returns the account with the given ID.
+func (a *Authority) GetAccountRecord(id string) (*AccountRecord, error) {
+	acc, err := getAccountByID(a.db, id)
+	if err != nil {
+		return nil, err
+	}
+	return acc.toRecord(), nil
+}
+
+// DeactivateAccountRecord deactivates the account with the given ID.
+func (a *Authority) DeactivateAccountRecord(id string) (*AccountRecord, error) {
+	acc, err := getAccountByID(a.db, id)
+	if err != nil {
+		return nil, err
+	}
+	if acc.Status != StatusDeactivated {
+		if acc, err = acc.deactivate(a.db); err != nil {
+			return nil, err
+		}
+	}
+	return acc.toRecord(), nil
+}
+
+// matches returns true if the order matches the filter.
+func (f OrderFilter) matches(o *order) bool {
+	if len(f.AccountID) > 0 && o.AccountID != f.AccountID {
+		return false
+	}
+	if len(f.Status) > 0 && o.Status != f.Status {
+		return false
+	}
+	if len(f.Identifier) > 0 {
+		for _, id := range o.Identifiers {
+			if strings.EqualFold(id.Value, f.Identifier) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// ListOrders returns a page of the orders matching the filter. The orders of
+// an account are read from the index of the orders by account.
+func (a *Authority) ListOrders(f OrderFilter, cursor string, limit int) ([]*OrderRecord, string, error) {
+	var records []*OrderRecord
+	if len(f.AccountID) > 0 {
+		oids, err := getOrderIDsByAccount(a.db, f.AccountID)
+		if err != nil {
+			return nil, "", err
+		}
+		next, err := listIDs(oids, cursor, limit, func(id string) (bool, error) {
+			o, err := getOrder(a.db, id)
+			if err != nil {
+				return false, err
+			}
+			if !f.matches(o) {
+				return false, nil
+			}
+			records = append(records, o.toRecord())
+			return true, nil
+		})
+		return records, next, err
+	}
+
+	next, err := a.listTable(orderTable, cursor, limit, func(e *database.Entry) (bool, error) {
+		o := new(order)
+		if err := json.Unmarshal(e.Value, o); err != nil {
+			return false, ServerInternalErr(errors.Wrap(err, "error unmarshaling order"))
+		}
+		if !f.matches(o) {
+			return false, nil
+		}
+		records = append(records, o.toRecord())
+		return true, nil
+	})
+	return records, next, err
+}
+
+// GetOrderRecord returns the order with the given ID.
+func (a *Authority) GetOrderRecord(id string) (*OrderRecord, error) {
+	o, err := getOrder(a.db, id)
+	if err != nil {
+		return nil, err
+	}
+	return o.toRecord(), nil
+}
+
+// matches returns true if the certificate matches the filter.
+func (f CertificateFilter) matches(c *certificate, r *CertificateRecord) bool {
+	switch {
+	case len(f.AccountID) > 0 && c.AccountID != f.AccountID:
+		return false
+	case len(f.OrderID) > 0 && c.OrderID != f.OrderID:
+		return false
+	case len(f.DNSName) > 0 && !containsFold(r.DNSNames, f.DNSName):
+		return false
+	default:
+		return true
+	}
+}
+
+// ListCertificates returns a page of the certificates matching the filter.
+// The certificate of an order is read from the order.
+func (a *Authority) ListCertificates(f CertificateFilter, cursor string, limit int) ([]*CertificateRecord, string, error) {
+	var records []*CertificateRecord
+	if len(f.OrderID) > 0 {
+		o, err := getOrder(a.db, f.OrderID)
+		if err != nil {
+			if database.IsErrNotFound(err) {
+				return nil, "", nil
+			}
+			return nil, "", err
+		}
+		var ids []string
+		if len(o.Certificate) > 0 {
+			ids = []string{o.Certificate}
+		}
+		next, err := listIDs(ids, cursor, limit, func(id string) (bool, error) {
+			c, err := getCert(a.db, id)
+			if err != nil {
+				return false, err
+			}
+			r, err := c.toRecord()
+			if err != nil {
+				return false, err
+			}
+			if !f.matches(c, r) {
+				return false, nil
+			}
+			records = append(records, r)
+			return true, nil
+		})
+		return records, next, err
+	}
+
+	next, err := a.listTable(certTable, cursor, limit, func(e *database.Entry) (bool, error) {
+		c := new(certificate)
+		if err := json.Unmarshal(e.Value, c); err != nil {
+			return false, ServerInternalErr(errors.Wrap(err, "error unmarshaling certificate"))
+		}
+		r, err := c.toRecord()
+		if err != nil {
+			return false, err
+		}
+		if !f.matches(c, r) {
+			return false, nil
+		}
+		records = append(records, r)
+		return true, nil
+	})
+	return records, next, err
+}
+
+// GetCertificateRecord returns the certificate with the given ID.
+func (a *Authority) GetCertificateRecord(id string) (*CertificateRecord, error) {
+	c, err := getCert(a.db, id)
+	if err != nil {
+		return nil, err
+	}
+	return c.toRecord()
+}
+
+// GetCertificateRecordBySerial returns the certificate with the given serial
+// number.
+func (a *Authority) GetCertificateRecordBySerial(serial string) (*CertificateRecord, error) {
+	c, err := getCertBySerial(a.db, serial)
+	if err != nil {
+		return nil, err
+	}
+	return c.toRecord()
+}
+
+// RevokeCertificate revokes the certificate with the given ID with the sign
+// authority and records the revocation.
+func (a *Authority) RevokeCertificate(id, reason string, reasonCode int) (*CertificateRecord, error) {
+	c, err := getCert(a.db, id)
+	if err != nil {
+		return nil, err
+	}
+	if c, err = a.revokeCert(c, reason, reasonCode); err != nil {
+		return nil, err
+	}
+	return c.toRecord()
+}
+
+func (a *Authority) revokeCert(c *certificate, reason string, reasonCode int) (*certificate, error) {
+	if _, ok := c.revoked(); ok {
+		return nil, AlreadyRevokedErr(errors.Errorf("certificate %s has already been revoked", c.ID))
+	}
+	leaf, err := c.leaf()
+	if err != nil {
+		return nil, err
+	}
+	if err := a.signAuth.Revoke(&authority.RevokeOptions{
+		Serial:      leaf.SerialNumber.String(),
+		Reason:      reason,
+		ReasonCode:  reasonCode,
+		PassiveOnly: true,
+		MTLS:        true,
+		Crt:         leaf,
+	}); err != nil {
+		return nil, ServerInternalErr(errors.Wrapf(err, "error revoking certificate %s", c.ID))
+	}
+	return c.revoke(a.db, reason)
+}
+
+// ScheduleCertificateRevocation schedules the revocation of the certificate
+// with the given ID at the given time. Until then the renewal window of the
+// certificate, served over ACME Renewal Information, ends at that time.
+func (a *Authority) ScheduleCertificateRevocation(id string, at time.Time, reason string, reasonCode int) (*CertificateRecord, error) {
+	c, err := getCert(a.db, id)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := c.revoked(); ok {
+		return nil, AlreadyRevokedErr(errors.Errorf("certificate %s has already been revoked", id))
+	}
+	if _, ok := c.revokeAt(); ok {
+		return nil, MalformedErr(errors.Errorf("certificate %s is already scheduled for revocation", id))
+	}
+	if c, err = c.scheduleRevocation(a.db, scheduledRevocation{
+		RevokeAt:   at,
+		Reason:     reason,
+		ReasonCode: reasonCode,
+	}); err != nil {
+		return nil, err
+	}
+	return c.toRecord()
+}
+
+// RevokeScheduledCertificates revokes the certificates whose scheduled
+// revocation time has passed. An entry that cannot be processed is logged
+// and kept for the next run, without holding up the others; the returned
+// error then reports how many failed.
+func (a *Authority) RevokeScheduledCertificates() error {
+	entries, err := a.db.List(scheduledRevocationTable)
+	if err != nil {
+		if database.IsErrNotFound(err) {
+			return nil
+		}
+		return errors.Wrap(err, "error listing scheduled revocations")
+	}
+	now := clock.Now()
+	var failed int
+	for _, e := range entries {
+		if err := a.revokeScheduled(e.Key, e.Value, now); err != nil {
+			log.Printf("acme: %v", err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return errors.Errorf("error revoking %d of %d scheduled certificate revocations", failed, len(entries))
+	}
+	return nil
+}
+
+// revokeScheduled revokes the certificate of a scheduled revocation entry if
+// its time has passed, and deletes the entry.
+func (a *Authority) revokeScheduled(key, value []byte, now time.Time) error {
+	var sr scheduledRevocation
+	if err := json.Unmarshal(value, &sr); err != nil {
+		return errors.Wrapf(err, "error unmarshaling scheduled revocation of %s", key)
+	}
+	if sr.RevokeAt.After(now) {
+		return nil
+	}
+	c, err := getCert(a.db, string(key))
+	switch {
+	case database.IsErrNotFound(errors.Cause(err)):
+	case err != nil:
+		return errors.Wrapf(err, "error loading certificate %s scheduled for revocation", key)
+	default:
+		if _, ok := c.revoked(); !ok {
+			if _, err := a.revokeCert(c, sr.Reason, sr.ReasonCode); err != nil {
+				return errors.Wrapf(err, "error revoking certificate %s scheduled for revocation", key)
+			}
+		}
+	}
+	if err := a.db.Del(scheduledRevocationTable, key); err != nil {
+		return errors.Wrapf(err, "error deleting scheduled revocation of %s", key)
+	}
+	return nil
+}
+
+// containsFold returns true if the list contains the value, ignoring case.
+func containsFold(list []string, v string) bool {
+	for _, s := range list {
+		if strings.EqualFold(s, v) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,209 @@
+package acme
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-ocf/step-ca/kvdb"
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/authority"
+	"github.com/smallstep/certificates/authority/provisioner"
+	"github.com/smallstep/nosql"
+)
+
+// mockSignAuth implements the SignAuthority methods used by a test; the
+// others panic.
+type mockSignAuth struct {
+	SignAuthority
+	sign   func(cr *x509.CertificateRequest, opts provisioner.Options, signOpts ...provisioner.SignOption) (*x509.Certificate, *x509.Certificate, error)
+	revoke func(*authority.RevokeOptions) error
+}
+
+func (m *mockSignAuth) Sign(cr *x509.CertificateRequest, opts provisioner.Options, signOpts ...provisioner.SignOption) (*x509.Certificate, *x509.Certificate, error) {
+	return m.sign(cr, opts, signOpts...)
+}
+
+func (m *mockSignAuth) Revoke(opts *authority.RevokeOptions) error {
+	return m.revoke(opts)
+}
+
+// newTestDB returns an embedded database with the ACME tables, removed by
+// the returned function.
+func newTestDB(t *testing.T) (nosql.DB, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := kvdb.New(kvdb.BoltDriver, filepath.Join(dir, "acme.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	if err := createTables(db); err != nil {
+		db.Close()
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return db, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestListOrdersPages(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+	a := &Authority{db: db}
+
+	count := map[string]int{"acc1": 0, "acc2": 0}
+	for i := 0; i < 25; i++ {
+		accID := "acc1"
+		if i%3 == 0 {
+			accID = "acc2"
+		}
+		_, err := newOrder(db, OrderOptions{
+			AccountID:   accID,
+			Identifiers: []Identifier{{Type: "dns", Value: "www.example.com"}},
+			NotBefore:   time.Now(),
+			NotAfter:    time.Now().Add(time.Hour),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		count[accID]++
+	}
+
+	tests := []struct {
+		name   string
+		filter OrderFilter
+		limit  int
+		want   int
+	}{
+		{"all", OrderFilter{}, 10, 25},
+		{"account", OrderFilter{AccountID: "acc1"}, 4, count["acc1"]},
+		{"other account", OrderFilter{AccountID: "acc2"}, 100, count["acc2"]},
+		{"unknown account", OrderFilter{AccountID: "acc3"}, 10, 0},
+		{"status", OrderFilter{Status: StatusPending}, 7, 25},
+		{"identifier", OrderFilter{Identifier: "other.example.com"}, 10, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seen := make(map[string]bool)
+			var cursor string
+			for pages := 0; ; pages++ {
+				if pages > 25 {
+					t.Fatal("too many pages")
+				}
+				records, next, err := a.ListOrders(tt.filter, cursor, tt.limit)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(records) > tt.limit {
+					t.Fatalf("page of %d records, limit %d", len(records), tt.limit)
+				}
+				for _, r := range records {
+					if seen[r.ID] {
+						t.Fatalf("order %s listed twice", r.ID)
+					}
+					if len(tt.filter.AccountID) > 0 && r.AccountID != tt.filter.AccountID {
+						t.Fatalf("order %s of account %s listed", r.ID, r.AccountID)
+					}
+					seen[r.ID] = true
+				}
+				if next == "" {
+					break
+				}
+				cursor = next
+			}
+			if len(seen) != tt.want {
+				t.Errorf("listed %d orders, want %d", len(seen), tt.want)
+			}
+		})
+	}
+}
+
+func TestRevokeScheduledCertificates(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+
+	root, rootKey := newTestCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "Root"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	newLeaf := func(cn string) *certificate {
+		leaf, _ := newTestCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: cn}}, root, rootKey)
+		c, err := newCert(db, CertOptions{AccountID: "acc1", Leaf: leaf})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	failing, due, later := newLeaf("failing.example.com"), newLeaf("due.example.com"), newLeaf("later.example.com")
+	var revoked []string
+	a := &Authority{db: db, signAuth: &mockSignAuth{
+		revoke: func(opts *authority.RevokeOptions) error {
+			if opts.Crt.Subject.CommonName == "failing.example.com" {
+				return errors.New("force")
+			}
+			revoked = append(revoked, opts.Crt.Subject.CommonName)
+			return nil
+		},
+	}}
+
+	now := time.Now()
+	for _, tt := range []struct {
+		c  *certificate
+		at time.Time
+	}{
+		{failing, now.Add(-time.Minute)},
+		{due, now.Add(-time.Minute)},
+		{later, now.Add(time.Hour)},
+	} {
+		if _, err := a.ScheduleCertificateRevocation(tt.c.ID, tt.at, "", 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rec, err := a.GetCertificateRecord(due.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := json.Marshal(rec); err != nil || strings.Contains(string(b), `"revoked"`) {
+		t.Errorf("record of a certificate not revoked yet = %s, %v", b, err)
+	}
+	if err := db.Set(scheduledRevocationTable, []byte("corrupt"), []byte("{")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The failing and corrupt entries are reported but do not hold up the
+	// revocation of the others.
+	err = a.RevokeScheduledCertificates()
+	if err == nil || !strings.Contains(err.Error(), "2 of 4") {
+		t.Errorf("RevokeScheduledCertificates() error = %v, want 2 failed entries", err)
+	}
+	if len(revoked) != 1 || revoked[0] != "due.example.com" {
+		t.Errorf("revoked %v, want [due.example.com]", revoked)
+	}
+	for id, scheduled := range map[string]bool{failing.ID: true, due.ID: false, later.ID: true, "corrupt": true} {
+		_, err := db.Get(scheduledRevocationTable, []byte(id))
+		if got := err == nil; got != scheduled {
+			t.Errorf("scheduled revocation of %s kept = %v, want %v", id, got, scheduled)
+		}
+	}
+	rec, err = a.GetCertificateRecord(due.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.Revoked == nil || rec.Revoked.IsZero() {
+		t.Errorf("record of a revoked certificate has no revocation time")
+	}
+}
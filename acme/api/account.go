@@ -13,9 +13,10 @@ import (
 
 // NewAccountRequest represents the payload for a new account request.
 type NewAccountRequest struct {
-	Contact              []string `json:"contact"`
-	OnlyReturnExisting   bool     `json:"onlyReturnExisting"`
-	TermsOfServiceAgreed bool     `json:"termsOfServiceAgreed"`
+	Contact                []string        `json:"contact"`
+	OnlyReturnExisting     bool            `json:"onlyReturnExisting"`
+	TermsOfServiceAgreed   bool            `json:"termsOfServiceAgreed"`
+	ExternalAccountBinding json.RawMessage `json:"externalAccountBinding,omitempty"`
 }
 
 func validateContacts(cs []string) error {
@@ -37,8 +38,9 @@ func (n *NewAccountRequest) Validate() error {
 
 // UpdateAccountRequest represents an update-account request.
 type UpdateAccountRequest struct {
-	Contact []string `json:"contact"`
-	Status  string   `json:"status"`
+	Contact              []string `json:"contact"`
+	Status               string   `json:"status"`
+	TermsOfServiceAgreed bool     `json:"termsOfServiceAgreed"`
 }
 
 // IsDeactivateRequest returns true if the update request is a deactivation
@@ -53,11 +55,16 @@ func (u *UpdateAccountRequest) Validate() error {
 	case len(u.Status) > 0 && len(u.Contact) > 0:
 		return acme.MalformedErr(errors.New("incompatible input; contact and " +
 			"status updates are mutually exclusive"))
+	case len(u.Status) > 0 && u.TermsOfServiceAgreed:
+		return acme.MalformedErr(errors.New("incompatible input; terms of " +
+			"service and status updates are mutually exclusive"))
 	case len(u.Contact) > 0:
 		if err := validateContacts(u.Contact); err != nil {
 			return err
 		}
 		return nil
+	case u.TermsOfServiceAgreed:
+		return nil
 	case len(u.Status) > 0:
 		if u.Status != acme.StatusDeactivated {
 			return acme.MalformedErr(errors.Errorf("cannot update account "+
@@ -113,9 +120,11 @@ func (h *Handler) NewAccount(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		if acc, err = h.Auth.NewAccount(prov, acme.AccountOptions{
-			Key:     jwk,
-			Contact: nar.Contact,
+		if acc, err = h.Auth.NewAccount(r.Context(), prov, acme.AccountOptions{
+			Key:                    jwk,
+			Contact:                nar.Contact,
+			TermsOfServiceAgreed:   nar.TermsOfServiceAgreed,
+			ExternalAccountBinding: nar.ExternalAccountBinding,
 		}); err != nil {
 			api.WriteError(w, err)
 			return
@@ -125,7 +134,7 @@ func (h *Handler) NewAccount(w http.ResponseWriter, r *http.Request) {
 		httpStatus = http.StatusOK
 	}
 
-	w.Header().Set("Location", h.Auth.GetLink(acme.AccountLink,
+	w.Header().Set("Location", h.Auth.GetLink(r.Context(), acme.AccountLink,
 		acme.URLSafeProvisionerName(prov), true, acc.GetID()))
 	api.JSONStatus(w, acc, httpStatus)
 	return
@@ -160,17 +169,21 @@ func (h *Handler) GetUpdateAccount(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		var err error
-		if uar.IsDeactivateRequest() {
-			acc, err = h.Auth.DeactivateAccount(prov, acc.GetID())
-		} else {
-			acc, err = h.Auth.UpdateAccount(prov, acc.GetID(), uar.Contact)
+		switch {
+		case uar.IsDeactivateRequest():
+			acc, err = h.Auth.DeactivateAccount(r.Context(), prov, acc.GetID())
+		case len(uar.Contact) > 0:
+			acc, err = h.Auth.UpdateAccount(r.Context(), prov, acc.GetID(), uar.Contact)
+		}
+		if err == nil && uar.TermsOfServiceAgreed {
+			acc, err = h.Auth.AgreeToTermsOfService(r.Context(), prov, acc.GetID())
 		}
 		if err != nil {
 			api.WriteError(w, err)
 			return
 		}
 	}
-	w.Header().Set("Location", h.Auth.GetLink(acme.AccountLink, acme.URLSafeProvisionerName(prov), true, acc.GetID()))
+	w.Header().Set("Location", h.Auth.GetLink(r.Context(), acme.AccountLink, acme.URLSafeProvisionerName(prov), true, acc.GetID()))
 	api.JSON(w, acc)
 	return
 }
@@ -202,7 +215,7 @@ func (h *Handler) GetOrdersByAccount(w http.ResponseWriter, r *http.Request) {
 		api.WriteError(w, acme.UnauthorizedErr(errors.New("account ID does not match url param")))
 		return
 	}
-	orders, err := h.Auth.GetOrdersByAccount(prov, acc.GetID())
+	orders, err := h.Auth.GetOrdersByAccount(r.Context(), prov, acc.GetID())
 	if err != nil {
 		api.WriteError(w, err)
 		return
@@ -0,0 +1,186 @@
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-ocf/step-ca/acme"
+	"github.com/go-ocf/step-ca/kvdb"
+	"github.com/smallstep/certificates/authority/provisioner"
+	"github.com/smallstep/cli/jose"
+)
+
+// newTestAuthority returns an ACME authority served at
+// https://ca.example.com/acme, on an embedded database removed by the
+// returned function.
+func newTestAuthority(t *testing.T, opts map[string]*acme.ProvisionerOptions) (*acme.Authority, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := kvdb.New(kvdb.BoltDriver, filepath.Join(dir, "acme.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	cleanup := func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+	a, err := acme.NewAuthority(db, "ca.example.com", "acme", nil, acme.WithProvisionerOptions(opts))
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	return a, cleanup
+}
+
+// newTestAccountKey returns a new account key.
+func newTestAccountKey(t *testing.T) *jose.JSONWebKey {
+	t.Helper()
+	jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := jwk.Public()
+	return &pub
+}
+
+// newTestRequest returns a request with the given values in its context.
+func newTestRequest(values map[contextKey]interface{}) *http.Request {
+	ctx := context.Background()
+	for k, v := range values {
+		ctx = context.WithValue(ctx, k, v)
+	}
+	return httptest.NewRequest("POST", "https://ca.example.com/acme/acme/", nil).WithContext(ctx)
+}
+
+func TestCheckTermsOfService(t *testing.T) {
+	opts := &acme.ProvisionerOptions{Meta: &acme.Meta{TermsOfService: "https://ca.example.com/tos/v1"}}
+	auth, cleanup := newTestAuthority(t, map[string]*acme.ProvisionerOptions{"acme": opts})
+	defer cleanup()
+	h := &Handler{Auth: auth}
+	var p provisioner.Interface = &provisioner.ACME{Type: "ACME", Name: "acme"}
+	acc, err := auth.NewAccount(context.Background(), p, acme.AccountOptions{Key: newTestAccountKey(t), TermsOfServiceAgreed: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(want int, link string) {
+		t.Helper()
+		acc, err := auth.GetAccount(context.Background(), p, acc.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var called bool
+		w := httptest.NewRecorder()
+		h.checkTermsOfService(func(w http.ResponseWriter, r *http.Request) {
+			called = true
+		})(w, newTestRequest(map[contextKey]interface{}{provisionerContextKey: p, accContextKey: acc}))
+		if got := w.Result().StatusCode; got != want {
+			t.Errorf("status = %d, want %d", got, want)
+		}
+		if called != (want == http.StatusOK) {
+			t.Errorf("next handler called = %v", called)
+		}
+		if got := w.Result().Header.Get("Link"); got != link {
+			t.Errorf("Link = %q, want %q", got, link)
+		}
+	}
+	check(http.StatusOK, "")
+
+	// New terms of service are linked to until the account agrees to them.
+	opts.Meta.TermsOfService = "https://ca.example.com/tos/v2"
+	check(http.StatusBadRequest, `<https://ca.example.com/tos/v2>;rel="terms-of-service"`)
+
+	w := httptest.NewRecorder()
+	h.GetUpdateAccount(w, newTestRequest(map[contextKey]interface{}{
+		provisionerContextKey: p,
+		accContextKey:         acc,
+		payloadContextKey:     &payloadInfo{value: []byte(`{"termsOfServiceAgreed":true}`)},
+	}))
+	if w.Result().StatusCode != http.StatusOK {
+		t.Fatalf("GetUpdateAccount() status = %d: %s", w.Result().StatusCode, w.Body)
+	}
+	var res acme.Account
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if !res.TermsOfServiceAgreed {
+		t.Error("GetUpdateAccount() termsOfServiceAgreed = false")
+	}
+	check(http.StatusOK, "")
+}
+
+func TestNewAccountExternalAccountBinding(t *testing.T) {
+	mac := []byte("0123456789abcdef0123456789abcdef")
+	auth, cleanup := newTestAuthority(t, map[string]*acme.ProvisionerOptions{"acme": {
+		Meta:                &acme.Meta{ExternalAccountRequired: true},
+		ExternalAccountKeys: map[string]string{"kid1": base64.RawURLEncoding.EncodeToString(mac)},
+	}})
+	defer cleanup()
+	h := &Handler{Auth: auth}
+	var p provisioner.Interface = &provisioner.ACME{Type: "ACME", Name: "acme"}
+
+	eab := func(key *jose.JSONWebKey) json.RawMessage {
+		signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.HS256, Key: mac},
+			new(jose.SignerOptions).WithHeader("kid", "kid1").WithHeader("url", "https://ca.example.com/acme/acme/new-account"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		payload, err := json.Marshal(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		jws, err := signer.Sign(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return json.RawMessage(jws.FullSerialize())
+	}
+	newAccount := func(key *jose.JSONWebKey, nar NewAccountRequest) *httptest.ResponseRecorder {
+		b, err := json.Marshal(nar)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		h.NewAccount(w, newTestRequest(map[contextKey]interface{}{
+			provisionerContextKey: p,
+			jwkContextKey:         key,
+			payloadContextKey:     &payloadInfo{value: b},
+		}))
+		return w
+	}
+
+	key, other := newTestAccountKey(t), newTestAccountKey(t)
+	tests := []struct {
+		name   string
+		key    *jose.JSONWebKey
+		nar    NewAccountRequest
+		status int
+	}{
+		{"required", key, NewAccountRequest{}, http.StatusBadRequest},
+		{"other account key", key, NewAccountRequest{ExternalAccountBinding: eab(other)}, http.StatusUnauthorized},
+		{"ok", key, NewAccountRequest{ExternalAccountBinding: eab(key)}, http.StatusCreated},
+		{"already bound", other, NewAccountRequest{ExternalAccountBinding: eab(other)}, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := newAccount(tt.key, tt.nar)
+			if got := w.Result().StatusCode; got != tt.status {
+				t.Errorf("NewAccount() status = %d, want %d: %s", got, tt.status, w.Body)
+			}
+			if tt.status == http.StatusCreated && w.Result().Header.Get("Location") == "" {
+				t.Error("NewAccount() has no Location header")
+			}
+		})
+	}
+}
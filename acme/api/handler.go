@@ -1,8 +1,11 @@
 package api
 
 import (
+	"context"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/go-chi/chi"
 	"github.com/go-ocf/step-ca/acme"
@@ -80,22 +83,31 @@ type Handler struct {
 
 // Route traffic and implement the Router interface.
 func (h *Handler) Route(r api.Router) {
-	getLink := h.Auth.GetLink
+	// The routes are relative links, which do not depend on the request.
+	getLink := func(typ acme.Link, provID string, abs bool, inputs ...string) string {
+		return h.Auth.GetLink(context.Background(), typ, provID, abs, inputs...)
+	}
 	// Standard ACME API
-	r.MethodFunc("GET", getLink(acme.NewNonceLink, "{provisionerID}", false), h.lookupProvisioner(h.addNonce(h.GetNonce)))
-	r.MethodFunc("HEAD", getLink(acme.NewNonceLink, "{provisionerID}", false), h.lookupProvisioner(h.addNonce(h.GetNonce)))
-	r.MethodFunc("GET", getLink(acme.DirectoryLink, "{provisionerID}", false), h.lookupProvisioner(h.addNonce(h.GetDirectory)))
-	r.MethodFunc("HEAD", getLink(acme.DirectoryLink, "{provisionerID}", false), h.lookupProvisioner(h.addNonce(h.GetDirectory)))
+	r.MethodFunc("GET", getLink(acme.NewNonceLink, "{provisionerID}", false), h.lookupBaseURL(h.lookupProvisioner(h.addNonce(h.GetNonce))))
+	r.MethodFunc("HEAD", getLink(acme.NewNonceLink, "{provisionerID}", false), h.lookupBaseURL(h.lookupProvisioner(h.addNonce(h.GetNonce))))
+	r.MethodFunc("GET", getLink(acme.DirectoryLink, "{provisionerID}", false), h.lookupBaseURL(h.lookupProvisioner(h.addNonce(h.GetDirectory))))
+	r.MethodFunc("HEAD", getLink(acme.DirectoryLink, "{provisionerID}", false), h.lookupBaseURL(h.lookupProvisioner(h.addNonce(h.GetDirectory))))
+	r.MethodFunc("GET", getLink(acme.RenewalInfoLink, "{provisionerID}", false, "{certID}"), h.lookupBaseURL(h.lookupProvisioner(h.GetRenewalInfo)))
 
 	extractPayloadByJWK := func(next nextHTTP) nextHTTP {
-		return h.lookupProvisioner(h.addNonce(h.addDirLink(h.verifyContentType(h.parseJWS(h.validateJWS(h.extractJWK(h.verifyAndExtractJWSPayload(next))))))))
+		return h.lookupBaseURL(h.lookupProvisioner(h.addNonce(h.addDirLink(h.verifyContentType(h.parseJWS(h.validateJWS(h.extractJWK(h.verifyAndExtractJWSPayload(next)))))))))
+	}
+	extractPayloadByKidAnyToS := func(next nextHTTP) nextHTTP {
+		return h.lookupBaseURL(h.lookupProvisioner(h.addNonce(h.addDirLink(h.verifyContentType(h.parseJWS(h.validateJWS(h.lookupJWK(h.verifyAndExtractJWSPayload(next)))))))))
 	}
 	extractPayloadByKid := func(next nextHTTP) nextHTTP {
-		return h.lookupProvisioner(h.addNonce(h.addDirLink(h.verifyContentType(h.parseJWS(h.validateJWS(h.lookupJWK(h.verifyAndExtractJWSPayload(next))))))))
+		return extractPayloadByKidAnyToS(h.checkTermsOfService(next))
 	}
 
 	r.MethodFunc("POST", getLink(acme.NewAccountLink, "{provisionerID}", false), extractPayloadByJWK(h.NewAccount))
-	r.MethodFunc("POST", getLink(acme.AccountLink, "{provisionerID}", false, "{accID}"), extractPayloadByKid(h.GetUpdateAccount))
+	// Accounts that have not agreed to the current terms of service can
+	// still be retrieved and updated in order to agree to them.
+	r.MethodFunc("POST", getLink(acme.AccountLink, "{provisionerID}", false, "{accID}"), extractPayloadByKidAnyToS(h.GetUpdateAccount))
 	r.MethodFunc("POST", getLink(acme.NewOrderLink, "{provisionerID}", false), extractPayloadByKid(h.NewOrder))
 	r.MethodFunc("POST", getLink(acme.OrderLink, "{provisionerID}", false, "{ordID}"), extractPayloadByKid(h.isPostAsGet(h.GetOrder)))
 	r.MethodFunc("POST", getLink(acme.OrdersByAccountLink, "{provisionerID}", false, "{accID}"), extractPayloadByKid(h.isPostAsGet(h.GetOrdersByAccount)))
@@ -103,6 +115,7 @@ func (h *Handler) Route(r api.Router) {
 	r.MethodFunc("POST", getLink(acme.AuthzLink, "{provisionerID}", false, "{authzID}"), extractPayloadByKid(h.isPostAsGet(h.GetAuthz)))
 	r.MethodFunc("POST", getLink(acme.ChallengeLink, "{provisionerID}", false, "{chID}"), extractPayloadByKid(h.GetChallenge))
 	r.MethodFunc("POST", getLink(acme.CertificateLink, "{provisionerID}", false, "{certID}"), extractPayloadByKid(h.isPostAsGet(h.GetCertificate)))
+	r.MethodFunc("POST", getLink(acme.AlternateCertificateLink, "{provisionerID}", false, "{certID}", "{chain}"), extractPayloadByKid(h.isPostAsGet(h.GetCertificate)))
 }
 
 // GetNonce just sets the right header since a Nonce is added to each response
@@ -124,11 +137,29 @@ func (h *Handler) GetDirectory(w http.ResponseWriter, r *http.Request) {
 		api.WriteError(w, err)
 		return
 	}
-	dir := h.Auth.GetDirectory(prov)
+	dir := h.Auth.GetDirectory(r.Context(), prov)
 	api.JSON(w, dir)
 	return
 }
 
+// GetRenewalInfo is the ACME Renewal Information (ARI) resource returning the
+// suggested renewal window of a certificate.
+func (h *Handler) GetRenewalInfo(w http.ResponseWriter, r *http.Request) {
+	prov, err := provisionerFromContext(r)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	ri, err := h.Auth.GetRenewalInfo(prov, chi.URLParam(r, "certID"))
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(ri.RetryAfter.Seconds())))
+	api.JSON(w, ri)
+	return
+}
+
 // GetAuthz ACME api for retrieving an Authz.
 func (h *Handler) GetAuthz(w http.ResponseWriter, r *http.Request) {
 	fmt.Printf("DEBUG GetAuthz\n")
@@ -142,13 +173,13 @@ func (h *Handler) GetAuthz(w http.ResponseWriter, r *http.Request) {
 		api.WriteError(w, err)
 		return
 	}
-	authz, err := h.Auth.GetAuthz(prov, acc.GetID(), chi.URLParam(r, "authzID"))
+	authz, err := h.Auth.GetAuthz(r.Context(), prov, acc.GetID(), chi.URLParam(r, "authzID"))
 	if err != nil {
 		api.WriteError(w, err)
 		return
 	}
 
-	w.Header().Set("Location", h.Auth.GetLink(acme.AuthzLink, acme.URLSafeProvisionerName(prov), true, authz.GetID()))
+	w.Header().Set("Location", h.Auth.GetLink(r.Context(), acme.AuthzLink, acme.URLSafeProvisionerName(prov), true, authz.GetID()))
 	api.JSON(w, authz)
 	return
 }
@@ -165,9 +196,7 @@ func (h *Handler) GetChallenge(w http.ResponseWriter, r *http.Request) {
 		api.WriteError(w, err)
 		return
 	}
-	// Just verify that the payload was set, since we're not strictly adhering
-	// to ACME V2 spec for reasons specified below.
-	_, err = payloadFromContext(r)
+	payload, err := payloadFromContext(r)
 	if err != nil {
 		api.WriteError(w, err)
 		return
@@ -176,40 +205,135 @@ func (h *Handler) GetChallenge(w http.ResponseWriter, r *http.Request) {
 	// NOTE: We should be checking that the request is either a POST-as-GET, or
 	// that the payload is an empty JSON block ({}). However, older ACME clients
 	// still send a vestigial body (rather than an empty JSON block) and
-	// strict enforcement would render these clients broken. For the time being
-	// we'll just ignore the body.
+	// strict enforcement would render these clients broken. The body is only
+	// used by the challenges that carry their response in it, such as
+	// device-attest-01.
 	var (
 		ch   *acme.Challenge
 		chID = chi.URLParam(r, "chID")
 	)
-	ch, err = h.Auth.ValidateChallenge(prov, acc.GetID(), chID, acc.GetKey())
+	ch, err = h.Auth.ValidateChallenge(r.Context(), prov, acc.GetID(), chID, acc.GetKey(), payload.value)
 	if err != nil {
 		api.WriteError(w, err)
 		return
 	}
 
 	getLink := h.Auth.GetLink
-	w.Header().Add("Link", link(getLink(acme.AuthzLink, acme.URLSafeProvisionerName(prov), true, ch.GetAuthzID()), "up"))
-	w.Header().Set("Location", getLink(acme.ChallengeLink, acme.URLSafeProvisionerName(prov), true, ch.GetID()))
+	w.Header().Add("Link", link(getLink(r.Context(), acme.AuthzLink, acme.URLSafeProvisionerName(prov), true, ch.GetAuthzID()), "up"))
+	w.Header().Set("Location", getLink(r.Context(), acme.ChallengeLink, acme.URLSafeProvisionerName(prov), true, ch.GetID()))
 	api.JSON(w, ch)
 	return
 }
 
+// certificateFormats are the certificate formats that can be requested with
+// the Accept header, the first one being the default.
+var certificateFormats = []string{acme.CertificateChainPEM, acme.CertificateDER, acme.CertificatePKCS7}
+
+// certificateFormat returns the certificate format preferred by the Accept
+// header: the supported format with the highest quality value, ties going to
+// the format listed first in the header, then to the default order. A format
+// matches the most specific media range naming it, and a quality value of 0
+// refuses it. It defaults to the PEM chain without an Accept header, and
+// returns false if the header accepts no supported format.
+func certificateFormat(r *http.Request) (string, bool) {
+	accept := r.Header.Get("Accept")
+	if strings.TrimSpace(accept) == "" {
+		return certificateFormats[0], true
+	}
+	type match struct {
+		specificity, pos int
+		q                float64
+	}
+	matches := make([]match, len(certificateFormats))
+	for pos, value := range strings.Split(accept, ",") {
+		params := strings.Split(value, ";")
+		mediaRange := strings.ToLower(strings.TrimSpace(params[0]))
+		q := 1.0
+		for _, p := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+			if len(kv) != 2 || strings.ToLower(strings.TrimSpace(kv[0])) != "q" {
+				continue
+			}
+			v, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64)
+			if err != nil || v < 0 || v > 1 {
+				v = 0
+			}
+			q = v
+		}
+		for i, f := range certificateFormats {
+			var specificity int
+			switch {
+			case mediaRange == f:
+				specificity = 3
+			case mediaRange == f[:strings.Index(f, "/")]+"/*":
+				specificity = 2
+			case mediaRange == "*/*":
+				specificity = 1
+			default:
+				continue
+			}
+			if specificity > matches[i].specificity {
+				matches[i] = match{specificity, pos, q}
+			}
+		}
+	}
+	best := -1
+	for i, m := range matches {
+		if m.q <= 0 {
+			continue
+		}
+		if best < 0 || m.q > matches[best].q || (m.q == matches[best].q && m.pos < matches[best].pos) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return "", false
+	}
+	return certificateFormats[best], true
+}
+
 // GetCertificate ACME api for retrieving a Certificate.
 func (h *Handler) GetCertificate(w http.ResponseWriter, r *http.Request) {
+	prov, err := provisionerFromContext(r)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
 	acc, err := accountFromContext(r)
 	if err != nil {
 		api.WriteError(w, err)
 		return
 	}
 	certID := chi.URLParam(r, "certID")
-	certBytes, err := h.Auth.GetCertificate(acc.GetID(), certID)
+	var chain int
+	if c := chi.URLParam(r, "chain"); c != "" {
+		if chain, err = strconv.Atoi(c); err != nil {
+			api.WriteError(w, acme.MalformedErr(errors.Wrapf(err, "invalid certificate chain %s", c)))
+			return
+		}
+	}
+	format, ok := certificateFormat(r)
+	if !ok {
+		e := acme.MalformedErr(errors.Errorf("none of the accepted media types %s is supported; "+
+			"supported types are %s", r.Header.Get("Accept"), strings.Join(certificateFormats, ", ")))
+		e.Status = http.StatusNotAcceptable
+		api.WriteError(w, e)
+		return
+	}
+	certBytes, alternates, err := h.Auth.GetCertificate(r.Context(), prov, acc.GetID(), certID, chain, format)
 	if err != nil {
 		api.WriteError(w, err)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/pem-certificate-chain; charset=utf-8")
+	for _, alt := range alternates {
+		w.Header().Add("Link", link(alt, "alternate"))
+	}
+	if format == acme.CertificateChainPEM {
+		w.Header().Set("Content-Type", "application/pem-certificate-chain; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", format)
+	}
 	w.Write(certBytes)
 	return
 }
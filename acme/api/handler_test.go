@@ -0,0 +1,126 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi"
+	"github.com/go-ocf/step-ca/acme"
+	"github.com/smallstep/certificates/authority/provisioner"
+)
+
+// mockAuthority implements the methods of the ACME authority used by a test;
+// the others panic.
+type mockAuthority struct {
+	acme.Interface
+	getCertificate func(ctx context.Context, p provisioner.Interface, accID, certID string, chain int, format string) ([]byte, []string, error)
+}
+
+func (m *mockAuthority) GetCertificate(ctx context.Context, p provisioner.Interface, accID, certID string, chain int, format string) ([]byte, []string, error) {
+	return m.getCertificate(ctx, p, accID, certID, chain, format)
+}
+
+func TestCertificateFormat(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   string
+		ok     bool
+	}{
+		{"", acme.CertificateChainPEM, true},
+		{"application/pkix-cert", acme.CertificateDER, true},
+		{"application/pkcs7-mime", acme.CertificatePKCS7, true},
+		{"Application/PKIX-Cert", acme.CertificateDER, true},
+		{"text/html, application/pkcs7-mime;q=0.5", acme.CertificatePKCS7, true},
+		{"application/pkix-cert, application/pkcs7-mime", acme.CertificateDER, true},
+		{"application/pkix-cert;q=0.5, application/pkcs7-mime", acme.CertificatePKCS7, true},
+		{"application/pkix-cert;q=0.9, application/pkcs7-mime;q=0.95", acme.CertificatePKCS7, true},
+		{"application/pkix-cert; Q=0.1, application/pem-certificate-chain;q=0.2", acme.CertificateChainPEM, true},
+		{"*/*", acme.CertificateChainPEM, true},
+		{"application/*", acme.CertificateChainPEM, true},
+		{"*/*;q=0.1, application/pkix-cert", acme.CertificateDER, true},
+		{"application/*, application/pem-certificate-chain;q=0", acme.CertificateDER, true},
+		{"*/*, application/pem-certificate-chain;q=0.00, application/pkix-cert;q=0", acme.CertificatePKCS7, true},
+		{"application/pkix-cert;q=0.00", "", false},
+		{"application/pkix-cert;q=0.000, */*;q=0.5", acme.CertificateChainPEM, true},
+		{"application/pkix-cert;q=invalid", "", false},
+		{"text/html", "", false},
+		{"*/*;q=0", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.accept, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/acme/certificate/cert1", nil)
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+			got, ok := certificateFormat(r)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("certificateFormat() = %q, %v, want %q, %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestGetCertificate(t *testing.T) {
+	p := &provisioner.ACME{Type: "ACME", Name: "acme"}
+	alternates := []string{
+		"https://ca.example.com/acme/acme/certificate/cert1",
+		"https://ca.example.com/acme/acme/certificate/cert1/2",
+	}
+	h := &Handler{Auth: &mockAuthority{
+		getCertificate: func(ctx context.Context, _ provisioner.Interface, accID, certID string, chain int, format string) ([]byte, []string, error) {
+			if accID != "acc1" || certID != "cert1" || chain != 1 {
+				return nil, nil, acme.MalformedErr(fmt.Errorf("unexpected certificate %s/%s/%d", accID, certID, chain))
+			}
+			return []byte(format), alternates, nil
+		},
+	}}
+
+	tests := []struct {
+		name        string
+		accept      string
+		status      int
+		contentType string
+	}{
+		{"pem", "", http.StatusOK, "application/pem-certificate-chain; charset=utf-8"},
+		{"der", "application/pkix-cert", http.StatusOK, acme.CertificateDER},
+		{"pkcs7", "application/pkcs7-mime", http.StatusOK, acme.CertificatePKCS7},
+		{"not acceptable", "text/html, application/pkix-cert;q=0", http.StatusNotAcceptable, "application/json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rctx := chi.NewRouteContext()
+			rctx.URLParams.Add("certID", "cert1")
+			rctx.URLParams.Add("chain", "1")
+			ctx := context.WithValue(context.Background(), chi.RouteCtxKey, rctx)
+			ctx = context.WithValue(ctx, provisionerContextKey, provisioner.Interface(p))
+			ctx = context.WithValue(ctx, accContextKey, &acme.Account{ID: "acc1"})
+			r := httptest.NewRequest("POST", "/acme/acme/certificate/cert1/1", nil).WithContext(ctx)
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+			w := httptest.NewRecorder()
+			h.GetCertificate(w, r)
+
+			res := w.Result()
+			if res.StatusCode != tt.status {
+				t.Fatalf("status = %d, want %d: %s", res.StatusCode, tt.status, w.Body)
+			}
+			if got := res.Header.Get("Content-Type"); got != tt.contentType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.contentType)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			want := []string{
+				`<https://ca.example.com/acme/acme/certificate/cert1>;rel="alternate"`,
+				`<https://ca.example.com/acme/acme/certificate/cert1/2>;rel="alternate"`,
+			}
+			if got := res.Header["Link"]; fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("Link = %v, want %v", got, want)
+			}
+		})
+	}
+}
@@ -56,7 +56,7 @@ func (h *Handler) addDirLink(next nextHTTP) nextHTTP {
 			api.WriteError(w, err)
 			return
 		}
-		w.Header().Add("Link", link(h.Auth.GetLink(acme.DirectoryLink, acme.URLSafeProvisionerName(prov), true), "index"))
+		w.Header().Add("Link", link(h.Auth.GetLink(r.Context(), acme.DirectoryLink, acme.URLSafeProvisionerName(prov), true), "index"))
 		next(w, r)
 		return
 	}
@@ -73,7 +73,7 @@ func (h *Handler) verifyContentType(next nextHTTP) nextHTTP {
 		}
 		ct := r.Header.Get("Content-Type")
 		var expected []string
-		if strings.Contains(r.URL.Path, h.Auth.GetLink(acme.CertificateLink, acme.URLSafeProvisionerName(prov), false, "")) {
+		if strings.Contains(r.URL.Path, h.Auth.GetLink(r.Context(), acme.CertificateLink, acme.URLSafeProvisionerName(prov), false, "")) {
 			// GET /certificate requests allow a greater range of content types.
 			expected = []string{"application/jose+json", "application/pkix-cert", "application/pkcs7-mime"}
 		} else {
@@ -188,7 +188,7 @@ func (h *Handler) validateJWS(next nextHTTP) nextHTTP {
 			api.WriteError(w, acme.MalformedErr(errors.Errorf("jws missing url protected header")))
 			return
 		}
-		reqURL := &url.URL{Scheme: "https", Host: r.Host, Path: r.URL.Path}
+		reqURL := h.Auth.RequestURL(r)
 		if jwsURL != reqURL.String() {
 			api.WriteError(w, acme.MalformedErr(errors.Errorf("url header in JWS (%s) does not match request url (%s)", jwsURL, reqURL)))
 			return
@@ -233,7 +233,7 @@ func (h *Handler) extractJWK(next nextHTTP) nextHTTP {
 			return
 		}
 		ctx = context.WithValue(ctx, jwkContextKey, jwk)
-		acc, err := h.Auth.GetAccountByKey(prov, jwk)
+		acc, err := h.Auth.GetAccountByKey(r.Context(), prov, jwk)
 		switch {
 		case nosql.IsErrNotFound(err):
 			// For NewAccount requests ...
@@ -253,6 +253,17 @@ func (h *Handler) extractJWK(next nextHTTP) nextHTTP {
 	}
 }
 
+// lookupBaseURL is a middleware that stores the external base URL of the
+// request in the context, so that the links of the response point to the
+// public name the client used.
+func (h *Handler) lookupBaseURL(next nextHTTP) nextHTTP {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := acme.NewContextWithBaseURL(r.Context(), h.Auth.BaseURL(r))
+		next(w, r.WithContext(ctx))
+		return
+	}
+}
+
 // lookupProvisioner loads the provisioner associated with the request.
 // Responsds 404 if the provisioner does not exist.
 func (h *Handler) lookupProvisioner(next nextHTTP) nextHTTP {
@@ -297,7 +308,7 @@ func (h *Handler) lookupJWK(next nextHTTP) nextHTTP {
 			return
 		}
 
-		kidPrefix := h.Auth.GetLink(acme.AccountLink, acme.URLSafeProvisionerName(prov), true, "")
+		kidPrefix := h.Auth.GetLink(r.Context(), acme.AccountLink, acme.URLSafeProvisionerName(prov), true, "")
 		kid := jws.Signatures[0].Protected.KeyID
 		if !strings.HasPrefix(kid, kidPrefix) {
 			api.WriteError(w, acme.MalformedErr(errors.Errorf("kid does not have "+
@@ -306,7 +317,7 @@ func (h *Handler) lookupJWK(next nextHTTP) nextHTTP {
 		}
 
 		accID := strings.TrimPrefix(kid, kidPrefix)
-		acc, err := h.Auth.GetAccount(prov, accID)
+		acc, err := h.Auth.GetAccount(r.Context(), prov, accID)
 		switch {
 		case nosql.IsErrNotFound(err):
 			api.WriteError(w, acme.AccountDoesNotExistErr(nil))
@@ -361,6 +372,33 @@ func (h *Handler) verifyAndExtractJWSPayload(next nextHTTP) nextHTTP {
 	}
 }
 
+// checkTermsOfService is a middleware that verifies that the account has
+// agreed to the current terms of service of the provisioner. Otherwise the
+// request is rejected with a link to the terms.
+func (h *Handler) checkTermsOfService(next nextHTTP) nextHTTP {
+	return func(w http.ResponseWriter, r *http.Request) {
+		prov, err := provisionerFromContext(r)
+		if err != nil {
+			api.WriteError(w, err)
+			return
+		}
+		acc, err := accountFromContext(r)
+		if err != nil {
+			api.WriteError(w, err)
+			return
+		}
+		if err := h.Auth.CheckTermsOfService(prov, acc); err != nil {
+			if e, ok := err.(*acme.Error); ok && len(e.Instance) > 0 {
+				w.Header().Add("Link", link(e.Instance, "terms-of-service"))
+			}
+			api.WriteError(w, err)
+			return
+		}
+		next(w, r)
+		return
+	}
+}
+
 // isPostAsGet asserts that the request is a PostAsGet (empty JWS payload).
 func (h *Handler) isPostAsGet(next nextHTTP) nextHTTP {
 	return func(w http.ResponseWriter, r *http.Request) {
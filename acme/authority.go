@@ -1,15 +1,18 @@
 package acme
 
 import (
+	"context"
 	"crypto"
 	"crypto/x509"
 	"encoding/base64"
-	"net"
+	"log"
 	"net/http"
 	"net/url"
+	"strconv"
+	"sync"
 	"time"
 
-	retryablehttp "github.com/hashicorp/go-retryablehttp"
+	"github.com/go-ocf/step-ca/events"
 	"github.com/pkg/errors"
 	"github.com/smallstep/certificates/authority/provisioner"
 	"github.com/smallstep/cli/jose"
@@ -18,53 +21,178 @@ import (
 
 // Interface is the acme authority interface.
 type Interface interface {
-	DeactivateAccount(provisioner.Interface, string) (*Account, error)
-	FinalizeOrder(provisioner.Interface, string, string, *x509.CertificateRequest) (*Order, error)
-	GetAccount(provisioner.Interface, string) (*Account, error)
-	GetAccountByKey(provisioner.Interface, *jose.JSONWebKey) (*Account, error)
-	GetAuthz(provisioner.Interface, string, string) (*Authz, error)
-	GetCertificate(string, string) ([]byte, error)
-	GetDirectory(provisioner.Interface) *Directory
-	GetLink(Link, string, bool, ...string) string
-	GetOrder(provisioner.Interface, string, string) (*Order, error)
-	GetOrdersByAccount(provisioner.Interface, string) ([]string, error)
+	AgreeToTermsOfService(context.Context, provisioner.Interface, string) (*Account, error)
+	BaseURL(*http.Request) *url.URL
+	CheckTermsOfService(provisioner.Interface, *Account) error
+	DeactivateAccount(context.Context, provisioner.Interface, string) (*Account, error)
+	FinalizeOrder(context.Context, provisioner.Interface, string, string, *x509.CertificateRequest) (*Order, error)
+	GetAccount(context.Context, provisioner.Interface, string) (*Account, error)
+	GetAccountByKey(context.Context, provisioner.Interface, *jose.JSONWebKey) (*Account, error)
+	GetAuthz(context.Context, provisioner.Interface, string, string) (*Authz, error)
+	GetCertificate(context.Context, provisioner.Interface, string, string, int, string) ([]byte, []string, error)
+	GetDirectory(context.Context, provisioner.Interface) *Directory
+	GetLink(context.Context, Link, string, bool, ...string) string
+	GetOrder(context.Context, provisioner.Interface, string, string) (*Order, error)
+	GetOrdersByAccount(context.Context, provisioner.Interface, string) ([]string, error)
+	GetRenewalInfo(provisioner.Interface, string) (*RenewalInfo, error)
 	LoadProvisionerByID(string) (provisioner.Interface, error)
-	NewAccount(provisioner.Interface, AccountOptions) (*Account, error)
+	NewAccount(context.Context, provisioner.Interface, AccountOptions) (*Account, error)
 	NewNonce() (string, error)
-	NewOrder(provisioner.Interface, OrderOptions) (*Order, error)
-	UpdateAccount(provisioner.Interface, string, []string) (*Account, error)
+	NewOrder(context.Context, provisioner.Interface, OrderOptions) (*Order, error)
+	RequestURL(*http.Request) *url.URL
+	UpdateAccount(context.Context, provisioner.Interface, string, []string) (*Account, error)
 	UseNonce(string) error
-	ValidateChallenge(provisioner.Interface, string, string, *jose.JSONWebKey) (*Challenge, error)
+	ValidateChallenge(context.Context, provisioner.Interface, string, string, *jose.JSONWebKey, []byte) (*Challenge, error)
 }
 
 // Authority is the layer that handles all ACME interactions.
 type Authority struct {
-	db       nosql.DB
-	dir      *directory
-	signAuth SignAuthority
+	db              nosql.DB
+	dir             *directory
+	signAuth        SignAuthority
+	alternateChains [][]*x509.Certificate
+	provOpts        map[string]*ProvisionerOptions
+	validator       Validator
+	maxAttempts     int
+	// manufacturerRoots are the roots of the device attestations.
+	manufacturerRoots *x509.CertPool
+	events            *events.Bus
+	nonces            NonceService
+	urlOpts           *URLOptions
+	urls              *urlResolver
+	// caaDisabled holds the names of the provisioners for which skipping
+	// the CAA checks has been logged.
+	caaDisabled         sync.Map
+	legacyProvisionerID string
+}
+
+// Option sets options to the Authority.
+type Option func(*Authority)
+
+// WithAlternateChains sets the alternate certificate chains offered next to
+// the chain a certificate was issued with. Each chain starts with the
+// intermediate that is offered in place of the issuing one.
+func WithAlternateChains(chains [][]*x509.Certificate) Option {
+	return func(a *Authority) {
+		a.alternateChains = chains
+	}
+}
+
+// WithValidator sets the Validator used to validate challenges and look up
+// CAA records.
+func WithValidator(v Validator) Option {
+	return func(a *Authority) {
+		a.validator = v
+	}
+}
+
+// WithMaxValidationAttempts sets the number of failed validations after
+// which a challenge becomes invalid. It defaults to one.
+func WithMaxValidationAttempts(n int) Option {
+	return func(a *Authority) {
+		a.maxAttempts = n
+	}
+}
+
+// WithManufacturerRoots sets the device manufacturer root certificates that
+// device-attest-01 attestations must chain to. Device attestation is only
+// offered if roots are set.
+func WithManufacturerRoots(roots []*x509.Certificate) Option {
+	return func(a *Authority) {
+		if len(roots) == 0 {
+			return
+		}
+		a.manufacturerRoots = x509.NewCertPool()
+		for _, crt := range roots {
+			a.manufacturerRoots.AddCert(crt)
+		}
+	}
+}
+
+// WithNonceService sets the service issuing the replay nonces. By default
+// the nonces are stored in the database.
+func WithNonceService(ns NonceService) Option {
+	return func(a *Authority) {
+		a.nonces = ns
+	}
+}
+
+// WithEventBus sets the bus the account, order and challenge events are
+// published to.
+func WithEventBus(b *events.Bus) Option {
+	return func(a *Authority) {
+		a.events = b
+	}
+}
+
+// WithLegacyProvisioner sets the ID of the ACME provisioner the records
+// stored before they were scoped to their provisioner are assigned to by the
+// schema migrations.
+func WithLegacyProvisioner(id string) Option {
+	return func(a *Authority) {
+		a.legacyProvisionerID = id
+	}
 }
 
 // NewAuthority returns a new Authority that implements the ACME interface.
-func NewAuthority(db nosql.DB, dns, prefix string, signAuth SignAuthority) *Authority {
-	return &Authority{
-		db: db, dir: newDirectory(dns, prefix), signAuth: signAuth,
+// It creates the ACME tables if they do not exist yet and applies the
+// pending schema migrations.
+func NewAuthority(db nosql.DB, dns, prefix string, signAuth SignAuthority, opts ...Option) (*Authority, error) {
+	a := &Authority{
+		db: db, signAuth: signAuth,
+	}
+	for _, o := range opts {
+		o(a)
+	}
+
+	results, err := Migrate(db, &MigrateOptions{LegacyProvisionerID: a.legacyProvisionerID})
+	if err != nil {
+		return nil, err
 	}
+	for _, r := range results {
+		log.Printf("acme: migrated %s", r)
+	}
+	for name, o := range a.provOpts {
+		if o == nil {
+			continue
+		}
+		if err := o.Validate(); err != nil {
+			return nil, errors.Wrapf(err, "invalid acme options of provisioner %s", name)
+		}
+	}
+	if a.urls, err = newURLResolver(dns, a.urlOpts); err != nil {
+		return nil, err
+	}
+	a.dir = newDirectory(a.urls.bases[0], prefix)
+	if a.maxAttempts < 1 {
+		a.maxAttempts = 1
+	}
+	if a.nonces == nil {
+		a.nonces = NewDBNonceService(db)
+	}
+	if a.validator == nil {
+		// Without options the validator cannot fail to be created.
+		a.validator, _ = NewValidator(nil)
+	}
+	return a, nil
 }
 
 // GetLink returns the requested link from the directory.
-func (a *Authority) GetLink(typ Link, provID string, abs bool, inputs ...string) string {
-	return a.dir.getLink(typ, provID, abs, inputs...)
+func (a *Authority) GetLink(ctx context.Context, typ Link, provID string, abs bool, inputs ...string) string {
+	return a.dir.getLink(ctx, typ, provID, abs, inputs...)
 }
 
 // GetDirectory returns the ACME directory object.
-func (a *Authority) GetDirectory(p provisioner.Interface) *Directory {
+func (a *Authority) GetDirectory(ctx context.Context, p provisioner.Interface) *Directory {
 	name := url.PathEscape(p.GetName())
 	return &Directory{
-		NewNonce:   a.dir.getLink(NewNonceLink, name, true),
-		NewAccount: a.dir.getLink(NewAccountLink, name, true),
-		NewOrder:   a.dir.getLink(NewOrderLink, name, true),
-		RevokeCert: a.dir.getLink(RevokeCertLink, name, true),
-		KeyChange:  a.dir.getLink(KeyChangeLink, name, true),
+		NewNonce:    a.dir.getLink(ctx, NewNonceLink, name, true),
+		NewAccount:  a.dir.getLink(ctx, NewAccountLink, name, true),
+		NewOrder:    a.dir.getLink(ctx, NewOrderLink, name, true),
+		RevokeCert:  a.dir.getLink(ctx, RevokeCertLink, name, true),
+		KeyChange:   a.dir.getLink(ctx, KeyChangeLink, name, true),
+		RenewalInfo: a.dir.getLink(ctx, RenewalInfoLink, name, true),
+		Meta:        a.getOptions(p).Meta,
 	}
 }
 
@@ -76,58 +204,136 @@ func (a *Authority) LoadProvisionerByID(id string) (provisioner.Interface, error
 
 // NewNonce generates, stores, and returns a new ACME nonce.
 func (a *Authority) NewNonce() (string, error) {
-	n, err := newNonce(a.db)
-	if err != nil {
-		return "", err
-	}
-	return n.ID, nil
+	return a.nonces.New()
 }
 
 // UseNonce consumes the given nonce if it is valid, returns error otherwise.
 func (a *Authority) UseNonce(nonce string) error {
-	return useNonce(a.db, nonce)
+	return a.nonces.Use(nonce)
+}
+
+// PurgeNonces deletes the database nonces older than the given age, issued
+// but never used by the clients.
+func (a *Authority) PurgeNonces(maxAge time.Duration) error {
+	return purgeNonces(a.db, clock.Now().Add(-maxAge))
+}
+
+// PurgeOrders deletes the orders that expired more than the given age ago
+// without a certificate, with their authorizations and challenges.
+func (a *Authority) PurgeOrders(maxAge time.Duration) error {
+	return purgeOrders(a.db, clock.Now().Add(-maxAge))
 }
 
 // NewAccount creates, stores, and returns a new ACME account.
-func (a *Authority) NewAccount(p provisioner.Interface, ao AccountOptions) (*Account, error) {
-	acc, err := newAccount(a.db, ao)
+func (a *Authority) NewAccount(ctx context.Context, p provisioner.Interface, ao AccountOptions) (*Account, error) {
+	opts := a.getOptions(p)
+	meta := opts.getMeta()
+	if len(meta.TermsOfService) > 0 && !ao.TermsOfServiceAgreed {
+		return nil, MalformedErr(errors.Errorf("must agree to terms of service %s", meta.TermsOfService))
+	}
+
+	var eabID string
+	switch {
+	case len(ao.ExternalAccountBinding) > 0:
+		var err error
+		url := a.dir.getLink(ctx, NewAccountLink, URLSafeProvisionerName(p), true)
+		if eabID, err = verifyExternalAccountBinding(ao.ExternalAccountBinding, ao.Key, url, opts.ExternalAccountKeys); err != nil {
+			return nil, err
+		}
+	case meta.ExternalAccountRequired:
+		return nil, ExternalAccountRequiredErr(nil)
+	}
+
+	var tos string
+	if ao.TermsOfServiceAgreed {
+		tos = meta.TermsOfService
+	}
+	ao.ProvisionerID = p.GetID()
+	acc, err := newAccount(a.db, ao, tos, eabID)
 	if err != nil {
 		return nil, err
 	}
-	return acc.toACME(a.db, a.dir, p)
+	a.events.Publish(events.AccountCreated, &events.AccountData{
+		ID:          acc.ID,
+		Contact:     acc.Contact,
+		Provisioner: p.GetName(),
+	})
+	return acc.toACME(ctx, a.db, a.dir, p)
+}
+
+// CheckTermsOfService returns an error if the provisioner has terms of
+// service that the account has not agreed to.
+func (a *Authority) CheckTermsOfService(p provisioner.Interface, acc *Account) error {
+	tos := a.getOptions(p).getMeta().TermsOfService
+	if len(tos) == 0 || acc.TermsOfService == tos {
+		return nil
+	}
+	err := UserActionRequiredErr(errors.Errorf("account %s must agree to "+
+		"the terms of service %s", acc.ID, tos))
+	err.Instance = tos
+	return err
+}
+
+// AgreeToTermsOfService records that the account agreed to the current terms
+// of service of the provisioner.
+func (a *Authority) AgreeToTermsOfService(ctx context.Context, p provisioner.Interface, id string) (*Account, error) {
+	acc, err := a.getAccount(p, id)
+	if err != nil {
+		return nil, err
+	}
+	tos := a.getOptions(p).getMeta().TermsOfService
+	if acc.TermsOfService != tos {
+		if acc, err = acc.agreeToTermsOfService(a.db, tos); err != nil {
+			return nil, err
+		}
+	}
+	return acc.toACME(ctx, a.db, a.dir, p)
 }
 
 // UpdateAccount updates an ACME account.
-func (a *Authority) UpdateAccount(p provisioner.Interface, id string, contact []string) (*Account, error) {
-	acc, err := getAccountByID(a.db, id)
+func (a *Authority) UpdateAccount(ctx context.Context, p provisioner.Interface, id string, contact []string) (*Account, error) {
+	acc, err := a.getAccount(p, id)
 	if err != nil {
-		return nil, ServerInternalErr(err)
+		return nil, err
 	}
 	if acc, err = acc.update(a.db, contact); err != nil {
 		return nil, err
 	}
-	return acc.toACME(a.db, a.dir, p)
+	return acc.toACME(ctx, a.db, a.dir, p)
 }
 
-// GetAccount returns an ACME account.
-func (a *Authority) GetAccount(p provisioner.Interface, id string) (*Account, error) {
+// getAccount retrieves the account with the given ID if it belongs to the
+// provisioner.
+func (a *Authority) getAccount(p provisioner.Interface, id string) (*account, error) {
 	acc, err := getAccountByID(a.db, id)
 	if err != nil {
 		return nil, err
 	}
-	return acc.toACME(a.db, a.dir, p)
+	if err := checkProvisioner(p, acc.ProvisionerID, "account", id); err != nil {
+		return nil, err
+	}
+	return acc, nil
+}
+
+// GetAccount returns an ACME account.
+func (a *Authority) GetAccount(ctx context.Context, p provisioner.Interface, id string) (*Account, error) {
+	acc, err := a.getAccount(p, id)
+	if err != nil {
+		return nil, err
+	}
+	return acc.toACME(ctx, a.db, a.dir, p)
 }
 
 // DeactivateAccount deactivates an ACME account.
-func (a *Authority) DeactivateAccount(p provisioner.Interface, id string) (*Account, error) {
-	acc, err := getAccountByID(a.db, id)
+func (a *Authority) DeactivateAccount(ctx context.Context, p provisioner.Interface, id string) (*Account, error) {
+	acc, err := a.getAccount(p, id)
 	if err != nil {
 		return nil, err
 	}
 	if acc, err = acc.deactivate(a.db); err != nil {
 		return nil, err
 	}
-	return acc.toACME(a.db, a.dir, p)
+	return acc.toACME(ctx, a.db, a.dir, p)
 }
 
 func keyToID(jwk *jose.JSONWebKey) (string, error) {
@@ -139,21 +345,24 @@ func keyToID(jwk *jose.JSONWebKey) (string, error) {
 }
 
 // GetAccountByKey returns the ACME associated with the jwk id.
-func (a *Authority) GetAccountByKey(p provisioner.Interface, jwk *jose.JSONWebKey) (*Account, error) {
+func (a *Authority) GetAccountByKey(ctx context.Context, p provisioner.Interface, jwk *jose.JSONWebKey) (*Account, error) {
 	kid, err := keyToID(jwk)
 	if err != nil {
 		return nil, err
 	}
-	acc, err := getAccountByKeyID(a.db, kid)
+	acc, err := getAccountByKeyID(a.db, p.GetID(), kid)
 	if err != nil {
 		return nil, err
 	}
-	return acc.toACME(a.db, a.dir, p)
+	if err := checkProvisioner(p, acc.ProvisionerID, "account with key id", kid); err != nil {
+		return nil, err
+	}
+	return acc.toACME(ctx, a.db, a.dir, p)
 }
 
 // GetOrder returns an ACME order.
-func (a *Authority) GetOrder(p provisioner.Interface, accID, orderID string) (*Order, error) {
-	o, err := getOrder(a.db, orderID)
+func (a *Authority) GetOrder(ctx context.Context, p provisioner.Interface, accID, orderID string) (*Order, error) {
+	o, err := a.getOrder(p, orderID)
 	if err != nil {
 		return nil, err
 	}
@@ -163,11 +372,24 @@ func (a *Authority) GetOrder(p provisioner.Interface, accID, orderID string) (*O
 	if o, err = o.updateStatus(a.db); err != nil {
 		return nil, err
 	}
-	return o.toACME(a.db, a.dir, p)
+	return o.toACME(ctx, a.db, a.dir, p)
+}
+
+// getOrder retrieves the order with the given ID if it belongs to the
+// provisioner.
+func (a *Authority) getOrder(p provisioner.Interface, id string) (*order, error) {
+	o, err := getOrder(a.db, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkProvisioner(p, o.ProvisionerID, "order", id); err != nil {
+		return nil, err
+	}
+	return o, nil
 }
 
 // GetOrdersByAccount returns the list of order urls owned by the account.
-func (a *Authority) GetOrdersByAccount(p provisioner.Interface, id string) ([]string, error) {
+func (a *Authority) GetOrdersByAccount(ctx context.Context, p provisioner.Interface, id string) ([]string, error) {
 	oids, err := getOrderIDsByAccount(a.db, id)
 	if err != nil {
 		return nil, err
@@ -179,46 +401,83 @@ func (a *Authority) GetOrdersByAccount(p provisioner.Interface, id string) ([]st
 		if err != nil {
 			return nil, ServerInternalErr(err)
 		}
-		if o.Status == StatusInvalid {
+		if o.Status == StatusInvalid || checkProvisioner(p, o.ProvisionerID, "order", o.ID) != nil {
 			continue
 		}
-		ret = append(ret, a.dir.getLink(OrderLink, URLSafeProvisionerName(p), true, o.ID))
+		ret = append(ret, a.dir.getLink(ctx, OrderLink, URLSafeProvisionerName(p), true, o.ID))
 	}
 	return ret, nil
 }
 
 // NewOrder generates, stores, and returns a new ACME order.
-func (a *Authority) NewOrder(p provisioner.Interface, ops OrderOptions) (*Order, error) {
+func (a *Authority) NewOrder(ctx context.Context, p provisioner.Interface, ops OrderOptions) (*Order, error) {
+	policy := a.getOptions(p).Policy
+	for _, id := range ops.Identifiers {
+		if err := policy.check(id); err != nil {
+			return nil, err
+		}
+	}
+	if opts := a.getOptions(p); opts.DNSPersist01 {
+		ops.IssuerDomainNames = opts.getMeta().CaaIdentities
+	}
+	ops.AccountURI = a.dir.getCanonicalLink(AccountLink, URLSafeProvisionerName(p), ops.AccountID)
+	ops.DeviceAttestation = a.manufacturerRoots != nil
+	ops.ProvisionerID = p.GetID()
 	order, err := newOrder(a.db, ops)
 	if err != nil {
 		return nil, Wrap(err, "error creating order")
 	}
-	return order.toACME(a.db, a.dir, p)
+	return order.toACME(ctx, a.db, a.dir, p)
 }
 
 // FinalizeOrder attempts to finalize an order and generate a new certificate.
-func (a *Authority) FinalizeOrder(p provisioner.Interface, accID, orderID string, csr *x509.CertificateRequest) (*Order, error) {
-	o, err := getOrder(a.db, orderID)
+func (a *Authority) FinalizeOrder(ctx context.Context, p provisioner.Interface, accID, orderID string, csr *x509.CertificateRequest) (*Order, error) {
+	o, err := a.getOrder(p, orderID)
 	if err != nil {
 		return nil, err
 	}
 	if accID != o.AccountID {
 		return nil, UnauthorizedErr(errors.New("account does not own order"))
 	}
-	o, err = o.finalize(a.db, csr, a.signAuth, p)
+	identities := a.getOptions(p).getMeta().CaaIdentities
+	if len(identities) == 0 {
+		if _, logged := a.caaDisabled.LoadOrStore(p.GetName(), true); !logged {
+			log.Printf("acme: CAA records are not checked for provisioner %s; "+
+				"no caaIdentities are configured", p.GetName())
+		}
+	}
+	o, err = o.finalize(a.db, csr, a.signAuth, p, caaOptions{
+		lookupCAA:  a.validator.LookupCAA,
+		identities: identities,
+		accountURI: a.dir.getLink(ctx, AccountLink, URLSafeProvisionerName(p), true, accID),
+	})
 	if err != nil {
 		return nil, Wrap(err, "error finalizing order")
 	}
-	return o.toACME(a.db, a.dir, p)
+	identifiers := make([]string, len(o.Identifiers))
+	for i, id := range o.Identifiers {
+		identifiers[i] = id.Value
+	}
+	a.events.Publish(events.OrderFinalized, &events.OrderData{
+		ID:            o.ID,
+		AccountID:     o.AccountID,
+		Identifiers:   identifiers,
+		CertificateID: o.Certificate,
+		Provisioner:   p.GetName(),
+	})
+	return o.toACME(ctx, a.db, a.dir, p)
 }
 
 // GetAuthz retrieves and attempts to update the status on an ACME authz
 // before returning.
-func (a *Authority) GetAuthz(p provisioner.Interface, accID, authzID string) (*Authz, error) {
+func (a *Authority) GetAuthz(ctx context.Context, p provisioner.Interface, accID, authzID string) (*Authz, error) {
 	az, err := getAuthz(a.db, authzID)
 	if err != nil {
 		return nil, err
 	}
+	if err := checkProvisioner(p, az.clone().ProvisionerID, "authz", authzID); err != nil {
+		return nil, err
+	}
 	if accID != az.getAccountID() {
 		return nil, UnauthorizedErr(errors.New("account does not own authz"))
 	}
@@ -226,43 +485,99 @@ func (a *Authority) GetAuthz(p provisioner.Interface, accID, authzID string) (*A
 	if err != nil {
 		return nil, Wrap(err, "error updating authz status")
 	}
-	return az.toACME(a.db, a.dir, p)
+	return az.toACME(ctx, a.db, a.dir, p)
 }
 
-// ValidateChallenge attempts to validate the challenge.
-func (a *Authority) ValidateChallenge(p provisioner.Interface, accID, chID string, jwk *jose.JSONWebKey) (*Challenge, error) {
+// ValidateChallenge attempts to validate the challenge. The payload is the
+// one of the request; challenges like device-attest-01 carry their response
+// in it.
+func (a *Authority) ValidateChallenge(ctx context.Context, p provisioner.Interface, accID, chID string, jwk *jose.JSONWebKey, payload []byte) (*Challenge, error) {
 	ch, err := getChallenge(a.db, chID)
 	if err != nil {
 		return nil, err
 	}
+	if err := checkProvisioner(p, ch.clone().ProvisionerID, "challenge", chID); err != nil {
+		return nil, err
+	}
 	if accID != ch.getAccountID() {
 		return nil, UnauthorizedErr(errors.New("account does not own challenge"))
 	}
-	client := retryablehttp.NewClient()
-	client.HTTPClient = &http.Client{
-		Timeout: 20 * time.Second,
-	}
-	client.RetryWaitMin = 100 * time.Millisecond
-	client.RetryWaitMax = 1 * time.Second
-	client.RetryMax = 10
-	ch, err = ch.validate(a.db, jwk, validateOptions{
-		httpGet:   client.Get,
-		lookupTxt: net.LookupTXT,
+	attempts := len(ch.clone().Attempts)
+	ch, err = ch.validate(a.db, jwk, a.validator, validateParams{
+		maxAttempts:       a.maxAttempts,
+		payload:           payload,
+		manufacturerRoots: a.manufacturerRoots,
 	})
 	if err != nil {
 		return nil, Wrap(err, "error attempting challenge validation")
 	}
-	return ch.toACME(a.db, a.dir, p)
+	if bc := ch.clone(); len(bc.Attempts) > attempts && bc.Error != nil {
+		a.events.Publish(events.ChallengeFailed, &events.ChallengeData{
+			ID:          bc.ID,
+			AuthzID:     bc.AuthzID,
+			AccountID:   bc.AccountID,
+			Type:        bc.Type,
+			Identifier:  bc.Value,
+			Status:      bc.Status,
+			Error:       bc.Error,
+			Provisioner: p.GetName(),
+		})
+	}
+	// Move the authz to its final status as soon as the challenge has one.
+	if ch.getStatus() != StatusPending {
+		az, err := getAuthz(a.db, ch.getAuthzID())
+		if err != nil {
+			return nil, err
+		}
+		if _, err := az.updateStatus(a.db); err != nil {
+			return nil, Wrap(err, "error updating authz status")
+		}
+	}
+	return ch.toACME(ctx, a.db, a.dir, p)
 }
 
-// GetCertificate retrieves the Certificate by ID.
-func (a *Authority) GetCertificate(accID, certID string) ([]byte, error) {
+// GetCertificate retrieves the Certificate by ID and encodes the requested
+// chain in the given format. Chain 0 is the chain the certificate was issued
+// with, the others are the applicable alternate chains. The links to all the
+// chains other than the requested one are returned as well.
+func (a *Authority) GetCertificate(ctx context.Context, p provisioner.Interface, accID, certID string, chain int, format string) ([]byte, []string, error) {
 	cert, err := getCert(a.db, certID)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	if err := checkProvisioner(p, cert.ProvisionerID, "certificate", certID); err != nil {
+		return nil, nil, err
 	}
 	if accID != cert.AccountID {
-		return nil, UnauthorizedErr(errors.New("account does not own certificate"))
+		return nil, nil, UnauthorizedErr(errors.New("account does not own certificate"))
+	}
+	chains, err := cert.chains(a.alternateChains)
+	if err != nil {
+		return nil, nil, err
+	}
+	if chain < 0 || chain >= len(chains) {
+		return nil, nil, MalformedErr(errors.Errorf("certificate %s has no chain %d", certID, chain))
 	}
-	return cert.toACME(a.db, a.dir)
+	b, err := encodeChain(chains[chain], format)
+	if err != nil {
+		return nil, nil, err
+	}
+	var links []string
+	for i := range chains {
+		switch {
+		case i == chain:
+			continue
+		case i == 0:
+			links = append(links, a.dir.getLink(ctx, CertificateLink, URLSafeProvisionerName(p), true, certID))
+		default:
+			links = append(links, a.dir.getLink(ctx, AlternateCertificateLink, URLSafeProvisionerName(p), true, certID, strconv.Itoa(i)))
+		}
+	}
+	return b, links, nil
+}
+
+// GetRenewalInfo returns the ACME Renewal Information of the certificate
+// with the given ARI identifier.
+func (a *Authority) GetRenewalInfo(p provisioner.Interface, id string) (*RenewalInfo, error) {
+	return getRenewalInfo(a.db, p, id)
 }
@@ -0,0 +1,187 @@
+package acme
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/authority/provisioner"
+	"github.com/smallstep/nosql"
+)
+
+// isNotFound returns true if the error is the not found error an authority
+// answers for the resources of other provisioners.
+func isNotFound(err error) bool {
+	e, ok := err.(*Error)
+	return ok && e.Type == malformedErr && nosql.IsErrNotFound(errors.Cause(e.Err))
+}
+
+func TestCrossProvisioner(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+	a := &Authority{db: db, dir: newTestDirectory(t), validator: unreachableValidator{}}
+	pA := &provisioner.ACME{Type: "ACME", Name: "tenant-a"}
+	pB := &provisioner.ACME{Type: "ACME", Name: "tenant-b"}
+	ctx := context.Background()
+
+	key := newTestAccountKey(t)
+	acc, err := a.NewAccount(ctx, pA, AccountOptions{Key: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	o, err := a.NewOrder(ctx, pA, OrderOptions{
+		AccountID:   acc.ID,
+		Identifiers: []Identifier{{Type: "dns", Value: "www.example.com"}},
+		NotBefore:   time.Now(),
+		NotAfter:    time.Now().Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	order, err := a.getOrder(pA, o.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	az, err := getAuthz(db, order.Authorizations[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	chID := az.getChallenges()[0]
+	root, rootKey := newTestCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "Root"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	leaf, _ := newTestCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "www.example.com"}}, root, rootKey)
+	cert, err := newCert(db, CertOptions{AccountID: acc.ID, OrderID: o.ID, ProvisionerID: pA.GetID(), Leaf: leaf, Intermediates: []*x509.Certificate{root}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	renewalID := base64.RawURLEncoding.EncodeToString(leaf.AuthorityKeyId) + "." + base64.RawURLEncoding.EncodeToString(leaf.SerialNumber.Bytes())
+
+	// All the resources of provisioner A are found through provisioner A
+	// and are unknown to provisioner B.
+	tests := []struct {
+		name string
+		fn   func(p provisioner.Interface) error
+	}{
+		{"GetAccount", func(p provisioner.Interface) error {
+			_, err := a.GetAccount(ctx, p, acc.ID)
+			return err
+		}},
+		{"GetAccountByKey", func(p provisioner.Interface) error {
+			_, err := a.GetAccountByKey(ctx, p, key)
+			return err
+		}},
+		{"UpdateAccount", func(p provisioner.Interface) error {
+			_, err := a.UpdateAccount(ctx, p, acc.ID, []string{"mailto:admin@example.com"})
+			return err
+		}},
+		{"AgreeToTermsOfService", func(p provisioner.Interface) error {
+			_, err := a.AgreeToTermsOfService(ctx, p, acc.ID)
+			return err
+		}},
+		{"GetOrder", func(p provisioner.Interface) error {
+			_, err := a.GetOrder(ctx, p, acc.ID, o.ID)
+			return err
+		}},
+		{"FinalizeOrder", func(p provisioner.Interface) error {
+			_, err := a.FinalizeOrder(ctx, p, acc.ID, o.ID, &x509.CertificateRequest{})
+			if p == pA {
+				// The order is found, but not ready to be finalized.
+				if e, ok := err.(*Error); ok && e.Type == orderNotReadyErr {
+					return nil
+				}
+			}
+			return err
+		}},
+		{"GetAuthz", func(p provisioner.Interface) error {
+			_, err := a.GetAuthz(ctx, p, acc.ID, az.getID())
+			return err
+		}},
+		{"GetCertificate", func(p provisioner.Interface) error {
+			_, _, err := a.GetCertificate(ctx, p, acc.ID, cert.ID, 0, CertificateChainPEM)
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.fn(pA); err != nil {
+				t.Errorf("%s() through provisioner A error = %v", tt.name, err)
+			}
+			if err := tt.fn(pB); !isNotFound(err) {
+				t.Errorf("%s() through provisioner B error = %v, want not found", tt.name, err)
+			}
+		})
+	}
+
+	t.Run("ValidateChallenge", func(t *testing.T) {
+		if _, err := a.ValidateChallenge(ctx, pB, acc.ID, chID, key, nil); !isNotFound(err) {
+			t.Errorf("ValidateChallenge() through provisioner B error = %v, want not found", err)
+		}
+		ch, err := getChallenge(db, chID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ch.getStatus() != StatusPending || len(ch.clone().Attempts) != 0 {
+			t.Errorf("challenge validated through provisioner B: %+v", ch.clone())
+		}
+	})
+	t.Run("GetOrdersByAccount", func(t *testing.T) {
+		if ids, err := a.GetOrdersByAccount(ctx, pA, acc.ID); err != nil || len(ids) != 1 {
+			t.Errorf("GetOrdersByAccount() through provisioner A = %v, %v, want 1 order", ids, err)
+		}
+		if ids, err := a.GetOrdersByAccount(ctx, pB, acc.ID); err != nil || len(ids) != 0 {
+			t.Errorf("GetOrdersByAccount() through provisioner B = %v, %v, want none", ids, err)
+		}
+	})
+	t.Run("GetRenewalInfo", func(t *testing.T) {
+		if _, err := a.GetRenewalInfo(pA, renewalID); err != nil {
+			t.Errorf("GetRenewalInfo() through provisioner A error = %v", err)
+		}
+		if _, err := a.GetRenewalInfo(pB, renewalID); err == nil || err.(*Error).Status != 404 {
+			t.Errorf("GetRenewalInfo() through provisioner B error = %v, want 404", err)
+		}
+	})
+	t.Run("DeactivateAccount", func(t *testing.T) {
+		if _, err := a.DeactivateAccount(ctx, pB, acc.ID); !isNotFound(err) {
+			t.Errorf("DeactivateAccount() through provisioner B error = %v, want not found", err)
+		}
+		got, err := a.GetAccount(ctx, pA, acc.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Status != StatusValid {
+			t.Errorf("account status = %s after a deactivation through provisioner B", got.Status)
+		}
+	})
+
+	// The same account key registers separate accounts on both
+	// provisioners.
+	t.Run("same key", func(t *testing.T) {
+		accB, err := a.NewAccount(ctx, pB, AccountOptions{Key: key})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if accB.ID == acc.ID {
+			t.Fatal("NewAccount() through provisioner B returned the account of provisioner A")
+		}
+		for p, want := range map[provisioner.Interface]string{pA: acc.ID, pB: accB.ID} {
+			got, err := a.GetAccountByKey(ctx, p, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.ID != want {
+				t.Errorf("GetAccountByKey() through %s = %s, want %s", p.GetName(), got.ID, want)
+			}
+		}
+		if _, err := a.GetAccount(ctx, pA, accB.ID); !isNotFound(err) {
+			t.Errorf("GetAccount() of the account of provisioner B through provisioner A error = %v, want not found", err)
+		}
+	})
+}
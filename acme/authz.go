@@ -1,13 +1,16 @@
 package acme
 
 import (
+	"context"
 	"encoding/json"
 	"strings"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/pkg/errors"
 	"github.com/smallstep/certificates/authority/provisioner"
 	"github.com/smallstep/nosql"
+	"github.com/smallstep/nosql/database"
 )
 
 var defaultExpiryDuration = time.Hour * 24
@@ -51,7 +54,7 @@ type authz interface {
 	getChallenges() []string
 	getCreated() time.Time
 	updateStatus(db nosql.DB) (authz, error)
-	toACME(nosql.DB, *directory, provisioner.Interface) (*Authz, error)
+	toACME(context.Context, nosql.DB, *directory, provisioner.Interface) (*Authz, error)
 }
 
 // baseAuthz is the base authz type that others build from.
@@ -64,10 +67,12 @@ type baseAuthz struct {
 	Challenges []string   `json:"challenges"`
 	Wildcard   bool       `json:"wildcard"`
 	Created    time.Time  `json:"created"`
-	Error      *Error     `json:"error"`
+	Error      *AError    `json:"error"`
+	// ProvisionerID is the ID of the provisioner of the order of the authz.
+	ProvisionerID string `json:"provisionerID,omitempty"`
 }
 
-func newBaseAuthz(accID string, identifier Identifier) (*baseAuthz, error) {
+func newBaseAuthz(accID, provID string, identifier Identifier) (*baseAuthz, error) {
 	id, err := randID()
 	if err != nil {
 		return nil, err
@@ -75,12 +80,13 @@ func newBaseAuthz(accID string, identifier Identifier) (*baseAuthz, error) {
 
 	now := clock.Now()
 	ba := &baseAuthz{
-		ID:         id,
-		AccountID:  accID,
-		Status:     StatusPending,
-		Created:    now,
-		Expires:    now.Add(defaultExpiryDuration),
-		Identifier: identifier,
+		ID:            id,
+		AccountID:     accID,
+		Status:        StatusPending,
+		Created:       now,
+		Expires:       now.Add(defaultExpiryDuration),
+		Identifier:    identifier,
+		ProvisionerID: provID,
 	}
 
 	if strings.HasPrefix(identifier.Value, "*.") {
@@ -141,14 +147,14 @@ func (ba *baseAuthz) getCreated() time.Time {
 
 // toACME converts the internal Authz type into the public acmeAuthz type for
 // presentation in the ACME protocol.
-func (ba *baseAuthz) toACME(db nosql.DB, dir *directory, p provisioner.Interface) (*Authz, error) {
+func (ba *baseAuthz) toACME(ctx context.Context, db nosql.DB, dir *directory, p provisioner.Interface) (*Authz, error) {
 	var chs = make([]*Challenge, len(ba.Challenges))
 	for i, chID := range ba.Challenges {
 		ch, err := getChallenge(db, chID)
 		if err != nil {
 			return nil, err
 		}
-		chs[i], err = ch.toACME(db, dir, p)
+		chs[i], err = ch.toACME(ctx, db, dir, p)
 		if err != nil {
 			return nil, err
 		}
@@ -214,27 +220,35 @@ func (ba *baseAuthz) updateStatus(db nosql.DB) (authz, error) {
 		// check expiry
 		if now.After(ba.Expires) {
 			newAuthz.Status = StatusInvalid
-			newAuthz.Error = MalformedErr(errors.New("authz has expired"))
+			newAuthz.Error = MalformedErr(errors.New("authz has expired")).ToACME()
 			break
 		}
 
-		var isValid = false
+		// A failed challenge invalidates the authz (RFC 8555, section 7.1.6).
+		var isValid, isInvalid bool
 		for _, chID := range ba.Challenges {
 			ch, err := getChallenge(db, chID)
 			if err != nil {
 				return ba, err
 			}
-			if ch.getStatus() == StatusValid {
+			switch ch.getStatus() {
+			case StatusValid:
 				isValid = true
-				break
+			case StatusInvalid:
+				isInvalid = true
+				newAuthz.Error = UnauthorizedErr(errors.Errorf("challenge %s failed validation", chID)).ToACME()
 			}
 		}
 
-		if !isValid {
+		switch {
+		case isValid:
+			newAuthz.Status = StatusValid
+			newAuthz.Error = nil
+		case isInvalid:
+			newAuthz.Status = StatusInvalid
+		default:
 			return ba.parent(), nil
 		}
-		newAuthz.Status = StatusValid
-		newAuthz.Error = nil
 	default:
 		return nil, ServerInternalErr(errors.Errorf("unrecognized authz status: %s", ba.Status))
 	}
@@ -273,11 +287,12 @@ type dnsAuthz struct {
 }
 
 // newAuthz returns a new acme authorization object based on the identifier
-// type.
-func newAuthz(db nosql.DB, accID string, identifier Identifier) (a authz, err error) {
+// type. The authz and its challenges are stored when the transaction is
+// committed.
+func newAuthz(tx *database.Tx, ops OrderOptions, identifier Identifier) (a authz, err error) {
 	switch identifier.Type {
 	case "dns":
-		a, err = newDNSAuthz(db, accID, identifier)
+		a, err = newDNSAuthz(tx, ops, identifier)
 	default:
 		err = MalformedErr(errors.Errorf("unexpected authz type %s",
 			identifier.Type))
@@ -286,38 +301,73 @@ func newAuthz(db nosql.DB, accID string, identifier Identifier) (a authz, err er
 }
 
 // newDNSAuthz returns a new dns acme authorization object.
-func newDNSAuthz(db nosql.DB, accID string, identifier Identifier) (authz, error) {
-	ba, err := newBaseAuthz(accID, identifier)
+func newDNSAuthz(tx *database.Tx, ops OrderOptions, identifier Identifier) (authz, error) {
+	accID := ops.AccountID
+	ba, err := newBaseAuthz(accID, ops.ProvisionerID, identifier)
 	if err != nil {
 		return nil, err
 	}
 
 	ba.Challenges = []string{}
+	if _, err := uuid.Parse(ba.Identifier.Value); err == nil && ops.DeviceAttestation && !ba.Wildcard {
+		// OCF devices are identified by their UUID, and only the device
+		// attestation proves it; a UUID is not a name to validate over
+		// HTTP or DNS.
+		ch, err := newDeviceAttest01Challenge(tx, ChallengeOptions{
+			AccountID:     accID,
+			ProvisionerID: ops.ProvisionerID,
+			AuthzID:       ba.ID,
+			Identifier:    ba.Identifier})
+		if err != nil {
+			return nil, Wrap(err, "error creating device-attest challenge")
+		}
+		ba.Challenges = append(ba.Challenges, ch.getID())
+		return insertDNSAuthz(tx, ba)
+	}
 	if !ba.Wildcard {
 		// http challenges are only permitted if the DNS is not a wildcard dns.
-		ch1, err := newHTTP01Challenge(db, ChallengeOptions{
-			AccountID:  accID,
-			AuthzID:    ba.ID,
-			Identifier: ba.Identifier})
+		ch1, err := newHTTP01Challenge(tx, ChallengeOptions{
+			AccountID:     accID,
+			ProvisionerID: ops.ProvisionerID,
+			AuthzID:       ba.ID,
+			Identifier:    ba.Identifier})
 		if err != nil {
 			return nil, Wrap(err, "error creating http challenge")
 		}
 		ba.Challenges = append(ba.Challenges, ch1.getID())
 	}
-	ch2, err := newDNS01Challenge(db, ChallengeOptions{
-		AccountID:  accID,
-		AuthzID:    ba.ID,
-		Identifier: identifier})
+	ch2, err := newDNS01Challenge(tx, ChallengeOptions{
+		AccountID:     accID,
+		ProvisionerID: ops.ProvisionerID,
+		AuthzID:       ba.ID,
+		Identifier:    identifier})
 	if err != nil {
 		return nil, Wrap(err, "error creating dns challenge")
 	}
 	ba.Challenges = append(ba.Challenges, ch2.getID())
+	if len(ops.IssuerDomainNames) > 0 {
+		ch3, err := newDNSPersist01Challenge(tx, ChallengeOptions{
+			AccountID:         accID,
+			ProvisionerID:     ops.ProvisionerID,
+			AuthzID:           ba.ID,
+			Identifier:        ba.Identifier,
+			Wildcard:          ba.Wildcard,
+			IssuerDomainNames: ops.IssuerDomainNames,
+			AccountURI:        ops.AccountURI})
+		if err != nil {
+			return nil, Wrap(err, "error creating dns-persist challenge")
+		}
+		ba.Challenges = append(ba.Challenges, ch3.getID())
+	}
+	return insertDNSAuthz(tx, ba)
+}
 
+// insertDNSAuthz adds the dns authz to the transaction.
+func insertDNSAuthz(tx *database.Tx, ba *baseAuthz) (authz, error) {
 	da := &dnsAuthz{ba}
-	if err := da.save(db, nil); err != nil {
+	if err := txInsert(tx, authzTable, da.ID, da); err != nil {
 		return nil, err
 	}
-
 	return da, nil
 }
 
@@ -0,0 +1,201 @@
+package acme
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/authority/provisioner"
+	"github.com/smallstep/nosql/database"
+)
+
+// unreachableValidator fails every lookup.
+type unreachableValidator struct{}
+
+func (unreachableValidator) HTTPGet(url string) (*http.Response, error) {
+	return nil, errors.New("connection refused")
+}
+
+func (unreachableValidator) LookupTXT(name string) ([]string, error) {
+	return nil, errors.New("no such host")
+}
+
+func (unreachableValidator) LookupCAA(name string) ([]caaRecord, error) {
+	return nil, nil
+}
+
+func TestNewDNSAuthzDeviceChallenges(t *testing.T) {
+	tests := []struct {
+		name       string
+		value      string
+		attest     bool
+		challenges int
+	}{
+		{"dns name", "www.example.com", true, 2},
+		{"uuid with attestation", testDeviceUUID, true, 1},
+		{"uuid without attestation", testDeviceUUID, false, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			az, err := newDNSAuthz(new(database.Tx), OrderOptions{
+				AccountID:         "accID",
+				DeviceAttestation: tt.attest,
+			}, Identifier{Type: "dns", Value: tt.value})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := len(az.getChallenges()); got != tt.challenges {
+				t.Errorf("newDNSAuthz() has %d challenges, want %d", got, tt.challenges)
+			}
+		})
+	}
+}
+
+func TestValidationAttempts(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxAttempts int
+		want        int
+	}{
+		{"default", 0, 1},
+		{"one", 1, 1},
+		{"three", 3, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, cleanup := newTestDB(t)
+			defer cleanup()
+			a, err := NewAuthority(db, "ca.example.com", "acme", nil,
+				WithValidator(unreachableValidator{}), WithMaxValidationAttempts(tt.maxAttempts))
+			if err != nil {
+				t.Fatal(err)
+			}
+			p := &provisioner.ACME{Type: "ACME", Name: "acme"}
+			ctx := context.Background()
+			o, err := newOrder(db, OrderOptions{
+				AccountID:     "acc1",
+				Identifiers:   []Identifier{{Type: "dns", Value: "www.example.com"}},
+				NotBefore:     time.Now(),
+				NotAfter:      time.Now().Add(time.Hour),
+				ProvisionerID: p.GetID(),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			az, err := getAuthz(db, o.Authorizations[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			var chID string
+			for _, id := range az.getChallenges() {
+				ch, err := getChallenge(db, id)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if ch.getType() == "http-01" {
+					chID = id
+				}
+			}
+			key := newTestAccountKey(t)
+
+			for i := 1; i <= tt.want+1; i++ {
+				ch, err := a.ValidateChallenge(ctx, p, "acc1", chID, key, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				wantStatus, wantRecords := StatusPending, i
+				if i >= tt.want {
+					// Validating an invalid challenge again does not
+					// attempt it.
+					wantStatus, wantRecords = StatusInvalid, tt.want
+				}
+				if ch.Status != wantStatus {
+					t.Errorf("attempt %d: challenge status = %s, want %s", i, ch.Status, wantStatus)
+				}
+				if ch.Error == nil {
+					t.Errorf("attempt %d: challenge has no error", i)
+				}
+				if len(ch.ValidationRecord) != wantRecords {
+					t.Fatalf("attempt %d: %d validation records, want %d", i, len(ch.ValidationRecord), wantRecords)
+				}
+				for _, vr := range ch.ValidationRecord {
+					if vr.Hostname != "www.example.com" || vr.Error == nil {
+						t.Errorf("attempt %d: validation record = %+v", i, vr)
+					}
+					if _, err := time.Parse(time.RFC3339, vr.Attempted); err != nil {
+						t.Errorf("attempt %d: validation record time %q: %v", i, vr.Attempted, err)
+					}
+				}
+
+				// The invalid challenge invalidates the authz, although
+				// its other challenges are still pending.
+				az, err := a.GetAuthz(ctx, p, "acc1", az.getID())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if az.Status != wantStatus {
+					t.Errorf("attempt %d: authz status = %s, want %s", i, az.Status, wantStatus)
+				}
+			}
+		})
+	}
+}
+
+func TestAuthzUpdateStatus(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+
+	tests := []struct {
+		name     string
+		statuses []string
+		want     string
+	}{
+		{"pending", []string{StatusPending, StatusPending}, StatusPending},
+		{"one invalid", []string{StatusInvalid, StatusPending}, StatusInvalid},
+		{"one valid", []string{StatusPending, StatusValid}, StatusValid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tx := new(database.Tx)
+			az, err := newDNSAuthz(tx, OrderOptions{AccountID: "acc1"}, Identifier{Type: "dns", Value: "www.example.com"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := commitInserts(db, tx); err != nil {
+				t.Fatal(err)
+			}
+			for i, id := range az.getChallenges() {
+				ch, err := getChallenge(db, id)
+				if err != nil {
+					t.Fatal(err)
+				}
+				bc := ch.clone()
+				switch tt.statuses[i] {
+				case StatusInvalid:
+					_, err = bc.storeError(db, ConnectionErr(errors.New("connection refused")), 1)
+				case StatusValid:
+					_, err = bc.storeValid(db)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, err := az.updateStatus(db)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.getStatus() != tt.want {
+				t.Errorf("updateStatus() status = %s, want %s", got.getStatus(), tt.want)
+			}
+			stored, err := getAuthz(db, az.getID())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored.getStatus() != tt.want {
+				t.Errorf("stored authz status = %s, want %s", stored.getStatus(), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,183 @@
+package acme
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// URLOptions configures the external URLs the ACME server is reached at,
+// e.g. behind a TLS terminating reverse proxy.
+type URLOptions struct {
+	// BaseURLs are the external base URLs of the ACME server, e.g.
+	// "https://ca.example.com/pki"; the ACME endpoints are served under
+	// their "acme" path. The first https one is the default. The others are
+	// used for the requests addressed to their host and scheme, so that
+	// several public names can front the same CA.
+	BaseURLs []string `json:"baseURLs,omitempty"`
+	// TrustedProxies are the IP addresses and CIDR ranges of the reverse
+	// proxies whose X-Forwarded-Host and X-Forwarded-Proto headers are
+	// trusted.
+	TrustedProxies []string `json:"trustedProxies,omitempty"`
+}
+
+// WithURLOptions sets the external URLs of the ACME server. By default the
+// links are built with the DNS name the Authority is created with.
+func WithURLOptions(o *URLOptions) Option {
+	return func(a *Authority) {
+		a.urlOpts = o
+	}
+}
+
+type baseURLContextKey struct{}
+
+// NewContextWithBaseURL returns a copy of ctx carrying the external base URL
+// the links of a request are built with.
+func NewContextWithBaseURL(ctx context.Context, u *url.URL) context.Context {
+	return context.WithValue(ctx, baseURLContextKey{}, u)
+}
+
+// BaseURLFromContext returns the external base URL stored in the context, if
+// any.
+func BaseURLFromContext(ctx context.Context) (*url.URL, bool) {
+	u, ok := ctx.Value(baseURLContextKey{}).(*url.URL)
+	return u, ok && u != nil
+}
+
+// urlResolver resolves the external base URL of the requests.
+type urlResolver struct {
+	bases   []*url.URL
+	proxies []*net.IPNet
+}
+
+// newURLResolver returns the resolver of the given options. Without base
+// URLs, the default base URL is the https URL of the given DNS name.
+func newURLResolver(dns string, o *URLOptions) (*urlResolver, error) {
+	if o == nil {
+		o = new(URLOptions)
+	}
+	res := new(urlResolver)
+	if len(o.BaseURLs) == 0 {
+		res.bases = []*url.URL{{Scheme: "https", Host: dns}}
+	}
+	for _, s := range o.BaseURLs {
+		u, err := url.Parse(s)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error parsing base URL %s", s)
+		}
+		if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return nil, errors.Errorf("base URL %s must be an absolute http or https URL", s)
+		}
+		if u.RawQuery != "" || u.Fragment != "" {
+			return nil, errors.Errorf("base URL %s must not have a query or fragment", s)
+		}
+		u.Path = strings.TrimSuffix(u.Path, "/")
+		u.RawPath = ""
+		res.bases = append(res.bases, u)
+	}
+	// The first https base URL is the default one.
+	for i, u := range res.bases {
+		if u.Scheme == "https" {
+			copy(res.bases[1:i+1], res.bases[:i])
+			res.bases[0] = u
+			break
+		}
+	}
+	for _, s := range o.TrustedProxies {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, errors.Errorf("invalid trusted proxy %s", s)
+			}
+			res.proxies = append(res.proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid trusted proxy %s", s)
+		}
+		res.proxies = append(res.proxies, n)
+	}
+	return res, nil
+}
+
+// isTrustedProxy returns true if the request comes from a trusted proxy.
+func (res *urlResolver) isTrustedProxy(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range res.proxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// baseURL returns the external base URL of the request. It is the base URL
+// of the host and scheme the request is addressed to, if configured, or the
+// default one. The host and scheme forwarded by a trusted proxy take
+// precedence over the ones of the request; an unconfigured forwarded host is
+// used as is. Plain HTTP requests, served by the insecure listener, are
+// answered with http links to the host they are addressed to.
+func (res *urlResolver) baseURL(r *http.Request) *url.URL {
+	host, scheme := r.Host, "https"
+	if r.TLS == nil {
+		scheme = "http"
+	}
+	var forwarded bool
+	if res.isTrustedProxy(r) {
+		if h := firstHeaderValue(r, "X-Forwarded-Host"); h != "" {
+			host, forwarded = h, true
+		}
+		if p := strings.ToLower(firstHeaderValue(r, "X-Forwarded-Proto")); p == "http" || p == "https" {
+			scheme, forwarded = p, true
+		}
+	}
+	for _, u := range res.bases {
+		if strings.EqualFold(u.Host, host) && scheme == u.Scheme {
+			return u
+		}
+	}
+	switch {
+	case forwarded:
+		return &url.URL{Scheme: scheme, Host: host, Path: res.bases[0].Path}
+	case r.TLS == nil:
+		return &url.URL{Scheme: scheme, Host: host}
+	default:
+		return res.bases[0]
+	}
+}
+
+// firstHeaderValue returns the first of the comma separated values of the
+// header.
+func firstHeaderValue(r *http.Request, name string) string {
+	v := r.Header.Get(name)
+	if i := strings.IndexByte(v, ','); i >= 0 {
+		v = v[:i]
+	}
+	return strings.TrimSpace(v)
+}
+
+// BaseURL returns the external base URL of the request, the one its links
+// must be built with.
+func (a *Authority) BaseURL(r *http.Request) *url.URL {
+	return a.urls.baseURL(r)
+}
+
+// RequestURL returns the external URL of the request, the one the url header
+// of its JWS must match.
+func (a *Authority) RequestURL(r *http.Request) *url.URL {
+	u := *a.urls.baseURL(r)
+	u.Path += r.URL.Path
+	return &u
+}
@@ -0,0 +1,131 @@
+package acme
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewURLResolver(t *testing.T) {
+	tests := []struct {
+		name  string
+		opts  *URLOptions
+		bases []string
+		ok    bool
+	}{
+		{"default", nil, []string{"https://ca.example.com"}, true},
+		{"https first", &URLOptions{BaseURLs: []string{"https://a.example.com/pki/"}}, []string{"https://a.example.com/pki"}, true},
+		{"https default moved first", &URLOptions{BaseURLs: []string{"http://a.internal", "http://b.internal", "https://c.example.com"}},
+			[]string{"https://c.example.com", "http://a.internal", "http://b.internal"}, true},
+		{"first of several https", &URLOptions{BaseURLs: []string{"http://a.internal", "https://b.example.com", "https://c.example.com"}},
+			[]string{"https://b.example.com", "http://a.internal", "https://c.example.com"}, true},
+		{"http only", &URLOptions{BaseURLs: []string{"http://a.internal"}}, []string{"http://a.internal"}, true},
+		{"relative", &URLOptions{BaseURLs: []string{"/pki"}}, nil, false},
+		{"other scheme", &URLOptions{BaseURLs: []string{"ftp://ca.example.com"}}, nil, false},
+		{"query", &URLOptions{BaseURLs: []string{"https://ca.example.com/?a=b"}}, nil, false},
+		{"fragment", &URLOptions{BaseURLs: []string{"https://ca.example.com/#a"}}, nil, false},
+		{"invalid url", &URLOptions{BaseURLs: []string{"https://ca.example.com/%zz"}}, nil, false},
+		{"trusted proxies", &URLOptions{TrustedProxies: []string{"10.0.0.1", "192.168.0.0/16", "::1"}}, []string{"https://ca.example.com"}, true},
+		{"invalid proxy", &URLOptions{TrustedProxies: []string{"proxy.internal"}}, nil, false},
+		{"invalid proxy range", &URLOptions{TrustedProxies: []string{"10.0.0.0/33"}}, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := newURLResolver("ca.example.com", tt.opts)
+			if (err == nil) != tt.ok {
+				t.Fatalf("newURLResolver() error = %v, want ok %v", err, tt.ok)
+			}
+			if err != nil {
+				return
+			}
+			var bases []string
+			for _, u := range res.bases {
+				bases = append(bases, u.String())
+			}
+			if len(bases) != len(tt.bases) {
+				t.Fatalf("bases = %v, want %v", bases, tt.bases)
+			}
+			for i := range bases {
+				if bases[i] != tt.bases[i] {
+					t.Errorf("bases = %v, want %v", bases, tt.bases)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestURLResolverBaseURL(t *testing.T) {
+	res, err := newURLResolver("ca.example.com", &URLOptions{
+		BaseURLs: []string{
+			"http://ca.internal:8080/pki",
+			"https://ca.example.com/pki",
+			"https://acme.example.org",
+		},
+		TrustedProxies: []string{"10.0.0.1", "192.168.0.0/16"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		target  string
+		remote  string
+		headers map[string]string
+		want    string
+	}{
+		{"default", "https://ca.example.com/acme/directory", "", nil, "https://ca.example.com/pki"},
+		{"other host", "https://acme.example.org/acme/directory", "", nil, "https://acme.example.org"},
+		{"host case", "https://ACME.example.org/acme/directory", "", nil, "https://acme.example.org"},
+		{"unknown host", "https://10.0.0.2:8443/acme/directory", "", nil, "https://ca.example.com/pki"},
+		{"plain http base", "http://ca.internal:8080/acme/directory", "", nil, "http://ca.internal:8080/pki"},
+		{"plain http fallback", "http://ca.example.com/acme/directory", "", nil, "http://ca.example.com"},
+		{"plain http unknown host", "http://10.0.0.2:8080/acme/directory", "", nil, "http://10.0.0.2:8080"},
+		{"untrusted forwarded host", "https://ca.example.com/acme/directory", "10.0.0.2:1234",
+			map[string]string{"X-Forwarded-Host": "acme.example.org"}, "https://ca.example.com/pki"},
+		{"untrusted forwarded proto", "http://ca.internal:8080/acme/directory", "192.0.2.1:1234",
+			map[string]string{"X-Forwarded-Proto": "https"}, "http://ca.internal:8080/pki"},
+		{"trusted forwarded host", "https://ca.example.com/acme/directory", "10.0.0.1:1234",
+			map[string]string{"X-Forwarded-Host": "acme.example.org"}, "https://acme.example.org"},
+		{"trusted range", "https://ca.example.com/acme/directory", "192.168.1.1:1234",
+			map[string]string{"X-Forwarded-Host": "acme.example.org, proxy.internal"}, "https://acme.example.org"},
+		{"trusted forwarded proto", "http://ca.example.com/acme/directory", "10.0.0.1:1234",
+			map[string]string{"X-Forwarded-Proto": "HTTPS"}, "https://ca.example.com/pki"},
+		{"trusted forwarded host and proto", "http://ca.internal:8080/acme/directory", "10.0.0.1:1234",
+			map[string]string{"X-Forwarded-Host": "ca.example.com", "X-Forwarded-Proto": "https"}, "https://ca.example.com/pki"},
+		{"trusted unconfigured forwarded host", "https://ca.example.com/acme/directory", "10.0.0.1:1234",
+			map[string]string{"X-Forwarded-Host": "public.example.net"}, "https://public.example.net/pki"},
+		{"trusted invalid forwarded proto", "https://acme.example.org/acme/directory", "10.0.0.1:1234",
+			map[string]string{"X-Forwarded-Proto": "ftp"}, "https://acme.example.org"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tt.target, nil)
+			if tt.remote != "" {
+				r.RemoteAddr = tt.remote
+			}
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			if got := res.baseURL(r).String(); got != tt.want {
+				t.Errorf("baseURL() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthorityRequestURL(t *testing.T) {
+	res, err := newURLResolver("ca.example.com", &URLOptions{BaseURLs: []string{"https://ca.example.com/pki"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &Authority{urls: res}
+	r := httptest.NewRequest("POST", "https://ca.example.com/acme/acme/new-order", nil)
+	if got, want := a.RequestURL(r).String(), "https://ca.example.com/pki/acme/acme/new-order"; got != want {
+		t.Errorf("RequestURL() = %s, want %s", got, want)
+	}
+	// The base URL is not modified.
+	if got := a.BaseURL(r).String(); got != "https://ca.example.com/pki" {
+		t.Errorf("BaseURL() = %s, want https://ca.example.com/pki", got)
+	}
+}
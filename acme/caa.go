@@ -0,0 +1,170 @@
+package acme
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/nosql"
+)
+
+// caaCriticalFlag is the issuer critical flag of a CAA record (RFC 8659,
+// section 4.1).
+const caaCriticalFlag = 128
+
+// caaRecord is a CAA resource record.
+type caaRecord struct {
+	Flag  uint8
+	Tag   string
+	Value string
+}
+
+type lookupCAA func(string) ([]caaRecord, error)
+
+// caaOptions are the options used to verify that the CAA records of an
+// identifier permit issuance.
+type caaOptions struct {
+	lookupCAA  lookupCAA
+	identities []string
+	accountURI string
+}
+
+// relevantCAASet returns the relevant CAA record set of a domain; the first
+// non-empty set found walking up the DNS tree, excluding the root.
+func relevantCAASet(lookup lookupCAA, domain string) ([]caaRecord, error) {
+	labels := strings.Split(strings.TrimSuffix(domain, "."), ".")
+	for i := range labels {
+		records, err := lookup(strings.Join(labels[i:], "."))
+		if err != nil {
+			return nil, err
+		}
+		if len(records) > 0 {
+			return records, nil
+		}
+	}
+	return nil, nil
+}
+
+// check returns an error if the CAA records of the domain do not permit the
+// CA to issue a certificate for it, validated with the given challenge type.
+// CAA checking is skipped if no CA identities are configured.
+func (co caaOptions) check(domain string, wildcard bool, method string) error {
+	if len(co.identities) == 0 {
+		return nil
+	}
+	records, err := relevantCAASet(co.lookupCAA, domain)
+	if err != nil {
+		return DNSErr(errors.Wrapf(err, "error looking up CAA records of %s", domain))
+	}
+
+	var issue, issueWild []caaRecord
+	for _, r := range records {
+		switch strings.ToLower(r.Tag) {
+		case "issue":
+			issue = append(issue, r)
+		case "issuewild":
+			issueWild = append(issueWild, r)
+		case "iodef", "contactemail", "contactphone":
+		default:
+			if r.Flag&caaCriticalFlag != 0 {
+				return CaaErr(errors.Errorf("CAA records of %s contain an unknown "+
+					"critical property %s", domain, r.Tag))
+			}
+		}
+	}
+	set := issue
+	if wildcard && len(issueWild) > 0 {
+		set = issueWild
+	}
+	if len(set) == 0 {
+		return nil
+	}
+	for _, r := range set {
+		if co.permits(r.Value, method) {
+			return nil
+		}
+	}
+	return CaaErr(errors.Errorf("CAA records of %s do not permit issuance", domain))
+}
+
+// permits returns true if the value of an issue or issuewild property
+// authorizes one of the CA identities for the account and challenge type.
+// Malformed values authorize no one.
+func (co caaOptions) permits(value, method string) bool {
+	domain, params, ok := parseCAAIssueValue(value)
+	if !ok {
+		return false
+	}
+	var found bool
+	for _, id := range co.identities {
+		if strings.EqualFold(domain, id) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return false
+	}
+	if uri, ok := params["accounturi"]; ok && uri != co.accountURI {
+		return false
+	}
+	if methods, ok := params["validationmethods"]; ok {
+		for _, m := range strings.Split(methods, ",") {
+			if m == method {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// parseCAAIssueValue parses the value of an issue or issuewild property; an
+// issuer domain name optionally followed by semicolon separated key=value
+// parameters.
+func parseCAAIssueValue(value string) (string, map[string]string, bool) {
+	parts := strings.Split(value, ";")
+	domain := strings.TrimSpace(parts[0])
+	params := make(map[string]string)
+	for _, p := range parts[1:] {
+		p = strings.TrimSpace(p)
+		if len(p) == 0 {
+			continue
+		}
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) != 2 || len(kv[0]) == 0 {
+			return "", nil, false
+		}
+		params[strings.ToLower(kv[0])] = kv[1]
+	}
+	return domain, params, true
+}
+
+// checkCAA verifies that the CAA records of the dns identifiers of the order
+// permit issuance, taking into account the challenge type each of them was
+// validated with.
+func (o *order) checkCAA(db nosql.DB, co caaOptions) error {
+	for _, azID := range o.Authorizations {
+		az, err := getAuthz(db, azID)
+		if err != nil {
+			return err
+		}
+		if az.getType() != "dns" {
+			continue
+		}
+		var method string
+		for _, chID := range az.getChallenges() {
+			ch, err := getChallenge(db, chID)
+			if err != nil {
+				return err
+			}
+			if ch.getStatus() == StatusValid {
+				method = ch.getType()
+				break
+			}
+		}
+		if err := co.check(az.getIdentifier().Value, az.getWildcard(), method); err != nil {
+			return err
+		}
+	}
+	return nil
+}
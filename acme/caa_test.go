@@ -0,0 +1,121 @@
+package acme
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// fakeCAA returns a CAA lookup answering from the given records by domain,
+// recording the domains looked up.
+func fakeCAA(records map[string][]caaRecord, looked *[]string) lookupCAA {
+	return func(domain string) ([]caaRecord, error) {
+		if looked != nil {
+			*looked = append(*looked, domain)
+		}
+		if domain == "servfail.example.com" {
+			return nil, errors.New("SERVFAIL")
+		}
+		return records[domain], nil
+	}
+}
+
+func TestRelevantCAASetClimbsTree(t *testing.T) {
+	var looked []string
+	lookup := fakeCAA(map[string][]caaRecord{
+		"example.com": {{Tag: "issue", Value: "ca.example.net"}},
+	}, &looked)
+
+	records, err := relevantCAASet(lookup, "a.b.example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Value != "ca.example.net" {
+		t.Errorf("relevantCAASet() = %v, want the example.com records", records)
+	}
+	want := []string{"a.b.example.com", "b.example.com", "example.com"}
+	if len(looked) != len(want) {
+		t.Fatalf("looked up %v, want %v", looked, want)
+	}
+	for i := range want {
+		if looked[i] != want[i] {
+			t.Errorf("looked up %v, want %v", looked, want)
+			break
+		}
+	}
+}
+
+func TestCAACheck(t *testing.T) {
+	records := map[string][]caaRecord{
+		"allowed.com": {{Tag: "issue", Value: "ca.example.net"}},
+		"denied.com":  {{Tag: "issue", Value: "other.example.org"}},
+		"wild.com": {
+			{Tag: "issue", Value: "ca.example.net"},
+			{Tag: "issuewild", Value: ";"},
+		},
+		"wildonly.com": {
+			{Tag: "issue", Value: ";"},
+			{Tag: "issuewild", Value: "ca.example.net"},
+		},
+		"critical.com": {
+			{Tag: "issue", Value: "ca.example.net"},
+			{Flag: caaCriticalFlag, Tag: "tbs", Value: "unknown"},
+		},
+		"noncritical.com": {
+			{Tag: "issue", Value: "ca.example.net"},
+			{Tag: "tbs", Value: "unknown"},
+		},
+		"account.com": {{Tag: "issue", Value: "ca.example.net; accounturi=https://ca/acct/1"}},
+		"method.com":  {{Tag: "issue", Value: "ca.example.net; validationmethods=dns-01"}},
+		"iodef.com":   {{Tag: "iodef", Value: "mailto:security@iodef.com"}},
+	}
+	co := caaOptions{
+		lookupCAA:  fakeCAA(records, nil),
+		identities: []string{"CA.example.net"},
+		accountURI: "https://ca/acct/2",
+	}
+
+	tests := []struct {
+		name     string
+		domain   string
+		wildcard bool
+		method   string
+		wantErr  bool
+	}{
+		{"no records", "norecords.com", false, "http-01", false},
+		{"only iodef", "iodef.com", false, "http-01", false},
+		{"allowed", "allowed.com", false, "http-01", false},
+		{"allowed subdomain", "www.allowed.com", false, "http-01", false},
+		{"denied", "denied.com", false, "http-01", true},
+		{"issuewild denies wildcard", "wild.com", true, "dns-01", true},
+		{"issue allows non-wildcard", "wild.com", false, "dns-01", false},
+		{"issuewild allows wildcard", "wildonly.com", true, "dns-01", false},
+		{"issue denies non-wildcard", "wildonly.com", false, "dns-01", true},
+		{"unknown critical tag", "critical.com", false, "http-01", true},
+		{"unknown non-critical tag", "noncritical.com", false, "http-01", false},
+		{"other account", "account.com", false, "http-01", true},
+		{"validation method allowed", "method.com", false, "dns-01", false},
+		{"validation method denied", "method.com", false, "http-01", true},
+		{"lookup failure", "servfail.example.com", false, "http-01", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := co.check(tt.domain, tt.wildcard, tt.method)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("check(%s) error = %v, wantErr %v", tt.domain, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCAACheckWithoutIdentities(t *testing.T) {
+	co := caaOptions{
+		lookupCAA: func(string) ([]caaRecord, error) {
+			t.Fatal("CAA records must not be looked up")
+			return nil, nil
+		},
+	}
+	if err := co.check("denied.com", false, "http-01"); err != nil {
+		t.Errorf("check() error = %v", err)
+	}
+}
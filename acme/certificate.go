@@ -1,6 +1,7 @@
 package acme
 
 import (
+	"bytes"
 	"crypto/x509"
 	"encoding/json"
 	"encoding/pem"
@@ -8,6 +9,8 @@ import (
 
 	"github.com/pkg/errors"
 	"github.com/smallstep/nosql"
+	"github.com/smallstep/nosql/database"
+	"go.mozilla.org/pkcs7"
 )
 
 type certificate struct {
@@ -17,12 +20,21 @@ type certificate struct {
 	OrderID       string    `json:"orderID"`
 	Leaf          []byte    `json:"leaf"`
 	Intermediates []byte    `json:"intermediates"`
+	// RevokeAt is the time at which the certificate is scheduled to be
+	// revoked by an operator, if any.
+	RevokeAt *time.Time `json:"revokeAt,omitempty"`
+	// Revoked is the time the certificate was revoked by an operator, and
+	// RevocationReason the reason given, if any.
+	Revoked          *time.Time `json:"revoked,omitempty"`
+	RevocationReason string     `json:"revocationReason,omitempty"`
+	ProvisionerID    string     `json:"provisionerID,omitempty"`
 }
 
 // CertOptions options with which to create and store a cert object.
 type CertOptions struct {
 	AccountID     string
 	OrderID       string
+	ProvisionerID string
 	Leaf          *x509.Certificate
 	Intermediates []*x509.Certificate
 }
@@ -49,29 +61,212 @@ func newCert(db nosql.DB, ops CertOptions) (*certificate, error) {
 		ID:            id,
 		AccountID:     ops.AccountID,
 		OrderID:       ops.OrderID,
+		ProvisionerID: ops.ProvisionerID,
 		Leaf:          leaf,
 		Intermediates: intermediates,
 		Created:       time.Now().UTC(),
 	}
-	certB, err := json.Marshal(cert)
-	if err != nil {
-		return nil, ServerInternalErr(errors.Wrap(err, "error marshaling certificate"))
+
+	// Store the certificate together with the serial -> certificate ID index.
+	tx := new(database.Tx)
+	if err := txInsert(tx, certTable, id, cert); err != nil {
+		return nil, err
+	}
+	txInsertBytes(tx, certBySerialTable, ops.Leaf.SerialNumber.String(), []byte(id))
+	if err := commitInserts(db, tx); err != nil {
+		return nil, Wrap(err, "error storing certificate")
 	}
+	return cert, nil
+}
 
-	_, swapped, err := db.CmpAndSwap(certTable, []byte(id), nil, certB)
+func (c *certificate) save(db nosql.DB, old *certificate) error {
+	oldB, err := json.Marshal(old)
+	if err != nil {
+		return ServerInternalErr(errors.Wrap(err, "error marshaling old certificate"))
+	}
+	newB, err := json.Marshal(c)
+	if err != nil {
+		return ServerInternalErr(errors.Wrap(err, "error marshaling new certificate"))
+	}
+	_, swapped, err := db.CmpAndSwap(certTable, []byte(c.ID), oldB, newB)
 	switch {
 	case err != nil:
-		return nil, ServerInternalErr(errors.Wrap(err, "error storing certificate"))
+		return ServerInternalErr(errors.Wrap(err, "error storing certificate"))
 	case !swapped:
-		return nil, ServerInternalErr(errors.New("error storing certificate; " +
+		return ServerInternalErr(errors.New("error storing certificate; " +
 			"value has changed since last read"))
 	default:
-		return cert, nil
+		return nil
+	}
+}
+
+// scheduledRevocation is the entry of a certificate in the table of the
+// scheduled revocations.
+type scheduledRevocation struct {
+	RevokeAt   time.Time `json:"revokeAt"`
+	Reason     string    `json:"reason,omitempty"`
+	ReasonCode int       `json:"reasonCode"`
+}
+
+// revokeAt returns the time at which the certificate is scheduled to be
+// revoked, if any. Records stored before RevokeAt was optional have a zero
+// time.
+func (c *certificate) revokeAt() (time.Time, bool) {
+	if c.RevokeAt == nil || c.RevokeAt.IsZero() {
+		return time.Time{}, false
+	}
+	return *c.RevokeAt, true
+}
+
+// revoked returns the time at which the certificate was revoked, if it was.
+// Records stored before Revoked was optional have a zero time.
+func (c *certificate) revoked() (time.Time, bool) {
+	if c.Revoked == nil || c.Revoked.IsZero() {
+		return time.Time{}, false
+	}
+	return *c.Revoked, true
+}
+
+// scheduleRevocation records the time at which the certificate is going to
+// be revoked, together with its entry in the scheduled revocations table.
+func (c *certificate) scheduleRevocation(db nosql.DB, sr scheduledRevocation) (*certificate, error) {
+	oldB, err := json.Marshal(c)
+	if err != nil {
+		return nil, ServerInternalErr(errors.Wrap(err, "error marshaling old certificate"))
+	}
+	b := *c
+	at := sr.RevokeAt.UTC()
+	b.RevokeAt = &at
+	newB, err := json.Marshal(&b)
+	if err != nil {
+		return nil, ServerInternalErr(errors.Wrap(err, "error marshaling new certificate"))
+	}
+
+	tx := new(database.Tx)
+	tx.Operations = append(tx.Operations, &database.TxEntry{
+		Bucket:   certTable,
+		Key:      []byte(c.ID),
+		CmpValue: oldB,
+		Value:    newB,
+		Cmd:      database.CmpAndSwap,
+	})
+	if err := txInsert(tx, scheduledRevocationTable, c.ID, sr); err != nil {
+		return nil, err
+	}
+	if err := commitInserts(db, tx); err != nil {
+		return nil, Wrap(err, "error scheduling certificate revocation")
+	}
+	return &b, nil
+}
+
+// revoke records that the certificate has been revoked.
+func (c *certificate) revoke(db nosql.DB, reason string) (*certificate, error) {
+	b := *c
+	now := time.Now().UTC()
+	b.Revoked = &now
+	b.RevocationReason = reason
+	if err := b.save(db, c); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// leaf returns the parsed leaf certificate.
+func (c *certificate) leaf() (*x509.Certificate, error) {
+	leaf, err := parseCertificates(c.Leaf)
+	if err != nil {
+		return nil, err
+	}
+	if len(leaf) != 1 {
+		return nil, ServerInternalErr(errors.Errorf("certificate %s has an invalid leaf", c.ID))
+	}
+	return leaf[0], nil
+}
+
+// Certificate formats that can be requested when downloading a certificate.
+const (
+	// CertificateChainPEM is the PEM encoded leaf followed by its chain.
+	CertificateChainPEM = "application/pem-certificate-chain"
+	// CertificateDER is the DER encoded leaf only.
+	CertificateDER = "application/pkix-cert"
+	// CertificatePKCS7 is a degenerate PKCS#7 bundle with the leaf and its
+	// chain.
+	CertificatePKCS7 = "application/pkcs7-mime"
+)
+
+// chains returns the chains the certificate can be served with. The first
+// one is the chain the certificate was issued with. An alternate chain
+// applies if its first certificate has the same subject and key as the
+// issuing intermediate.
+func (c *certificate) chains(alternates [][]*x509.Certificate) ([][]*x509.Certificate, error) {
+	leaf, err := c.leaf()
+	if err != nil {
+		return nil, err
+	}
+	intermediates, err := parseCertificates(c.Intermediates)
+	if err != nil {
+		return nil, err
+	}
+	chains := [][]*x509.Certificate{append([]*x509.Certificate{leaf}, intermediates...)}
+	if len(intermediates) == 0 {
+		return chains, nil
+	}
+	issuer := intermediates[0]
+	for _, alt := range alternates {
+		if bytes.Equal(alt[0].Raw, issuer.Raw) ||
+			!bytes.Equal(alt[0].RawSubject, issuer.RawSubject) ||
+			!bytes.Equal(alt[0].RawSubjectPublicKeyInfo, issuer.RawSubjectPublicKeyInfo) {
+			continue
+		}
+		chains = append(chains, append([]*x509.Certificate{leaf}, alt...))
+	}
+	return chains, nil
+}
+
+// encodeChain encodes a leaf certificate and its chain in the given format.
+func encodeChain(chain []*x509.Certificate, format string) ([]byte, error) {
+	switch format {
+	case CertificateChainPEM:
+		var b []byte
+		for _, cert := range chain {
+			b = append(b, pem.EncodeToMemory(&pem.Block{
+				Type:  "CERTIFICATE",
+				Bytes: cert.Raw,
+			})...)
+		}
+		return b, nil
+	case CertificateDER:
+		return chain[0].Raw, nil
+	case CertificatePKCS7:
+		var der []byte
+		for _, cert := range chain {
+			der = append(der, cert.Raw...)
+		}
+		b, err := pkcs7.DegenerateCertificate(der)
+		if err != nil {
+			return nil, ServerInternalErr(errors.Wrap(err, "error encoding PKCS#7 certificate bundle"))
+		}
+		return b, nil
+	default:
+		return nil, MalformedErr(errors.Errorf("unsupported certificate format %s", format))
 	}
 }
 
-func (c *certificate) toACME(db nosql.DB, dir *directory) ([]byte, error) {
-	return append(c.Leaf, c.Intermediates...), nil
+// parseCertificates parses the PEM encoded certificates.
+func parseCertificates(b []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, b = pem.Decode(b)
+		if block == nil {
+			return certs, nil
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, ServerInternalErr(errors.Wrap(err, "error parsing stored certificate"))
+		}
+		certs = append(certs, cert)
+	}
 }
 
 func getCert(db nosql.DB, id string) (*certificate, error) {
@@ -87,3 +282,14 @@ func getCert(db nosql.DB, id string) (*certificate, error) {
 	}
 	return &cert, nil
 }
+
+// getCertBySerial retrieves the certificate with the given leaf serial number.
+func getCertBySerial(db nosql.DB, serial string) (*certificate, error) {
+	id, err := db.Get(certBySerialTable, []byte(serial))
+	if nosql.IsErrNotFound(err) {
+		return nil, MalformedErr(errors.Wrapf(err, "certificate with serial %s not found", serial))
+	} else if err != nil {
+		return nil, ServerInternalErr(errors.Wrap(err, "error loading serial-certificate index"))
+	}
+	return getCert(db, string(id))
+}
@@ -0,0 +1,136 @@
+package acme
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/smallstep/certificates/authority/provisioner"
+	"go.mozilla.org/pkcs7"
+)
+
+func TestGetCertificateChains(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+
+	ca := func(cn string) *x509.Certificate {
+		return &x509.Certificate{
+			Subject:               pkix.Name{CommonName: cn},
+			IsCA:                  true,
+			BasicConstraintsValid: true,
+			KeyUsage:              x509.KeyUsageCertSign,
+		}
+	}
+	root, rootKey := newTestCert(t, ca("Root"), nil, nil)
+	intermediate, intermediateKey := newTestCert(t, ca("Intermediate"), root, rootKey)
+	leaf, _ := newTestCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "www.example.com"}}, intermediate, intermediateKey)
+
+	// The alternate intermediate has the subject and key of the issuing one
+	// but is signed by another root; the other intermediate has another key
+	// and does not apply.
+	altRoot, altRootKey := newTestCert(t, ca("Alternate Root"), nil, nil)
+	tmpl := ca("Intermediate")
+	tmpl.SerialNumber = big.NewInt(time.Now().UnixNano())
+	tmpl.NotBefore, tmpl.NotAfter = intermediate.NotBefore, intermediate.NotAfter
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, altRoot, intermediateKey.Public(), altRootKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	altIntermediate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := newTestCert(t, ca("Intermediate"), altRoot, altRootKey)
+
+	p := &provisioner.ACME{Type: "ACME", Name: "acme"}
+	cert, err := newCert(db, CertOptions{
+		AccountID:     "acc1",
+		ProvisionerID: p.GetID(),
+		Leaf:          leaf,
+		Intermediates: []*x509.Certificate{intermediate},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	base, err := url.Parse("https://ca.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &Authority{
+		db:              db,
+		dir:             newDirectory(base, "acme"),
+		alternateChains: [][]*x509.Certificate{{other}, {altIntermediate, altRoot}},
+	}
+	certLink := "https://ca.example.com/acme/acme/certificate/" + cert.ID
+
+	tests := []struct {
+		name   string
+		chain  int
+		format string
+		want   []*x509.Certificate
+		links  []string
+	}{
+		{"pem", 0, CertificateChainPEM, []*x509.Certificate{leaf, intermediate}, []string{certLink + "/1"}},
+		{"pem alternate", 1, CertificateChainPEM, []*x509.Certificate{leaf, altIntermediate, altRoot}, []string{certLink}},
+		{"der", 0, CertificateDER, []*x509.Certificate{leaf}, []string{certLink + "/1"}},
+		{"der alternate", 1, CertificateDER, []*x509.Certificate{leaf}, []string{certLink}},
+		{"pkcs7", 0, CertificatePKCS7, []*x509.Certificate{leaf, intermediate}, []string{certLink + "/1"}},
+		{"pkcs7 alternate", 1, CertificatePKCS7, []*x509.Certificate{leaf, altIntermediate, altRoot}, []string{certLink}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, links, err := a.GetCertificate(context.Background(), p, "acc1", cert.ID, tt.chain, tt.format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []*x509.Certificate
+			switch tt.format {
+			case CertificateChainPEM:
+				for block, rest := pem.Decode(b); block != nil; block, rest = pem.Decode(rest) {
+					c, err := x509.ParseCertificate(block.Bytes)
+					if err != nil {
+						t.Fatal(err)
+					}
+					got = append(got, c)
+				}
+			case CertificateDER:
+				c, err := x509.ParseCertificate(b)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, c)
+			case CertificatePKCS7:
+				p7, err := pkcs7.Parse(b)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = p7.Certificates
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("GetCertificate() returned %d certificates, want %d", len(got), len(tt.want))
+			}
+			for i := range got {
+				if !got[i].Equal(tt.want[i]) {
+					t.Errorf("certificate %d is %s, want %s", i, got[i].Subject, tt.want[i].Subject)
+				}
+			}
+			if fmt.Sprint(links) != fmt.Sprint(tt.links) {
+				t.Errorf("GetCertificate() links = %v, want %v", links, tt.links)
+			}
+		})
+	}
+
+	if _, _, err := a.GetCertificate(context.Background(), p, "acc1", cert.ID, 2, CertificateChainPEM); err == nil {
+		t.Error("GetCertificate() of a missing chain error = nil")
+	}
+	if _, _, err := a.GetCertificate(context.Background(), p, "acc1", cert.ID, 0, "text/plain"); err == nil {
+		t.Error("GetCertificate() in an unsupported format error = nil")
+	}
+}
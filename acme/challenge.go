@@ -1,38 +1,52 @@
 package acme
 
 import (
+	"context"
 	"crypto"
 	"crypto/sha256"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"net/http"
 	/*
 	"net"
 	"os"
-	"strconv"
 	*/
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/pkg/errors"
 	"github.com/smallstep/certificates/authority/provisioner"
 	"github.com/smallstep/cli/jose"
 	"github.com/smallstep/nosql"
+	"github.com/smallstep/nosql/database"
 )
 
 // Challenge is a subset of the challenge type containing only those attributes
 // required for responses in the ACME protocol.
 type Challenge struct {
-	Type      string  `json:"type"`
-	Status    string  `json:"status"`
-	Token     string  `json:"token"`
-	Validated string  `json:"validated,omitempty"`
-	URL       string  `json:"url"`
+	Type             string             `json:"type"`
+	Status           string             `json:"status"`
+	Token            string             `json:"token"`
+	Validated        string             `json:"validated,omitempty"`
+	URL              string             `json:"url"`
+	Error            *AError            `json:"error,omitempty"`
+	ValidationRecord []ValidationRecord `json:"validationRecord,omitempty"`
+	// IssuerDomainNames are the CA identities a dns-persist-01 record
+	// must name.
+	IssuerDomainNames []string `json:"issuer-domain-names,omitempty"`
+	ID                string   `json:"-"`
+	AuthzID           string   `json:"-"`
+}
+
+// ValidationRecord describes a validation attempt of a challenge.
+type ValidationRecord struct {
+	Hostname  string  `json:"hostname"`
+	Attempted string  `json:"attempted"`
 	Error     *AError `json:"error,omitempty"`
-	ID        string  `json:"-"`
-	AuthzID   string  `json:"-"`
 }
 
 // ToLog enables response logging.
@@ -54,18 +68,21 @@ func (c *Challenge) GetAuthzID() string {
 	return c.AuthzID
 }
 
-type httpGetter func(string) (*http.Response, error)
-type lookupTxt func(string) ([]string, error)
-
-type validateOptions struct {
-	httpGet   httpGetter
-	lookupTxt lookupTxt
+// validateParams are the parameters of a validation attempt.
+type validateParams struct {
+	// maxAttempts is the number of failed validations after which the
+	// challenge becomes invalid.
+	maxAttempts int
+	// payload is the payload of the request that triggered the validation.
+	payload []byte
+	// manufacturerRoots are the roots device attestations must chain to.
+	manufacturerRoots *x509.CertPool
 }
 
 // challenge is the interface ACME challenege types must implement.
 type challenge interface {
 	save(db nosql.DB, swap challenge) error
-	validate(nosql.DB, *jose.JSONWebKey, validateOptions) (challenge, error)
+	validate(nosql.DB, *jose.JSONWebKey, Validator, validateParams) (challenge, error)
 	getType() string
 	getError() *AError
 	getValue() string
@@ -77,14 +94,18 @@ type challenge interface {
 	getAccountID() string
 	getValidated() time.Time
 	getCreated() time.Time
-	toACME(nosql.DB, *directory, provisioner.Interface) (*Challenge, error)
+	toACME(context.Context, nosql.DB, *directory, provisioner.Interface) (*Challenge, error)
 }
 
 // ChallengeOptions is the type used to created a new Challenge.
 type ChallengeOptions struct {
-	AccountID  string
-	AuthzID    string
-	Identifier Identifier
+	AccountID         string
+	ProvisionerID     string
+	AuthzID           string
+	Identifier        Identifier
+	Wildcard          bool
+	IssuerDomainNames []string
+	AccountURI        string
 }
 
 // baseChallenge is the base Challenge type that others build from.
@@ -99,9 +120,23 @@ type baseChallenge struct {
 	Validated time.Time `json:"validated"`
 	Created   time.Time `json:"created"`
 	Error     *AError   `json:"error"`
+	Attempts  []attempt `json:"attempts,omitempty"`
+	// Persistent DNS validation attributes.
+	Wildcard          bool     `json:"wildcard,omitempty"`
+	IssuerDomainNames []string `json:"issuerDomainNames,omitempty"`
+	AccountURI        string   `json:"accountURI,omitempty"`
+	// ProvisionerID is the ID of the provisioner of the order of the
+	// challenge.
+	ProvisionerID string `json:"provisionerID,omitempty"`
+}
+
+// attempt is the record of a validation attempt.
+type attempt struct {
+	Attempted time.Time `json:"attempted"`
+	Error     *AError   `json:"error,omitempty"`
 }
 
-func newBaseChallenge(accountID, authzID string) (*baseChallenge, error) {
+func newBaseChallenge(accountID, provID, authzID string) (*baseChallenge, error) {
 	id, err := randID()
 	if err != nil {
 		return nil, Wrap(err, "error generating random id for ACME challenge")
@@ -112,12 +147,13 @@ func newBaseChallenge(accountID, authzID string) (*baseChallenge, error) {
 	}
 
 	return &baseChallenge{
-		ID:        id,
-		AccountID: accountID,
-		AuthzID:   authzID,
-		Status:    StatusPending,
-		Token:     token,
-		Created:   clock.Now(),
+		ID:            id,
+		AccountID:     accountID,
+		AuthzID:       authzID,
+		Status:        StatusPending,
+		Token:         token,
+		Created:       clock.Now(),
+		ProvisionerID: provID,
 	}, nil
 }
 
@@ -173,21 +209,31 @@ func (bc *baseChallenge) getError() *AError {
 
 // toACME converts the internal Challenge type into the public acmeChallenge
 // type for presentation in the ACME protocol.
-func (bc *baseChallenge) toACME(db nosql.DB, dir *directory, p provisioner.Interface) (*Challenge, error) {
+func (bc *baseChallenge) toACME(ctx context.Context, db nosql.DB, dir *directory, p provisioner.Interface) (*Challenge, error) {
 	ac := &Challenge{
 		Type:    bc.getType(),
 		Status:  bc.getStatus(),
 		Token:   bc.getToken(),
-		URL:     dir.getLink(ChallengeLink, URLSafeProvisionerName(p), true, bc.getID()),
+		URL:     dir.getLink(ctx, ChallengeLink, URLSafeProvisionerName(p), true, bc.getID()),
 		ID:      bc.getID(),
 		AuthzID: bc.getAuthzID(),
 	}
+	if len(bc.IssuerDomainNames) > 0 {
+		ac.IssuerDomainNames = bc.IssuerDomainNames
+	}
 	if !bc.Validated.IsZero() {
 		ac.Validated = bc.Validated.Format(time.RFC3339)
 	}
 	if bc.Error != nil {
 		ac.Error = bc.Error
 	}
+	for _, at := range bc.Attempts {
+		ac.ValidationRecord = append(ac.ValidationRecord, ValidationRecord{
+			Hostname:  bc.Value,
+			Attempted: at.Attempted.Format(time.RFC3339),
+			Error:     at.Error,
+		})
+	}
 	return ac, nil
 }
 
@@ -229,14 +275,40 @@ func (bc *baseChallenge) clone() *baseChallenge {
 	return &u
 }
 
-func (bc *baseChallenge) validate(db nosql.DB, jwk *jose.JSONWebKey, vo validateOptions) (challenge, error) {
+func (bc *baseChallenge) validate(db nosql.DB, jwk *jose.JSONWebKey, v Validator, vp validateParams) (challenge, error) {
 	return nil, ServerInternalErr(errors.New("unimplemented"))
 }
 
-func (bc *baseChallenge) storeError(db nosql.DB, err *Error) error {
+// storeError records a failed validation attempt and returns the updated
+// challenge. The challenge becomes invalid once maxAttempts validations have
+// failed; it stays pending otherwise so that the client can retry.
+func (bc *baseChallenge) storeError(db nosql.DB, err *Error, maxAttempts int) (*baseChallenge, error) {
 	clone := bc.clone()
 	clone.Error = err.ToACME()
-	return clone.save(db, bc)
+	clone.Attempts = append(clone.Attempts, attempt{
+		Attempted: clock.Now(),
+		Error:     clone.Error,
+	})
+	if len(clone.Attempts) >= maxAttempts {
+		clone.Status = StatusInvalid
+	}
+	if err := clone.save(db, bc); err != nil {
+		return nil, err
+	}
+	return clone, nil
+}
+
+// storeValid marks the challenge as valid and returns the updated challenge.
+func (bc *baseChallenge) storeValid(db nosql.DB) (*baseChallenge, error) {
+	clone := bc.clone()
+	clone.Status = StatusValid
+	clone.Error = nil
+	clone.Validated = clock.Now()
+	clone.Attempts = append(clone.Attempts, attempt{Attempted: clone.Validated})
+	if err := clone.save(db, bc); err != nil {
+		return nil, err
+	}
+	return clone, nil
 }
 
 // unmarshalChallenge unmarshals a challenge type into the correct sub-type.
@@ -263,6 +335,20 @@ func unmarshalChallenge(data []byte) (challenge, error) {
 				"challenge type into http01Challenge"))
 		}
 		return &http01Challenge{&bc}, nil
+	case "device-attest-01":
+		var bc baseChallenge
+		if err := json.Unmarshal(data, &bc); err != nil {
+			return nil, ServerInternalErr(errors.Wrap(err, "error unmarshaling "+
+				"challenge type into deviceAttest01Challenge"))
+		}
+		return &deviceAttest01Challenge{&bc}, nil
+	case "dns-persist-01":
+		var bc baseChallenge
+		if err := json.Unmarshal(data, &bc); err != nil {
+			return nil, ServerInternalErr(errors.Wrap(err, "error unmarshaling "+
+				"challenge type into dnsPersist01Challenge"))
+		}
+		return &dnsPersist01Challenge{&bc}, nil
 	default:
 		return nil, ServerInternalErr(errors.Errorf("unexpected challenge type %s", getType.Type))
 	}
@@ -273,9 +359,10 @@ type http01Challenge struct {
 	*baseChallenge
 }
 
-// newHTTP01Challenge returns a new acme http-01 challenge.
-func newHTTP01Challenge(db nosql.DB, ops ChallengeOptions) (challenge, error) {
-	bc, err := newBaseChallenge(ops.AccountID, ops.AuthzID)
+// newHTTP01Challenge returns a new acme http-01 challenge. The challenge is
+// stored when the transaction is committed.
+func newHTTP01Challenge(tx *database.Tx, ops ChallengeOptions) (challenge, error) {
+	bc, err := newBaseChallenge(ops.AccountID, ops.ProvisionerID, ops.AuthzID)
 	if err != nil {
 		return nil, err
 	}
@@ -283,7 +370,7 @@ func newHTTP01Challenge(db nosql.DB, ops ChallengeOptions) (challenge, error) {
 	bc.Value = ops.Identifier.Value
 
 	hc := &http01Challenge{bc}
-	if err := hc.save(db, nil); err != nil {
+	if err := txInsert(tx, challengeTable, hc.ID, hc); err != nil {
 		return nil, err
 	}
 	return hc, nil
@@ -292,11 +379,18 @@ func newHTTP01Challenge(db nosql.DB, ops ChallengeOptions) (challenge, error) {
 // Validate attempts to validate the challenge. If the challenge has been
 // satisfactorily validated, the 'status' and 'validated' attributes are
 // updated.
-func (hc *http01Challenge) validate(db nosql.DB, jwk *jose.JSONWebKey, vo validateOptions) (challenge, error) {
+func (hc *http01Challenge) validate(db nosql.DB, jwk *jose.JSONWebKey, v Validator, vp validateParams) (challenge, error) {
 	// If already valid or invalid then return without performing validation.
 	if hc.getStatus() == StatusValid || hc.getStatus() == StatusInvalid {
 		return hc, nil
 	}
+	fail := func(e *Error) (challenge, error) {
+		bc, err := hc.storeError(db, e, vp.maxAttempts)
+		if err != nil {
+			return nil, err
+		}
+		return &http01Challenge{bc}, nil
+	}
 	url := fmt.Sprintf("http://%s/.well-known/acme-challenge/%s", hc.Value, hc.Token)
 /*
 	v := hc.Value
@@ -330,25 +424,18 @@ func (hc *http01Challenge) validate(db nosql.DB, jwk *jose.JSONWebKey, vo valida
 		<-time.After(time.Until(delayTo))
 	}
 */
-	resp, err := vo.httpGet(url)
+	resp, err := v.HTTPGet(url)
 	fmt.Printf("DEBUG http01Challenge.validate.httpGet %v: %v\n", url, err)
 	if err != nil {
-		if err = hc.storeError(db, ConnectionErr(errors.Wrapf(err,
-			"error doing http GET for url %s", url))); err != nil {
-			return nil, err
-		}
-		return hc, nil
+		return fail(ConnectionErr(errors.Wrapf(err,
+			"error doing http GET for url %s", url)))
 	}
+	defer resp.Body.Close()
 
 	if resp.StatusCode >= 400 {
-		if err = hc.storeError(db,
-			ConnectionErr(errors.Errorf("error doing http GET for url %s with status code %d",
-				url, resp.StatusCode))); err != nil {
-			return nil, err
-		}
-		return hc, nil
+		return fail(ConnectionErr(errors.Errorf("error doing http GET for url %s with status code %d",
+			url, resp.StatusCode)))
 	}
-	defer resp.Body.Close()
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
@@ -362,24 +449,16 @@ func (hc *http01Challenge) validate(db nosql.DB, jwk *jose.JSONWebKey, vo valida
 		return nil, err
 	}
 	if keyAuth != expected {
-		if err = hc.storeError(db,
-			RejectedIdentifierErr(errors.Errorf("keyAuthorization does not match; "+
-				"expected %s, but got %s", expected, keyAuth))); err != nil {
-			return nil, err
-		}
-		return hc, nil
+		return fail(RejectedIdentifierErr(errors.Errorf("keyAuthorization does not match; "+
+			"expected %s, but got %s", expected, keyAuth)))
 	}
 
 	// Update and store the challenge.
-	upd := &http01Challenge{hc.baseChallenge.clone()}
-	upd.Status = StatusValid
-	upd.Error = nil
-	upd.Validated = clock.Now()
-
-	if err := upd.save(db, hc); err != nil {
+	bc, err := hc.storeValid(db)
+	if err != nil {
 		return nil, err
 	}
-	return upd, nil
+	return &http01Challenge{bc}, nil
 }
 
 // dns01Challenge represents an dns-01 acme challenge.
@@ -387,9 +466,10 @@ type dns01Challenge struct {
 	*baseChallenge
 }
 
-// newDNS01Challenge returns a new acme dns-01 challenge.
-func newDNS01Challenge(db nosql.DB, ops ChallengeOptions) (challenge, error) {
-	bc, err := newBaseChallenge(ops.AccountID, ops.AuthzID)
+// newDNS01Challenge returns a new acme dns-01 challenge. The challenge is
+// stored when the transaction is committed.
+func newDNS01Challenge(tx *database.Tx, ops ChallengeOptions) (challenge, error) {
+	bc, err := newBaseChallenge(ops.AccountID, ops.ProvisionerID, ops.AuthzID)
 	if err != nil {
 		return nil, err
 	}
@@ -397,7 +477,7 @@ func newDNS01Challenge(db nosql.DB, ops ChallengeOptions) (challenge, error) {
 	bc.Value = ops.Identifier.Value
 
 	dc := &dns01Challenge{bc}
-	if err := dc.save(db, nil); err != nil {
+	if err := txInsert(tx, challengeTable, dc.ID, dc); err != nil {
 		return nil, err
 	}
 	return dc, nil
@@ -417,22 +497,25 @@ func KeyAuthorization(token string, jwk *jose.JSONWebKey) (string, error) {
 // validate attempts to validate the challenge. If the challenge has been
 // satisfactorily validated, the 'status' and 'validated' attributes are
 // updated.
-func (dc *dns01Challenge) validate(db nosql.DB, jwk *jose.JSONWebKey, vo validateOptions) (challenge, error) {
+func (dc *dns01Challenge) validate(db nosql.DB, jwk *jose.JSONWebKey, v Validator, vp validateParams) (challenge, error) {
 	// If already valid or invalid then return without performing validation.
 	if dc.getStatus() == StatusValid || dc.getStatus() == StatusInvalid {
 		return dc, nil
 	}
+	fail := func(e *Error) (challenge, error) {
+		bc, err := dc.storeError(db, e, vp.maxAttempts)
+		if err != nil {
+			return nil, err
+		}
+		return &dns01Challenge{bc}, nil
+	}
 
 	fmt.Printf("DEBUG dns01Challenge.validate before %v\n", "_acme-challenge."+dc.Value)
-	txtRecords, err := vo.lookupTxt("_acme-challenge." + dc.Value)
+	txtRecords, err := v.LookupTXT("_acme-challenge." + dc.Value)
 	fmt.Printf("DEBUG dns01Challenge.validate after %v\n", "_acme-challenge."+dc.Value)
 	if err != nil {
-		if err = dc.storeError(db,
-			DNSErr(errors.Wrapf(err, "error looking up TXT "+
-				"records for domain %s", dc.Value))); err != nil {
-			return nil, err
-		}
-		return dc, nil
+		return fail(DNSErr(errors.Wrapf(err, "error looking up TXT "+
+			"records for domain %s", dc.Value)))
 	}
 
 	expectedKeyAuth, err := KeyAuthorization(dc.Token, jwk)
@@ -449,24 +532,246 @@ func (dc *dns01Challenge) validate(db nosql.DB, jwk *jose.JSONWebKey, vo validat
 		}
 	}
 	if !found {
-		if err = dc.storeError(db,
-			RejectedIdentifierErr(errors.Errorf("keyAuthorization "+
-				"does not match; expected %s, but got %s", expectedKeyAuth, txtRecords))); err != nil {
+		return fail(RejectedIdentifierErr(errors.Errorf("keyAuthorization "+
+			"does not match; expected %s, but got %s", expectedKeyAuth, txtRecords)))
+	}
+
+	// Update and store the challenge.
+	bc, err := dc.storeValid(db)
+	if err != nil {
+		return nil, err
+	}
+	return &dns01Challenge{bc}, nil
+}
+
+// dnsPersist01Challenge represents a dns-persist-01 challenge. It is
+// validated by a long-lived TXT record at _validation-persist.<domain> that
+// names the CA and the account, so that the record does not have to change
+// with every order.
+type dnsPersist01Challenge struct {
+	*baseChallenge
+}
+
+// newDNSPersist01Challenge returns a new acme dns-persist-01 challenge. The
+// challenge is stored when the transaction is committed.
+func newDNSPersist01Challenge(tx *database.Tx, ops ChallengeOptions) (challenge, error) {
+	bc, err := newBaseChallenge(ops.AccountID, ops.ProvisionerID, ops.AuthzID)
+	if err != nil {
+		return nil, err
+	}
+	bc.Type = "dns-persist-01"
+	bc.Value = ops.Identifier.Value
+	bc.Wildcard = ops.Wildcard
+	bc.IssuerDomainNames = ops.IssuerDomainNames
+	bc.AccountURI = ops.AccountURI
+
+	dc := &dnsPersist01Challenge{bc}
+	if err := txInsert(tx, challengeTable, dc.ID, dc); err != nil {
+		return nil, err
+	}
+	return dc, nil
+}
+
+// validate attempts to validate the challenge. A record authorizes the
+// account if it names one of the issuer domain names and the account URI,
+// has not expired and, for wildcard identifiers, has the wildcard policy.
+func (dc *dnsPersist01Challenge) validate(db nosql.DB, jwk *jose.JSONWebKey, v Validator, vp validateParams) (challenge, error) {
+	// If already valid or invalid then return without performing validation.
+	if dc.getStatus() == StatusValid || dc.getStatus() == StatusInvalid {
+		return dc, nil
+	}
+	fail := func(e *Error) (challenge, error) {
+		bc, err := dc.storeError(db, e, vp.maxAttempts)
+		if err != nil {
 			return nil, err
 		}
+		return &dnsPersist01Challenge{bc}, nil
+	}
+
+	name := "_validation-persist." + dc.Value
+	txtRecords, err := v.LookupTXT(name)
+	if err != nil {
+		return fail(DNSErr(errors.Wrapf(err, "error looking up TXT "+
+			"records for domain %s", name)))
+	}
+	var found bool
+	for _, r := range txtRecords {
+		if dc.authorizes(r, clock.Now()) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return fail(UnauthorizedErr(errors.Errorf("no TXT record at %s "+
+			"authorizes account %s", name, dc.AccountURI)))
+	}
+
+	bc, err := dc.storeValid(db)
+	if err != nil {
+		return nil, err
+	}
+	return &dnsPersist01Challenge{bc}, nil
+}
+
+// authorizes returns true if the persistent validation record authorizes
+// the account of the challenge. Records have the syntax of a CAA issue
+// value; the issuer domain name followed by the accounturi and optional
+// policy and persistUntil parameters.
+func (dc *dnsPersist01Challenge) authorizes(record string, now time.Time) bool {
+	issuer, params, ok := parseCAAIssueValue(record)
+	if !ok {
+		return false
+	}
+	var known bool
+	for _, name := range dc.IssuerDomainNames {
+		if strings.EqualFold(issuer, name) {
+			known = true
+			break
+		}
+	}
+	if !known || params["accounturi"] != dc.AccountURI {
+		return false
+	}
+	if dc.Wildcard && !strings.EqualFold(params["policy"], "wildcard") {
+		return false
+	}
+	if until, ok := params["persistuntil"]; ok {
+		ts, err := strconv.ParseInt(until, 10, 64)
+		if err != nil || now.After(time.Unix(ts, 0)) {
+			return false
+		}
+	}
+	return true
+}
+
+// deviceAttest01Challenge represents a device-attest-01 challenge. It proves
+// that the requester controls a genuine device with a manufacturer
+// certificate, and that the device identity is the identifier of the authz.
+type deviceAttest01Challenge struct {
+	*baseChallenge
+}
+
+// deviceAttestation is the payload of an attestation object.
+type deviceAttestation struct {
+	// KeyAuthorization binds the attestation to the challenge and account.
+	KeyAuthorization string `json:"keyAuthorization"`
+	// uuid is the device UUID of the manufacturer certificate.
+	uuid uuid.UUID
+}
+
+// newDeviceAttest01Challenge returns a new acme device-attest-01 challenge.
+// The challenge is stored when the transaction is committed.
+func newDeviceAttest01Challenge(tx *database.Tx, ops ChallengeOptions) (challenge, error) {
+	bc, err := newBaseChallenge(ops.AccountID, ops.ProvisionerID, ops.AuthzID)
+	if err != nil {
+		return nil, err
+	}
+	bc.Type = "device-attest-01"
+	bc.Value = ops.Identifier.Value
+
+	dc := &deviceAttest01Challenge{bc}
+	if err := txInsert(tx, challengeTable, dc.ID, dc); err != nil {
+		return nil, err
+	}
+	return dc, nil
+}
+
+// validate attempts to validate the challenge with the attestation object
+// posted by the client, {"attObj": "<JWS>"}. The attestation object is a
+// JWS with the manufacturer certificate chain in its x5c header, signed with
+// the key of the manufacturer certificate.
+func (dc *deviceAttest01Challenge) validate(db nosql.DB, jwk *jose.JSONWebKey, v Validator, vp validateParams) (challenge, error) {
+	// If already valid or invalid then return without performing validation.
+	if dc.getStatus() == StatusValid || dc.getStatus() == StatusInvalid {
 		return dc, nil
 	}
+	if vp.manufacturerRoots == nil {
+		return nil, ServerInternalErr(errors.New("device attestation is not configured"))
+	}
+	var req struct {
+		AttObj string `json:"attObj"`
+	}
+	if err := json.Unmarshal(vp.payload, &req); err != nil || len(req.AttObj) == 0 {
+		return nil, MalformedErr(errors.New("device-attest-01 challenge requires an attObj"))
+	}
+	fail := func(e *Error) (challenge, error) {
+		bc, err := dc.storeError(db, e, vp.maxAttempts)
+		if err != nil {
+			return nil, err
+		}
+		return &deviceAttest01Challenge{bc}, nil
+	}
 
-	// Update and store the challenge.
-	upd := &dns01Challenge{dc.baseChallenge.clone()}
-	upd.Status = StatusValid
-	upd.Error = nil
-	upd.Validated = time.Now().UTC()
+	att, err := verifyDeviceAttestation(req.AttObj, vp.manufacturerRoots)
+	if err != nil {
+		return fail(UnauthorizedErr(err))
+	}
+	expected, err := KeyAuthorization(dc.Token, jwk)
+	if err != nil {
+		return nil, err
+	}
+	if att.KeyAuthorization != expected {
+		return fail(RejectedIdentifierErr(errors.Errorf("keyAuthorization does not match; "+
+			"expected %s, but got %s", expected, att.KeyAuthorization)))
+	}
+	if att.uuid.String() != strings.ToLower(dc.Value) {
+		return fail(RejectedIdentifierErr(errors.Errorf("attested identifier %s does not "+
+			"match identifier %s", att.uuid, dc.Value)))
+	}
 
-	if err := upd.save(db, dc); err != nil {
+	bc, err := dc.storeValid(db)
+	if err != nil {
+		return nil, err
+	}
+	return &deviceAttest01Challenge{bc}, nil
+}
+
+// verifyDeviceAttestation verifies that the attestation object is signed by
+// a manufacturer certificate chaining to the given roots and returns its
+// payload, with the device UUID of the certificate. The UUID is never taken
+// from the payload, which is written by the device.
+func verifyDeviceAttestation(attObj string, roots *x509.CertPool) (*deviceAttestation, error) {
+	jws, err := jose.ParseJWS(attObj)
+	if err != nil {
+		return nil, errors.Wrap(err, "error parsing attestation object")
+	}
+	if len(jws.Signatures) != 1 {
+		return nil, errors.New("attestation object must contain exactly one signature")
+	}
+	chains, err := jws.Signatures[0].Protected.Certificates(x509.VerifyOptions{
+		Roots:     roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "error verifying attestation certificate chain")
+	}
+	payload, err := jws.Verify(chains[0][0].PublicKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "error verifying attestation object signature")
+	}
+	var att deviceAttestation
+	if err := json.Unmarshal(payload, &att); err != nil {
+		return nil, errors.Wrap(err, "error unmarshaling attestation object payload")
+	}
+	if att.uuid, err = certificateUUID(chains[0][0]); err != nil {
 		return nil, err
 	}
-	return upd, nil
+	return &att, nil
+}
+
+// certificateUUID returns the device UUID of a certificate; the one of a
+// urn:uuid URI SAN or, per the OCF convention, of a "uuid:<UUID>" subject
+// common name.
+func certificateUUID(cert *x509.Certificate) (uuid.UUID, error) {
+	for _, u := range cert.URIs {
+		if strings.EqualFold(u.Scheme, "urn") && strings.HasPrefix(strings.ToLower(u.Opaque), "uuid:") {
+			return uuid.Parse(u.Opaque[len("uuid:"):])
+		}
+	}
+	if cn := cert.Subject.CommonName; strings.HasPrefix(strings.ToLower(cn), "uuid:") {
+		return uuid.Parse(cn[len("uuid:"):])
+	}
+	return uuid.UUID{}, errors.New("attestation certificate does not contain a device UUID")
 }
 
 // getChallenge retrieves and unmarshals an ACME challenge type from the database.
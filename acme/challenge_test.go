@@ -0,0 +1,117 @@
+package acme
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/smallstep/cli/jose"
+)
+
+const testDeviceUUID = "9f2c3e4a-7b1d-4c5e-8f6a-0b1c2d3e4f50"
+
+// newTestCert returns a certificate signed by the parent, or self-signed if
+// the parent is nil.
+func newTestCert(t *testing.T, tmpl *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl.SerialNumber = big.NewInt(time.Now().UnixNano())
+	tmpl.NotBefore = time.Now().Add(-time.Minute)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, key.Public(), parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// newTestAttestation returns an attestation object with the payload, signed
+// by the key of the manufacturer certificate.
+func newTestAttestation(t *testing.T, cert *x509.Certificate, key *ecdsa.PrivateKey, payload interface{}) string {
+	t.Helper()
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: key},
+		new(jose.SignerOptions).WithHeader("x5c", []string{base64.StdEncoding.EncodeToString(cert.Raw)}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jws, err := signer.Sign(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := jws.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestVerifyDeviceAttestationUUIDFromCertificate(t *testing.T) {
+	root, rootKey := newTestCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "Manufacturer Root"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+
+	urn, _ := url.Parse("urn:uuid:" + testDeviceUUID)
+	tests := []struct {
+		name    string
+		tmpl    *x509.Certificate
+		want    string
+		wantErr bool
+	}{
+		{"ocf common name", &x509.Certificate{Subject: pkix.Name{CommonName: "uuid:" + testDeviceUUID}}, testDeviceUUID, false},
+		{"uri san", &x509.Certificate{Subject: pkix.Name{CommonName: "device"}, URIs: []*url.URL{urn}}, testDeviceUUID, false},
+		{"no uuid", &x509.Certificate{Subject: pkix.Name{CommonName: "device"}}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cert, key := newTestCert(t, tt.tmpl, root, rootKey)
+			// The identifier written by the device is ignored.
+			attObj := newTestAttestation(t, cert, key, map[string]string{
+				"identifier":       "00000000-0000-0000-0000-000000000001",
+				"keyAuthorization": "token.thumbprint",
+			})
+			att, err := verifyDeviceAttestation(attObj, roots)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("verifyDeviceAttestation() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && att.uuid.String() != tt.want {
+				t.Errorf("verifyDeviceAttestation() uuid = %s, want %s", att.uuid, tt.want)
+			}
+		})
+	}
+
+	// Certificates of other roots are rejected.
+	other, otherKey := newTestCert(t, &x509.Certificate{
+		Subject: pkix.Name{CommonName: "uuid:" + testDeviceUUID},
+	}, nil, nil)
+	attObj := newTestAttestation(t, other, otherKey, map[string]string{"keyAuthorization": "token.thumbprint"})
+	if _, err := verifyDeviceAttestation(attObj, roots); err == nil {
+		t.Error("verifyDeviceAttestation() with an untrusted certificate error = nil, want an error")
+	}
+}
@@ -2,18 +2,24 @@ package acme
 
 import (
 	"crypto/x509"
+	"encoding/json"
 	"net/url"
 	"time"
 
+	"github.com/go-ocf/step-ca/kvdb"
 	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/authority"
 	"github.com/smallstep/certificates/authority/provisioner"
 	"github.com/smallstep/cli/crypto/randutil"
+	"github.com/smallstep/nosql"
+	"github.com/smallstep/nosql/database"
 )
 
 // SignAuthority is the interface implemented by a CA authority.
 type SignAuthority interface {
 	Sign(cr *x509.CertificateRequest, opts provisioner.Options, signOpts ...provisioner.SignOption) (*x509.Certificate, *x509.Certificate, error)
 	LoadProvisionerByID(string) (provisioner.Interface, error)
+	Revoke(*authority.RevokeOptions) error
 }
 
 // Identifier encodes the type that an order pertains to.
@@ -23,16 +29,34 @@ type Identifier struct {
 }
 
 var (
-	accountTable           = []byte("acme-accounts")
-	accountByKeyIDTable    = []byte("acme-keyID-accountID-index")
+	accountTable        = []byte("acme-accounts")
+	accountByKeyIDTable = []byte("acme-keyID-accountID-index")
+	// accountByEABKeyIDTable binds the external account keys to the
+	// account they were used for, by provisioner.
+	accountByEABKeyIDTable = []byte("acme-eab-keyID-accountID-index")
 	authzTable             = []byte("acme-authzs")
 	challengeTable         = []byte("acme-challenges")
 	nonceTable             = []byte("nonce-table")
 	orderTable             = []byte("acme-orders")
 	ordersByAccountIDTable = []byte("acme-account-orders-index")
 	certTable              = []byte("acme-certs")
+	certBySerialTable      = []byte("acme-serial-certID-index")
+	// scheduledRevocationTable holds the certificates scheduled to be
+	// revoked, by certificate ID.
+	scheduledRevocationTable = []byte("acme-scheduled-revocations")
 )
 
+// Tables returns the names of the tables holding the ACME records. The
+// replay nonces are short lived and left out.
+func Tables() []string {
+	return []string{string(accountTable), string(accountByKeyIDTable),
+		string(accountByEABKeyIDTable),
+		string(authzTable), string(challengeTable), string(orderTable),
+		string(ordersByAccountIDTable), string(certTable),
+		string(certBySerialTable), string(scheduledRevocationTable),
+		string(schemaVersionTable)}
+}
+
 var (
 	// StatusValid -- valid
 	StatusValid = "valid"
@@ -74,3 +98,92 @@ var clock = new(Clock)
 func URLSafeProvisionerName(p provisioner.Interface) string {
 	return url.PathEscape(p.GetName())
 }
+
+// checkProvisioner returns a not found error if the record with the given
+// type and ID was created through another provisioner than p.
+func checkProvisioner(p provisioner.Interface, provID, typ, id string) error {
+	if provID == p.GetID() {
+		return nil
+	}
+	return MalformedErr(errors.Wrapf(database.ErrNotFound, "%s %s not found", typ, id))
+}
+
+// txInsert marshals v and appends an insert of bucket/key to the
+// transaction. The insert only succeeds if no value exists under the key.
+func txInsert(tx *database.Tx, bucket []byte, key string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return ServerInternalErr(errors.Wrapf(err, "error marshaling %s/%s", bucket, key))
+	}
+	txInsertBytes(tx, bucket, key, b)
+	return nil
+}
+
+// txInsertBytes appends an insert of the raw value under bucket/key to the
+// transaction, e.g. for index entries.
+func txInsertBytes(tx *database.Tx, bucket []byte, key string, value []byte) {
+	tx.Operations = append(tx.Operations, &database.TxEntry{
+		Bucket: bucket,
+		Key:    []byte(key),
+		Value:  value,
+		Cmd:    database.CmpAndSwap,
+	})
+}
+
+// commitInserts executes a transaction built from txInsert entries, and
+// compare-and-swap entries updating indexes. The databases of the CA roll
+// back the whole transaction if an entry does not swap; with the others, the
+// entries that did swap are reverted so that no partial state is left
+// behind. The error of a lost race is a conflict error.
+func commitInserts(db nosql.DB, tx *database.Tx) error {
+	if err := db.Update(tx); err != nil {
+		return ServerInternalErr(errors.Wrap(err, "error storing new records"))
+	}
+	for _, op := range tx.Operations {
+		if !op.Swapped {
+			if err := rollbackInserts(db, tx); err != nil {
+				return ServerInternalErr(errors.Wrapf(err, "error storing %s/%s; "+
+					"value has changed", op.Bucket, op.Key))
+			}
+			return ServerInternalErr(errors.Wrapf(kvdb.ErrConflict, "error storing %s/%s; "+
+				"value has changed", op.Bucket, op.Key))
+		}
+	}
+	return nil
+}
+
+// rollbackInserts reverts every entry that swapped in a transaction built
+// by commitInserts: the inserted records are deleted and the updated indexes
+// restored.
+func rollbackInserts(db nosql.DB, tx *database.Tx) error {
+	undo := new(database.Tx)
+	for _, op := range tx.Operations {
+		switch {
+		case !op.Swapped:
+		case op.CmpValue == nil:
+			undo.Del(op.Bucket, op.Key)
+		default:
+			undo.Operations = append(undo.Operations, &database.TxEntry{
+				Bucket:   op.Bucket,
+				Key:      op.Key,
+				CmpValue: op.Value,
+				Value:    op.CmpValue,
+				Cmd:      database.CmpAndSwap,
+			})
+		}
+	}
+	if len(undo.Operations) == 0 {
+		return nil
+	}
+	if err := db.Update(undo); err != nil {
+		return errors.Wrap(err, "error reverting new records")
+	}
+	return nil
+}
+
+// isConflictErr returns true if the error reports that a database operation
+// lost a race against a concurrent one. Such an operation has not been
+// applied and can be retried.
+func isConflictErr(err error) bool {
+	return kvdb.IsConflict(err)
+}
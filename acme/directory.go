@@ -1,20 +1,35 @@
 package acme
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"net/url"
+	"strings"
 
 	"github.com/pkg/errors"
 )
 
 // Directory represents an ACME directory for configuring clients.
 type Directory struct {
-	NewNonce   string `json:"newNonce,omitempty"`
-	NewAccount string `json:"newAccount,omitempty"`
-	NewOrder   string `json:"newOrder,omitempty"`
-	NewAuthz   string `json:"newAuthz,omitempty"`
-	RevokeCert string `json:"revokeCert,omitempty"`
-	KeyChange  string `json:"keyChange,omitempty"`
+	NewNonce    string `json:"newNonce,omitempty"`
+	NewAccount  string `json:"newAccount,omitempty"`
+	NewOrder    string `json:"newOrder,omitempty"`
+	NewAuthz    string `json:"newAuthz,omitempty"`
+	RevokeCert  string `json:"revokeCert,omitempty"`
+	KeyChange   string `json:"keyChange,omitempty"`
+	RenewalInfo string `json:"renewalInfo,omitempty"`
+	Meta        *Meta  `json:"meta,omitempty"`
+}
+
+// Meta is the metadata object of an ACME directory.
+type Meta struct {
+	// TermsOfService is the URL of the current terms of service. A new URL
+	// is considered a new version of the terms that accounts must agree to.
+	TermsOfService          string   `json:"termsOfService,omitempty"`
+	Website                 string   `json:"website,omitempty"`
+	CaaIdentities           []string `json:"caaIdentities,omitempty"`
+	ExternalAccountRequired bool     `json:"externalAccountRequired,omitempty"`
 }
 
 // ToLog enables response logging for the Directory type.
@@ -27,12 +42,14 @@ func (d *Directory) ToLog() (interface{}, error) {
 }
 
 type directory struct {
-	prefix, dns string
+	prefix string
+	// base is the default external base URL of the links.
+	base *url.URL
 }
 
 // newDirectory returns a new Directory type.
-func newDirectory(dns, prefix string) *directory {
-	return &directory{prefix: prefix, dns: dns}
+func newDirectory(base *url.URL, prefix string) *directory {
+	return &directory{prefix: prefix, base: base}
 }
 
 // Link captures the link type.
@@ -67,6 +84,10 @@ const (
 	RevokeCertLink
 	// KeyChangeLink key rollover
 	KeyChangeLink
+	// AlternateCertificateLink certificate with an alternate chain
+	AlternateCertificateLink
+	// RenewalInfoLink renewal information (ARI)
+	RenewalInfoLink
 )
 
 func (l Link) String() string {
@@ -87,7 +108,7 @@ func (l Link) String() string {
 		return "authz"
 	case ChallengeLink:
 		return "challenge"
-	case CertificateLink:
+	case CertificateLink, AlternateCertificateLink:
 		return "certificate"
 	case DirectoryLink:
 		return "directory"
@@ -95,13 +116,16 @@ func (l Link) String() string {
 		return "revoke-cert"
 	case KeyChangeLink:
 		return "key-change"
+	case RenewalInfoLink:
+		return "renewal-info"
 	default:
 		return "unexpected"
 	}
 }
 
-// getLink returns an absolute or partial path to the given resource.
-func (d *directory) getLink(typ Link, provisionerName string, abs bool, inputs ...string) string {
+// getLink returns an absolute or partial path to the given resource. The
+// absolute links are built with the base URL of the context, if any.
+func (d *directory) getLink(ctx context.Context, typ Link, provisionerName string, abs bool, inputs ...string) string {
 	var link string
 	switch typ {
 	case NewNonceLink, NewAccountLink, NewOrderLink, NewAuthzLink, DirectoryLink, KeyChangeLink, RevokeCertLink:
@@ -112,9 +136,28 @@ func (d *directory) getLink(typ Link, provisionerName string, abs bool, inputs .
 		link = fmt.Sprintf("/%s/%s/%s/orders", provisionerName, AccountLink.String(), inputs[0])
 	case FinalizeLink:
 		link = fmt.Sprintf("/%s/%s/%s/finalize", provisionerName, OrderLink.String(), inputs[0])
+	case AlternateCertificateLink:
+		link = fmt.Sprintf("/%s/%s/%s/%s", provisionerName, typ.String(), inputs[0], inputs[1])
+	case RenewalInfoLink:
+		link = fmt.Sprintf("/%s/%s", provisionerName, typ.String())
+		if len(inputs) > 0 {
+			link = fmt.Sprintf("%s/%s", link, inputs[0])
+		}
 	}
 	if abs {
-		return fmt.Sprintf("https://%s/%s%s", d.dns, d.prefix, link)
+		base, ok := BaseURLFromContext(ctx)
+		if !ok {
+			base = d.base
+		}
+		return fmt.Sprintf("%s/%s%s", strings.TrimSuffix(base.String(), "/"), d.prefix, link)
 	}
 	return link
 }
+
+// getCanonicalLink returns the absolute link to the given resource built
+// with the default base URL, whatever the base URL of the request is. It is
+// used for the links that are stored with a record, e.g. the account URI the
+// dns-persist-01 records must authorize.
+func (d *directory) getCanonicalLink(typ Link, provisionerName string, inputs ...string) string {
+	return d.getLink(context.Background(), typ, provisionerName, true, inputs...)
+}
@@ -0,0 +1,225 @@
+package acme
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"syscall"
+
+	retryablehttp "github.com/hashicorp/go-retryablehttp"
+	"github.com/pkg/errors"
+)
+
+// Defaults of the egress policy applied to http-01 validation requests.
+var (
+	defaultMaxRedirects int   = 10
+	defaultMaxBodySize  int64 = 64 * 1024
+
+	// defaultDenyCIDRs are the loopback, private, shared, link-local,
+	// unspecified, multicast, documentation and benchmarking ranges, and
+	// the IPv6 ranges that translate or tunnel to IPv4 addresses. IPv4-mapped
+	// IPv6 addresses are checked as the IPv4 addresses they map.
+	defaultDenyCIDRs = []string{
+		"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8",
+		"169.254.0.0/16", "172.16.0.0/12", "192.0.0.0/24", "192.0.2.0/24",
+		"192.168.0.0/16", "198.18.0.0/15", "198.51.100.0/24", "203.0.113.0/24",
+		"224.0.0.0/4", "240.0.0.0/4",
+		"::/128", "::1/128", "64:ff9b::/96", "64:ff9b:1::/48",
+		"100::/64", "2001::/32", "2001:db8::/32", "2002::/16", "fc00::/7",
+		"fe80::/10", "ff00::/8",
+	}
+)
+
+// EgressPolicy restricts the connections made to validate http-01
+// challenges.
+type EgressPolicy struct {
+	// Allow are the CIDRs connections are always allowed to. If not empty,
+	// connections to addresses outside of them and of Deny are rejected.
+	Allow []string `json:"allow,omitempty"`
+	// Deny are the CIDRs connections are rejected to, unless allowed. It
+	// defaults to the loopback, private, link-local and other special-purpose
+	// ranges.
+	Deny []string `json:"deny,omitempty"`
+	// MaxRedirects is the maximum number of redirects followed; 10 by
+	// default.
+	MaxRedirects *int `json:"maxRedirects,omitempty"`
+	// MaxBodySize is the maximum size in bytes of a response body; 64KiB
+	// by default.
+	MaxBodySize int64 `json:"maxBodySize,omitempty"`
+}
+
+// egressPolicy is the parsed EgressPolicy.
+type egressPolicy struct {
+	allow        []*net.IPNet
+	deny         []*net.IPNet
+	maxRedirects int
+	maxBodySize  int64
+}
+
+// egressError is the error returned when a request violates the egress
+// policy. Requests failing with it are not retried.
+type egressError struct {
+	msg string
+}
+
+func (e *egressError) Error() string {
+	return e.msg
+}
+
+func newEgressPolicy(p *EgressPolicy) (*egressPolicy, error) {
+	if p == nil {
+		p = &EgressPolicy{}
+	}
+	ep := &egressPolicy{
+		maxRedirects: defaultMaxRedirects,
+		maxBodySize:  defaultMaxBodySize,
+	}
+	if p.MaxRedirects != nil {
+		ep.maxRedirects = *p.MaxRedirects
+	}
+	if p.MaxBodySize > 0 {
+		ep.maxBodySize = p.MaxBodySize
+	}
+	deny := p.Deny
+	if len(deny) == 0 {
+		deny = defaultDenyCIDRs
+	}
+	var err error
+	if ep.allow, err = parseCIDRs(p.Allow); err != nil {
+		return nil, err
+	}
+	if ep.deny, err = parseCIDRs(deny); err != nil {
+		return nil, err
+	}
+	return ep, nil
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, s := range cidrs {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error parsing egress CIDR %s", s)
+		}
+		nets[i] = n
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// permits returns true if connections to the given IP are allowed. Allowed
+// CIDRs take precedence over denied ones.
+func (ep *egressPolicy) permits(ip net.IP) bool {
+	switch {
+	case containsIP(ep.allow, ip):
+		return true
+	case containsIP(ep.deny, ip):
+		return false
+	default:
+		return len(ep.allow) == 0
+	}
+}
+
+// control is a net.Dialer control function that rejects connections the
+// policy does not permit. It runs once the address has been resolved, for
+// every connection, including the ones of redirects.
+func (ep *egressPolicy) control(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !ep.permits(ip) {
+		return &egressError{msg: "connection to " + address + " denied by egress policy"}
+	}
+	return nil
+}
+
+// proxyTransport enforces the egress policy on requests sent through an
+// HTTP proxy, where the connections to the targets are made by the proxy.
+// The host of every request, including the ones of redirects, is resolved
+// and rejected if any of its addresses is not permitted.
+type proxyTransport struct {
+	next     http.RoundTripper
+	resolver *net.Resolver
+	egress   *egressPolicy
+}
+
+// RoundTrip implements the http.RoundTripper interface.
+func (t *proxyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Hostname()
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		addrs, err := t.resolver.LookupIPAddr(req.Context(), host)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error resolving %s", host)
+		}
+		for _, a := range addrs {
+			ips = append(ips, a.IP)
+		}
+	}
+	for _, ip := range ips {
+		if !t.egress.permits(ip) {
+			return nil, &egressError{msg: "connection to " + host + " (" + ip.String() +
+				") denied by egress policy"}
+		}
+	}
+	return t.next.RoundTrip(req)
+}
+
+// checkRedirect limits the number of redirects and only allows them to the
+// ports 80 and 443.
+func (ep *egressPolicy) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) > ep.maxRedirects {
+		return &egressError{msg: "too many redirects"}
+	}
+	switch req.URL.Scheme {
+	case "http", "https":
+	default:
+		return &egressError{msg: "redirect to unsupported scheme " + req.URL.Scheme}
+	}
+	switch req.URL.Port() {
+	case "", "80", "443":
+		return nil
+	default:
+		return &egressError{msg: "redirect to disallowed port " + req.URL.Port()}
+	}
+}
+
+// checkRetry is the retry policy of validation requests. Requests denied by
+// the egress policy are not retried.
+func (ep *egressPolicy) checkRetry(ctx context.Context, resp *http.Response, err error) (bool, error) {
+	var ee *egressError
+	if errors.As(err, &ee) {
+		return false, err
+	}
+	return retryablehttp.DefaultRetryPolicy(ctx, resp, err)
+}
+
+// limitBody reads the response body, failing if it exceeds the maximum size,
+// and replaces it with the read contents.
+func (ep *egressPolicy) limitBody(resp *http.Response) error {
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, ep.maxBodySize+1))
+	if err != nil {
+		return errors.Wrap(err, "error reading response body")
+	}
+	if int64(len(body)) > ep.maxBodySize {
+		return &egressError{msg: "response body exceeds the maximum size"}
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return nil
+}
@@ -0,0 +1,93 @@
+package acme
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestEgressPolicyPermits(t *testing.T) {
+	ep, err := newEgressPolicy(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"169.254.169.254", false},
+		{"192.0.2.1", false},
+		{"198.18.0.1", false},
+		{"::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:93.184.216.34", true},
+		{"64:ff9b::7f00:1", false},
+		{"64:ff9b:1::a00:1", false},
+		{"2002:7f00:1::", false},
+		{"2001:0:4136:e378::1", false},
+		{"2001:db8::1", false},
+		{"100::1", false},
+		{"fd00::1", false},
+		{"fe80::1", false},
+	}
+	for _, tt := range tests {
+		if got := ep.permits(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("permits(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestEgressPolicyWithProxy(t *testing.T) {
+	var proxied int32
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&proxied, 1)
+		if r.URL.Host == "93.184.216.34" && r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "http://169.254.169.254/latest/meta-data", http.StatusFound)
+			return
+		}
+		w.Write([]byte("token.thumbprint"))
+	}))
+	defer proxy.Close()
+
+	ep, err := newEgressPolicy(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := newNetValidator(nil, proxy.URL, 0, 0, ep)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Denied targets are not sent to the proxy.
+	if _, err := v.HTTPGet("http://127.0.0.1/.well-known/acme-challenge/token"); err == nil {
+		t.Error("HTTPGet() to a loopback address error = nil, want an error")
+	}
+	if n := atomic.LoadInt32(&proxied); n != 0 {
+		t.Errorf("proxy received %d requests, want 0", n)
+	}
+
+	resp, err := v.HTTPGet("http://93.184.216.34/.well-known/acme-challenge/token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if string(body) != "token.thumbprint" {
+		t.Errorf("HTTPGet() body = %s, want token.thumbprint", body)
+	}
+
+	// Redirects to denied targets are rejected too.
+	atomic.StoreInt32(&proxied, 0)
+	if _, err := v.HTTPGet("http://93.184.216.34/redirect"); err == nil {
+		t.Error("HTTPGet() redirected to a link-local address error = nil, want an error")
+	}
+	if n := atomic.LoadInt32(&proxied); n != 1 {
+		t.Errorf("proxy received %d requests, want 1", n)
+	}
+}
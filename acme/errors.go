@@ -363,6 +363,7 @@ type Error struct {
 	Status     int
 	Sub        []*Error
 	Identifier *Identifier
+	Instance   string
 }
 
 // Wrap attempts to wrap the internal error.
@@ -408,6 +409,9 @@ func (e *Error) ToACME() *AError {
 	if e.Identifier != nil {
 		ae.Identifier = *e.Identifier
 	}
+	if len(e.Instance) > 0 {
+		ae.Instance = e.Instance
+	}
 	for _, p := range e.Sub {
 		ae.Subproblems = append(ae.Subproblems, p.ToACME())
 	}
@@ -425,6 +429,7 @@ type AError struct {
 	Detail      string        `json:"detail"`
 	Identifier  interface{}   `json:"identifier,omitempty"`
 	Subproblems []interface{} `json:"subproblems,omitempty"`
+	Instance    string        `json:"instance,omitempty"`
 	Status      int           `json:"-"`
 }
 
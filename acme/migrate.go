@@ -0,0 +1,545 @@
+package acme
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/nosql"
+	"github.com/smallstep/nosql/database"
+)
+
+var schemaVersionTable = []byte("acme-schema-versions")
+
+// schemaVersion is the version of the records stored in a table.
+type schemaVersion struct {
+	Version int       `json:"version"`
+	Updated time.Time `json:"updated"`
+}
+
+// migration upgrades a table to a new schema version. Migrations must be
+// idempotent, a replica may stop or run concurrently with another one before
+// the version is stored. In dry-run mode apply must not write and only count
+// the records it would change.
+type migration struct {
+	table       []byte
+	version     int
+	description string
+	apply       func(db nosql.DB, opts *MigrateOptions) (int, error)
+}
+
+// MigrateOptions are the options of the schema migrations.
+type MigrateOptions struct {
+	// DryRun only reports the migrations that would be applied.
+	DryRun bool
+	// LegacyProvisionerID is the ID of the ACME provisioner the records
+	// stored before they were scoped to their provisioner are assigned to,
+	// e.g. "acme/my-acme". If it is empty, the migrations fail on such
+	// records.
+	LegacyProvisionerID string
+}
+
+// migrations are the schema migrations, in the order they are applied. New
+// migrations are appended with the next version of their table.
+var migrations = []*migration{
+	{
+		table:       accountTable,
+		version:     1,
+		description: "backfill the key ID to account index",
+		apply:       backfillAccountsByKeyID,
+	},
+	{
+		table:       orderTable,
+		version:     1,
+		description: "backfill the account to orders index",
+		apply:       backfillOrdersByAccountID,
+	},
+	{
+		table:       certTable,
+		version:     1,
+		description: "backfill the serial number to certificate index",
+		apply:       backfillCertsBySerial,
+	},
+	{
+		table:       accountTable,
+		version:     2,
+		description: "bind the external account keys to their first account",
+		apply:       backfillAccountsByEABKeyID,
+	},
+	{
+		table:       accountTable,
+		version:     3,
+		description: "assign the accounts without provisioner to the legacy provisioner",
+		apply:       assignLegacyAccounts,
+	},
+	{
+		table:       orderTable,
+		version:     2,
+		description: "assign the orders without provisioner to the legacy provisioner",
+		apply:       assignLegacyRecords(orderTable, "order"),
+	},
+	{
+		table:       authzTable,
+		version:     1,
+		description: "assign the authorizations without provisioner to the legacy provisioner",
+		apply:       assignLegacyRecords(authzTable, "authz"),
+	},
+	{
+		table:       challengeTable,
+		version:     1,
+		description: "assign the challenges without provisioner to the legacy provisioner",
+		apply:       assignLegacyRecords(challengeTable, "challenge"),
+	},
+	{
+		table:       certTable,
+		version:     2,
+		description: "assign the certificates without provisioner to the legacy provisioner",
+		apply:       assignLegacyRecords(certTable, "certificate"),
+	},
+}
+
+// MigrationResult describes a migration applied, or to apply in dry-run
+// mode, to a table.
+type MigrationResult struct {
+	Table       string `json:"table"`
+	From        int    `json:"from"`
+	To          int    `json:"to"`
+	Description string `json:"description"`
+	Changes     int    `json:"changes"`
+}
+
+// createTables creates the ACME tables if they do not exist yet.
+func createTables(db nosql.DB) error {
+	tables := [][]byte{accountTable, accountByKeyIDTable,
+		accountByEABKeyIDTable, authzTable, challengeTable, nonceTable,
+		orderTable, ordersByAccountIDTable, certTable, certBySerialTable,
+		scheduledRevocationTable, schemaVersionTable}
+	for _, t := range tables {
+		if err := db.CreateTable(t); err != nil {
+			return errors.Wrapf(err, "error creating table %s", string(t))
+		}
+	}
+	return nil
+}
+
+// latestVersions returns the newest schema version of every migrated table.
+func latestVersions() map[string]int {
+	latest := make(map[string]int)
+	for _, m := range migrations {
+		if m.version > latest[string(m.table)] {
+			latest[string(m.table)] = m.version
+		}
+	}
+	return latest
+}
+
+// getSchemaVersion returns the schema version of a table and the stored
+// value, nil if the table has never been migrated.
+func getSchemaVersion(db nosql.DB, table []byte) (int, []byte, error) {
+	b, err := db.Get(schemaVersionTable, table)
+	switch {
+	case nosql.IsErrNotFound(err):
+		return 0, nil, nil
+	case err != nil:
+		return 0, nil, errors.Wrapf(err, "error loading schema version of %s", table)
+	}
+	var v schemaVersion
+	if err := json.Unmarshal(b, &v); err != nil {
+		return 0, nil, errors.Wrapf(err, "error unmarshaling schema version of %s", table)
+	}
+	return v.Version, b, nil
+}
+
+// SchemaVersions returns the current schema version of the ACME tables.
+func SchemaVersions(db nosql.DB) (map[string]int, error) {
+	if err := createTables(db); err != nil {
+		return nil, err
+	}
+	versions := make(map[string]int)
+	for _, m := range migrations {
+		if _, ok := versions[string(m.table)]; ok {
+			continue
+		}
+		v, _, err := getSchemaVersion(db, m.table)
+		if err != nil {
+			return nil, err
+		}
+		versions[string(m.table)] = v
+	}
+	return versions, nil
+}
+
+// Migrate applies the pending migrations of the ACME tables, in order. In
+// dry-run mode nothing is written, not even the missing tables, and the
+// results describe the migrations that would be applied. It fails without
+// applying anything if a table has a schema version newer than the ones this
+// binary knows.
+func Migrate(db nosql.DB, opts *MigrateOptions) ([]*MigrationResult, error) {
+	if opts == nil {
+		opts = new(MigrateOptions)
+	}
+	if !opts.DryRun {
+		if err := createTables(db); err != nil {
+			return nil, err
+		}
+	}
+	for table, latest := range latestVersions() {
+		cur, _, err := getSchemaVersion(db, []byte(table))
+		if err != nil {
+			return nil, err
+		}
+		if cur > latest {
+			return nil, errors.Errorf("database is newer than this binary: "+
+				"%s has schema version %d, the latest known is %d", table, cur, latest)
+		}
+	}
+	// Versions of the tables after the migrations applied so far, used in
+	// dry-run mode, where they are not stored.
+	versions := make(map[string]int)
+	var results []*MigrationResult
+	for _, m := range migrations {
+		cur, old, err := getSchemaVersion(db, m.table)
+		if err != nil {
+			return results, err
+		}
+		if v, ok := versions[string(m.table)]; ok && v > cur {
+			cur = v
+		}
+		if cur >= m.version {
+			continue
+		}
+		if cur != m.version-1 {
+			return results, errors.Errorf("cannot migrate %s from version %d to %d", m.table, cur, m.version)
+		}
+		n, err := m.apply(db, opts)
+		if err != nil {
+			return results, errors.Wrapf(err, "error migrating %s to version %d", m.table, m.version)
+		}
+		results = append(results, &MigrationResult{
+			Table:       string(m.table),
+			From:        cur,
+			To:          m.version,
+			Description: m.description,
+			Changes:     n,
+		})
+		versions[string(m.table)] = m.version
+		if opts.DryRun {
+			continue
+		}
+		b, err := json.Marshal(schemaVersion{Version: m.version, Updated: clock.Now()})
+		if err != nil {
+			return results, errors.Wrapf(err, "error marshaling schema version of %s", m.table)
+		}
+		if _, swapped, err := db.CmpAndSwap(schemaVersionTable, m.table, old, b); err != nil {
+			return results, errors.Wrapf(err, "error storing schema version of %s", m.table)
+		} else if !swapped {
+			// Another replica has migrated the table concurrently; the
+			// migration is idempotent so both runs leave the same data.
+			if v, _, err := getSchemaVersion(db, m.table); err != nil {
+				return results, err
+			} else if v < m.version {
+				return results, errors.Errorf("error storing schema version of %s; "+
+					"value has changed since last read", m.table)
+			}
+		}
+	}
+	return results, nil
+}
+
+// listEntries returns the entries of a table, none if it is empty.
+func listEntries(db nosql.DB, table []byte) ([]*database.Entry, error) {
+	entries, err := db.List(table)
+	switch {
+	case database.IsErrNotFound(err):
+		return nil, nil
+	case err != nil:
+		return nil, errors.Wrapf(err, "error listing %s", table)
+	default:
+		return entries, nil
+	}
+}
+
+// backfillIndex stores the value of the key in a one to one index if the
+// key is not indexed yet. It returns true if the index has changed.
+func backfillIndex(db nosql.DB, table []byte, key, value string, dryRun bool) (bool, error) {
+	_, err := db.Get(table, []byte(key))
+	switch {
+	case err == nil:
+		return false, nil
+	case !nosql.IsErrNotFound(err):
+		return false, errors.Wrapf(err, "error loading %s index of %s", table, key)
+	case dryRun:
+		return true, nil
+	}
+	_, swapped, err := db.CmpAndSwap(table, []byte(key), nil, []byte(value))
+	if err != nil {
+		return false, errors.Wrapf(err, "error storing %s index of %s", table, key)
+	}
+	return swapped, nil
+}
+
+// backfillAccountsByKeyID indexes the accounts by the ID of their key.
+func backfillAccountsByKeyID(db nosql.DB, opts *MigrateOptions) (int, error) {
+	entries, err := listEntries(db, accountTable)
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	for _, e := range entries {
+		acc := new(account)
+		if err := json.Unmarshal(e.Value, acc); err != nil {
+			return n, errors.Wrapf(err, "error unmarshaling account %s", e.Key)
+		}
+		if acc.Key == nil {
+			continue
+		}
+		kid, err := keyToID(acc.Key)
+		if err != nil {
+			return n, err
+		}
+		ok, err := backfillIndex(db, accountByKeyIDTable, accountKeyIndex(acc.ProvisionerID, kid), acc.ID, opts.DryRun)
+		if err != nil {
+			return n, err
+		}
+		if ok {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// backfillAccountsByEABKeyID binds the external account keys used before
+// they were bound to a single account to the oldest account they were used
+// for.
+func backfillAccountsByEABKeyID(db nosql.DB, opts *MigrateOptions) (int, error) {
+	entries, err := listEntries(db, accountTable)
+	if err != nil {
+		return 0, err
+	}
+	accounts := make([]*account, 0, len(entries))
+	for _, e := range entries {
+		acc := new(account)
+		if err := json.Unmarshal(e.Value, acc); err != nil {
+			return 0, errors.Wrapf(err, "error unmarshaling account %s", e.Key)
+		}
+		if len(acc.ExternalAccountID) > 0 {
+			accounts = append(accounts, acc)
+		}
+	}
+	sort.Slice(accounts, func(i, j int) bool {
+		return accounts[i].Created.Before(accounts[j].Created)
+	})
+
+	var n int
+	bound := make(map[string]bool)
+	for _, acc := range accounts {
+		key := accountKeyIndex(acc.ProvisionerID, acc.ExternalAccountID)
+		if bound[key] {
+			continue
+		}
+		bound[key] = true
+		ok, err := backfillIndex(db, accountByEABKeyIDTable, key, acc.ID, opts.DryRun)
+		if err != nil {
+			return n, err
+		}
+		if ok {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// backfillOrdersByAccountID adds the missing orders to the list of orders
+// of their account.
+func backfillOrdersByAccountID(db nosql.DB, opts *MigrateOptions) (int, error) {
+	entries, err := listEntries(db, orderTable)
+	if err != nil {
+		return 0, err
+	}
+	byAccount := make(map[string][]*order)
+	for _, e := range entries {
+		o := new(order)
+		if err := json.Unmarshal(e.Value, o); err != nil {
+			return 0, errors.Wrapf(err, "error unmarshaling order %s", e.Key)
+		}
+		byAccount[o.AccountID] = append(byAccount[o.AccountID], o)
+	}
+
+	var n int
+	for accID, orders := range byAccount {
+		oids, err := getOrderIDsByAccount(db, accID)
+		if err != nil {
+			return n, err
+		}
+		indexed := make(map[string]bool, len(oids))
+		for _, id := range oids {
+			indexed[id] = true
+		}
+		// Keep the creation order of the orders.
+		sort.Slice(orders, func(i, j int) bool {
+			return orders[i].Created.Before(orders[j].Created)
+		})
+		for _, o := range orders {
+			if indexed[o.ID] {
+				continue
+			}
+			if !opts.DryRun {
+				if err := addOrderIDToAccount(db, accID, o.ID); err != nil {
+					return n, err
+				}
+			}
+			n++
+		}
+	}
+	return n, nil
+}
+
+// backfillCertsBySerial indexes the certificates by the serial number of
+// their leaf.
+func backfillCertsBySerial(db nosql.DB, opts *MigrateOptions) (int, error) {
+	entries, err := listEntries(db, certTable)
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	for _, e := range entries {
+		c := new(certificate)
+		if err := json.Unmarshal(e.Value, c); err != nil {
+			return n, errors.Wrapf(err, "error unmarshaling certificate %s", e.Key)
+		}
+		leaf, err := c.leaf()
+		if err != nil {
+			return n, err
+		}
+		ok, err := backfillIndex(db, certBySerialTable, leaf.SerialNumber.String(), c.ID, opts.DryRun)
+		if err != nil {
+			return n, err
+		}
+		if ok {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// legacyRecord is a record stored before the records were scoped to their
+// provisioner, with the fields it is stored with.
+type legacyRecord map[string]json.RawMessage
+
+// provisionerID returns the provisioner ID of the record, empty if it has
+// none.
+func (r legacyRecord) provisionerID() (string, error) {
+	var id string
+	if b, ok := r["provisionerID"]; ok {
+		if err := json.Unmarshal(b, &id); err != nil {
+			return "", errors.Wrap(err, "error unmarshaling provisionerID")
+		}
+	}
+	return id, nil
+}
+
+// assignLegacyEntries assigns the entries of a table without provisioner to
+// the legacy provisioner, calling assigned with the value stored for each of
+// them. Without legacy provisioner it fails if such an entry exists.
+func assignLegacyEntries(db nosql.DB, table []byte, typ string, opts *MigrateOptions, assigned func(key, value []byte) error) (int, error) {
+	entries, err := listEntries(db, table)
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	for _, e := range entries {
+		r := make(legacyRecord)
+		if err := json.Unmarshal(e.Value, &r); err != nil {
+			return n, errors.Wrapf(err, "error unmarshaling %s %s", typ, e.Key)
+		}
+		if id, err := r.provisionerID(); err != nil {
+			return n, errors.Wrapf(err, "error migrating %s %s", typ, e.Key)
+		} else if id != "" {
+			continue
+		}
+		if opts.LegacyProvisionerID == "" {
+			return n, errors.Errorf("%s %s has no provisioner: "+
+				"configure the legacy ACME provisioner to assign it to", typ, e.Key)
+		}
+		n++
+		if opts.DryRun {
+			continue
+		}
+		if r["provisionerID"], err = json.Marshal(opts.LegacyProvisionerID); err != nil {
+			return n, errors.Wrapf(err, "error marshaling %s %s", typ, e.Key)
+		}
+		b, err := json.Marshal(r)
+		if err != nil {
+			return n, errors.Wrapf(err, "error marshaling %s %s", typ, e.Key)
+		}
+		if _, swapped, err := db.CmpAndSwap(table, e.Key, e.Value, b); err != nil {
+			return n, errors.Wrapf(err, "error storing %s %s", typ, e.Key)
+		} else if !swapped {
+			// Another replica has assigned the record concurrently.
+			continue
+		}
+		if assigned != nil {
+			if err := assigned(e.Key, b); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// assignLegacyRecords returns the migration assigning the records of a table
+// without provisioner to the legacy provisioner.
+func assignLegacyRecords(table []byte, typ string) func(nosql.DB, *MigrateOptions) (int, error) {
+	return func(db nosql.DB, opts *MigrateOptions) (int, error) {
+		return assignLegacyEntries(db, table, typ, opts, nil)
+	}
+}
+
+// assignLegacyAccounts assigns the accounts without provisioner to the
+// legacy provisioner, and moves their key and external account key indexes
+// to the ones of the provisioner.
+func assignLegacyAccounts(db nosql.DB, opts *MigrateOptions) (int, error) {
+	return assignLegacyEntries(db, accountTable, "account", opts, func(key, value []byte) error {
+		acc := new(account)
+		if err := json.Unmarshal(value, acc); err != nil {
+			return errors.Wrapf(err, "error unmarshaling account %s", key)
+		}
+		// Key IDs by index table.
+		indexes := make(map[string]string)
+		if acc.Key != nil {
+			kid, err := keyToID(acc.Key)
+			if err != nil {
+				return err
+			}
+			indexes[string(accountByKeyIDTable)] = kid
+		}
+		if len(acc.ExternalAccountID) > 0 {
+			indexes[string(accountByEABKeyIDTable)] = acc.ExternalAccountID
+		}
+		for t, kid := range indexes {
+			table := []byte(t)
+			if _, err := backfillIndex(db, table, accountKeyIndex(acc.ProvisionerID, kid), acc.ID, false); err != nil {
+				return err
+			}
+			// Remove the unscoped index if it points to the account.
+			id, err := db.Get(table, []byte(kid))
+			switch {
+			case nosql.IsErrNotFound(err):
+			case err != nil:
+				return errors.Wrapf(err, "error loading %s index of %s", table, kid)
+			case string(id) == acc.ID:
+				if err := db.Del(table, []byte(kid)); err != nil {
+					return errors.Wrapf(err, "error deleting %s index of %s", table, kid)
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// String returns a one line description of the migration result.
+func (r *MigrationResult) String() string {
+	return fmt.Sprintf("%s %d -> %d: %s (%d changes)", r.Table, r.From, r.To, r.Description, r.Changes)
+}
@@ -0,0 +1,143 @@
+package acme
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/go-ocf/step-ca/sqldb"
+	"github.com/go-ocf/step-ca/sqldb/sqldbtest"
+	"github.com/smallstep/cli/jose"
+	"github.com/smallstep/nosql"
+)
+
+func TestMigrateDryRun(t *testing.T) {
+	db, err := sqldb.NewFromDB(sqldb.PostgreSQL, sqldbtest.NewServer().DB())
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := Migrate(db, &MigrateOptions{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(migrations) {
+		t.Errorf("Migrate() dry-run returned %d results, want %d", len(results), len(migrations))
+	}
+	if _, err := db.List(accountTable); !nosql.IsErrNotFound(err) {
+		t.Errorf("List() after a dry-run error = %v, want the table not to exist", err)
+	}
+
+	if _, err := Migrate(db, nil); err != nil {
+		t.Fatal(err)
+	}
+	if results, err = Migrate(db, &MigrateOptions{DryRun: true}); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 0 {
+		t.Errorf("Migrate() dry-run of a migrated database returned %d results, want 0", len(results))
+	}
+}
+
+func TestMigrateNewerDatabase(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+
+	latest := latestVersions()[string(orderTable)]
+	b, err := json.Marshal(schemaVersion{Version: latest + 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set(schemaVersionTable, orderTable, b); err != nil {
+		t.Fatal(err)
+	}
+	for _, dryRun := range []bool{true, false} {
+		results, err := Migrate(db, &MigrateOptions{DryRun: dryRun})
+		if err == nil || !strings.Contains(err.Error(), "database is newer than this binary") {
+			t.Errorf("Migrate(%v) error = %v, want a newer database error", dryRun, err)
+		}
+		if len(results) != 0 {
+			t.Errorf("Migrate(%v) applied %d migrations, want none", dryRun, len(results))
+		}
+	}
+}
+
+func TestMigrateLegacyRecords(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+
+	jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := jwk.Public()
+	kid, err := keyToID(&pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Records stored before they were scoped to their provisioner.
+	acc, err := newAccount(db, AccountOptions{Key: &pub}, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := &order{ID: "legacy-order", AccountID: acc.ID, Status: StatusPending}
+	b, err := json.Marshal(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set(orderTable, []byte(o.ID), b); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without legacy provisioner the records are rejected.
+	if _, err := Migrate(db, nil); err == nil || !strings.Contains(err.Error(), "has no provisioner") {
+		t.Fatalf("Migrate() error = %v, want a legacy record error", err)
+	}
+
+	opts := &MigrateOptions{DryRun: true, LegacyProvisionerID: "acme/legacy"}
+	results, err := Migrate(db, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acc, err := getAccountByID(db, acc.ID); err != nil || acc.ProvisionerID != "" {
+		t.Fatalf("dry-run assigned account = %v, error = %v", acc, err)
+	}
+	var changes int
+	for _, r := range results {
+		changes += r.Changes
+	}
+	if changes == 0 {
+		t.Error("Migrate() dry-run reported no changes")
+	}
+
+	opts.DryRun = false
+	if _, err := Migrate(db, opts); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		provID  string
+		wantErr bool
+	}{
+		{"legacy", "acme/legacy", false},
+		{"other", "acme/other", true},
+		{"unscoped", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := getAccountByKeyID(db, tt.provID, kid)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("getAccountByKeyID() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (got.ID != acc.ID || got.ProvisionerID != tt.provID) {
+				t.Errorf("getAccountByKeyID() = %+v, want account %s of %s", got, acc.ID, tt.provID)
+			}
+		})
+	}
+	got, err := getOrder(db, o.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ProvisionerID != "acme/legacy" {
+		t.Errorf("order provisioner = %q, want acme/legacy", got.ProvisionerID)
+	}
+}
@@ -71,3 +71,28 @@ func useNonce(db nosql.DB, nonce string) error {
 		return nil
 	}
 }
+
+// purgeNonces deletes the unused nonces created before the given time.
+func purgeNonces(db nosql.DB, before time.Time) error {
+	entries, err := db.List(nonceTable)
+	if err != nil {
+		if nosql.IsErrNotFound(err) {
+			return nil
+		}
+		return ServerInternalErr(errors.Wrap(err, "error listing nonces"))
+	}
+	for _, e := range entries {
+		n := new(nonce)
+		if err := json.Unmarshal(e.Value, n); err != nil {
+			return ServerInternalErr(errors.Wrap(err, "error unmarshaling nonce"))
+		}
+		if !n.Created.Before(before) {
+			continue
+		}
+		// Nonces used in the meantime are already gone.
+		if err := db.Del(nonceTable, e.Key); err != nil && !nosql.IsErrNotFound(err) {
+			return ServerInternalErr(errors.Wrapf(err, "error deleting nonce %s", n.ID))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package acme
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/authority/provisioner"
+	"github.com/smallstep/nosql"
+)
+
+// Nonce service modes.
+const (
+	// NonceModeDB stores the nonces in the database; required when several
+	// replicas share the same database.
+	NonceModeDB = "db"
+	// NonceModeHMAC issues stateless authenticated nonces, only tracking the
+	// recently used ones in memory.
+	NonceModeHMAC = "hmac"
+)
+
+const (
+	defaultNonceLifetime = 5 * time.Minute
+	nonceMACSize         = 16
+)
+
+// NonceService issues and consumes ACME replay nonces.
+type NonceService interface {
+	// New returns a new nonce.
+	New() (string, error)
+	// Use consumes the nonce; it returns a badNonce error if the nonce is
+	// not valid or has already been used.
+	Use(string) error
+}
+
+// NonceOptions configure the nonce service.
+type NonceOptions struct {
+	// Mode is db, the default, or hmac.
+	Mode string `json:"mode,omitempty"`
+	// Key is the base64 encoded HMAC key of the hmac mode. If empty, a random
+	// key is generated, invalidating the outstanding nonces on restart and
+	// reload.
+	Key string `json:"key,omitempty"`
+	// Lifetime is the time hmac nonces are valid for; 5m by default.
+	Lifetime *provisioner.Duration `json:"lifetime,omitempty"`
+}
+
+// NewNonceService returns the nonce service configured by the options.
+func NewNonceService(db nosql.DB, o *NonceOptions) (NonceService, error) {
+	if o == nil {
+		o = &NonceOptions{}
+	}
+	switch o.Mode {
+	case "", NonceModeDB:
+		return NewDBNonceService(db), nil
+	case NonceModeHMAC:
+		var key []byte
+		if len(o.Key) > 0 {
+			var err error
+			if key, err = base64.StdEncoding.DecodeString(o.Key); err != nil {
+				return nil, errors.Wrap(err, "error decoding nonce key")
+			}
+		}
+		lifetime := defaultNonceLifetime
+		if o.Lifetime != nil {
+			lifetime = o.Lifetime.Duration
+		}
+		return NewHMACNonceService(key, lifetime)
+	default:
+		return nil, errors.Errorf("unsupported nonce mode %s", o.Mode)
+	}
+}
+
+type dbNonceService struct {
+	db nosql.DB
+}
+
+// NewDBNonceService returns a nonce service storing the nonces in the
+// database.
+func NewDBNonceService(db nosql.DB) NonceService {
+	return &dbNonceService{db: db}
+}
+
+func (s *dbNonceService) New() (string, error) {
+	n, err := newNonce(s.db)
+	if err != nil {
+		return "", err
+	}
+	return n.ID, nil
+}
+
+func (s *dbNonceService) Use(nonce string) error {
+	return useNonce(s.db, nonce)
+}
+
+// hmacNonceService issues nonces made of a counter, the issuance time and an
+// HMAC of both. Used nonces are remembered until they expire. The counter
+// starts at a random value, so that the nonces issued after a restart or a
+// reload with the same key do not repeat the previous ones.
+type hmacNonceService struct {
+	key      []byte
+	lifetime time.Duration
+	counter  uint64
+	mu       sync.Mutex
+	used     map[[16]byte]time.Time
+	purged   time.Time
+}
+
+// NewHMACNonceService returns a stateless nonce service. If the key is empty
+// a random one is generated.
+func NewHMACNonceService(key []byte, lifetime time.Duration) (NonceService, error) {
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, errors.Wrap(err, "error generating nonce key")
+		}
+	}
+	if lifetime <= 0 {
+		lifetime = defaultNonceLifetime
+	}
+	var seed [8]byte
+	if _, err := rand.Read(seed[:]); err != nil {
+		return nil, errors.Wrap(err, "error generating nonce counter")
+	}
+	return &hmacNonceService{
+		key:      key,
+		lifetime: lifetime,
+		counter:  binary.BigEndian.Uint64(seed[:]),
+		used:     make(map[[16]byte]time.Time),
+		purged:   clock.Now(),
+	}, nil
+}
+
+func (s *hmacNonceService) mac(b []byte) []byte {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write(b)
+	return mac.Sum(nil)[:nonceMACSize]
+}
+
+func (s *hmacNonceService) New() (string, error) {
+	b := make([]byte, 16, 16+nonceMACSize)
+	binary.BigEndian.PutUint64(b[:8], atomic.AddUint64(&s.counter, 1))
+	binary.BigEndian.PutUint64(b[8:], uint64(clock.Now().Unix()))
+	return base64.RawURLEncoding.EncodeToString(append(b, s.mac(b)...)), nil
+}
+
+func (s *hmacNonceService) Use(nonce string) error {
+	b, err := base64.RawURLEncoding.DecodeString(nonce)
+	if err != nil || len(b) != 16+nonceMACSize || !hmac.Equal(b[16:], s.mac(b[:16])) {
+		return BadNonceErr(nil)
+	}
+	var id [16]byte
+	copy(id[:], b[:16])
+	issued := time.Unix(int64(binary.BigEndian.Uint64(b[8:16])), 0)
+	now := clock.Now()
+	if now.Sub(issued) > s.lifetime {
+		return BadNonceErr(nil)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Forget the nonces that have expired; they are rejected by their time.
+	if now.Sub(s.purged) > s.lifetime {
+		for n, t := range s.used {
+			if now.Sub(t) > s.lifetime {
+				delete(s.used, n)
+			}
+		}
+		s.purged = now
+	}
+	if _, ok := s.used[id]; ok {
+		return BadNonceErr(nil)
+	}
+	s.used[id] = issued
+	return nil
+}
@@ -0,0 +1,61 @@
+package acme
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestHMACNonceService(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	s, err := NewHMACNonceService(key, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := s.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Use(n); err != nil {
+		t.Fatalf("Use() error = %v", err)
+	}
+	if err := s.Use(n); err == nil {
+		t.Error("Use() of a used nonce error = nil, want an error")
+	}
+	if err := s.Use(n[:len(n)-2] + "AA"); err == nil {
+		t.Error("Use() of a forged nonce error = nil, want an error")
+	}
+
+	// A nonce with the same counter but another issuance time is a different
+	// nonce, and a service with the same key does not start at the same
+	// counter.
+	hs := s.(*hmacNonceService)
+	b, _ := base64.RawURLEncoding.DecodeString(n)
+	binary.BigEndian.PutUint64(b[8:16], binary.BigEndian.Uint64(b[8:16])-1)
+	other := base64.RawURLEncoding.EncodeToString(append(b[:16:16], hs.mac(b[:16])...))
+	if err := s.Use(other); err != nil {
+		t.Errorf("Use() of a nonce with a used counter error = %v", err)
+	}
+
+	s2, err := NewHMACNonceService(key, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n2, err := s2.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b2, _ := base64.RawURLEncoding.DecodeString(n2)
+	if hmac.Equal(b[:8], b2[:8]) {
+		t.Error("NewHMACNonceService() counters start at the same value")
+	}
+
+	// Expired nonces are rejected.
+	binary.BigEndian.PutUint64(b[8:16], uint64(time.Now().Add(-2*time.Minute).Unix()))
+	expired := base64.RawURLEncoding.EncodeToString(append(b[:16:16], hs.mac(b[:16])...))
+	if err := s.Use(expired); err == nil {
+		t.Error("Use() of an expired nonce error = nil, want an error")
+	}
+}
@@ -4,16 +4,23 @@ import (
 	"context"
 	"crypto/x509"
 	"encoding/json"
+	"math/rand"
 	"reflect"
 	"time"
 
+	"github.com/go-ocf/step-ca/inventory"
+	"github.com/go-ocf/step-ca/kvdb"
 	"github.com/pkg/errors"
 	"github.com/smallstep/certificates/authority/provisioner"
 	"github.com/smallstep/nosql"
+	"github.com/smallstep/nosql/database"
 )
 
 var defaultOrderExpiry = time.Hour * 24
 
+// purgeBatchSize is the number of orders read at once by purgeOrders.
+const purgeBatchSize = 100
+
 // Order contains order metadata for the ACME protocol order type.
 type Order struct {
 	Status         string       `json:"status"`
@@ -48,6 +55,19 @@ type OrderOptions struct {
 	Identifiers []Identifier `json:"identifiers"`
 	NotBefore   time.Time    `json:"notBefore"`
 	NotAfter    time.Time    `json:"notAfter"`
+	// IssuerDomainNames and AccountURI are the CA identities and the account
+	// URI persistent DNS validation records must name. The dns-persist-01
+	// challenge is only offered if issuer domain names are set, that is if
+	// the provisioner enables it.
+	IssuerDomainNames []string `json:"-"`
+	AccountURI        string   `json:"-"`
+	// DeviceAttestation enables device-attest-01 challenges for UUID
+	// identifiers.
+	DeviceAttestation bool `json:"-"`
+	// ProvisionerID is the ID of the provisioner the order is created
+	// through; its authorizations, challenges and certificate are scoped to
+	// the same provisioner.
+	ProvisionerID string `json:"-"`
 }
 
 type order struct {
@@ -59,21 +79,27 @@ type order struct {
 	Identifiers    []Identifier `json:"identifiers"`
 	NotBefore      time.Time    `json:"notBefore,omitempty"`
 	NotAfter       time.Time    `json:"notAfter,omitempty"`
-	Error          *Error       `json:"error,omitempty"`
+	Error          *AError      `json:"error,omitempty"`
 	Authorizations []string     `json:"authorizations"`
 	Certificate    string       `json:"certificate,omitempty"`
+	ProvisionerID  string       `json:"provisionerID,omitempty"`
 }
 
 // newOrder returns a new Order type.
+//
+// The order, its authorizations and their challenges are stored in a single
+// transaction, together with the update of the "order IDs by account ID"
+// index.
 func newOrder(db nosql.DB, ops OrderOptions) (*order, error) {
 	id, err := randID()
 	if err != nil {
 		return nil, err
 	}
 
+	tx := new(database.Tx)
 	authzs := make([]string, len(ops.Identifiers))
 	for i, identifier := range ops.Identifiers {
-		az, err := newAuthz(db, ops.AccountID, identifier)
+		az, err := newAuthz(tx, ops, identifier)
 		if err != nil {
 			return nil, err
 		}
@@ -91,53 +117,81 @@ func newOrder(db nosql.DB, ops OrderOptions) (*order, error) {
 		NotBefore:      ops.NotBefore,
 		NotAfter:       ops.NotAfter,
 		Authorizations: authzs,
+		ProvisionerID:  ops.ProvisionerID,
 	}
-	if err := o.save(db, nil); err != nil {
-		return nil, err
-	}
-
-	// Update the "order IDs by account ID" index //
-	oids, err := getOrderIDsByAccount(db, ops.AccountID)
-	if err != nil {
+	if err := txInsert(tx, orderTable, o.ID, o); err != nil {
 		return nil, err
 	}
-	newOids := append(oids, o.ID)
-	if err = orderIDs(newOids).save(db, oids, o.AccountID); err != nil {
-		db.Del(orderTable, []byte(o.ID))
+	if err := commitWithOrderIndex(db, tx, o.AccountID, o.ID); err != nil {
 		return nil, err
 	}
 	return o, nil
 }
 
-type orderIDs []string
+var (
+	// orderIndexRetries is the number of times an update of the "order IDs
+	// by account ID" index is attempted when it is concurrently modified.
+	orderIndexRetries = 100
+	// orderIndexRetryWait is the upper bound of the random wait between two
+	// attempts.
+	orderIndexRetryWait = 10 * time.Millisecond
+)
 
-func (oids orderIDs) save(db nosql.DB, old orderIDs, accID string) error {
-	var (
-		err  error
-		oldb []byte
-	)
-	if len(old) == 0 {
-		oldb = nil
-	} else {
-		oldb, err = json.Marshal(old)
-		if err != nil {
-			return ServerInternalErr(errors.Wrap(err, "error marshaling old order IDs slice"))
+// addOrderIDToAccount appends the order ID to the "order IDs by account ID"
+// index.
+func addOrderIDToAccount(db nosql.DB, accID, oid string) error {
+	return commitWithOrderIndex(db, new(database.Tx), accID, oid)
+}
+
+// commitWithOrderIndex commits the transaction with the append of the order
+// ID to the "order IDs by account ID" index. The index is compared and
+// swapped in the same transaction, so a concurrent update of the index of
+// the account rolls everything back, and the transaction is retried against
+// the latest index instead of failing.
+func commitWithOrderIndex(db nosql.DB, tx *database.Tx, accID, oid string) error {
+	n := len(tx.Operations)
+	for i := 0; i < orderIndexRetries; i++ {
+		if i > 0 {
+			time.Sleep(time.Duration(rand.Int63n(int64(orderIndexRetryWait))))
+		}
+		tx.Operations = tx.Operations[:n]
+		if err := txAddOrderIDToAccount(db, tx, accID, oid); err != nil {
+			return err
+		}
+		if err := commitInserts(db, tx); !isConflictErr(err) {
+			return err
+		}
+	}
+	return ServerInternalErr(errors.Errorf("error storing order IDs "+
+		"for account %s; order IDs changed since last read", accID))
+}
+
+// txAddOrderIDToAccount appends to the transaction the compare-and-swap of
+// the "order IDs by account ID" index of the account with the order ID
+// appended.
+func txAddOrderIDToAccount(db nosql.DB, tx *database.Tx, accID, oid string) error {
+	oldb, err := db.Get(ordersByAccountIDTable, []byte(accID))
+	if err != nil && !nosql.IsErrNotFound(err) {
+		return ServerInternalErr(errors.Wrapf(err, "error loading orderIDs for account %s", accID))
+	}
+	var oids []string
+	if oldb != nil {
+		if err := json.Unmarshal(oldb, &oids); err != nil {
+			return ServerInternalErr(errors.Wrapf(err, "error unmarshaling orderIDs for account %s", accID))
 		}
 	}
-	newb, err := json.Marshal(oids)
+	newb, err := json.Marshal(append(oids, oid))
 	if err != nil {
 		return ServerInternalErr(errors.Wrap(err, "error marshaling new order IDs slice"))
 	}
-	_, swapped, err := db.CmpAndSwap(ordersByAccountIDTable, []byte(accID), oldb, newb)
-	switch {
-	case err != nil:
-		return ServerInternalErr(errors.Wrapf(err, "error storing order IDs for account %s", accID))
-	case !swapped:
-		return ServerInternalErr(errors.Errorf("error storing order IDs "+
-			"for account %s; order IDs changed since last read", accID))
-	default:
-		return nil
-	}
+	tx.Operations = append(tx.Operations, &database.TxEntry{
+		Bucket:   ordersByAccountIDTable,
+		Key:      []byte(accID),
+		CmpValue: oldb,
+		Value:    newb,
+		Cmd:      database.CmpAndSwap,
+	})
+	return nil
 }
 
 func (o *order) save(db nosql.DB, old *order) error {
@@ -185,7 +239,7 @@ func (o *order) updateStatus(db nosql.DB) (*order, error) {
 		// check expiry
 		if now.After(o.Expires) {
 			newOrder.Status = StatusInvalid
-			newOrder.Error = MalformedErr(errors.New("order has expired"))
+			newOrder.Error = MalformedErr(errors.New("order has expired")).ToACME()
 			break
 		}
 		return o, nil
@@ -193,7 +247,7 @@ func (o *order) updateStatus(db nosql.DB) (*order, error) {
 		// check expiry
 		if now.After(o.Expires) {
 			newOrder.Status = StatusInvalid
-			newOrder.Error = MalformedErr(errors.New("order has expired"))
+			newOrder.Error = MalformedErr(errors.New("order has expired")).ToACME()
 			break
 		}
 
@@ -235,7 +289,7 @@ func (o *order) updateStatus(db nosql.DB) (*order, error) {
 
 // finalize signs a certificate if the necessary conditions for Order completion
 // have been met.
-func (o *order) finalize(db nosql.DB, csr *x509.CertificateRequest, auth SignAuthority, p provisioner.Interface) (*order, error) {
+func (o *order) finalize(db nosql.DB, csr *x509.CertificateRequest, auth SignAuthority, p provisioner.Interface, co caaOptions) (*order, error) {
 	var err error
 	if o, err = o.updateStatus(db); err != nil {
 		return nil, err
@@ -266,6 +320,10 @@ func (o *order) finalize(db nosql.DB, csr *x509.CertificateRequest, auth SignAut
 		return nil, BadCSRErr(errors.Errorf("CSR names do not match identifiers exactly"))
 	}
 
+	if err := o.checkCAA(db, co); err != nil {
+		return nil, err
+	}
+
 	// Get authorizations from the ACME provisioner.
 	ctx := provisioner.NewContextWithMethod(context.Background(), provisioner.SignMethod)
 	signOps, err := p.AuthorizeSign(ctx, "")
@@ -273,7 +331,9 @@ func (o *order) finalize(db nosql.DB, csr *x509.CertificateRequest, auth SignAut
 		return nil, ServerInternalErr(errors.Wrapf(err, "error retrieving authorization options from ACME provisioner"))
 	}
 
-	// Create and store a new certificate.
+	// Create and store a new certificate. The account ID is recorded in the
+	// certificate inventory and the provisioner name selects the issuer.
+	signOps = append(signOps, inventory.AccountID(o.AccountID), inventory.Provisioner(p.GetName()))
 	leaf, inter, err := auth.Sign(csr, provisioner.Options{
 		NotBefore: provisioner.NewTimeDuration(o.NotBefore),
 		NotAfter:  provisioner.NewTimeDuration(o.NotAfter),
@@ -285,6 +345,7 @@ func (o *order) finalize(db nosql.DB, csr *x509.CertificateRequest, auth SignAut
 	cert, err := newCert(db, CertOptions{
 		AccountID:     o.AccountID,
 		OrderID:       o.ID,
+		ProvisionerID: o.ProvisionerID,
 		Leaf:          leaf,
 		Intermediates: []*x509.Certificate{inter},
 	})
@@ -319,10 +380,10 @@ func getOrder(db nosql.DB, id string) (*order, error) {
 
 // toACME converts the internal Order type into the public acmeOrder type for
 // presentation in the ACME protocol.
-func (o *order) toACME(db nosql.DB, dir *directory, p provisioner.Interface) (*Order, error) {
+func (o *order) toACME(ctx context.Context, db nosql.DB, dir *directory, p provisioner.Interface) (*Order, error) {
 	azs := make([]string, len(o.Authorizations))
 	for i, aid := range o.Authorizations {
-		azs[i] = dir.getLink(AuthzLink, URLSafeProvisionerName(p), true, aid)
+		azs[i] = dir.getLink(ctx, AuthzLink, URLSafeProvisionerName(p), true, aid)
 	}
 	ao := &Order{
 		Status:         o.Status,
@@ -331,12 +392,112 @@ func (o *order) toACME(db nosql.DB, dir *directory, p provisioner.Interface) (*O
 		NotBefore:      o.NotBefore.Format(time.RFC3339),
 		NotAfter:       o.NotAfter.Format(time.RFC3339),
 		Authorizations: azs,
-		Finalize:       dir.getLink(FinalizeLink, URLSafeProvisionerName(p), true, o.ID),
+		Finalize:       dir.getLink(ctx, FinalizeLink, URLSafeProvisionerName(p), true, o.ID),
 		ID:             o.ID,
 	}
 
 	if o.Certificate != "" {
-		ao.Certificate = dir.getLink(CertificateLink, URLSafeProvisionerName(p), true, o.Certificate)
+		ao.Certificate = dir.getLink(ctx, CertificateLink, URLSafeProvisionerName(p), true, o.Certificate)
 	}
 	return ao, nil
 }
+
+// purgeOrders deletes the orders that expired before the given time without
+// a certificate, with their authorizations and challenges.
+func purgeOrders(db nosql.DB, before time.Time) error {
+	var after []byte
+	for {
+		entries, err := kvdb.ListRange(db, orderTable, nil, after, purgeBatchSize)
+		if err != nil {
+			if nosql.IsErrNotFound(err) {
+				return nil
+			}
+			return ServerInternalErr(errors.Wrap(err, "error listing orders"))
+		}
+		for _, e := range entries {
+			o := new(order)
+			if err := json.Unmarshal(e.Value, o); err != nil {
+				return ServerInternalErr(errors.Wrap(err, "error unmarshaling order"))
+			}
+			if o.Expires.IsZero() || !o.Expires.Before(before) || len(o.Certificate) > 0 {
+				continue
+			}
+			if err := o.purge(db); err != nil {
+				return err
+			}
+		}
+		if len(entries) < purgeBatchSize {
+			return nil
+		}
+		after = entries[len(entries)-1].Key
+	}
+}
+
+// purge deletes the order, its authorizations and challenges, and removes
+// it from the "order IDs by account ID" index.
+func (o *order) purge(db nosql.DB) error {
+	for _, azID := range o.Authorizations {
+		az, err := getAuthz(db, azID)
+		switch {
+		case err == nil:
+			for _, chID := range az.getChallenges() {
+				if err := db.Del(challengeTable, []byte(chID)); err != nil && !nosql.IsErrNotFound(err) {
+					return ServerInternalErr(errors.Wrapf(err, "error deleting challenge %s", chID))
+				}
+			}
+		case !nosql.IsErrNotFound(err):
+			return err
+		}
+		if err := db.Del(authzTable, []byte(azID)); err != nil && !nosql.IsErrNotFound(err) {
+			return ServerInternalErr(errors.Wrapf(err, "error deleting authz %s", azID))
+		}
+	}
+	if err := removeOrderIDFromAccount(db, o.AccountID, o.ID); err != nil {
+		return err
+	}
+	if err := db.Del(orderTable, []byte(o.ID)); err != nil && !nosql.IsErrNotFound(err) {
+		return ServerInternalErr(errors.Wrapf(err, "error deleting order %s", o.ID))
+	}
+	return nil
+}
+
+// removeOrderIDFromAccount removes the order ID from the "order IDs by
+// account ID" index, retrying if the index is concurrently modified.
+func removeOrderIDFromAccount(db nosql.DB, accID, oid string) error {
+	for i := 0; i < orderIndexRetries; i++ {
+		oldb, err := db.Get(ordersByAccountIDTable, []byte(accID))
+		switch {
+		case nosql.IsErrNotFound(err):
+			return nil
+		case err != nil:
+			return ServerInternalErr(errors.Wrapf(err, "error loading orderIDs for account %s", accID))
+		}
+		var oids []string
+		if err := json.Unmarshal(oldb, &oids); err != nil {
+			return ServerInternalErr(errors.Wrapf(err, "error unmarshaling orderIDs for account %s", accID))
+		}
+		kept := oids[:0]
+		for _, id := range oids {
+			if id != oid {
+				kept = append(kept, id)
+			}
+		}
+		if len(kept) == len(oids) {
+			return nil
+		}
+		newb, err := json.Marshal(kept)
+		if err != nil {
+			return ServerInternalErr(errors.Wrap(err, "error marshaling new order IDs slice"))
+		}
+		_, swapped, err := db.CmpAndSwap(ordersByAccountIDTable, []byte(accID), oldb, newb)
+		switch {
+		case err != nil && !isConflictErr(err):
+			return ServerInternalErr(errors.Wrapf(err, "error storing orderIDs for account %s", accID))
+		case swapped:
+			return nil
+		}
+		time.Sleep(time.Duration(rand.Int63n(int64(orderIndexRetryWait))))
+	}
+	return ServerInternalErr(errors.Errorf("error storing order IDs "+
+		"for account %s; order IDs changed since last read", accID))
+}
@@ -0,0 +1,236 @@
+package acme
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-ocf/step-ca/kvdb"
+	"github.com/go-ocf/step-ca/sqldb"
+	"github.com/go-ocf/step-ca/sqldb/sqldbtest"
+	"github.com/smallstep/certificates/authority/provisioner"
+	"github.com/smallstep/nosql"
+)
+
+// staleIndexDB returns an outdated "order IDs by account ID" index, so that
+// every update of the index conflicts.
+type staleIndexDB struct {
+	nosql.DB
+}
+
+func (db staleIndexDB) Get(bucket, key []byte) ([]byte, error) {
+	if string(bucket) == string(ordersByAccountIDTable) {
+		return []byte(`["stale"]`), nil
+	}
+	return db.DB.Get(bucket, key)
+}
+
+func TestPurgeOrders(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+
+	ops := OrderOptions{
+		AccountID:   "acc1",
+		Identifiers: []Identifier{{Type: "dns", Value: "www.example.com"}},
+		NotBefore:   time.Now(),
+		NotAfter:    time.Now().Add(time.Hour),
+	}
+	expired, err := newOrder(db, ops)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issued, err := newOrder(db, ops)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withCert := *issued
+	withCert.Certificate = "cert1"
+	if err := withCert.save(db, issued); err != nil {
+		t.Fatal(err)
+	}
+
+	// Orders that have not expired yet are kept.
+	if err := purgeOrders(db, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := getOrder(db, expired.ID); err != nil {
+		t.Errorf("getOrder() of an unexpired order error = %v", err)
+	}
+
+	if err := purgeOrders(db, expired.Expires.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := getOrder(db, expired.ID); err == nil {
+		t.Error("getOrder() of a purged order error = nil")
+	}
+	az, err := getAuthz(db, issued.Authorizations[0])
+	if err != nil {
+		t.Fatalf("getAuthz() of an order with a certificate error = %v", err)
+	}
+	if _, err := getChallenge(db, az.getChallenges()[0]); err != nil {
+		t.Errorf("getChallenge() of an order with a certificate error = %v", err)
+	}
+	for _, id := range expired.Authorizations {
+		if _, err := getAuthz(db, id); err == nil {
+			t.Errorf("getAuthz() of a purged authz error = nil")
+		}
+	}
+	oids, err := getOrderIDsByAccount(db, "acc1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(oids) != 1 || oids[0] != issued.ID {
+		t.Errorf("getOrderIDsByAccount() = %v, want [%s]", oids, issued.ID)
+	}
+}
+
+func TestNewOrderAccountURI(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+
+	base, err := url.Parse("https://ca.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &Authority{
+		db:  db,
+		dir: newDirectory(base, "acme"),
+		provOpts: map[string]*ProvisionerOptions{"acme": {
+			DNSPersist01: true,
+			Meta:         &Meta{CaaIdentities: []string{"ca.example.com"}},
+		}},
+	}
+	p := &provisioner.ACME{Type: "ACME", Name: "acme"}
+	for _, rawurl := range []string{"https://ca.example.com", "https://10.0.0.1:8443", "http://acme.internal"} {
+		t.Run(rawurl, func(t *testing.T) {
+			u, err := url.Parse(rawurl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx := NewContextWithBaseURL(context.Background(), u)
+			if _, err := a.NewOrder(ctx, p, OrderOptions{
+				AccountID:   "acc1",
+				Identifiers: []Identifier{{Type: "dns", Value: "www.example.com"}},
+				NotBefore:   time.Now(),
+				NotAfter:    time.Now().Add(time.Hour),
+			}); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	entries, err := db.List(challengeTable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	for _, e := range entries {
+		var ch struct {
+			Type       string `json:"type"`
+			AccountURI string `json:"accountURI"`
+		}
+		if err := json.Unmarshal(e.Value, &ch); err != nil {
+			t.Fatal(err)
+		}
+		if ch.Type != "dns-persist-01" {
+			continue
+		}
+		n++
+		if want := "https://ca.example.com/acme/acme/account/acc1"; ch.AccountURI != want {
+			t.Errorf("dns-persist-01 account URI = %q, want %q", ch.AccountURI, want)
+		}
+	}
+	if n != 3 {
+		t.Errorf("found %d dns-persist-01 challenges, want 3", n)
+	}
+}
+
+func TestNewOrderConcurrent(t *testing.T) {
+	bolt, cleanup := newTestDB(t)
+	defer cleanup()
+	sqlDB, err := sqldb.NewFromDB(sqldb.PostgreSQL, sqldbtest.NewServer().DB())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := createTables(sqlDB); err != nil {
+		t.Fatal(err)
+	}
+
+	ops := OrderOptions{
+		AccountID:   "acc1",
+		Identifiers: []Identifier{{Type: "dns", Value: "www.example.com"}},
+		NotBefore:   time.Now(),
+		NotAfter:    time.Now().Add(time.Hour),
+	}
+	const n = 20
+	for typ, db := range map[string]nosql.DB{kvdb.BoltDriver: bolt, sqldb.PostgreSQL: sqlDB} {
+		t.Run(typ, func(t *testing.T) {
+			var (
+				wg  sync.WaitGroup
+				mu  sync.Mutex
+				ids = make(map[string]bool)
+			)
+			for i := 0; i < n; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					o, err := newOrder(db, ops)
+					if err != nil {
+						t.Errorf("newOrder() error = %v", err)
+						return
+					}
+					mu.Lock()
+					ids[o.ID] = true
+					mu.Unlock()
+				}()
+			}
+			wg.Wait()
+
+			oids, err := getOrderIDsByAccount(db, "acc1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(oids) != n || len(ids) != n {
+				t.Fatalf("index has %d order IDs, %d orders created, want %d", len(oids), len(ids), n)
+			}
+			for _, id := range oids {
+				if !ids[id] {
+					t.Errorf("index contains unknown order %s", id)
+				}
+			}
+		})
+	}
+
+	// A conflict that outlasts the retries leaves nothing behind.
+	defer func(retries int, wait time.Duration) {
+		orderIndexRetries, orderIndexRetryWait = retries, wait
+	}(orderIndexRetries, orderIndexRetryWait)
+	orderIndexRetries, orderIndexRetryWait = 2, time.Millisecond
+	for typ, db := range map[string]nosql.DB{kvdb.BoltDriver: bolt, sqldb.PostgreSQL: sqlDB} {
+		t.Run(typ+"/conflict", func(t *testing.T) {
+			before := make(map[string]int)
+			for _, table := range [][]byte{orderTable, authzTable, challengeTable} {
+				entries, err := db.List(table)
+				if err != nil {
+					t.Fatal(err)
+				}
+				before[string(table)] = len(entries)
+			}
+			if _, err := newOrder(staleIndexDB{db}, ops); err == nil {
+				t.Fatal("newOrder() with a conflicting index error = nil")
+			}
+			for _, table := range [][]byte{orderTable, authzTable, challengeTable} {
+				entries, err := db.List(table)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(entries) != before[string(table)] {
+					t.Errorf("%s has %d entries after a conflict, want %d", table, len(entries), before[string(table)])
+				}
+			}
+		})
+	}
+}
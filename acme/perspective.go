@@ -0,0 +1,181 @@
+package acme
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Methods of the requests sent to the remote validation agents.
+const (
+	perspectiveHTTPGet   = "http-get"
+	perspectiveLookupTXT = "txt"
+	perspectiveLookupCAA = "caa"
+)
+
+// maxPerspectiveResponseSize bounds the responses of the remote validation
+// agents; the bodies they return are bounded by their egress policy.
+const maxPerspectiveResponseSize = 1 << 20
+
+// PerspectiveRequest is the request sent to a remote validation agent.
+type PerspectiveRequest struct {
+	Method string `json:"method"`
+	Target string `json:"target"`
+}
+
+// PerspectiveResponse is the observation of a remote validation agent. The
+// error is the one of the validation request made by the agent.
+type PerspectiveResponse struct {
+	Error      string      `json:"error,omitempty"`
+	StatusCode int         `json:"statusCode,omitempty"`
+	Body       []byte      `json:"body,omitempty"`
+	Records    []string    `json:"records,omitempty"`
+	CAA        []caaRecord `json:"caa,omitempty"`
+}
+
+// remoteValidator is a validation perspective that makes its requests
+// through a remote validation agent, from the network of that agent.
+type remoteValidator struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+// newRemoteValidator returns the validator of the agent at the given URL.
+// The agent is given the time of its own validation requests to answer.
+func newRemoteValidator(url, token string, dnsTimeout, httpTimeout time.Duration) *remoteValidator {
+	if dnsTimeout == 0 {
+		dnsTimeout = defaultDNSTimeout
+	}
+	if httpTimeout == 0 {
+		httpTimeout = defaultHTTPTimeout
+	}
+	timeout := httpTimeout
+	if dnsTimeout > timeout {
+		timeout = dnsTimeout
+	}
+	return &remoteValidator{
+		url:    url,
+		token:  token,
+		client: &http.Client{Timeout: 2 * timeout},
+	}
+}
+
+// do sends a request to the agent and returns its observation.
+func (v *remoteValidator) do(method, target string) (*PerspectiveResponse, error) {
+	b, err := json.Marshal(PerspectiveRequest{Method: method, Target: target})
+	if err != nil {
+		return nil, errors.Wrap(err, "error marshaling perspective request")
+	}
+	req, err := http.NewRequest("POST", v.url, bytes.NewReader(b))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error creating request to %s", v.url)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(v.token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+v.token)
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error querying validation agent %s", v.url)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("validation agent %s returned %s", v.url, resp.Status)
+	}
+	var pr PerspectiveResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxPerspectiveResponseSize)).Decode(&pr); err != nil {
+		return nil, errors.Wrapf(err, "error decoding response of validation agent %s", v.url)
+	}
+	if len(pr.Error) > 0 {
+		return nil, errors.New(pr.Error)
+	}
+	return &pr, nil
+}
+
+// HTTPGet implements the Validator interface.
+func (v *remoteValidator) HTTPGet(url string) (*http.Response, error) {
+	pr, err := v.do(perspectiveHTTPGet, url)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		Status:     http.StatusText(pr.StatusCode),
+		StatusCode: pr.StatusCode,
+		Header:     make(http.Header),
+		Body:       ioutil.NopCloser(bytes.NewReader(pr.Body)),
+	}, nil
+}
+
+// LookupTXT implements the Validator interface.
+func (v *remoteValidator) LookupTXT(name string) ([]string, error) {
+	pr, err := v.do(perspectiveLookupTXT, name)
+	if err != nil {
+		return nil, err
+	}
+	return pr.Records, nil
+}
+
+// LookupCAA implements the Validator interface.
+func (v *remoteValidator) LookupCAA(name string) ([]caaRecord, error) {
+	pr, err := v.do(perspectiveLookupCAA, name)
+	if err != nil {
+		return nil, err
+	}
+	return pr.CAA, nil
+}
+
+// NewPerspectiveAgent returns the handler of a remote validation agent,
+// making the validation requests of a CA with the given validator from the
+// network it runs in. Requests must present the bearer token, if any.
+func NewPerspectiveAgent(v Validator, token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if len(token) > 0 {
+			got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		var req PerspectiveRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+			http.Error(w, "error decoding request", http.StatusBadRequest)
+			return
+		}
+
+		var resp PerspectiveResponse
+		var err error
+		switch req.Method {
+		case perspectiveHTTPGet:
+			var hr *http.Response
+			if hr, err = v.HTTPGet(req.Target); err == nil {
+				defer hr.Body.Close()
+				resp.StatusCode = hr.StatusCode
+				resp.Body, err = ioutil.ReadAll(hr.Body)
+			}
+		case perspectiveLookupTXT:
+			resp.Records, err = v.LookupTXT(req.Target)
+		case perspectiveLookupCAA:
+			resp.CAA, err = v.LookupCAA(req.Target)
+		default:
+			http.Error(w, "unsupported method "+req.Method, http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			resp = PerspectiveResponse{Error: err.Error()}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	})
+}
@@ -0,0 +1,243 @@
+package acme
+
+import (
+	"crypto/x509"
+	"net"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+// IdentifierPolicy restricts the identifiers that can be ordered from a
+// provisioner. Denied identifiers are always rejected. If any allowed rule is
+// configured, identifiers not matching one of them are rejected too.
+type IdentifierPolicy struct {
+	Allow *IdentifierRules `json:"allow,omitempty"`
+	Deny  *IdentifierRules `json:"deny,omitempty"`
+	// DisallowWildcards rejects wildcard identifiers.
+	DisallowWildcards bool `json:"disallowWildcards,omitempty"`
+}
+
+// IdentifierRules are the patterns identifiers are matched against.
+type IdentifierRules struct {
+	// DNS are DNS name patterns. A pattern matches the name itself,
+	// "*.example.com" matches the names one label below example.com, and
+	// ".example.com" the names at any depth below it.
+	DNS []string `json:"dns,omitempty"`
+	// IPs are IP addresses or CIDR ranges, matched against IP address
+	// identifiers.
+	IPs []string `json:"ips,omitempty"`
+	// UUIDs are OCF device UUIDs, or prefixes of them followed by "*",
+	// matched against device identifiers; uuid:<UUID> or the bare UUID.
+	UUIDs []string `json:"uuids,omitempty"`
+
+	// ipNets are the parsed IPs.
+	ipNets []*net.IPNet
+}
+
+// Validate parses the rules of the policy, returning an error if one of them
+// cannot be parsed. A policy must be validated before it is used.
+func (p *IdentifierPolicy) Validate() error {
+	for _, r := range []*IdentifierRules{p.Allow, p.Deny} {
+		if r == nil {
+			continue
+		}
+		ipNets := make([]*net.IPNet, len(r.IPs))
+		for i, s := range r.IPs {
+			n, err := parseIPRule(s)
+			if err != nil {
+				return err
+			}
+			ipNets[i] = n
+		}
+		r.ipNets = ipNets
+		for _, s := range r.DNS {
+			if len(strings.TrimPrefix(strings.TrimPrefix(s, "*"), ".")) == 0 {
+				return errors.Errorf("invalid dns policy rule %q", s)
+			}
+		}
+		for _, s := range r.UUIDs {
+			if len(strings.TrimSuffix(s, "*")) == 0 {
+				return errors.Errorf("invalid uuid policy rule %q", s)
+			}
+		}
+	}
+	return nil
+}
+
+func (r *IdentifierRules) empty() bool {
+	return r == nil || len(r.DNS)+len(r.IPs)+len(r.UUIDs) == 0
+}
+
+// parseIPRule parses an IP address or CIDR range.
+func parseIPRule(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid ip policy rule %q", s)
+		}
+		return n, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, errors.Errorf("invalid ip policy rule %q", s)
+	}
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 8*net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// matchDNS returns true if the name matches the pattern.
+func matchDNS(pattern, name string) bool {
+	pattern, name = strings.ToLower(pattern), strings.ToLower(name)
+	switch {
+	case strings.HasPrefix(pattern, "*."):
+		i := strings.Index(name, ".")
+		return i > 0 && name[i:] == pattern[1:]
+	case strings.HasPrefix(pattern, "."):
+		return strings.HasSuffix(name, pattern) && len(name) > len(pattern)
+	default:
+		return name == pattern
+	}
+}
+
+// overlapsWildcard returns true if the pattern matches one of the names the
+// wildcard "*.<base>" covers, the names one label below base.
+func overlapsWildcard(pattern, base string) bool {
+	pattern, base = strings.ToLower(pattern), strings.ToLower(base)
+	switch {
+	case strings.HasPrefix(pattern, "*."):
+		return pattern[2:] == base
+	case strings.HasPrefix(pattern, "."):
+		return base == pattern[1:] || strings.HasSuffix(base, pattern)
+	default:
+		i := strings.Index(pattern, ".")
+		return i > 0 && pattern[i+1:] == base
+	}
+}
+
+// matchUUID returns true if the canonical UUID matches the pattern.
+func matchUUID(pattern, id string) bool {
+	pattern = strings.ToLower(strings.TrimPrefix(strings.ToLower(pattern), "uuid:"))
+	if strings.HasSuffix(pattern, "*") {
+		return strings.HasPrefix(id, strings.TrimSuffix(pattern, "*"))
+	}
+	return id == pattern
+}
+
+// matches returns true if the identifier value matches one of the rules.
+func (r *IdentifierRules) matches(value string) bool {
+	if r == nil {
+		return false
+	}
+	if ip := net.ParseIP(value); ip != nil {
+		for _, n := range r.ipNets {
+			if n.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	if id, ok := deviceUUID(value); ok {
+		for _, s := range r.UUIDs {
+			if matchUUID(s, id) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, s := range r.DNS {
+		if matchDNS(s, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// overlapsWildcard returns true if one of the rules matches one of the names
+// the wildcard "*.<base>" covers.
+func (r *IdentifierRules) overlapsWildcard(base string) bool {
+	if r == nil {
+		return false
+	}
+	for _, s := range r.DNS {
+		if overlapsWildcard(s, base) {
+			return true
+		}
+	}
+	return false
+}
+
+// deviceUUID returns the canonical UUID of an OCF device identifier.
+func deviceUUID(value string) (string, bool) {
+	v := value
+	if strings.HasPrefix(strings.ToLower(v), "uuid:") {
+		v = v[len("uuid:"):]
+	}
+	id, err := uuid.Parse(v)
+	if err != nil {
+		return "", false
+	}
+	return id.String(), true
+}
+
+// check returns a rejectedIdentifier error if the policy does not permit
+// the identifier.
+func (p *IdentifierPolicy) check(id Identifier) error {
+	if p == nil {
+		return nil
+	}
+	// A wildcard identifier is denied if a deny rule matches any of the
+	// names it covers, and allowed only by the "*.example.com" and
+	// ".example.com" patterns, that match all of them.
+	value := id.Value
+	if strings.HasPrefix(value, "*.") {
+		if p.DisallowWildcards {
+			return RejectedIdentifierErr(errors.Errorf("wildcard identifier %s is not allowed", value))
+		}
+		if p.Deny.overlapsWildcard(value[2:]) {
+			return RejectedIdentifierErr(errors.Errorf("identifier %s covers names denied by policy", id.Value))
+		}
+	}
+	if p.Deny.matches(value) {
+		return RejectedIdentifierErr(errors.Errorf("identifier %s is denied by policy", id.Value))
+	}
+	if !p.Allow.empty() && !p.Allow.matches(value) {
+		return RejectedIdentifierErr(errors.Errorf("identifier %s is not allowed by policy", id.Value))
+	}
+	return nil
+}
+
+// CheckCSR returns a rejectedIdentifier error if the policy does not permit
+// one of the names of the certificate request: its common name, DNS names,
+// IP addresses and urn:uuid URIs. It is used by the enrollments that do not
+// go through an order.
+func (p *IdentifierPolicy) CheckCSR(csr *x509.CertificateRequest) error {
+	if p == nil {
+		return nil
+	}
+	var ids []Identifier
+	if cn := csr.Subject.CommonName; len(cn) > 0 {
+		ids = append(ids, Identifier{Type: "dns", Value: cn})
+	}
+	for _, name := range csr.DNSNames {
+		ids = append(ids, Identifier{Type: "dns", Value: name})
+	}
+	for _, ip := range csr.IPAddresses {
+		ids = append(ids, Identifier{Type: "ip", Value: ip.String()})
+	}
+	for _, u := range csr.URIs {
+		if strings.EqualFold(u.Scheme, "urn") && strings.HasPrefix(strings.ToLower(u.Opaque), "uuid:") {
+			ids = append(ids, Identifier{Type: "dns", Value: u.Opaque})
+		}
+	}
+	for _, id := range ids {
+		if err := p.check(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package acme
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"net/url"
+	"testing"
+)
+
+func TestIdentifierPolicyCheck(t *testing.T) {
+	p := &IdentifierPolicy{
+		Allow: &IdentifierRules{
+			DNS: []string{".example.com", "*.example.org", "example.net", "*.example.net"},
+			IPs: []string{"192.0.2.0/24", "2001:db8::1"},
+		},
+		Deny: &IdentifierRules{
+			DNS: []string{"admin.example.com", ".internal.example.com", "*.corp.example.com", "mail.example.net"},
+			IPs: []string{"192.0.2.1"},
+		},
+	}
+	if err := p.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		value   string
+		wantErr bool
+	}{
+		{"www.example.com", false},
+		{"a.b.example.com", false},
+		{"admin.example.com", true},
+		{"host.internal.example.com", true},
+		{"host.corp.example.com", true},
+		{"www.example.org", false},
+		{"a.b.example.org", true},
+		{"example.net", false},
+		{"other.com", true},
+		// Wildcards covering a denied name.
+		{"*.example.com", true},
+		{"*.internal.example.com", true},
+		{"*.a.internal.example.com", true},
+		{"*.corp.example.com", true},
+		{"*.example.net", true},
+		// Wildcards covering allowed names only.
+		{"*.www.example.com", false},
+		{"*.example.org", false},
+		// IP addresses, matched with the parsed rules.
+		{"192.0.2.10", false},
+		{"192.0.2.1", true},
+		{"198.51.100.1", true},
+		{"2001:db8::1", false},
+		{"2001:db8::2", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			err := p.check(Identifier{Type: "dns", Value: tt.value})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("check(%s) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestIdentifierPolicyDisallowWildcards(t *testing.T) {
+	p := &IdentifierPolicy{DisallowWildcards: true}
+	if err := p.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.check(Identifier{Type: "dns", Value: "*.example.com"}); err == nil {
+		t.Error("check() of a wildcard error = nil, want an error")
+	}
+	if err := p.check(Identifier{Type: "dns", Value: "www.example.com"}); err != nil {
+		t.Errorf("check() error = %v", err)
+	}
+}
+
+func TestIdentifierPolicyValidate(t *testing.T) {
+	for _, r := range []*IdentifierRules{
+		{IPs: []string{"192.0.2.0/33"}},
+		{IPs: []string{"host"}},
+		{DNS: []string{"*."}},
+		{UUIDs: []string{"*"}},
+	} {
+		if err := (&IdentifierPolicy{Deny: r}).Validate(); err == nil {
+			t.Errorf("Validate() of %+v error = nil, want an error", r)
+		}
+	}
+}
+
+func TestIdentifierPolicyCheckCSR(t *testing.T) {
+	p := &IdentifierPolicy{
+		Allow: &IdentifierRules{
+			DNS:   []string{".example.com"},
+			IPs:   []string{"192.0.2.0/24"},
+			UUIDs: []string{"9f2c3e4a-*"},
+		},
+	}
+	if err := p.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	device, other := "uuid:9f2c3e4a-7b1d-4c5e-8f6a-0b1c2d3e4f50", "uuid:1d2c3b4a-0000-4c5e-8f6a-0b1c2d3e4f50"
+
+	tests := []struct {
+		name    string
+		csr     *x509.CertificateRequest
+		wantErr bool
+	}{
+		{"device", &x509.CertificateRequest{Subject: pkix.Name{CommonName: device}}, false},
+		{"other device", &x509.CertificateRequest{Subject: pkix.Name{CommonName: other}}, true},
+		{"names", &x509.CertificateRequest{
+			Subject:     pkix.Name{CommonName: "www.example.com"},
+			DNSNames:    []string{"www.example.com", "api.example.com"},
+			IPAddresses: []net.IP{net.ParseIP("192.0.2.10")},
+		}, false},
+		{"dns name", &x509.CertificateRequest{DNSNames: []string{"www.example.org"}}, true},
+		{"ip address", &x509.CertificateRequest{IPAddresses: []net.IP{net.ParseIP("198.51.100.1")}}, true},
+		{"uuid uri", &x509.CertificateRequest{URIs: []*url.URL{{Scheme: "urn", Opaque: other}}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := p.CheckCSR(tt.csr); (err != nil) != tt.wantErr {
+				t.Errorf("CheckCSR() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
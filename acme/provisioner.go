@@ -0,0 +1,55 @@
+package acme
+
+import (
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/authority/provisioner"
+)
+
+// ProvisionerOptions are the ACME options of a provisioner.
+type ProvisionerOptions struct {
+	// Meta is the metadata object published in the directory.
+	Meta *Meta `json:"meta,omitempty"`
+	// ExternalAccountKeys are the base64url encoded MAC keys, indexed by key
+	// identifier, that external account bindings are verified with.
+	ExternalAccountKeys map[string]string `json:"externalAccountKeys,omitempty"`
+	// Policy restricts the identifiers that can be ordered.
+	Policy *IdentifierPolicy `json:"policy,omitempty"`
+	// DNSPersist01 enables the dns-persist-01 challenge. Its records must
+	// name one of the issuer domain names in Meta.CaaIdentities.
+	DNSPersist01 bool `json:"dnsPersist01,omitempty"`
+}
+
+// Validate returns an error if the options are not valid.
+func (o *ProvisionerOptions) Validate() error {
+	if o.DNSPersist01 && len(o.getMeta().CaaIdentities) == 0 {
+		return errors.New("dnsPersist01 requires an issuer domain name in meta.caaIdentities")
+	}
+	if o.Policy != nil {
+		return o.Policy.Validate()
+	}
+	return nil
+}
+
+// WithProvisionerOptions sets the ACME options of the provisioners, indexed
+// by provisioner name.
+func WithProvisionerOptions(opts map[string]*ProvisionerOptions) Option {
+	return func(a *Authority) {
+		a.provOpts = opts
+	}
+}
+
+// getOptions returns the ACME options of the provisioner.
+func (a *Authority) getOptions(p provisioner.Interface) *ProvisionerOptions {
+	if o, ok := a.provOpts[p.GetName()]; ok && o != nil {
+		return o
+	}
+	return &ProvisionerOptions{}
+}
+
+// getMeta returns the directory metadata of the provisioner.
+func (o *ProvisionerOptions) getMeta() *Meta {
+	if o.Meta == nil {
+		return &Meta{}
+	}
+	return o.Meta
+}
@@ -0,0 +1,26 @@
+package acme
+
+import "testing"
+
+func TestProvisionerOptionsValidateDNSPersist01(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    ProvisionerOptions
+		wantErr bool
+	}{
+		{"disabled", ProvisionerOptions{}, false},
+		{"without issuer domain names", ProvisionerOptions{DNSPersist01: true}, true},
+		{"with empty meta", ProvisionerOptions{DNSPersist01: true, Meta: &Meta{}}, true},
+		{"with issuer domain names", ProvisionerOptions{
+			DNSPersist01: true,
+			Meta:         &Meta{CaaIdentities: []string{"ca.example.net"}},
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.opts.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
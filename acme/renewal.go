@@ -0,0 +1,132 @@
+package acme
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/authority/provisioner"
+	"github.com/smallstep/nosql"
+)
+
+// renewalInfoRetryAfter is the interval after which clients are asked to poll
+// the renewal information again.
+var renewalInfoRetryAfter = 6 * time.Hour
+
+// RenewalInfo is the ACME Renewal Information (ARI) of a certificate.
+type RenewalInfo struct {
+	SuggestedWindow RenewalWindow `json:"suggestedWindow"`
+	RetryAfter      time.Duration `json:"-"`
+}
+
+// RenewalWindow is the time window in which a certificate should be renewed.
+type RenewalWindow struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// ToLog enables response logging.
+func (ri *RenewalInfo) ToLog() (interface{}, error) {
+	b, err := json.Marshal(ri)
+	if err != nil {
+		return nil, ServerInternalErr(errors.Wrap(err, "error marshaling renewal info for logging"))
+	}
+	return string(b), nil
+}
+
+// parseRenewalInfoID parses an ARI certificate identifier; the base64url
+// encoded authority key identifier and serial number joined by a dot.
+func parseRenewalInfoID(id string) (aki []byte, serial *big.Int, err error) {
+	parts := strings.Split(id, ".")
+	if len(parts) != 2 {
+		return nil, nil, MalformedErr(errors.Errorf("invalid renewal info certificate identifier %s", id))
+	}
+	if aki, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[0], "=")); err != nil {
+		return nil, nil, MalformedErr(errors.Wrapf(err, "error decoding authority key identifier of %s", id))
+	}
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil || len(b) == 0 {
+		return nil, nil, MalformedErr(errors.Errorf("error decoding serial number of %s", id))
+	}
+	return aki, new(big.Int).SetBytes(b), nil
+}
+
+// renewalInfoNotFoundErr returns the error of a renewal info request for a
+// certificate that is unknown to the provisioner.
+func renewalInfoNotFoundErr(err error) *Error {
+	return &Error{
+		Type:   malformedErr,
+		Detail: "Certificate not found",
+		Status: 404,
+		Err:    err,
+	}
+}
+
+// getRenewalInfo returns the renewal information of the certificate with the
+// given ARI identifier, if it was issued through the provisioner. The error
+// for other certificates has status 404.
+func getRenewalInfo(db nosql.DB, p provisioner.Interface, id string) (*RenewalInfo, error) {
+	aki, serial, err := parseRenewalInfoID(id)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := getCertBySerial(db, serial.String())
+	switch {
+	case nosql.IsErrNotFound(errors.Cause(err)):
+		return nil, renewalInfoNotFoundErr(errors.Wrapf(err, "certificate %s not found", id))
+	case err != nil:
+		return nil, err
+	}
+	if err := checkProvisioner(p, cert.ProvisionerID, "certificate", id); err != nil {
+		return nil, renewalInfoNotFoundErr(err)
+	}
+	leaf, err := cert.leaf()
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(leaf.AuthorityKeyId, aki) {
+		return nil, renewalInfoNotFoundErr(errors.Errorf("certificate %s not found; "+
+			"it has a different authority key identifier", id))
+	}
+	start, end := cert.renewalWindow(leaf, clock.Now())
+	return &RenewalInfo{
+		SuggestedWindow: RenewalWindow{
+			Start: start.Format(time.RFC3339),
+			End:   end.Format(time.RFC3339),
+		},
+		RetryAfter: renewalInfoRetryAfter,
+	}, nil
+}
+
+// renewalWindow returns the suggested renewal window of a certificate.
+//
+// The window spans a twelfth of the certificate lifetime and lies between two
+// thirds and five sixths of it. Its position within that range is derived
+// from the serial number, so that certificates issued at the same time are
+// not all renewed at the same time. For certificates scheduled for
+// revocation the window starts now and ends at the revocation time.
+func (c *certificate) renewalWindow(leaf *x509.Certificate, now time.Time) (time.Time, time.Time) {
+	if at, ok := c.revokeAt(); ok && at.Before(leaf.NotAfter) {
+		if at.Before(now) {
+			return now, now
+		}
+		return now, at
+	}
+
+	lifetime := leaf.NotAfter.Sub(leaf.NotBefore)
+	width := lifetime / 12
+	var offset time.Duration
+	if width > 0 {
+		h := sha256.Sum256(leaf.SerialNumber.Bytes())
+		offset = time.Duration(binary.BigEndian.Uint64(h[:8]) % uint64(width))
+	}
+	start := leaf.NotBefore.Add(lifetime * 2 / 3).Add(offset).Truncate(time.Second)
+	return start, start.Add(width).Truncate(time.Second)
+}
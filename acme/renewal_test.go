@@ -0,0 +1,165 @@
+package acme
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/smallstep/certificates/authority/provisioner"
+)
+
+func TestParseRenewalInfoID(t *testing.T) {
+	aki := []byte{1, 2, 3, 4}
+	serial := big.NewInt(0x1234567)
+	id := base64.RawURLEncoding.EncodeToString(aki) + "." + base64.RawURLEncoding.EncodeToString(serial.Bytes())
+	padded := base64.URLEncoding.EncodeToString(aki) + "." + base64.URLEncoding.EncodeToString(serial.Bytes())
+
+	tests := []struct {
+		name string
+		id   string
+		ok   bool
+	}{
+		{"valid", id, true},
+		{"padded", padded, true},
+		{"no dot", "AQIDBA", false},
+		{"too many parts", id + ".AQ", false},
+		{"invalid key identifier", "A*B." + base64.RawURLEncoding.EncodeToString(serial.Bytes()), false},
+		{"invalid serial", "AQIDBA.A*B", false},
+		{"empty serial", "AQIDBA.", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotAKI, gotSerial, err := parseRenewalInfoID(tt.id)
+			if !tt.ok {
+				if err == nil {
+					t.Fatalf("parseRenewalInfoID(%q) error = nil", tt.id)
+				}
+				if e, ok := err.(*Error); !ok || e.Status != 400 {
+					t.Errorf("parseRenewalInfoID(%q) error = %v, want a malformed error", tt.id, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(gotAKI) != string(aki) || gotSerial.Cmp(serial) != 0 {
+				t.Errorf("parseRenewalInfoID() = %x, %v, want %x, %v", gotAKI, gotSerial, aki, serial)
+			}
+		})
+	}
+}
+
+func TestRenewalWindow(t *testing.T) {
+	notBefore := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	lifetime := 90 * 24 * time.Hour
+	notAfter := notBefore.Add(lifetime)
+	now := notBefore.Add(24 * time.Hour)
+
+	// The windows of certificates issued at the same time lie within the
+	// same range but are spread by their serial numbers.
+	starts := make(map[time.Time]bool)
+	for i := int64(1); i <= 20; i++ {
+		leaf := &x509.Certificate{SerialNumber: big.NewInt(i), NotBefore: notBefore, NotAfter: notAfter}
+		start, end := new(certificate).renewalWindow(leaf, now)
+		if min, max := notBefore.Add(lifetime*2/3), notBefore.Add(lifetime*3/4); start.Before(min) || !start.Before(max) {
+			t.Errorf("serial %d: window start %v not in [%v, %v)", i, start, min, max)
+		}
+		if end.Sub(start) != lifetime/12 {
+			t.Errorf("serial %d: window width %v, want %v", i, end.Sub(start), lifetime/12)
+		}
+		if end.After(notBefore.Add(lifetime * 5 / 6)) {
+			t.Errorf("serial %d: window end %v after five sixths of the lifetime", i, end)
+		}
+		starts[start] = true
+	}
+	if len(starts) < 15 {
+		t.Errorf("20 certificates have %d distinct windows", len(starts))
+	}
+
+	leaf := &x509.Certificate{SerialNumber: big.NewInt(1), NotBefore: notBefore, NotAfter: notAfter}
+	normalStart, normalEnd := new(certificate).renewalWindow(leaf, now)
+	at := func(t time.Time) *time.Time { return &t }
+	tests := []struct {
+		name       string
+		revokeAt   *time.Time
+		start, end time.Time
+	}{
+		{"not scheduled", nil, normalStart, normalEnd},
+		{"zero time", at(time.Time{}), normalStart, normalEnd},
+		{"scheduled", at(now.Add(48 * time.Hour)), now, now.Add(48 * time.Hour)},
+		{"scheduled in the past", at(now.Add(-time.Hour)), now, now},
+		{"scheduled after expiry", at(notAfter.Add(time.Hour)), normalStart, normalEnd},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, end := (&certificate{RevokeAt: tt.revokeAt}).renewalWindow(leaf, now)
+			if !start.Equal(tt.start) || !end.Equal(tt.end) {
+				t.Errorf("renewalWindow() = %v, %v, want %v, %v", start, end, tt.start, tt.end)
+			}
+		})
+	}
+}
+
+func TestGetRenewalInfo(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+
+	root, rootKey := newTestCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "Root"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	leaf, _ := newTestCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "www.example.com"}}, root, rootKey)
+	p := &provisioner.ACME{Type: "ACME", Name: "acme"}
+	if _, err := newCert(db, CertOptions{AccountID: "acc1", ProvisionerID: p.GetID(), Leaf: leaf}); err != nil {
+		t.Fatal(err)
+	}
+	id := func(aki []byte, serial *big.Int) string {
+		return base64.RawURLEncoding.EncodeToString(aki) + "." + base64.RawURLEncoding.EncodeToString(serial.Bytes())
+	}
+
+	tests := []struct {
+		name   string
+		p      provisioner.Interface
+		id     string
+		status int
+	}{
+		{"ok", p, id(leaf.AuthorityKeyId, leaf.SerialNumber), 0},
+		{"malformed", p, "AQIDBA", 400},
+		{"unknown serial", p, id(leaf.AuthorityKeyId, big.NewInt(42)), 404},
+		{"other authority key identifier", p, id([]byte{1, 2, 3, 4}, leaf.SerialNumber), 404},
+		{"other provisioner", &provisioner.ACME{Type: "ACME", Name: "other"}, id(leaf.AuthorityKeyId, leaf.SerialNumber), 404},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ri, err := getRenewalInfo(db, tt.p, tt.id)
+			if tt.status != 0 {
+				if e, ok := err.(*Error); !ok || e.Status != tt.status {
+					t.Errorf("getRenewalInfo() error = %v, want status %d", err, tt.status)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			start, err := time.Parse(time.RFC3339, ri.SuggestedWindow.Start)
+			if err != nil {
+				t.Fatal(err)
+			}
+			end, err := time.Parse(time.RFC3339, ri.SuggestedWindow.End)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if start.Before(leaf.NotBefore) || !end.After(start) || end.After(leaf.NotAfter) {
+				t.Errorf("suggested window [%v, %v] not within the lifetime of the certificate", start, end)
+			}
+			if ri.RetryAfter != renewalInfoRetryAfter {
+				t.Errorf("RetryAfter = %v, want %v", ri.RetryAfter, renewalInfoRetryAfter)
+			}
+		})
+	}
+}
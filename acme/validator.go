@@ -0,0 +1,421 @@
+package acme
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	retryablehttp "github.com/hashicorp/go-retryablehttp"
+	"github.com/miekg/dns"
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/authority/provisioner"
+)
+
+// resolvConf is the resolver configuration used when no resolvers are
+// configured.
+var resolvConf = "/etc/resolv.conf"
+
+// Default timeouts of the network requests made to validate challenges.
+var (
+	defaultDNSTimeout  = 5 * time.Second
+	defaultHTTPTimeout = 20 * time.Second
+)
+
+// Validator performs the network requests with which challenges are
+// validated and CAA records are checked.
+type Validator interface {
+	HTTPGet(url string) (*http.Response, error)
+	LookupTXT(name string) ([]string, error)
+	LookupCAA(name string) ([]caaRecord, error)
+}
+
+// ValidationOptions configures the networking used to validate challenges.
+type ValidationOptions struct {
+	// Resolvers are the recursive resolvers, as host:port, used for DNS
+	// lookups. If empty, the resolvers in /etc/resolv.conf are used.
+	Resolvers   []string              `json:"resolvers,omitempty"`
+	DNSTimeout  *provisioner.Duration `json:"dnsTimeout,omitempty"`
+	HTTPTimeout *provisioner.Duration `json:"httpTimeout,omitempty"`
+	// Perspectives are the vantage points every validation is corroborated
+	// from.
+	Perspectives []*PerspectiveOptions `json:"perspectives,omitempty"`
+	// Quorum is the number of perspectives that must agree with the local
+	// validation. It defaults to all of them.
+	Quorum int `json:"quorum,omitempty"`
+	// Egress restricts the connections made to validate http-01
+	// challenges.
+	Egress *EgressPolicy `json:"egress,omitempty"`
+	// MaxAttempts is the number of failed validations after which a
+	// challenge becomes invalid. It defaults to one.
+	MaxAttempts int `json:"maxAttempts,omitempty"`
+}
+
+// PerspectiveOptions configures a validation perspective.
+//
+// A perspective with a URL is a remote validation agent, started with
+// "step-ca perspective" on another network, that makes the DNS queries and
+// HTTP requests itself. Without a URL the requests are made from the CA
+// host, only through other resolvers and an HTTP proxy; such a perspective
+// does not observe the network from another vantage point unless those
+// resolvers and proxy run on another network.
+type PerspectiveOptions struct {
+	Name string `json:"name"`
+	// URL and Token are the address of the remote validation agent and
+	// the bearer token it requires.
+	URL   string `json:"url,omitempty"`
+	Token string `json:"token,omitempty"`
+	// Resolvers and HTTPProxy are the ones of a local perspective.
+	Resolvers []string `json:"resolvers,omitempty"`
+	HTTPProxy string   `json:"httpProxy,omitempty"`
+}
+
+// NewValidator returns the Validator described by the options. A nil options
+// value returns a validator using the system resolvers.
+func NewValidator(opts *ValidationOptions) (Validator, error) {
+	if opts == nil {
+		opts = &ValidationOptions{}
+	}
+	ep, err := newEgressPolicy(opts.Egress)
+	if err != nil {
+		return nil, err
+	}
+	primary, err := newNetValidator(opts.Resolvers, "", opts.DNSTimeout.Value(), opts.HTTPTimeout.Value(), ep)
+	if err != nil {
+		return nil, err
+	}
+	if len(opts.Perspectives) == 0 {
+		return primary, nil
+	}
+
+	mv := &multiPerspectiveValidator{
+		primary: primary,
+		quorum:  opts.Quorum,
+	}
+	for _, po := range opts.Perspectives {
+		if len(po.URL) > 0 {
+			if len(po.Resolvers) > 0 || len(po.HTTPProxy) > 0 {
+				return nil, errors.Errorf("validation perspective %s: url cannot be "+
+					"combined with resolvers or httpProxy", po.Name)
+			}
+			mv.perspectives = append(mv.perspectives, newRemoteValidator(po.URL, po.Token,
+				opts.DNSTimeout.Value(), opts.HTTPTimeout.Value()))
+			continue
+		}
+		v, err := newNetValidator(po.Resolvers, po.HTTPProxy, opts.DNSTimeout.Value(), opts.HTTPTimeout.Value(), ep)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error configuring validation perspective %s", po.Name)
+		}
+		mv.perspectives = append(mv.perspectives, v)
+	}
+	switch {
+	case mv.quorum == 0:
+		mv.quorum = len(mv.perspectives)
+	case mv.quorum < 0 || mv.quorum > len(mv.perspectives):
+		return nil, errors.Errorf("validation quorum must be between 1 and %d", len(mv.perspectives))
+	}
+	return mv, nil
+}
+
+// netValidator validates challenges from the local host.
+type netValidator struct {
+	resolver *dnsResolver
+	client   *retryablehttp.Client
+	egress   *egressPolicy
+}
+
+// newNetValidator returns a validator using the given resolvers and HTTP
+// proxy. The egress policy limits redirects, response sizes and the
+// addresses connected to; with a proxy, the addresses the requested hosts
+// resolve to.
+func newNetValidator(resolvers []string, proxy string, dnsTimeout, httpTimeout time.Duration, ep *egressPolicy) (*netValidator, error) {
+	if dnsTimeout == 0 {
+		dnsTimeout = defaultDNSTimeout
+	}
+	if httpTimeout == 0 {
+		httpTimeout = defaultHTTPTimeout
+	}
+	r := &dnsResolver{servers: resolvers, timeout: dnsTimeout}
+
+	dialer := &net.Dialer{Timeout: httpTimeout}
+	resolver := net.DefaultResolver
+	if len(resolvers) > 0 {
+		// Resolve the hosts of http-01 challenges with the same resolvers.
+		resolver = r.netResolver()
+		dialer.Resolver = resolver
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	var rt http.RoundTripper = transport
+	if len(proxy) > 0 {
+		u, err := url.Parse(proxy)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error parsing http proxy %s", proxy)
+		}
+		transport.Proxy = http.ProxyURL(u)
+		// The proxy may be on a denied network; the targets are checked
+		// instead of the connections.
+		rt = &proxyTransport{next: transport, resolver: resolver, egress: ep}
+	} else {
+		dialer.Control = ep.control
+	}
+
+	client := retryablehttp.NewClient()
+	client.HTTPClient = &http.Client{
+		Timeout:       httpTimeout,
+		Transport:     rt,
+		CheckRedirect: ep.checkRedirect,
+	}
+	client.RetryWaitMin = 100 * time.Millisecond
+	client.RetryWaitMax = 1 * time.Second
+	client.RetryMax = 10
+	client.CheckRetry = ep.checkRetry
+	return &netValidator{resolver: r, client: client, egress: ep}, nil
+}
+
+// HTTPGet implements the Validator interface. The response body is read
+// and bounded by the egress policy.
+func (v *netValidator) HTTPGet(url string) (*http.Response, error) {
+	resp, err := v.client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	if err := v.egress.limitBody(resp); err != nil {
+		return nil, errors.Wrapf(err, "error doing http GET for url %s", url)
+	}
+	return resp, nil
+}
+
+// LookupTXT implements the Validator interface.
+func (v *netValidator) LookupTXT(name string) ([]string, error) {
+	return v.resolver.LookupTXT(name)
+}
+
+// LookupCAA implements the Validator interface.
+func (v *netValidator) LookupCAA(name string) ([]caaRecord, error) {
+	return v.resolver.LookupCAA(name)
+}
+
+// dnsResolver queries recursive resolvers directly.
+type dnsResolver struct {
+	servers []string
+	timeout time.Duration
+}
+
+// getServers returns the configured resolvers or the system ones.
+func (r *dnsResolver) getServers() ([]string, error) {
+	if len(r.servers) > 0 {
+		return r.servers, nil
+	}
+	conf, err := dns.ClientConfigFromFile(resolvConf)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading %s", resolvConf)
+	}
+	servers := make([]string, len(conf.Servers))
+	for i, s := range conf.Servers {
+		servers[i] = net.JoinHostPort(s, conf.Port)
+	}
+	return servers, nil
+}
+
+// exchange sends a recursive query to the resolvers, in order, until one of
+// them answers. A name that does not exist is an answer without records.
+func (r *dnsResolver) exchange(name string, qtype uint16) (*dns.Msg, error) {
+	servers, err := r.getServers()
+	if err != nil {
+		return nil, err
+	}
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), qtype)
+	m.RecursionDesired = true
+
+	qname := dns.TypeToString[qtype]
+	lastErr := errors.Errorf("no resolvers configured to query %s records of %s", qname, name)
+	for _, server := range servers {
+		resp, _, err := (&dns.Client{Timeout: r.timeout}).Exchange(m, server)
+		if err == nil && resp.Truncated {
+			resp, _, err = (&dns.Client{Net: "tcp", Timeout: r.timeout}).Exchange(m, server)
+		}
+		if err != nil {
+			lastErr = errors.Wrapf(err, "error querying %s records of %s", qname, name)
+			continue
+		}
+		if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+			lastErr = errors.Errorf("error querying %s records of %s: %s", qname, name, dns.RcodeToString[resp.Rcode])
+			continue
+		}
+		return resp, nil
+	}
+	return nil, lastErr
+}
+
+// LookupTXT returns the TXT records of the given name.
+func (r *dnsResolver) LookupTXT(name string) ([]string, error) {
+	resp, err := r.exchange(name, dns.TypeTXT)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Rcode == dns.RcodeNameError {
+		return nil, errors.Errorf("no such host %s", name)
+	}
+	var records []string
+	for _, rr := range resp.Answer {
+		if txt, ok := rr.(*dns.TXT); ok {
+			var s string
+			for _, t := range txt.Txt {
+				s += t
+			}
+			records = append(records, s)
+		}
+	}
+	return records, nil
+}
+
+// LookupCAA returns the CAA records of the given name.
+func (r *dnsResolver) LookupCAA(name string) ([]caaRecord, error) {
+	resp, err := r.exchange(name, dns.TypeCAA)
+	if err != nil {
+		return nil, err
+	}
+	var records []caaRecord
+	for _, rr := range resp.Answer {
+		if caa, ok := rr.(*dns.CAA); ok {
+			records = append(records, caaRecord{Flag: caa.Flag, Tag: caa.Tag, Value: caa.Value})
+		}
+	}
+	return records, nil
+}
+
+// netResolver returns a net.Resolver that sends its queries to the
+// configured resolvers.
+func (r *dnsResolver) netResolver() *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			d := net.Dialer{Timeout: r.timeout}
+			var err error
+			for _, server := range r.servers {
+				var conn net.Conn
+				if conn, err = d.DialContext(ctx, network, server); err == nil {
+					return conn, nil
+				}
+			}
+			return nil, err
+		},
+	}
+}
+
+// multiPerspectiveValidator corroborates the results of the primary
+// validator from a number of perspectives. A result is only accepted
+// if at least quorum perspectives observe the same.
+type multiPerspectiveValidator struct {
+	primary      Validator
+	perspectives []Validator
+	quorum       int
+}
+
+// HTTPGet implements the Validator interface. The response of the primary
+// validator is returned if enough perspectives get the same status code and
+// body.
+func (v *multiPerspectiveValidator) HTTPGet(url string) (*http.Response, error) {
+	resp, err := v.primary.HTTPGet(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading response body for url %s", url)
+	}
+
+	agree := v.count(func(p Validator) bool {
+		r, err := p.HTTPGet(url)
+		if err != nil {
+			return false
+		}
+		defer r.Body.Close()
+		b, err := ioutil.ReadAll(r.Body)
+		return err == nil && r.StatusCode == resp.StatusCode && bytes.Equal(b, body)
+	})
+	if agree < v.quorum {
+		return nil, errors.Errorf("http GET for url %s corroborated by %d of %d "+
+			"perspectives, %d required", url, agree, len(v.perspectives), v.quorum)
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
+
+// LookupTXT implements the Validator interface. Only the records of the
+// primary validator that enough perspectives also see are returned.
+func (v *multiPerspectiveValidator) LookupTXT(name string) ([]string, error) {
+	records, err := v.primary.LookupTXT(name)
+	if err != nil || len(records) == 0 {
+		return records, err
+	}
+
+	var mu sync.Mutex
+	seen := make(map[string]int)
+	v.count(func(p Validator) bool {
+		rs, err := p.LookupTXT(name)
+		if err != nil {
+			return false
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		dedup := make(map[string]bool)
+		for _, r := range rs {
+			if !dedup[r] {
+				dedup[r] = true
+				seen[r]++
+			}
+		}
+		return true
+	})
+	var corroborated []string
+	for _, r := range records {
+		if seen[r] >= v.quorum {
+			corroborated = append(corroborated, r)
+		}
+	}
+	if len(corroborated) == 0 {
+		return nil, errors.Errorf("TXT records of %s not corroborated by %d of %d "+
+			"perspectives", name, v.quorum, len(v.perspectives))
+	}
+	return corroborated, nil
+}
+
+// LookupCAA implements the Validator interface. CAA records are looked up
+// by the primary validator only.
+func (v *multiPerspectiveValidator) LookupCAA(name string) ([]caaRecord, error) {
+	return v.primary.LookupCAA(name)
+}
+
+// count runs fn concurrently for every perspective and returns the number of
+// them for which it returned true.
+func (v *multiPerspectiveValidator) count(fn func(Validator) bool) int {
+	var wg sync.WaitGroup
+	results := make(chan bool, len(v.perspectives))
+	for _, p := range v.perspectives {
+		wg.Add(1)
+		go func(p Validator) {
+			defer wg.Done()
+			results <- fn(p)
+		}(p)
+	}
+	wg.Wait()
+	close(results)
+
+	var n int
+	for ok := range results {
+		if ok {
+			n++
+		}
+	}
+	return n
+}
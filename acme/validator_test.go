@@ -0,0 +1,185 @@
+package acme
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// fakeValidator answers from fixed records and HTTP bodies, failing every
+// request if err is set.
+type fakeValidator struct {
+	txt  map[string][]string
+	caa  map[string][]caaRecord
+	http map[string]string
+	err  error
+}
+
+func (v *fakeValidator) HTTPGet(url string) (*http.Response, error) {
+	if v.err != nil {
+		return nil, v.err
+	}
+	body, ok := v.http[url]
+	if !ok {
+		return &http.Response{
+			StatusCode: http.StatusNotFound,
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+		}, nil
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(bytes.NewReader([]byte(body))),
+	}, nil
+}
+
+func (v *fakeValidator) LookupTXT(name string) ([]string, error) {
+	if v.err != nil {
+		return nil, v.err
+	}
+	return v.txt[name], nil
+}
+
+func (v *fakeValidator) LookupCAA(name string) ([]caaRecord, error) {
+	if v.err != nil {
+		return nil, v.err
+	}
+	return v.caa[name], nil
+}
+
+const (
+	testTXTName = "_acme-challenge.example.com"
+	testURL     = "http://example.com/.well-known/acme-challenge/token"
+)
+
+// testPerspective returns a validator seeing the given TXT record and HTTP
+// body.
+func testPerspective(record, body string) *fakeValidator {
+	return &fakeValidator{
+		txt:  map[string][]string{testTXTName: {record}},
+		http: map[string]string{testURL: body},
+	}
+}
+
+func TestMultiPerspectiveQuorum(t *testing.T) {
+	primary := testPerspective("good", "token.thumbprint")
+	agree := testPerspective("good", "token.thumbprint")
+	disagree := testPerspective("hijacked", "token.other")
+	failing := &fakeValidator{err: errors.New("SERVFAIL")}
+
+	tests := []struct {
+		name         string
+		perspectives []Validator
+		quorum       int
+		wantErr      bool
+	}{
+		{"all agree", []Validator{agree, agree, agree}, 3, false},
+		{"quorum reached", []Validator{agree, agree, disagree}, 2, false},
+		{"quorum with failure", []Validator{agree, failing, agree}, 2, false},
+		{"quorum missed", []Validator{agree, disagree, disagree}, 2, true},
+		{"all fail", []Validator{failing, failing}, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := &multiPerspectiveValidator{
+				primary:      primary,
+				perspectives: tt.perspectives,
+				quorum:       tt.quorum,
+			}
+
+			records, err := v.LookupTXT(testTXTName)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LookupTXT() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && (len(records) != 1 || records[0] != "good") {
+				t.Errorf("LookupTXT() = %v, want [good]", records)
+			}
+
+			resp, err := v.HTTPGet(testURL)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("HTTPGet() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil {
+				body, _ := ioutil.ReadAll(resp.Body)
+				if string(body) != "token.thumbprint" {
+					t.Errorf("HTTPGet() body = %s, want token.thumbprint", body)
+				}
+			}
+		})
+	}
+}
+
+func TestMultiPerspectiveTXTOnlyCorroboratedRecords(t *testing.T) {
+	primary := &fakeValidator{txt: map[string][]string{testTXTName: {"good", "injected"}}}
+	v := &multiPerspectiveValidator{
+		primary:      primary,
+		perspectives: []Validator{testPerspective("good", ""), testPerspective("good", "")},
+		quorum:       2,
+	}
+	records, err := v.LookupTXT(testTXTName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0] != "good" {
+		t.Errorf("LookupTXT() = %v, want [good]", records)
+	}
+}
+
+func TestNewValidatorRejectsMixedPerspective(t *testing.T) {
+	_, err := NewValidator(&ValidationOptions{
+		Perspectives: []*PerspectiveOptions{{
+			Name:      "remote",
+			URL:       "https://agent.example.com",
+			Resolvers: []string{"127.0.0.1:53"},
+		}},
+	})
+	if err == nil {
+		t.Error("NewValidator() error = nil, want an error")
+	}
+}
+
+func TestPerspectiveAgentRoundTrip(t *testing.T) {
+	fv := testPerspective("good", "token.thumbprint")
+	fv.caa = map[string][]caaRecord{"example.com": {{Tag: "issue", Value: "ca.example.net"}}}
+	srv := httptest.NewServer(NewPerspectiveAgent(fv, "secret"))
+	defer srv.Close()
+
+	rv := newRemoteValidator(srv.URL, "secret", 0, 0)
+	records, err := rv.LookupTXT(testTXTName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0] != "good" {
+		t.Errorf("LookupTXT() = %v, want [good]", records)
+	}
+	caa, err := rv.LookupCAA("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(caa) != 1 || caa[0].Value != "ca.example.net" {
+		t.Errorf("LookupCAA() = %v, want the example.com records", caa)
+	}
+	resp, err := rv.HTTPGet(testURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "token.thumbprint" {
+		t.Errorf("HTTPGet() = %d %s, want 200 token.thumbprint", resp.StatusCode, body)
+	}
+
+	// Errors of the agent are errors of the perspective.
+	fv.err = errors.New("SERVFAIL")
+	if _, err := rv.LookupTXT(testTXTName); err == nil || err.Error() != "SERVFAIL" {
+		t.Errorf("LookupTXT() error = %v, want SERVFAIL", err)
+	}
+
+	// A wrong token is rejected.
+	bad := newRemoteValidator(srv.URL, "wrong", 0, 0)
+	if _, err := bad.LookupTXT(testTXTName); err == nil {
+		t.Error("LookupTXT() with a wrong token error = nil, want an error")
+	}
+}
@@ -0,0 +1,282 @@
+// Package admin implements the API used by the CA operators to inspect and
+// manage the ACME accounts, orders and certificates.
+package admin
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-ocf/step-ca/acme"
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/api"
+)
+
+// Options are the authentication options of the admin API.
+type Options struct {
+	// Token is the bearer token that authorizes requests.
+	Token string `json:"token,omitempty"`
+	// Fingerprints are the hex encoded SHA-256 fingerprints of the client
+	// certificates that authorize requests. Any certificate issued by the
+	// CA is verified by the TLS server, so the admin certificates are
+	// pinned rather than matched by name.
+	Fingerprints []string `json:"fingerprints,omitempty"`
+}
+
+// isAdmin returns true if the certificate is one of the admin ones.
+func (o *Options) isAdmin(cert *x509.Certificate) bool {
+	sum := sha256.Sum256(cert.Raw)
+	fp := hex.EncodeToString(sum[:])
+	for _, s := range o.Fingerprints {
+		if strings.ToLower(strings.Replace(s, ":", "", -1)) == fp {
+			return true
+		}
+	}
+	return false
+}
+
+// Handler is the admin request handler.
+type Handler struct {
+	Auth      acme.AdminInterface
+	Inventory InventoryInterface
+	Snapshots BackupInterface
+	opts      Options
+}
+
+// New returns a new admin API router. The inventory and snapshots may be nil
+// if the CA does not support them.
+func New(auth acme.AdminInterface, inv InventoryInterface, snapshots BackupInterface, opts Options) api.RouterHandler {
+	return &Handler{Auth: auth, Inventory: inv, Snapshots: snapshots, opts: opts}
+}
+
+// Route traffic and implement the Router interface.
+func (h *Handler) Route(r api.Router) {
+	r.MethodFunc("GET", "/admin/accounts", h.authenticate(h.ListAccounts))
+	r.MethodFunc("GET", "/admin/accounts/{id}", h.authenticate(h.GetAccount))
+	r.MethodFunc("POST", "/admin/accounts/{id}/deactivate", h.authenticate(h.DeactivateAccount))
+	r.MethodFunc("GET", "/admin/orders", h.authenticate(h.ListOrders))
+	r.MethodFunc("GET", "/admin/orders/{id}", h.authenticate(h.GetOrder))
+	r.MethodFunc("GET", "/admin/certificates", h.authenticate(h.ListCertificates))
+	r.MethodFunc("GET", "/admin/certificates/{id}", h.authenticate(h.GetCertificate))
+	r.MethodFunc("POST", "/admin/certificates/{id}/revoke", h.authenticate(h.RevokeCertificate))
+	r.MethodFunc("GET", "/admin/inventory", h.authenticate(h.FindInventory))
+	r.MethodFunc("GET", "/admin/inventory/{serial}", h.authenticate(h.GetInventoryCertificate))
+	r.MethodFunc("GET", "/admin/backup", h.authenticate(h.Backup))
+}
+
+// authenticate only lets through requests with the configured bearer token
+// or with a verified client certificate with one of the configured
+// fingerprints.
+func (h *Handler) authenticate(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if auth := r.Header.Get("Authorization"); len(auth) > 0 {
+			token := strings.TrimPrefix(auth, "Bearer ")
+			if len(h.opts.Token) > 0 && token != auth &&
+				subtle.ConstantTimeCompare([]byte(token), []byte(h.opts.Token)) == 1 {
+				next(w, r)
+				return
+			}
+			api.WriteError(w, api.Unauthorized(errors.New("invalid admin token")))
+			return
+		}
+		if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+			leaf := r.TLS.VerifiedChains[0][0]
+			if h.opts.isAdmin(leaf) {
+				next(w, r)
+				return
+			}
+			api.WriteError(w, api.Forbidden(errors.Errorf("client certificate %s is not an admin", leaf.Subject.CommonName)))
+			return
+		}
+		api.WriteError(w, api.Unauthorized(errors.New("missing admin credentials")))
+	}
+}
+
+// pagination returns the cursor and limit query parameters.
+func pagination(r *http.Request) (string, int, error) {
+	q := r.URL.Query()
+	var limit int
+	if v := q.Get("limit"); len(v) > 0 {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil {
+			return "", 0, api.BadRequest(errors.Wrapf(err, "error converting %s to integer", v))
+		}
+	}
+	return q.Get("cursor"), limit, nil
+}
+
+// ListAccountsResponse is the response of the account list.
+type ListAccountsResponse struct {
+	Accounts   []*acme.AccountRecord `json:"accounts"`
+	NextCursor string                `json:"nextCursor"`
+}
+
+// ListAccounts returns a page of the ACME accounts, optionally filtered by
+// status and contact.
+func (h *Handler) ListAccounts(w http.ResponseWriter, r *http.Request) {
+	cursor, limit, err := pagination(r)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	q := r.URL.Query()
+	accs, next, err := h.Auth.ListAccounts(acme.AccountFilter{
+		Status:  q.Get("status"),
+		Contact: q.Get("contact"),
+	}, cursor, limit)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	api.JSON(w, &ListAccountsResponse{Accounts: accs, NextCursor: next})
+}
+
+// GetAccount returns an ACME account.
+func (h *Handler) GetAccount(w http.ResponseWriter, r *http.Request) {
+	acc, err := h.Auth.GetAccountRecord(chi.URLParam(r, "id"))
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	api.JSON(w, acc)
+}
+
+// DeactivateAccount deactivates an ACME account.
+func (h *Handler) DeactivateAccount(w http.ResponseWriter, r *http.Request) {
+	acc, err := h.Auth.DeactivateAccountRecord(chi.URLParam(r, "id"))
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	api.JSON(w, acc)
+}
+
+// ListOrdersResponse is the response of the order list.
+type ListOrdersResponse struct {
+	Orders     []*acme.OrderRecord `json:"orders"`
+	NextCursor string              `json:"nextCursor"`
+}
+
+// ListOrders returns a page of the ACME orders, optionally filtered by
+// account, status and identifier.
+func (h *Handler) ListOrders(w http.ResponseWriter, r *http.Request) {
+	cursor, limit, err := pagination(r)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	q := r.URL.Query()
+	orders, next, err := h.Auth.ListOrders(acme.OrderFilter{
+		AccountID:  q.Get("account"),
+		Status:     q.Get("status"),
+		Identifier: q.Get("identifier"),
+	}, cursor, limit)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	api.JSON(w, &ListOrdersResponse{Orders: orders, NextCursor: next})
+}
+
+// GetOrder returns an ACME order.
+func (h *Handler) GetOrder(w http.ResponseWriter, r *http.Request) {
+	o, err := h.Auth.GetOrderRecord(chi.URLParam(r, "id"))
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	api.JSON(w, o)
+}
+
+// ListCertificatesResponse is the response of the certificate list.
+type ListCertificatesResponse struct {
+	Certificates []*acme.CertificateRecord `json:"certificates"`
+	NextCursor   string                    `json:"nextCursor"`
+}
+
+// ListCertificates returns a page of the certificates issued over ACME,
+// optionally filtered by account, order and DNS name. If the serial query
+// parameter is set, the certificate with that serial number is returned
+// instead.
+func (h *Handler) ListCertificates(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if serial := q.Get("serial"); len(serial) > 0 {
+		cert, err := h.Auth.GetCertificateRecordBySerial(serial)
+		if err != nil {
+			api.WriteError(w, err)
+			return
+		}
+		api.JSON(w, &ListCertificatesResponse{Certificates: []*acme.CertificateRecord{cert}})
+		return
+	}
+	cursor, limit, err := pagination(r)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	certs, next, err := h.Auth.ListCertificates(acme.CertificateFilter{
+		AccountID: q.Get("account"),
+		OrderID:   q.Get("order"),
+		DNSName:   q.Get("dnsName"),
+	}, cursor, limit)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	api.JSON(w, &ListCertificatesResponse{Certificates: certs, NextCursor: next})
+}
+
+// GetCertificate returns a certificate issued over ACME.
+func (h *Handler) GetCertificate(w http.ResponseWriter, r *http.Request) {
+	cert, err := h.Auth.GetCertificateRecord(chi.URLParam(r, "id"))
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	api.JSON(w, cert)
+}
+
+// RevokeRequest is the request body of a certificate revocation. The
+// revocation is scheduled if RevokeAt is in the future.
+type RevokeRequest struct {
+	Reason     string     `json:"reason"`
+	ReasonCode int        `json:"reasonCode"`
+	RevokeAt   *time.Time `json:"revokeAt,omitempty"`
+}
+
+// RevokeCertificate revokes a certificate issued over ACME, now or at the
+// requested time.
+func (h *Handler) RevokeCertificate(w http.ResponseWriter, r *http.Request) {
+	var body RevokeRequest
+	if r.ContentLength != 0 {
+		if err := api.ReadJSON(r.Body, &body); err != nil {
+			api.WriteError(w, err)
+			return
+		}
+	}
+	// Reason codes as defined in RFC 5280, section 5.3.1.
+	if body.ReasonCode < 0 || body.ReasonCode > 10 {
+		api.WriteError(w, api.BadRequest(errors.Errorf("reasonCode %d is not valid", body.ReasonCode)))
+		return
+	}
+	var (
+		cert *acme.CertificateRecord
+		err  error
+	)
+	if body.RevokeAt != nil && body.RevokeAt.After(time.Now()) {
+		cert, err = h.Auth.ScheduleCertificateRevocation(chi.URLParam(r, "id"), *body.RevokeAt, body.Reason, body.ReasonCode)
+	} else {
+		cert, err = h.Auth.RevokeCertificate(chi.URLParam(r, "id"), body.Reason, body.ReasonCode)
+	}
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	api.JSON(w, cert)
+}
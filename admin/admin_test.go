@@ -0,0 +1,91 @@
+package admin
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestClientCert(t *testing.T, cn string) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     []string{cn},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestAuthenticate(t *testing.T) {
+	admin := newTestClientCert(t, "admin.example.com")
+	// Same names, other certificate.
+	impostor := newTestClientCert(t, "admin.example.com")
+	sum := sha256.Sum256(admin.Raw)
+	fp := hex.EncodeToString(sum[:])
+
+	h := &Handler{opts: Options{
+		Token:        "secret",
+		Fingerprints: []string{strings.ToUpper(fp)},
+	}}
+	ok := h.authenticate(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	tests := []struct {
+		name  string
+		token string
+		cert  *x509.Certificate
+		want  int
+	}{
+		{"token", "Bearer secret", nil, http.StatusNoContent},
+		{"wrong token", "Bearer other", nil, http.StatusUnauthorized},
+		{"token without bearer", "secret", nil, http.StatusUnauthorized},
+		{"admin certificate", "", admin, http.StatusNoContent},
+		{"other certificate with the same names", "", impostor, http.StatusForbidden},
+		{"no credentials", "", nil, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/admin/accounts", nil)
+			if len(tt.token) > 0 {
+				r.Header.Set("Authorization", tt.token)
+			}
+			if tt.cert != nil {
+				r.TLS = &tls.ConnectionState{
+					PeerCertificates: []*x509.Certificate{tt.cert},
+					VerifiedChains:   [][]*x509.Certificate{{tt.cert}},
+				}
+			}
+			w := httptest.NewRecorder()
+			ok(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,41 @@
+package admin
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+
+	"github.com/go-ocf/step-ca/backup"
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/api"
+)
+
+// BackupInterface takes consistent snapshots of the CA database.
+type BackupInterface interface {
+	Backup() (*backup.Archive, error)
+}
+
+// Backup returns an archive with a consistent snapshot of the database
+// tables of the running CA.
+func (h *Handler) Backup(w http.ResponseWriter, r *http.Request) {
+	if h.Snapshots == nil {
+		api.WriteError(w, api.NotImplemented(errors.New("the CA does not support online backups")))
+		return
+	}
+	a, err := h.Snapshots.Backup()
+	if err != nil {
+		api.WriteError(w, api.InternalServerError(err))
+		return
+	}
+	// Errors cannot be reported once the body is written.
+	var buf bytes.Buffer
+	if err := a.Write(&buf); err != nil {
+		api.WriteError(w, api.InternalServerError(err))
+		return
+	}
+	name := fmt.Sprintf("step-ca-%s.tar.gz", a.Manifest.Created.Format("20060102T150405Z"))
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	w.Header().Set("Last-Modified", a.Manifest.Created.UTC().Format(http.TimeFormat))
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,116 @@
+package admin
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/go-ocf/step-ca/inventory"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/api"
+	"github.com/smallstep/nosql"
+)
+
+// InventoryInterface is the interface of the certificate inventory queries.
+type InventoryInterface interface {
+	Find(inventory.Query, string, int) ([]*inventory.Certificate, string, error)
+	Get(string) (*inventory.Certificate, error)
+}
+
+// FindInventoryResponse is the response of an inventory query.
+type FindInventoryResponse struct {
+	Certificates []*inventory.Certificate `json:"certificates"`
+	NextCursor   string                   `json:"nextCursor"`
+}
+
+// parseTime parses an RFC 3339 time query parameter.
+func parseTime(v string) (time.Time, error) {
+	if len(v) == 0 {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, api.BadRequest(errors.Wrapf(err, "error parsing time %s", v))
+	}
+	return t, nil
+}
+
+// FindInventory returns a page of the issued certificates matching the
+// query parameters device, subject, provisioner, account, status,
+// expiresAfter, expiresBefore and expiresWithin; the latter a duration from
+// now.
+func (h *Handler) FindInventory(w http.ResponseWriter, r *http.Request) {
+	if h.Inventory == nil {
+		api.WriteError(w, api.NotImplemented(errors.New("certificate inventory requires a database")))
+		return
+	}
+	cursor, limit, err := pagination(r)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	q := r.URL.Query()
+	query := inventory.Query{
+		Subject:     q.Get("subject"),
+		DeviceID:    q.Get("device"),
+		Provisioner: q.Get("provisioner"),
+		AccountID:   q.Get("account"),
+		Status:      q.Get("status"),
+	}
+	if len(query.DeviceID) > 0 {
+		if _, err := uuid.Parse(query.DeviceID); err != nil {
+			api.WriteError(w, api.BadRequest(errors.Wrapf(err, "device %s is not a valid UUID", query.DeviceID)))
+			return
+		}
+	}
+	switch query.Status {
+	case "", inventory.StatusValid, inventory.StatusExpired, inventory.StatusRevoked:
+	default:
+		api.WriteError(w, api.BadRequest(errors.Errorf("status %s is not valid", query.Status)))
+		return
+	}
+	if query.ExpiresAfter, err = parseTime(q.Get("expiresAfter")); err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	if query.ExpiresBefore, err = parseTime(q.Get("expiresBefore")); err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	if v := q.Get("expiresWithin"); len(v) > 0 {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			api.WriteError(w, api.BadRequest(errors.Wrapf(err, "error parsing duration %s", v)))
+			return
+		}
+		now := time.Now()
+		query.ExpiresAfter, query.ExpiresBefore = now, now.Add(d)
+	}
+
+	certs, next, err := h.Inventory.Find(query, cursor, limit)
+	if err != nil {
+		api.WriteError(w, api.InternalServerError(err))
+		return
+	}
+	api.JSON(w, &FindInventoryResponse{Certificates: certs, NextCursor: next})
+}
+
+// GetInventoryCertificate returns the issued certificate with the given
+// serial number.
+func (h *Handler) GetInventoryCertificate(w http.ResponseWriter, r *http.Request) {
+	if h.Inventory == nil {
+		api.WriteError(w, api.NotImplemented(errors.New("certificate inventory requires a database")))
+		return
+	}
+	cert, err := h.Inventory.Get(chi.URLParam(r, "serial"))
+	if err != nil {
+		if nosql.IsErrNotFound(errors.Cause(err)) {
+			api.WriteError(w, api.NotFound(err))
+		} else {
+			api.WriteError(w, api.InternalServerError(err))
+		}
+		return
+	}
+	api.JSON(w, cert)
+}
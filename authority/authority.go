@@ -4,7 +4,14 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
-
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/go-ocf/step-ca/events"
+	"github.com/go-ocf/step-ca/inventory"
+	"github.com/pkg/errors"
 	"github.com/smallstep/certificates/authority"
 	stepAuthority "github.com/smallstep/certificates/authority"
 	stepProvisioner "github.com/smallstep/certificates/authority/provisioner"
@@ -12,6 +19,7 @@ import (
 	"github.com/smallstep/cli/crypto/pemutil"
 	"github.com/smallstep/cli/crypto/tlsutil"
 	"github.com/smallstep/cli/crypto/x509util"
+	"github.com/smallstep/nosql"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -24,6 +32,16 @@ type Authority struct {
 	config               *Config
 	stepAuth             *stepAuthority.Authority
 	intermediateIdentity *x509util.Identity
+	alternateChains      [][]*x509.Certificate
+	manufacturerRoots    []*x509.Certificate
+	inventory            *inventory.Store
+	eventSinks           []events.Sink
+	policyHook           *policyHook
+	events               *events.Bus
+	issuers              issuerGroup
+	namedIssuers         map[string]issuerGroup
+	issuerNames          []string
+	provisionerIssuers   map[string]string
 }
 
 type Option interface{}
@@ -33,25 +51,45 @@ type WrapperOption func(*Authority)
 
 // WithDatabase sets an already initialized authority database to a new
 // authority. This option is intended to be use on graceful reloads.
-func WithDatabase(db db.AuthDB) stepAuthority.Option {
-	return stepAuthority.WithDatabase(db)
+func WithDatabase(db db.AuthDB) Option {
+	return databaseOption{db: db}
 }
 
 // New creates and initiates a new Authority type.
 func New(config *Config, opts ...Option) (*Authority, error) {
 	var stepOpts []stepAuthority.Option
 	var wrapOpts []WrapperOption
+	var authDB db.AuthDB
 	for _, o := range opts {
 		switch v := o.(type) {
 		case WrapperOption:
 			wrapOpts = append(wrapOpts, v)
+		case databaseOption:
+			authDB = v.db
 		case stepAuthority.Option:
 			stepOpts = append(stepOpts, v)
 		}
 	}
 
+	// The authority opens the configured database itself to take snapshots
+	// of it.
+	var owned *ownedDB
+	if authDB == nil && config.DB != nil {
+		var err error
+		if owned, err = openOwnedDB(config.DB); err != nil {
+			return nil, err
+		}
+		authDB = owned
+	}
+	if authDB != nil {
+		stepOpts = append(stepOpts, stepAuthority.WithDatabase(authDB))
+	}
+
 	stepAuth, err := stepAuthority.New(config.Config, stepOpts...)
 	if err != nil {
+		if owned != nil {
+			owned.Shutdown()
+		}
 		return nil, err
 	}
 
@@ -74,11 +112,124 @@ func New(config *Config, opts ...Option) (*Authority, error) {
 		}
 	}
 
-	return &Authority{
+	var alternateChains [][]*x509.Certificate
+	if config.ACME != nil {
+		for _, files := range config.ACME.AlternateChains {
+			var chain []*x509.Certificate
+			for _, fn := range files {
+				certs, err := pemutil.ReadCertificateBundle(fn)
+				if err != nil {
+					return nil, err
+				}
+				chain = append(chain, certs...)
+			}
+			if len(chain) == 0 {
+				return nil, errors.New("acme.alternateChains cannot contain an empty chain")
+			}
+			alternateChains = append(alternateChains, chain)
+		}
+	}
+
+	var manufacturerRoots []*x509.Certificate
+	if config.ACME != nil {
+		for name, o := range config.ACME.Provisioners {
+			if o == nil {
+				continue
+			}
+			if err := o.Validate(); err != nil {
+				return nil, errors.Wrapf(err, "invalid acme options of provisioner %s", name)
+			}
+		}
+		for _, fn := range config.ACME.ManufacturerRoots {
+			certs, err := pemutil.ReadCertificateBundle(fn)
+			if err != nil {
+				return nil, err
+			}
+			manufacturerRoots = append(manufacturerRoots, certs...)
+		}
+	}
+
+	// The inventory requires a nosql database.
+	var inv *inventory.Store
+	if db, ok := stepAuth.GetDatabase().(nosql.DB); ok {
+		if inv, err = inventory.New(db); err != nil {
+			return nil, err
+		}
+		if err := db.CreateTable(crlTable); err != nil {
+			return nil, errors.Wrapf(err, "error creating table %s", crlTable)
+		}
+	}
+
+	// The configured crt and key are the main intermediate.
+	issuers, err := loadIssuerGroup(config.Config, &issuer{identity: intermediateIdentity, stepAuth: stepAuth}, config.Intermediates)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &Authority{
 		config:               config,
 		stepAuth:             stepAuth,
 		intermediateIdentity: intermediateIdentity,
-	}, nil
+		alternateChains:      alternateChains,
+		manufacturerRoots:    manufacturerRoots,
+		inventory:            inv,
+		issuers:              issuers,
+	}
+	if err := a.loadNamedIssuers(config, stepAuth); err != nil {
+		return nil, err
+	}
+	for _, o := range wrapOpts {
+		o(a)
+	}
+
+	if config.IssuancePolicy != nil {
+		if a.policyHook, err = newPolicyHook(config.IssuancePolicy); err != nil {
+			return nil, err
+		}
+	}
+
+	sinks := a.eventSinks
+	if config.Events != nil {
+		for _, o := range config.Events.Webhooks {
+			w, err := events.NewWebhook(o)
+			if err != nil {
+				return nil, err
+			}
+			sinks = append(sinks, w)
+		}
+	}
+	a.events = events.NewBus(sinks...)
+
+	return a, nil
+}
+
+// WithEventSinks adds sinks the events of the authority are delivered to,
+// next to the configured webhooks.
+func WithEventSinks(sinks ...events.Sink) WrapperOption {
+	return func(a *Authority) {
+		a.eventSinks = append(a.eventSinks, sinks...)
+	}
+}
+
+// GetEventBus returns the bus the issuance lifecycle events are published to.
+func (a *Authority) GetEventBus() *events.Bus {
+	return a.events
+}
+
+// GetAlternateChains returns the configured alternate certificate chains.
+func (a *Authority) GetAlternateChains() [][]*x509.Certificate {
+	return a.alternateChains
+}
+
+// GetManufacturerRoots returns the configured device manufacturer roots.
+func (a *Authority) GetManufacturerRoots() []*x509.Certificate {
+	return a.manufacturerRoots
+}
+
+// GetInventory returns the issued certificate inventory, nil if the
+// database does not support it.
+func (a *Authority) GetInventory() *inventory.Store {
+	return a.inventory
 }
 
 // GetDatabase returns the authority database. If the configuration does not
@@ -89,15 +240,28 @@ func (a *Authority) GetDatabase() db.AuthDB {
 
 // Shutdown safely shuts down any clients, databases, etc. held by the Authority.
 func (a *Authority) Shutdown() error {
+	a.events.Close()
 	return a.stepAuth.Shutdown()
 }
 
+// Authorize authorizes a token. The sign options of the sign method carry
+// the name of the provisioner of the token.
 func (a *Authority) Authorize(ctx context.Context, ott string) ([]stepProvisioner.SignOption, error) {
-	return a.stepAuth.Authorize(ctx, ott)
+	signOpts, err := a.stepAuth.Authorize(ctx, ott)
+	if err != nil || stepProvisioner.MethodFromContext(ctx) != stepProvisioner.SignMethod {
+		return signOpts, err
+	}
+	return append(signOpts, inventory.Provisioner(signOptionsProvisioner(signOpts))), nil
 }
 
+// AuthorizeSign authorizes a sign token. The sign options carry the name of
+// the provisioner of the token.
 func (a *Authority) AuthorizeSign(ott string) ([]stepProvisioner.SignOption, error) {
-	return a.stepAuth.AuthorizeSign(ott)
+	signOpts, err := a.stepAuth.AuthorizeSign(ott)
+	if err != nil {
+		return nil, err
+	}
+	return append(signOpts, inventory.Provisioner(signOptionsProvisioner(signOpts))), nil
 }
 
 func (a *Authority) GetTLSOptions() *tlsutil.TLSOptions {
@@ -105,18 +269,91 @@ func (a *Authority) GetTLSOptions() *tlsutil.TLSOptions {
 }
 
 func (a *Authority) Root(shasum string) (*x509.Certificate, error) {
-	return a.stepAuth.Root(shasum)
+	crt, err := a.stepAuth.Root(shasum)
+	if err != nil {
+		if r, ok := a.namedRoot(shasum); ok {
+			return r, nil
+		}
+	}
+	return crt, err
 }
 
 func (a *Authority) Sign(cr *x509.CertificateRequest, opts stepProvisioner.Options, signOpts ...stepProvisioner.SignOption) (*x509.Certificate, *x509.Certificate, error) {
-	if a.isOCF(signOpts) {
-		return a.OCFSign(cr, opts, signOpts...)
+	// The account ID is only used by the inventory, and the provisioner name
+	// selects the issuer.
+	var (
+		accountID       inventory.AccountID
+		provisionerName inventory.Provisioner
+	)
+	filtered := signOpts[:0:0]
+	for _, o := range signOpts {
+		switch v := o.(type) {
+		case inventory.AccountID:
+			accountID = v
+		case inventory.Provisioner:
+			provisionerName = v
+		default:
+			filtered = append(filtered, o)
+		}
+	}
+
+	var (
+		leaf, issuer *x509.Certificate
+		err          error
+	)
+	if a.isOCF(filtered) {
+		leaf, issuer, err = a.ocfSign(cr, opts, string(accountID), string(provisionerName), filtered...)
+	} else {
+		iss := a.issuerFor(string(provisionerName))
+		leaf, issuer, err = iss.stepAuth.Sign(cr, opts, filtered...)
+	}
+	if err != nil {
+		return nil, nil, err
 	}
-	return a.stepAuth.Sign(cr, opts, signOpts...)
+	a.addToInventory(leaf, string(accountID))
+	a.publishIssued(leaf, string(accountID))
+	return leaf, issuer, nil
 }
 
 func (a *Authority) Renew(peer *x509.Certificate) (*x509.Certificate, *x509.Certificate, error) {
-	return a.stepAuth.Renew(peer)
+	leaf, issuer, err := a.issuerFor(inventory.ProvisionerName(peer)).stepAuth.Renew(peer)
+	if err != nil {
+		return nil, nil, err
+	}
+	var accountID string
+	if a.inventory != nil {
+		if c, err := a.inventory.Get(peer.SerialNumber.String()); err == nil {
+			accountID = c.AccountID
+		}
+	}
+	a.addToInventory(leaf, accountID)
+	a.publishIssued(leaf, accountID)
+	return leaf, issuer, nil
+}
+
+// publishIssued publishes the cert.issued event of a certificate.
+func (a *Authority) publishIssued(cert *x509.Certificate, accountID string) {
+	a.events.Publish(events.CertIssued, &events.CertificateData{
+		Serial:    cert.SerialNumber.String(),
+		Subject:   cert.Subject.CommonName,
+		DNSNames:  cert.DNSNames,
+		NotBefore: cert.NotBefore,
+		NotAfter:  cert.NotAfter,
+		AccountID: accountID,
+	})
+}
+
+// addToInventory adds an issued certificate to the inventory, if any. The
+// certificate is valid whether it is in the inventory or not, so a failure
+// is only logged; failing the request would hide a certificate that has been
+// issued.
+func (a *Authority) addToInventory(cert *x509.Certificate, accountID string) {
+	if a.inventory == nil {
+		return
+	}
+	if err := a.inventory.Add(cert, accountID); err != nil {
+		log.Printf("error adding certificate %s to the inventory: %v", cert.SerialNumber, err)
+	}
 }
 
 func (a *Authority) LoadProvisionerByCertificate(c *x509.Certificate) (stepProvisioner.Interface, error) {
@@ -131,16 +368,42 @@ func (a *Authority) GetProvisioners(cursor string, limit int) (stepProvisioner.L
 	return a.stepAuth.GetProvisioners(cursor, limit)
 }
 
+// Revoke revokes a certificate. The certificate, if given, must have been
+// issued by one of the intermediates of the authority, rotated out or not,
+// so that its revocation is listed in the CRL of that intermediate.
 func (a *Authority) Revoke(opts *authority.RevokeOptions) error {
-	return a.stepAuth.Revoke(opts)
+	if opts.Crt != nil {
+		if _, err := a.GetIssuer(opts.Crt); err != nil {
+			return &apiError{err, http.StatusBadRequest, apiCtx{"serial": opts.Serial}}
+		}
+	}
+	if err := a.stepAuth.Revoke(opts); err != nil {
+		return err
+	}
+	if a.inventory != nil {
+		if err := a.inventory.Revoke(opts.Serial, opts.Reason); err != nil {
+			return &apiError{err, http.StatusInternalServerError, apiCtx{"serial": opts.Serial}}
+		}
+	}
+	a.events.Publish(events.CertRevoked, &events.RevocationData{
+		Serial:     opts.Serial,
+		Reason:     opts.Reason,
+		ReasonCode: opts.ReasonCode,
+	})
+	return nil
 }
 
 func (a *Authority) GetEncryptedKey(kid string) (string, error) {
 	return a.stepAuth.GetEncryptedKey(kid)
 }
 
+// GetRoots returns the roots of the authority and of its named issuers.
 func (a *Authority) GetRoots() (federation []*x509.Certificate, err error) {
-	return a.stepAuth.GetRoots()
+	roots, err := a.stepAuth.GetRoots()
+	if err != nil {
+		return nil, err
+	}
+	return appendRoots(roots, a.namedRoots()...), nil
 }
 
 func (a *Authority) GetFederation() ([]*x509.Certificate, error) {
@@ -148,13 +411,16 @@ func (a *Authority) GetFederation() ([]*x509.Certificate, error) {
 }
 
 func (a *Authority) GetTLSCertificate() (*tls.Certificate, error) {
-	return a.stepAuth.GetTLSCertificate()
+	return a.issuers.active().stepAuth.GetTLSCertificate()
 }
 
 func (a *Authority) SignSSH(key ssh.PublicKey, opts stepProvisioner.SSHOptions, signOpts ...stepProvisioner.SignOption) (*ssh.Certificate, error) {
 	return a.stepAuth.SignSSH(key, opts, signOpts)
 }
 
+// GetRootCertificates returns the roots of the authority. The roots of the
+// named issuers are only served by GetRoots and Root, they are not trusted
+// to authenticate clients.
 func (a *Authority) GetRootCertificates() []*x509.Certificate {
 	return a.stepAuth.GetRootCertificates()
 }
@@ -163,12 +429,21 @@ func (a *Authority) SignSSHAddUser(key ssh.PublicKey, subject *ssh.Certificate)
 	return a.stepAuth.SignSSHAddUser(key, subject)
 }
 
+// LoadConfiguration parses the given filename in JSON format and returns the
+// configuration struct.
 func LoadConfiguration(filename string) (*Config, error) {
-	config, err := stepAuthority.LoadConfiguration(filename)
+	f, err := os.Open(filename)
 	if err != nil {
-		return nil, err
+		return nil, errors.Wrapf(err, "error opening %s", filename)
+	}
+	defer f.Close()
+
+	var c Config
+	if err := json.NewDecoder(f).Decode(&c); err != nil {
+		return nil, errors.Wrapf(err, "error parsing %s", filename)
+	}
+	if c.Config == nil {
+		c.Config = new(stepAuthority.Config)
 	}
-	return &Config{
-		Config: config,
-	}, nil
+	return &c, nil
 }
@@ -0,0 +1,101 @@
+package authority
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/go-ocf/step-ca/inventory"
+	"github.com/pkg/errors"
+	stepProvisioner "github.com/smallstep/certificates/authority/provisioner"
+	"github.com/smallstep/nosql"
+	"github.com/smallstep/nosql/database"
+)
+
+// failingUpdateDB fails all the transactions.
+type failingUpdateDB struct {
+	nosql.DB
+}
+
+func (failingUpdateDB) Update(*database.Tx) error {
+	return errors.New("force")
+}
+
+func TestSignInventory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authority")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p, key := newTestJWK(t, "default")
+	iss := newTestIssuer(t, dir, p)
+
+	csrKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: "ca.example.com"},
+		DNSNames: []string{"ca.example.com"},
+	}, csrKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		fail bool
+	}{
+		{"ok", false},
+		{"inventory failure", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, cleanup := newTestDatabase(t)
+			defer cleanup()
+			store, err := inventory.New(db)
+			if err != nil {
+				t.Fatal(err)
+			}
+			a := &Authority{stepAuth: iss.stepAuth, issuers: issuerGroup{iss}, inventory: store}
+			if tt.fail {
+				if a.inventory, err = inventory.New(failingUpdateDB{db}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			signOpts, err := a.AuthorizeSign(newTestToken(t, "default", key))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// A certificate that has been issued is returned even if it
+			// could not be added to the inventory.
+			leaf, _, err := a.Sign(csr, stepProvisioner.Options{}, append(signOpts, inventory.AccountID("acc1"))...)
+			if err != nil {
+				t.Fatalf("Sign() error = %v", err)
+			}
+			c, err := store.Get(leaf.SerialNumber.String())
+			if tt.fail {
+				if err == nil {
+					t.Error("inventory contains a certificate that failed to be added")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.AccountID != "acc1" || c.Provisioner != "default" {
+				t.Errorf("inventory certificate = %+v", c)
+			}
+		})
+	}
+}
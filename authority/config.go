@@ -1,7 +1,67 @@
 package authority
 
-import stepAuthority "github.com/smallstep/certificates/authority"
+import (
+	"github.com/go-ocf/step-ca/acme"
+	"github.com/go-ocf/step-ca/admin"
+	"github.com/go-ocf/step-ca/est"
+	"github.com/go-ocf/step-ca/events"
+	stepAuthority "github.com/smallstep/certificates/authority"
+)
 
+// Config represents the CA configuration. It extends the step-ca
+// configuration with the attributes specific to this CA; both are read from
+// the same JSON object.
 type Config struct {
 	*stepAuthority.Config
+	ACME   *ACMEConfig    `json:"acme,omitempty"`
+	Admin  *admin.Options `json:"admin,omitempty"`
+	Events *EventsConfig  `json:"events,omitempty"`
+	// IssuancePolicy is the webhook consulted before signing OCF identity
+	// certificates.
+	IssuancePolicy *PolicyHookOptions `json:"issuancePolicy,omitempty"`
+	// Intermediates are the intermediate CAs rotated in next to the one of
+	// the crt and key attributes.
+	Intermediates []*IntermediateConfig `json:"intermediates,omitempty"`
+	// Issuers are the named issuing CAs the provisioners can be bound to.
+	Issuers map[string]*IssuerConfig `json:"issuers,omitempty"`
+	// EST configures the enrollment of certificates over CoAP.
+	EST *est.Options `json:"est,omitempty"`
+}
+
+// ACMEConfig contains the configuration of the ACME server.
+type ACMEConfig struct {
+	// AlternateChains is a list of alternate certificate chains offered to
+	// ACME clients next to the default one. Each chain is a list of PEM
+	// files, the first one containing an intermediate cross-signed by
+	// another root.
+	AlternateChains [][]string `json:"alternateChains,omitempty"`
+	// Provisioners holds the ACME options of the provisioners, keyed by the
+	// provisioner name.
+	Provisioners map[string]*acme.ProvisionerOptions `json:"provisioners,omitempty"`
+	// ManufacturerRoots are the PEM files with the device manufacturer root
+	// certificates device-attest-01 attestations must chain to.
+	ManufacturerRoots []string `json:"manufacturerRoots,omitempty"`
+	// Validation configures the networking used to validate challenges.
+	Validation *acme.ValidationOptions `json:"validation,omitempty"`
+	// Nonces configures the service issuing the replay nonces.
+	Nonces *acme.NonceOptions `json:"nonces,omitempty"`
+	// URLs configures the external URLs of the ACME server. By default the
+	// links point to the first DNS name and the port of the CA.
+	URLs *acme.URLOptions `json:"urls,omitempty"`
+	// InsecureAddress is the address of an additional listener serving the
+	// ACME endpoints, and only those, over plain HTTP, e.g. ":8080" or
+	// "unix:/run/step-ca/acme.sock". It is meant for the clients behind a
+	// gateway that terminates TLS, and disabled if empty.
+	InsecureAddress string `json:"insecureAddress,omitempty"`
+	// LegacyProvisioner is the ID of the ACME provisioner, e.g.
+	// "acme/my-acme", the records stored before they were scoped to their
+	// provisioner are assigned to on migration. The CA does not start with
+	// such records if it is empty.
+	LegacyProvisioner string `json:"legacyProvisioner,omitempty"`
+}
+
+// EventsConfig configures the delivery of the issuance lifecycle events.
+type EventsConfig struct {
+	// Webhooks are the webhooks the events are posted to.
+	Webhooks []*events.WebhookOptions `json:"webhooks,omitempty"`
 }
@@ -0,0 +1,176 @@
+package authority
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"time"
+
+	"github.com/go-ocf/step-ca/backup"
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/db"
+	"github.com/smallstep/cli/crypto/x509util"
+	"github.com/smallstep/nosql"
+	"github.com/smallstep/nosql/database"
+)
+
+var (
+	crlTable          = []byte("crls")
+	certsTable        = []byte("x509_certs")
+	revokedCertsTable = []byte("revoked_x509_certs")
+)
+
+// CRLLifetime is the time a generated CRL is valid for. CRLs must be
+// generated again before they expire.
+const CRLLifetime = 24 * time.Hour
+
+// crlRecord is the latest CRL of an intermediate.
+type crlRecord struct {
+	Number     int64     `json:"number"`
+	ThisUpdate time.Time `json:"thisUpdate"`
+	NextUpdate time.Time `json:"nextUpdate"`
+	DER        []byte    `json:"der"`
+}
+
+// crlID returns the identifier of the CRL of an intermediate; the SHA-256
+// fingerprint of its certificate.
+func crlID(crt *x509.Certificate) string {
+	return backup.Fingerprint(crt)
+}
+
+// GenerateCRLs generates and stores the CRL of every intermediate of the
+// authority, with the unexpired certificates it issued that have been
+// revoked.
+func (a *Authority) GenerateCRLs() error {
+	d, ok := a.GetDatabase().(nosql.DB)
+	if !ok {
+		return errors.New("the authority database does not support CRLs")
+	}
+	return a.generateCRLs(d, time.Now().UTC())
+}
+
+func (a *Authority) generateCRLs(d nosql.DB, now time.Time) error {
+	entries, err := d.List(revokedCertsTable)
+	if err != nil && !database.IsErrNotFound(errors.Cause(err)) {
+		return errors.Wrap(err, "error listing revoked certificates")
+	}
+
+	revoked := make(map[*x509util.Identity][]x509.RevocationListEntry)
+	for _, e := range entries {
+		var rci db.RevokedCertificateInfo
+		if err := json.Unmarshal(e.Value, &rci); err != nil {
+			return errors.Wrapf(err, "error unmarshaling revoked certificate %s", e.Key)
+		}
+		// Certificates not stored by the authority cannot be attributed to
+		// an intermediate.
+		der, err := d.Get(certsTable, e.Key)
+		switch {
+		case database.IsErrNotFound(errors.Cause(err)):
+			continue
+		case err != nil:
+			return errors.Wrapf(err, "error loading certificate %s", e.Key)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return errors.Wrapf(err, "error parsing certificate %s", e.Key)
+		}
+		if now.After(cert.NotAfter) {
+			continue
+		}
+		iss, err := a.GetIssuer(cert)
+		if err != nil {
+			continue
+		}
+		revoked[iss] = append(revoked[iss], x509.RevocationListEntry{
+			SerialNumber:   cert.SerialNumber,
+			RevocationTime: rci.RevokedAt,
+			ReasonCode:     rci.ReasonCode,
+		})
+	}
+
+	for _, g := range a.groups() {
+		for _, iss := range g {
+			if err := a.storeCRL(d, iss.identity, revoked[iss.identity], now); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// storeCRL signs and stores the next CRL of the intermediate.
+func (a *Authority) storeCRL(d nosql.DB, iss *x509util.Identity, entries []x509.RevocationListEntry, now time.Time) error {
+	id := crlID(iss.Crt)
+	signer, ok := iss.Key.(crypto.Signer)
+	if !ok {
+		return errors.Errorf("the key of intermediate %s cannot sign CRLs", id)
+	}
+	old, err := d.Get(crlTable, []byte(id))
+	var prev crlRecord
+	switch {
+	case database.IsErrNotFound(errors.Cause(err)):
+		old = nil
+	case err != nil:
+		return errors.Wrapf(err, "error loading CRL %s", id)
+	default:
+		if err := json.Unmarshal(old, &prev); err != nil {
+			return errors.Wrapf(err, "error unmarshaling CRL %s", id)
+		}
+	}
+
+	rec := crlRecord{
+		Number:     prev.Number + 1,
+		ThisUpdate: now,
+		NextUpdate: now.Add(CRLLifetime),
+	}
+	if rec.DER, err = x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(rec.Number),
+		ThisUpdate:                rec.ThisUpdate,
+		NextUpdate:                rec.NextUpdate,
+		RevokedCertificateEntries: entries,
+	}, iss.Crt, signer); err != nil {
+		return errors.Wrapf(err, "error creating CRL %s", id)
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return errors.Wrapf(err, "error marshaling CRL %s", id)
+	}
+	_, swapped, err := d.CmpAndSwap(crlTable, []byte(id), old, b)
+	switch {
+	case err != nil:
+		return errors.Wrapf(err, "error storing CRL %s", id)
+	case !swapped:
+		return errors.Errorf("error storing CRL %s; value has changed since last read", id)
+	}
+	return nil
+}
+
+// GetCRL returns the DER encoded CRL of the intermediate with the given
+// SHA-256 fingerprint, or of the active intermediate if the fingerprint is
+// empty.
+func (a *Authority) GetCRL(fingerprint string) ([]byte, error) {
+	d, ok := a.GetDatabase().(nosql.DB)
+	if !ok {
+		return nil, &apiError{errors.New("the authority database does not support CRLs"), http.StatusNotImplemented, apiCtx{}}
+	}
+	id := fingerprint
+	if len(id) == 0 {
+		id = crlID(a.GetActiveIntermediate())
+	}
+	b, err := d.Get(crlTable, bytes.ToLower([]byte(id)))
+	switch {
+	case database.IsErrNotFound(errors.Cause(err)):
+		return nil, &apiError{errors.Errorf("CRL %s not found", id), http.StatusNotFound, apiCtx{"fingerprint": id}}
+	case err != nil:
+		return nil, &apiError{errors.Wrapf(err, "error loading CRL %s", id), http.StatusInternalServerError, apiCtx{"fingerprint": id}}
+	}
+	var rec crlRecord
+	if err := json.Unmarshal(b, &rec); err != nil {
+		return nil, &apiError{errors.Wrapf(err, "error unmarshaling CRL %s", id), http.StatusInternalServerError, apiCtx{"fingerprint": id}}
+	}
+	return rec.DER, nil
+}
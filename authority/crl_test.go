@@ -0,0 +1,146 @@
+package authority
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-ocf/step-ca/kvdb"
+	"github.com/smallstep/certificates/db"
+	"github.com/smallstep/cli/crypto/x509util"
+	"github.com/smallstep/nosql"
+)
+
+// newTestIdentity returns a certificate signed by the parent, or self
+// signed if the parent is nil, and its key.
+func newTestIdentity(t *testing.T, serial int64, notAfter time.Time, parent *x509util.Identity) *x509util.Identity {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: "test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+	signer, issuer := key, tmpl
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	} else {
+		signer, issuer = parent.Key.(*ecdsa.PrivateKey), parent.Crt
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, issuer, key.Public(), signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crt, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &x509util.Identity{Crt: crt, Key: key}
+}
+
+func newTestDatabase(t *testing.T) (nosql.DB, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "authority")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := kvdb.New(kvdb.BoltDriver, filepath.Join(dir, "ca.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	for _, table := range [][]byte{certsTable, revokedCertsTable, crlTable} {
+		if err := d.CreateTable(table); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return d, func() {
+		d.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestGenerateCRLs(t *testing.T) {
+	d, cleanup := newTestDatabase(t)
+	defer cleanup()
+
+	now := time.Now().UTC()
+	main := newTestIdentity(t, 1, now.Add(24*time.Hour), nil)
+	next := newTestIdentity(t, 2, now.Add(24*time.Hour), nil)
+	a := &Authority{issuers: issuerGroup{{identity: main}, {identity: next}}}
+
+	revoke := func(leaf *x509util.Identity, reasonCode int) {
+		t.Helper()
+		serial := leaf.Crt.SerialNumber.String()
+		if err := d.Set(certsTable, []byte(serial), leaf.Crt.Raw); err != nil {
+			t.Fatal(err)
+		}
+		b, err := json.Marshal(db.RevokedCertificateInfo{Serial: serial, ReasonCode: reasonCode, RevokedAt: now})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Set(revokedCertsTable, []byte(serial), b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	revoke(newTestIdentity(t, 10, now.Add(time.Hour), main), 1)
+	revoke(newTestIdentity(t, 11, now.Add(-time.Minute), main), 1)
+	revoke(newTestIdentity(t, 12, now.Add(time.Hour), next), 4)
+
+	tests := []struct {
+		issuer  *x509util.Identity
+		serials []int64
+	}{
+		{main, []int64{10}},
+		{next, []int64{12}},
+	}
+	for round := int64(1); round <= 2; round++ {
+		if err := a.generateCRLs(d, now); err != nil {
+			t.Fatal(err)
+		}
+		for _, tt := range tests {
+			b, err := d.Get(crlTable, []byte(crlID(tt.issuer.Crt)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var rec crlRecord
+			if err := json.Unmarshal(b, &rec); err != nil {
+				t.Fatal(err)
+			}
+			crl, err := x509.ParseRevocationList(rec.DER)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := crl.CheckSignatureFrom(tt.issuer.Crt); err != nil {
+				t.Errorf("CRL signature error = %v", err)
+			}
+			if crl.Number.Int64() != round {
+				t.Errorf("CRL number = %d, want %d", crl.Number, round)
+			}
+			if len(crl.RevokedCertificateEntries) != len(tt.serials) {
+				t.Fatalf("CRL has %d entries, want %d", len(crl.RevokedCertificateEntries), len(tt.serials))
+			}
+			for i, e := range crl.RevokedCertificateEntries {
+				if e.SerialNumber.Int64() != tt.serials[i] {
+					t.Errorf("CRL entry %d serial = %d, want %d", i, e.SerialNumber, tt.serials[i])
+				}
+			}
+		}
+	}
+}
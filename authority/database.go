@@ -0,0 +1,113 @@
+package authority
+
+import (
+	"github.com/go-ocf/step-ca/acme"
+	"github.com/go-ocf/step-ca/backup"
+	"github.com/go-ocf/step-ca/inventory"
+	"github.com/go-ocf/step-ca/kvdb"
+	"github.com/go-ocf/step-ca/sqldb"
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/db"
+	"github.com/smallstep/nosql"
+	"github.com/smallstep/nosql/database"
+)
+
+// Tables used by the step certificates database.
+var stepTables = []string{"x509_certs", "revoked_x509_certs", "used_ott"}
+
+// databaseOption is the option returned by WithDatabase.
+type databaseOption struct {
+	db db.AuthDB
+}
+
+// ownedDB is an authority database opened by the authority. MySQL and
+// PostgreSQL databases can be shared by several replicas.
+type ownedDB struct {
+	*db.DB
+	snapshots *backup.DB
+}
+
+// Shutdown closes the database.
+func (o *ownedDB) Shutdown() error {
+	return o.DB.DB.Close()
+}
+
+// ListRange implements the kvdb.Ranger interface.
+func (o *ownedDB) ListRange(bucket, prefix, after []byte, limit int) ([]*database.Entry, error) {
+	return o.snapshots.ListRange(bucket, prefix, after, limit)
+}
+
+// OpenDatabase opens the database of the configuration without starting an
+// authority, e.g. to maintain it while the CA is stopped. The caller must
+// close it.
+func OpenDatabase(c *db.Config) (nosql.DB, error) {
+	if c == nil {
+		return nil, errors.New("the configuration does not define a database")
+	}
+	var d nosql.DB
+	switch {
+	case sqldb.Supports(c.Type):
+		dsn := c.DataSource
+		if c.Type == sqldb.MySQL {
+			// Same data source name as the one of the nosql mysql driver.
+			dsn += c.Database
+		}
+		sqlDB, err := sqldb.New(c.Type, dsn)
+		if err != nil {
+			return nil, err
+		}
+		d = sqlDB
+	case kvdb.Supports(c.Type):
+		var err error
+		d, err = kvdb.New(c.Type, c.DataSource, nosql.WithValueDir(c.ValueDir))
+		if err != nil {
+			return nil, errors.Wrapf(err, "error opening database of type %s with source %s", c.Type, c.DataSource)
+		}
+	default:
+		return nil, errors.Errorf("unsupported database type %s", c.Type)
+	}
+	for _, t := range stepTables {
+		if err := d.CreateTable([]byte(t)); err != nil {
+			d.Close()
+			return nil, errors.Wrapf(err, "error creating table %s", t)
+		}
+	}
+	return d, nil
+}
+
+// openOwnedDB opens the database of the configuration for an authority.
+func openOwnedDB(c *db.Config) (*ownedDB, error) {
+	d, err := OpenDatabase(c)
+	if err != nil {
+		return nil, err
+	}
+	s := backup.NewDB(d)
+	return &ownedDB{DB: &db.DB{DB: s}, snapshots: s}, nil
+}
+
+// BackupTables returns the names of the tables holding the state of the CA.
+func BackupTables() []string {
+	tables := append([]string{}, stepTables...)
+	tables = append(tables, acme.Tables()...)
+	return append(tables, inventory.Tables()...)
+}
+
+// Backup returns an archive with a consistent snapshot of the database
+// tables of the CA. It does not contain any files.
+func (a *Authority) Backup() (*backup.Archive, error) {
+	o, ok := a.GetDatabase().(*ownedDB)
+	if !ok {
+		return nil, errors.New("the authority database does not support snapshots")
+	}
+	tables, err := o.snapshots.Snapshot(BackupTables())
+	if err != nil {
+		return nil, err
+	}
+	m := &backup.Manifest{
+		Intermediate: backup.Fingerprint(a.intermediateIdentity.Crt),
+	}
+	for _, crt := range a.stepAuth.GetRootCertificates() {
+		m.Roots = append(m.Roots, backup.Fingerprint(crt))
+	}
+	return &backup.Archive{Manifest: m, Tables: tables}, nil
+}
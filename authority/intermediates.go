@@ -0,0 +1,168 @@
+package authority
+
+import (
+	"bytes"
+	"crypto/x509"
+	"time"
+
+	"github.com/pkg/errors"
+	stepAuthority "github.com/smallstep/certificates/authority"
+	"github.com/smallstep/certificates/db"
+	"github.com/smallstep/cli/crypto/pemutil"
+	"github.com/smallstep/cli/crypto/x509util"
+)
+
+// IntermediateConfig configures an intermediate CA rotated in next to the
+// one of the crt and key attributes. Its key is decrypted with the same
+// password.
+type IntermediateConfig struct {
+	Crt string `json:"crt"`
+	Key string `json:"key"`
+	// ActiveFrom is the time new certificates start being signed with this
+	// intermediate.
+	ActiveFrom time.Time `json:"activeFrom"`
+	// ActiveUntil, if set, is the time this intermediate stops signing new
+	// certificates.
+	ActiveUntil *time.Time `json:"activeUntil,omitempty"`
+}
+
+// issuer is an intermediate CA of the authority.
+type issuer struct {
+	identity    *x509util.Identity
+	stepAuth    *stepAuthority.Authority
+	activeFrom  time.Time
+	activeUntil time.Time
+}
+
+// isActive returns true if the issuer may sign new certificates at the given
+// time.
+func (i *issuer) isActive(now time.Time) bool {
+	return !now.Before(i.activeFrom) &&
+		(i.activeUntil.IsZero() || now.Before(i.activeUntil)) &&
+		now.Before(i.identity.Crt.NotAfter)
+}
+
+// issuerGroup are the intermediates of a trust anchor, the main one first.
+// The issuer with the latest active window that has started signs the new
+// certificates; the others remain available to serve the chains of the
+// certificates they issued.
+type issuerGroup []*issuer
+
+// active returns the issuer of the new certificates: the active one with the
+// latest activeFrom, or the main intermediate if none is active.
+func (g issuerGroup) active() *issuer {
+	now := time.Now()
+	var active *issuer
+	for _, i := range g {
+		if i.isActive(now) && (active == nil || i.activeFrom.After(active.activeFrom)) {
+			active = i
+		}
+	}
+	if active == nil {
+		return g[0]
+	}
+	return active
+}
+
+// loadIntermediate loads an intermediate and the step authority signing with
+// it, based on the given step configuration and sharing the given database.
+// The intermediate must chain to one of the roots of the configuration.
+func loadIntermediate(base *stepAuthority.Config, authDB db.AuthDB, crt, key string) (*issuer, error) {
+	var opts []pemutil.Options
+	if len(base.Password) > 0 {
+		opts = append(opts, pemutil.WithPassword([]byte(base.Password)))
+	}
+	identity, err := x509util.LoadIdentityFromDisk(crt, key, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	c := *base
+	c.IntermediateCert = crt
+	c.IntermediateKey = key
+	sa, err := stepAuthority.New(&c, stepAuthority.WithDatabase(authDB))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error initializing intermediate %s", crt)
+	}
+	roots := x509.NewCertPool()
+	for _, r := range sa.GetRootCertificates() {
+		roots.AddCert(r)
+	}
+	if _, err := identity.Crt.Verify(x509.VerifyOptions{
+		Roots:     roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}); err != nil {
+		return nil, errors.Wrapf(err, "error verifying intermediate %s", crt)
+	}
+	return &issuer{identity: identity, stepAuth: sa}, nil
+}
+
+// loadIssuerGroup returns the group of the given main intermediate and the
+// intermediates rotated in next to it, based on the same step configuration.
+func loadIssuerGroup(base *stepAuthority.Config, main *issuer, intermediates []*IntermediateConfig) (issuerGroup, error) {
+	group := issuerGroup{main}
+	for _, ic := range intermediates {
+		if ic == nil {
+			continue
+		}
+		if ic.ActiveUntil != nil && !ic.ActiveUntil.After(ic.ActiveFrom) {
+			return nil, errors.Errorf("intermediate %s is never active: activeUntil is not after activeFrom", ic.Crt)
+		}
+		iss, err := loadIntermediate(base, main.stepAuth.GetDatabase(), ic.Crt, ic.Key)
+		if err != nil {
+			return nil, err
+		}
+		iss.activeFrom = ic.ActiveFrom
+		if ic.ActiveUntil != nil {
+			iss.activeUntil = *ic.ActiveUntil
+		}
+		group = append(group, iss)
+	}
+	return group, nil
+}
+
+// groups returns the issuer groups of the authority, the main one first.
+func (a *Authority) groups() []issuerGroup {
+	groups := []issuerGroup{a.issuers}
+	for _, name := range a.issuerNames {
+		groups = append(groups, a.namedIssuers[name])
+	}
+	return groups
+}
+
+// GetIntermediates returns the certificates of all the intermediates of the
+// authority, the main one first.
+func (a *Authority) GetIntermediates() []*x509.Certificate {
+	var certs []*x509.Certificate
+	for _, g := range a.groups() {
+		for _, iss := range g {
+			certs = append(certs, iss.identity.Crt)
+		}
+	}
+	return certs
+}
+
+// GetActiveIntermediate returns the certificate of the intermediate signing
+// the new certificates of the main trust anchor.
+func (a *Authority) GetActiveIntermediate() *x509.Certificate {
+	return a.issuers.active().identity.Crt
+}
+
+// GetIssuer returns the intermediate that issued the given certificate, to
+// check its revocation or list it in a CRL, even if the intermediate does not
+// sign new certificates anymore.
+func (a *Authority) GetIssuer(cert *x509.Certificate) (*x509util.Identity, error) {
+	for _, g := range a.groups() {
+		for _, iss := range g {
+			crt := iss.identity.Crt
+			if len(cert.AuthorityKeyId) > 0 && len(crt.SubjectKeyId) > 0 &&
+				!bytes.Equal(cert.AuthorityKeyId, crt.SubjectKeyId) {
+				continue
+			}
+			if cert.CheckSignatureFrom(crt) == nil {
+				return iss.identity, nil
+			}
+		}
+	}
+	return nil, errors.Errorf("certificate %s was not issued by this authority", cert.SerialNumber)
+}
@@ -0,0 +1,55 @@
+package authority
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	stepAuthority "github.com/smallstep/certificates/authority"
+	"github.com/smallstep/cli/crypto/x509util"
+)
+
+func TestGetIssuer(t *testing.T) {
+	now := time.Now()
+	old := newTestIdentity(t, 1, now.Add(time.Hour), nil)
+	active := newTestIdentity(t, 2, now.Add(time.Hour), nil)
+	foreign := newTestIdentity(t, 3, now.Add(time.Hour), nil)
+	a := &Authority{issuers: issuerGroup{
+		{identity: old, activeUntil: now.Add(-time.Minute)},
+		{identity: active, activeFrom: now.Add(-time.Minute)},
+	}}
+	if got := a.issuers.active().identity; got != active {
+		t.Error("active() did not return the active intermediate")
+	}
+
+	tests := []struct {
+		name    string
+		parent  *x509util.Identity
+		wantErr bool
+	}{
+		{"rotated out", old, false},
+		{"active", active, false},
+		{"foreign", foreign, true},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			leaf := newTestIdentity(t, int64(10+i), now.Add(time.Hour), tt.parent)
+			iss, err := a.GetIssuer(leaf.Crt)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GetIssuer() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && iss != tt.parent {
+				t.Error("GetIssuer() did not return the issuer of the certificate")
+			}
+
+			// Certificates of other authorities cannot be revoked.
+			if tt.wantErr {
+				err := a.Revoke(&stepAuthority.RevokeOptions{Serial: leaf.Crt.SerialNumber.String(), Crt: leaf.Crt})
+				e, ok := err.(*apiError)
+				if !ok || e.StatusCode() != http.StatusBadRequest {
+					t.Errorf("Revoke() error = %v, want a bad request", err)
+				}
+			}
+		})
+	}
+}
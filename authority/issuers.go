@@ -0,0 +1,152 @@
+package authority
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"sort"
+	"strings"
+
+	"github.com/go-ocf/step-ca/inventory"
+	"github.com/pkg/errors"
+	stepAuthority "github.com/smallstep/certificates/authority"
+	stepProvisioner "github.com/smallstep/certificates/authority/provisioner"
+	"github.com/smallstep/cli/crypto/x509util"
+)
+
+// FileSigner is the signer backend of the keys stored in PEM files.
+const FileSigner = "file"
+
+// IssuerConfig configures a named issuing CA with its own trust anchor. The
+// provisioners bound to it sign their certificates with it instead of the
+// intermediate of the crt and key attributes.
+type IssuerConfig struct {
+	// Root is the PEM file with the root certificate of the issuer.
+	Root string `json:"root"`
+	Crt  string `json:"crt"`
+	Key  string `json:"key"`
+	// Signer is the backend holding the key; only "file", the default, is
+	// supported. The key is decrypted with the password of the CA.
+	Signer string `json:"signer,omitempty"`
+	// Intermediates are the intermediates rotated in next to this one.
+	Intermediates []*IntermediateConfig `json:"intermediates,omitempty"`
+	// Provisioners are the names of the provisioners bound to the issuer.
+	Provisioners []string `json:"provisioners"`
+}
+
+// loadNamedIssuers loads the named issuers of the configuration, sharing the
+// database of the given step authority, and binds their provisioners.
+func (a *Authority) loadNamedIssuers(config *Config, stepAuth *stepAuthority.Authority) error {
+	a.namedIssuers = make(map[string]issuerGroup)
+	a.provisionerIssuers = make(map[string]string)
+	known := make(map[string]bool)
+	if config.AuthorityConfig != nil {
+		for _, p := range config.AuthorityConfig.Provisioners {
+			known[p.GetName()] = true
+		}
+	}
+	for name, ic := range config.Issuers {
+		if ic == nil {
+			continue
+		}
+		if ic.Signer != "" && ic.Signer != FileSigner {
+			return errors.Errorf("issuer %s: unsupported signer %s", name, ic.Signer)
+		}
+		if len(ic.Root) == 0 || len(ic.Crt) == 0 || len(ic.Key) == 0 {
+			return errors.Errorf("issuer %s: root, crt and key are required", name)
+		}
+		for _, p := range ic.Provisioners {
+			if !known[p] {
+				return errors.Errorf("issuer %s: unknown provisioner %s", name, p)
+			}
+			if other, ok := a.provisionerIssuers[p]; ok {
+				return errors.Errorf("provisioner %s is bound to the issuers %s and %s", p, other, name)
+			}
+			a.provisionerIssuers[p] = name
+		}
+		base := *config.Config
+		base.Root = []string{ic.Root}
+		main, err := loadIntermediate(&base, stepAuth.GetDatabase(), ic.Crt, ic.Key)
+		if err != nil {
+			return errors.Wrapf(err, "issuer %s", name)
+		}
+		group, err := loadIssuerGroup(&base, main, ic.Intermediates)
+		if err != nil {
+			return errors.Wrapf(err, "issuer %s", name)
+		}
+		a.namedIssuers[name] = group
+		a.issuerNames = append(a.issuerNames, name)
+	}
+	sort.Strings(a.issuerNames)
+	return nil
+}
+
+// issuerFor returns the issuer of the new certificates authorized by the
+// given provisioner.
+func (a *Authority) issuerFor(provisionerName string) *issuer {
+	if name, ok := a.provisionerIssuers[provisionerName]; ok {
+		return a.namedIssuers[name].active()
+	}
+	return a.issuers.active()
+}
+
+// signOptionsProvisioner returns the name of the provisioner in the
+// provisioner extension the sign options of a verified token add to the
+// certificates, or an empty string.
+func signOptionsProvisioner(signOpts []stepProvisioner.SignOption) string {
+	for _, o := range signOpts {
+		v, ok := o.(stepProvisioner.ProfileModifier)
+		if !ok {
+			continue
+		}
+		p, err := x509util.NewLeafProfileWithTemplate(&x509.Certificate{}, &x509.Certificate{}, nil)
+		if err != nil {
+			continue
+		}
+		if err := v.Option(stepProvisioner.Options{})(p); err != nil {
+			continue
+		}
+		if name := inventory.ProvisionerName(p.Subject()); name != "" {
+			return name
+		}
+	}
+	return ""
+}
+
+// namedRoots returns the roots of the named issuers.
+func (a *Authority) namedRoots() []*x509.Certificate {
+	var roots []*x509.Certificate
+	for _, name := range a.issuerNames {
+		roots = append(roots, a.namedIssuers[name][0].stepAuth.GetRootCertificates()...)
+	}
+	return roots
+}
+
+// appendRoots appends the roots that are not in the list yet.
+func appendRoots(list []*x509.Certificate, roots ...*x509.Certificate) []*x509.Certificate {
+	for _, r := range roots {
+		var found bool
+		for _, c := range list {
+			if c.Equal(r) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, r)
+		}
+	}
+	return list
+}
+
+// namedRoot returns the root of a named issuer with the given SHA-256
+// fingerprint.
+func (a *Authority) namedRoot(sum string) (*x509.Certificate, bool) {
+	for _, r := range a.namedRoots() {
+		h := sha256.Sum256(r.Raw)
+		if strings.EqualFold(hex.EncodeToString(h[:]), sum) {
+			return r, true
+		}
+	}
+	return nil, false
+}
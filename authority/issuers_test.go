@@ -0,0 +1,192 @@
+package authority
+
+import (
+	"context"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-ocf/step-ca/inventory"
+	stepAuthority "github.com/smallstep/certificates/authority"
+	stepProvisioner "github.com/smallstep/certificates/authority/provisioner"
+	"github.com/smallstep/cli/crypto/pemutil"
+	"github.com/smallstep/cli/jose"
+)
+
+// newTestIssuer returns an issuer with a new root and intermediate, and a
+// step authority with the given provisioners.
+func newTestIssuer(t *testing.T, dir string, provisioners ...stepProvisioner.Interface) *issuer {
+	t.Helper()
+	root := newTestIdentity(t, 1, time.Now().Add(time.Hour), nil)
+	intermediate := newTestIdentity(t, 2, time.Now().Add(time.Hour), root)
+	dir, err := ioutil.TempDir(dir, "ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := func(name string, b *pem.Block) string {
+		fn := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(fn, pem.EncodeToMemory(b), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return fn
+	}
+	key, err := pemutil.Serialize(intermediate.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sa, err := stepAuthority.New(&stepAuthority.Config{
+		Root:             []string{write("root_ca.crt", &pem.Block{Type: "CERTIFICATE", Bytes: root.Crt.Raw})},
+		IntermediateCert: write("intermediate_ca.crt", &pem.Block{Type: "CERTIFICATE", Bytes: intermediate.Crt.Raw}),
+		IntermediateKey:  write("intermediate_ca_key", key),
+		Address:          ":443",
+		DNSNames:         []string{"ca.example.com"},
+		AuthorityConfig:  &stepAuthority.AuthConfig{Provisioners: provisioners},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &issuer{identity: intermediate, stepAuth: sa}
+}
+
+// newTestJWK returns a JWK provisioner and its private key.
+func newTestJWK(t *testing.T, name string) (*stepProvisioner.JWK, *jose.JSONWebKey) {
+	t.Helper()
+	jwk, err := jose.GenerateJWK("EC", "P-256", "ES256", "sig", name, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := jwk.Public()
+	return &stepProvisioner.JWK{Type: "JWK", Name: name, Key: &pub}, jwk
+}
+
+// newTestToken returns a sign token of a JWK provisioner.
+func newTestToken(t *testing.T, name string, jwk *jose.JSONWebKey) string {
+	t.Helper()
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: jwk.Key},
+		new(jose.SignerOptions).WithType("JWT").WithHeader("kid", jwk.KeyID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	tok, err := jose.Signed(signer).Claims(jose.Claims{
+		Issuer:    name,
+		Subject:   "ca.example.com",
+		Audience:  jose.Audience{"https://ca.example.com/1.0/sign"},
+		NotBefore: jose.NewNumericDate(now),
+		Expiry:    jose.NewNumericDate(now.Add(time.Minute)),
+		ID:        name + now.String(),
+	}).CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tok
+}
+
+func TestAuthorizeSignProvisioner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "issuers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	def, defKey := newTestJWK(t, "default")
+	tenant, tenantKey := newTestJWK(t, "tenant")
+	a := &Authority{stepAuth: newTestIssuer(t, dir, def, tenant).stepAuth}
+
+	tests := []struct {
+		name   string
+		method stepProvisioner.Method
+		token  string
+		want   inventory.Provisioner
+	}{
+		{"default", stepProvisioner.SignMethod, newTestToken(t, "default", defKey), "default"},
+		{"tenant", stepProvisioner.SignMethod, newTestToken(t, "tenant", tenantKey), "tenant"},
+		{"revoke", stepProvisioner.RevokeMethod, newTestToken(t, "tenant", tenantKey), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := stepProvisioner.NewContextWithMethod(context.Background(), tt.method)
+			signOpts, err := a.Authorize(ctx, tt.token)
+			if err != nil && tt.method == stepProvisioner.SignMethod {
+				t.Fatalf("Authorize() error = %v", err)
+			}
+			var got inventory.Provisioner
+			for _, o := range signOpts {
+				if v, ok := o.(inventory.Provisioner); ok {
+					got = v
+				}
+			}
+			if got != tt.want {
+				t.Errorf("Authorize() provisioner = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := a.AuthorizeSign(newTestToken(t, "tenant", defKey)); err == nil {
+		t.Error("AuthorizeSign() with a forged token error = nil, want an error")
+	}
+}
+
+func TestLoadNamedIssuers(t *testing.T) {
+	tenant, _ := newTestJWK(t, "tenant")
+	config := &Config{
+		Config: &stepAuthority.Config{
+			AuthorityConfig: &stepAuthority.AuthConfig{Provisioners: stepProvisioner.List{tenant}},
+		},
+		Issuers: map[string]*IssuerConfig{
+			"acme-corp": {Root: "root.crt", Crt: "int.crt", Key: "int.key", Provisioners: []string{"tenant", "unknown"}},
+		},
+	}
+	err := new(Authority).loadNamedIssuers(config, nil)
+	if err == nil || !strings.Contains(err.Error(), "unknown provisioner unknown") {
+		t.Errorf("loadNamedIssuers() error = %v, want an unknown provisioner error", err)
+	}
+}
+
+func TestNamedRoots(t *testing.T) {
+	dir, err := ioutil.TempDir("", "issuers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p, _ := newTestJWK(t, "default")
+	main := newTestIssuer(t, dir, p).stepAuth
+	named := newTestIssuer(t, dir, p).stepAuth
+	a := &Authority{
+		stepAuth:     main,
+		namedIssuers: map[string]issuerGroup{"acme-corp": {{stepAuth: named}}},
+		issuerNames:  []string{"acme-corp"},
+	}
+	mainRoot, namedRoot := main.GetRootCertificates()[0], named.GetRootCertificates()[0]
+
+	// The roots of the named issuers do not authenticate clients.
+	if roots := a.GetRootCertificates(); len(roots) != 1 || !roots[0].Equal(mainRoot) {
+		t.Errorf("GetRootCertificates() = %v, want the root of the authority", roots)
+	}
+	federation, err := a.GetFederation()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range federation {
+		if r.Equal(namedRoot) {
+			t.Error("GetFederation() contains the root of a named issuer")
+		}
+	}
+	roots, err := a.GetRoots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roots) != 2 || !roots[0].Equal(mainRoot) || !roots[1].Equal(namedRoot) {
+		t.Errorf("GetRoots() = %v, want the roots of the authority and of the named issuer", roots)
+	}
+}
+
+func TestSignOptionsProvisioner(t *testing.T) {
+	withoutExtension := []stepProvisioner.SignOption{inventory.AccountID("acc1"), inventory.Provisioner("forged")}
+	if got := signOptionsProvisioner(withoutExtension); got != "" {
+		t.Errorf("signOptionsProvisioner() without a provisioner extension = %q, want none", got)
+	}
+}
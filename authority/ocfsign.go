@@ -10,6 +10,7 @@ import (
 
 	"github.com/google/uuid"
 
+	"github.com/go-ocf/step-ca/inventory"
 	"github.com/pkg/errors"
 	"github.com/smallstep/certificates/authority/provisioner"
 	stepProvisioner "github.com/smallstep/certificates/authority/provisioner"
@@ -58,15 +59,7 @@ func cleanUpCert(cert *x509.Certificate) error {
 	return nil
 }
 
-type stepProvisionerASN1 struct {
-	Type          int
-	Name          []byte
-	CredentialID  []byte
-	KeyValuePairs []string `asn1:"optional,omitempty"`
-}
-
 func (a *Authority) isOCF(signOpts []stepProvisioner.SignOption) bool {
-	stepOIDProvisioner := asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 37476, 9000, 64, 1}
 	var isOCF bool
 	for _, o := range signOpts {
 		var tmp stepProvisioner.Options
@@ -79,8 +72,8 @@ func (a *Authority) isOCF(signOpts []stepProvisioner.SignOption) bool {
 			withOption(p)
 			for _, ext := range p.Subject().ExtraExtensions {
 				fmt.Printf("Authority.isOCF ext.Id=%+v\n", ext.Id)
-				if reflect.DeepEqual(ext.Id, stepOIDProvisioner) {
-					var val stepProvisionerASN1
+				if reflect.DeepEqual(ext.Id, inventory.OIDProvisioner) {
+					var val inventory.ProvisionerExtension
 					_, err := asn1.Unmarshal(ext.Value, &val)
 					if err != nil {
 						continue
@@ -98,10 +91,26 @@ func (a *Authority) isOCF(signOpts []stepProvisioner.SignOption) bool {
 }
 
 func (a *Authority) OCFSign(csr *x509.CertificateRequest, signOpts stepProvisioner.Options, extraOpts ...stepProvisioner.SignOption) (*x509.Certificate, *x509.Certificate, error) {
+	var provisionerName string
+	filtered := extraOpts[:0:0]
+	for _, o := range extraOpts {
+		if v, ok := o.(inventory.Provisioner); ok {
+			provisionerName = string(v)
+			continue
+		}
+		filtered = append(filtered, o)
+	}
+	return a.ocfSign(csr, signOpts, "", provisionerName, filtered...)
+}
+
+// ocfSign signs an OCF identity certificate for the given ACME account, if
+// any, with the issuer of the given provisioner. If an issuance policy is
+// configured, it is consulted before signing.
+func (a *Authority) ocfSign(csr *x509.CertificateRequest, signOpts stepProvisioner.Options, accountID, provisionerName string, extraOpts ...stepProvisioner.SignOption) (*x509.Certificate, *x509.Certificate, error) {
 	var (
 		errContext     = apiCtx{"csr": csr, "signOptions": signOpts}
 		certValidators = []provisioner.CertificateValidator{}
-		issIdentity    = a.intermediateIdentity
+		issIdentity    = a.issuerFor(provisionerName).identity
 		mods           = []x509util.WithOption{}
 	)
 
@@ -147,6 +156,26 @@ func (a *Authority) OCFSign(csr *x509.CertificateRequest, signOpts stepProvision
 			http.StatusInternalServerError, errContext}
 	}
 
+	if a.policyHook != nil {
+		tmpl := leaf.Subject()
+		exts, err := a.policyHook.authorize(&PolicyHookRequest{
+			CSR:         csr.Raw,
+			Subject:     csr.Subject.CommonName,
+			Provisioner: inventory.ProvisionerName(tmpl),
+			AccountID:   accountID,
+			Profile: PolicyHookProfile{
+				NotBefore: tmpl.NotBefore,
+				NotAfter:  tmpl.NotAfter,
+				KeyUsage:  int(tmpl.KeyUsage),
+			},
+			Extensions: policyHookExtensions(tmpl.ExtraExtensions),
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		tmpl.ExtraExtensions = append(tmpl.ExtraExtensions, exts...)
+	}
+
 	crtBytes, err := leaf.CreateCertificate()
 	if err != nil {
 		return nil, nil, &apiError{errors.Wrap(err, "ocfsign: error creating new leaf certificate"),
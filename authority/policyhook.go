@@ -0,0 +1,250 @@
+package authority
+
+import (
+	"bytes"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-ocf/step-ca/events"
+	"github.com/pkg/errors"
+	stepProvisioner "github.com/smallstep/certificates/authority/provisioner"
+)
+
+const defaultPolicyHookTimeout = 5 * time.Second
+
+// PolicyHookOptions configure the webhook consulted before an OCF identity
+// certificate is signed.
+type PolicyHookOptions struct {
+	URL string `json:"url"`
+	// Secret, if set, is the key of the HMAC signature of the requests; see
+	// the events package for the signature format.
+	Secret string `json:"secret,omitempty"`
+	// Timeout is the timeout of the requests; 5s by default.
+	Timeout *stepProvisioner.Duration `json:"timeout,omitempty"`
+	// FailOpen allows the issuance if the webhook cannot be reached or does
+	// not return a valid response. By default issuance is denied.
+	FailOpen bool `json:"failOpen,omitempty"`
+	// AllowedExtensions are the OIDs, in dotted notation, of the extensions
+	// the webhook may add to the certificates. The X.509 and PKIX
+	// extensions cannot be allowed, and added extensions cannot be
+	// critical.
+	AllowedExtensions []string `json:"allowedExtensions,omitempty"`
+}
+
+// PolicyHookRequest is the body of the requests to the policy webhook.
+type PolicyHookRequest struct {
+	// CSR is the DER of the certificate request.
+	CSR         []byte            `json:"csr"`
+	Subject     string            `json:"subject"`
+	Provisioner string            `json:"provisioner,omitempty"`
+	AccountID   string            `json:"accountID,omitempty"`
+	Profile     PolicyHookProfile `json:"profile"`
+	// Extensions are the extensions the CA adds to the certificate, next
+	// to the ones of the profile.
+	Extensions []PolicyHookExtension `json:"extensions,omitempty"`
+}
+
+// PolicyHookProfile is the profile of the certificate to be signed.
+type PolicyHookProfile struct {
+	NotBefore time.Time `json:"notBefore"`
+	NotAfter  time.Time `json:"notAfter"`
+	KeyUsage  int       `json:"keyUsage"`
+}
+
+// PolicyHookExtension is a certificate extension; the OID in dotted notation
+// and the DER of the value.
+type PolicyHookExtension struct {
+	ID       string `json:"id"`
+	Critical bool   `json:"critical,omitempty"`
+	Value    []byte `json:"value"`
+}
+
+// PolicyHookResponse is the body of the responses of the policy webhook.
+// Extensions are added to the certificate if the issuance is allowed; they
+// must be allowed by the options and not critical.
+type PolicyHookResponse struct {
+	Allow      bool                  `json:"allow"`
+	Reason     string                `json:"reason,omitempty"`
+	Extensions []PolicyHookExtension `json:"extensions,omitempty"`
+}
+
+type policyHook struct {
+	url      string
+	secret   []byte
+	failOpen bool
+	allowed  []asn1.ObjectIdentifier
+	client   *http.Client
+}
+
+// reservedOIDArcs are the arcs of the extensions that a policy webhook can
+// never add: the X.509 certificate extensions (id-ce), the PKIX ones
+// (id-pe) and the step ones, e.g. the provisioner extension.
+var reservedOIDArcs = []asn1.ObjectIdentifier{
+	{2, 5, 29},
+	{1, 3, 6, 1, 5, 5, 7, 1},
+	{1, 3, 6, 1, 4, 1, 37476, 9000, 64},
+}
+
+// isReservedOID returns true if the OID is in one of the reserved arcs.
+func isReservedOID(oid asn1.ObjectIdentifier) bool {
+	for _, arc := range reservedOIDArcs {
+		if len(oid) >= len(arc) && oid[:len(arc)].Equal(arc) {
+			return true
+		}
+	}
+	return false
+}
+
+func newPolicyHook(o *PolicyHookOptions) (*policyHook, error) {
+	if len(o.URL) == 0 {
+		return nil, errors.New("issuancePolicy url cannot be empty")
+	}
+	h := &policyHook{
+		url:      o.URL,
+		secret:   []byte(o.Secret),
+		failOpen: o.FailOpen,
+		client:   &http.Client{Timeout: defaultPolicyHookTimeout},
+	}
+	if o.Timeout != nil {
+		h.client.Timeout = o.Timeout.Duration
+	}
+	for _, s := range o.AllowedExtensions {
+		oid, err := parseOID(s)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid issuancePolicy allowedExtensions")
+		}
+		if isReservedOID(oid) {
+			return nil, errors.Errorf("issuancePolicy allowedExtensions cannot contain %s; "+
+				"it is a standard or step extension", s)
+		}
+		h.allowed = append(h.allowed, oid)
+	}
+	return h, nil
+}
+
+// isAllowed returns true if the webhook may add the extension.
+func (h *policyHook) isAllowed(oid asn1.ObjectIdentifier) bool {
+	for _, a := range h.allowed {
+		if a.Equal(oid) {
+			return true
+		}
+	}
+	return false
+}
+
+// policyHookExtensions returns the extensions in the format of the webhook.
+func policyHookExtensions(exts []pkix.Extension) []PolicyHookExtension {
+	ret := make([]PolicyHookExtension, len(exts))
+	for i, e := range exts {
+		ret[i] = PolicyHookExtension{ID: e.Id.String(), Critical: e.Critical, Value: e.Value}
+	}
+	return ret
+}
+
+// parseOID parses an OID in dotted notation.
+func parseOID(s string) (asn1.ObjectIdentifier, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) < 2 {
+		return nil, errors.Errorf("invalid OID %s", s)
+	}
+	oid := make(asn1.ObjectIdentifier, len(parts))
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return nil, errors.Errorf("invalid OID %s", s)
+		}
+		oid[i] = n
+	}
+	return oid, nil
+}
+
+// authorize asks the webhook whether the certificate can be signed. It
+// returns the extensions to add to the certificate, or an error with the
+// status of the response to the client if the issuance is not allowed.
+func (h *policyHook) authorize(req *PolicyHookRequest) ([]pkix.Extension, error) {
+	resp, err := h.call(req)
+	if err != nil {
+		if h.failOpen {
+			return nil, nil
+		}
+		return nil, &apiError{errors.Wrap(err, "error consulting issuance policy"),
+			http.StatusServiceUnavailable, apiCtx{"subject": req.Subject}}
+	}
+	if !resp.Allow {
+		reason := resp.Reason
+		if len(reason) == 0 {
+			reason = "denied by issuance policy"
+		}
+		return nil, &apiError{errors.New(reason), http.StatusForbidden, apiCtx{"subject": req.Subject}}
+	}
+
+	exts := make([]pkix.Extension, len(resp.Extensions))
+	for i, e := range resp.Extensions {
+		oid, err := parseOID(e.ID)
+		switch {
+		case err != nil:
+			err = errors.Wrap(err, "error parsing issuance policy response")
+		case e.Critical:
+			err = errors.Errorf("issuance policy cannot add the critical extension %s", e.ID)
+		case isReservedOID(oid) || !h.isAllowed(oid):
+			err = errors.Errorf("issuance policy cannot add the extension %s; it is not allowed", e.ID)
+		}
+		if err != nil {
+			return nil, &apiError{err, http.StatusInternalServerError, apiCtx{"subject": req.Subject}}
+		}
+		for _, prev := range exts[:i] {
+			if prev.Id.Equal(oid) {
+				return nil, &apiError{errors.Errorf("issuance policy added the extension %s twice", e.ID),
+					http.StatusInternalServerError, apiCtx{"subject": req.Subject}}
+			}
+		}
+		for _, prev := range req.Extensions {
+			if prev.ID == oid.String() {
+				return nil, &apiError{errors.Errorf("issuance policy cannot replace the extension %s", e.ID),
+					http.StatusInternalServerError, apiCtx{"subject": req.Subject}}
+			}
+		}
+		exts[i] = pkix.Extension{Id: oid, Value: e.Value}
+	}
+	return exts, nil
+}
+
+func (h *policyHook) call(r *PolicyHookRequest) (*PolicyHookResponse, error) {
+	body, err := json.Marshal(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "error marshaling issuance policy request")
+	}
+	req, err := http.NewRequest("POST", h.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error creating request for %s", h.url)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(h.secret) > 0 {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(events.TimestampHeader, ts)
+		req.Header.Set(events.SignatureHeader, "sha256="+events.Sign(h.secret, ts, body))
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error posting to %s", h.url)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+		return nil, fmt.Errorf("%s returned unexpected status %s", h.url, resp.Status)
+	}
+	var pr PolicyHookResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1024*1024)).Decode(&pr); err != nil {
+		return nil, errors.Wrapf(err, "error decoding response of %s", h.url)
+	}
+	return &pr, nil
+}
@@ -0,0 +1,111 @@
+package authority
+
+import (
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-ocf/step-ca/inventory"
+	stepProvisioner "github.com/smallstep/certificates/authority/provisioner"
+)
+
+func TestNewPolicyHookAllowedExtensions(t *testing.T) {
+	for _, oid := range []string{"2.5.29.17", "1.3.6.1.5.5.7.1.1", inventory.OIDProvisioner.String(), "1.2.x"} {
+		_, err := newPolicyHook(&PolicyHookOptions{URL: "https://policy.example.com", AllowedExtensions: []string{oid}})
+		if err == nil {
+			t.Errorf("newPolicyHook() with allowed extension %s error = nil, want an error", oid)
+		}
+	}
+}
+
+func TestPolicyHookAuthorize(t *testing.T) {
+	const (
+		allowedOID = "1.3.6.1.4.1.44924.1.100"
+		otherOID   = "1.3.6.1.4.1.44924.1.101"
+	)
+	provExt := pkix.Extension{Id: inventory.OIDProvisioner, Value: []byte{0x30, 0x00}}
+	tests := []struct {
+		name     string
+		resp     PolicyHookResponse
+		wait     time.Duration
+		failOpen bool
+		wantExts int
+		wantCode int
+	}{
+		{"allow", PolicyHookResponse{Allow: true}, 0, false, 0, 0},
+		{"deny", PolicyHookResponse{Allow: false, Reason: "not in inventory"}, 0, false, 0, http.StatusForbidden},
+		{"timeout", PolicyHookResponse{Allow: true}, 200 * time.Millisecond, false, 0, http.StatusServiceUnavailable},
+		{"timeout fail open", PolicyHookResponse{Allow: true}, 200 * time.Millisecond, true, 0, 0},
+		{"allowed extension", PolicyHookResponse{Allow: true, Extensions: []PolicyHookExtension{
+			{ID: allowedOID, Value: []byte{0x05, 0x00}},
+		}}, 0, false, 1, 0},
+		{"critical extension", PolicyHookResponse{Allow: true, Extensions: []PolicyHookExtension{
+			{ID: allowedOID, Critical: true, Value: []byte{0x05, 0x00}},
+		}}, 0, false, 0, http.StatusInternalServerError},
+		{"extension not allowed", PolicyHookResponse{Allow: true, Extensions: []PolicyHookExtension{
+			{ID: otherOID, Value: []byte{0x05, 0x00}},
+		}}, 0, false, 0, http.StatusInternalServerError},
+		{"standard extension", PolicyHookResponse{Allow: true, Extensions: []PolicyHookExtension{
+			{ID: "2.5.29.19", Value: []byte{0x30, 0x03, 0x01, 0x01, 0xff}},
+		}}, 0, false, 0, http.StatusInternalServerError},
+		{"provisioner extension", PolicyHookResponse{Allow: true, Extensions: []PolicyHookExtension{
+			{ID: inventory.OIDProvisioner.String(), Value: []byte{0x30, 0x00}},
+		}}, 0, false, 0, http.StatusInternalServerError},
+		{"duplicated extension", PolicyHookResponse{Allow: true, Extensions: []PolicyHookExtension{
+			{ID: allowedOID, Value: []byte{0x05, 0x00}},
+			{ID: allowedOID, Value: []byte{0x05, 0x00}},
+		}}, 0, false, 0, http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got PolicyHookRequest
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+					t.Errorf("error decoding request: %v", err)
+				}
+				time.Sleep(tt.wait)
+				json.NewEncoder(w).Encode(tt.resp)
+			}))
+			defer srv.Close()
+
+			h, err := newPolicyHook(&PolicyHookOptions{
+				URL:               srv.URL,
+				Timeout:           &stepProvisioner.Duration{Duration: 100 * time.Millisecond},
+				FailOpen:          tt.failOpen,
+				AllowedExtensions: []string{allowedOID},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			exts, err := h.authorize(&PolicyHookRequest{
+				Subject:    "uuid:9f2c3e4a-7b1d-4c5e-8f6a-0b1c2d3e4f50",
+				Extensions: policyHookExtensions([]pkix.Extension{provExt}),
+			})
+			if tt.wantCode != 0 {
+				ae, ok := err.(*apiError)
+				if !ok || ae.code != tt.wantCode {
+					t.Fatalf("authorize() error = %v, want status %d", err, tt.wantCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("authorize() error = %v", err)
+			}
+			if len(exts) != tt.wantExts {
+				t.Fatalf("authorize() = %d extensions, want %d", len(exts), tt.wantExts)
+			}
+			for _, e := range exts {
+				if !e.Id.Equal(asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 44924, 1, 100}) || e.Critical {
+					t.Errorf("authorize() extension = %v", e)
+				}
+			}
+			if tt.wait == 0 && (len(got.Extensions) != 1 || got.Extensions[0].ID != inventory.OIDProvisioner.String()) {
+				t.Errorf("webhook received extensions %v, want the provisioner one", got.Extensions)
+			}
+		})
+	}
+}
@@ -0,0 +1,258 @@
+// Package backup implements the portable archives of the CA state.
+//
+// An archive is a gzipped tar file with a manifest.json, the entries of the
+// database tables in tables/<name>.json and the files of the CA, like its
+// certificates and keys, in files/<name>. The manifest contains the SHA-256
+// checksum of every other member. Archives can be encrypted with a password.
+package backup
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/nosql/database"
+)
+
+// ManifestVersion is the version of the archive format.
+const ManifestVersion = 1
+
+const (
+	manifestName = "manifest.json"
+	tablesDir    = "tables/"
+	filesDir     = "files/"
+)
+
+// Manifest describes the contents of an archive.
+type Manifest struct {
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+	// Roots and Intermediate are the SHA-256 fingerprints of the root and
+	// intermediate certificates of the CA the archive was taken from.
+	Roots        []string         `json:"roots,omitempty"`
+	Intermediate string           `json:"intermediate,omitempty"`
+	Tables       []*ManifestEntry `json:"tables"`
+	Files        []*ManifestEntry `json:"files,omitempty"`
+}
+
+// ManifestEntry describes a table or file of an archive.
+type ManifestEntry struct {
+	Name string `json:"name"`
+	// Path is the original path of a file.
+	Path string `json:"path,omitempty"`
+	// Entries is the number of entries of a table.
+	Entries int    `json:"entries,omitempty"`
+	SHA256  string `json:"sha256"`
+}
+
+// File is a file of the CA.
+type File struct {
+	Name string
+	Path string
+	Data []byte
+}
+
+// Archive is the state of a CA.
+type Archive struct {
+	Manifest *Manifest
+	Tables   []*Table
+	Files    []*File
+}
+
+// entry is the encoding of a table entry, one per line.
+type entry struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// Fingerprint returns the hex encoded SHA-256 fingerprint of a certificate.
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+func checksum(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// Table returns the table with the given name, nil if the archive does not
+// contain it.
+func (a *Archive) Table(name string) *Table {
+	for _, t := range a.Tables {
+		if t.Name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+// File returns the file with the given name, nil if the archive does not
+// contain it.
+func (a *Archive) File(name string) *File {
+	for _, f := range a.Files {
+		if f.Name == name {
+			return f
+		}
+	}
+	return nil
+}
+
+// Write writes the archive, filling in the tables and files of the manifest.
+func (a *Archive) Write(w io.Writer) error {
+	if a.Manifest == nil {
+		a.Manifest = new(Manifest)
+	}
+	a.Manifest.Version = ManifestVersion
+	if a.Manifest.Created.IsZero() {
+		a.Manifest.Created = time.Now().UTC()
+	}
+	a.Manifest.Tables = nil
+	a.Manifest.Files = nil
+
+	type member struct {
+		name string
+		data []byte
+	}
+	var members []member
+	for _, t := range a.Tables {
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		for _, e := range t.Entries {
+			if err := enc.Encode(entry{Key: e.Key, Value: e.Value}); err != nil {
+				return errors.Wrapf(err, "error encoding table %s", t.Name)
+			}
+		}
+		members = append(members, member{tablesDir + t.Name + ".json", buf.Bytes()})
+		a.Manifest.Tables = append(a.Manifest.Tables, &ManifestEntry{
+			Name:    t.Name,
+			Entries: len(t.Entries),
+			SHA256:  checksum(buf.Bytes()),
+		})
+	}
+	for _, f := range a.Files {
+		members = append(members, member{filesDir + f.Name, f.Data})
+		a.Manifest.Files = append(a.Manifest.Files, &ManifestEntry{
+			Name:   f.Name,
+			Path:   f.Path,
+			SHA256: checksum(f.Data),
+		})
+	}
+	manifest, err := json.MarshalIndent(a.Manifest, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "error marshaling manifest")
+	}
+	members = append([]member{{manifestName, manifest}}, members...)
+
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	for _, m := range members {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:    m.name,
+			Mode:    0600,
+			Size:    int64(len(m.data)),
+			ModTime: a.Manifest.Created,
+		}); err != nil {
+			return errors.Wrapf(err, "error writing %s", m.name)
+		}
+		if _, err := tw.Write(m.data); err != nil {
+			return errors.Wrapf(err, "error writing %s", m.name)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return errors.Wrap(err, "error writing archive")
+	}
+	return errors.Wrap(gw.Close(), "error writing archive")
+}
+
+// Read reads an archive and verifies the checksums of its members.
+func Read(r io.Reader) (*Archive, error) {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading archive")
+	}
+	members := make(map[string][]byte)
+	tr := tar.NewReader(gr)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "error reading archive")
+		}
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error reading %s", h.Name)
+		}
+		members[h.Name] = b
+	}
+
+	b, ok := members[manifestName]
+	if !ok {
+		return nil, errors.New("archive does not contain a manifest")
+	}
+	m := new(Manifest)
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, errors.Wrap(err, "error unmarshaling manifest")
+	}
+	if m.Version != ManifestVersion {
+		return nil, errors.Errorf("unsupported archive version %d", m.Version)
+	}
+
+	member := func(name, sum string) ([]byte, error) {
+		b, ok := members[name]
+		if !ok {
+			return nil, errors.Errorf("archive does not contain %s", name)
+		}
+		if checksum(b) != sum {
+			return nil, errors.Errorf("checksum of %s does not match the manifest", name)
+		}
+		return b, nil
+	}
+	a := &Archive{Manifest: m}
+	for _, me := range m.Tables {
+		b, err := member(tablesDir+me.Name+".json", me.SHA256)
+		if err != nil {
+			return nil, err
+		}
+		t := &Table{Name: me.Name}
+		s := bufio.NewScanner(bytes.NewReader(b))
+		s.Buffer(nil, len(b)+1)
+		for s.Scan() {
+			var e entry
+			if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+				return nil, errors.Wrapf(err, "error decoding table %s", me.Name)
+			}
+			t.Entries = append(t.Entries, &database.Entry{
+				Bucket: []byte(me.Name), Key: e.Key, Value: e.Value,
+			})
+		}
+		if len(t.Entries) != me.Entries {
+			return nil, errors.Errorf("table %s has %d entries, the manifest %d", me.Name, len(t.Entries), me.Entries)
+		}
+		a.Tables = append(a.Tables, t)
+	}
+	for _, me := range m.Files {
+		if strings.Contains(me.Name, "/") || me.Name != path.Clean(me.Name) {
+			return nil, errors.Errorf("invalid file name %s", me.Name)
+		}
+		b, err := member(filesDir+me.Name, me.SHA256)
+		if err != nil {
+			return nil, err
+		}
+		a.Files = append(a.Files, &File{Name: me.Name, Path: me.Path, Data: b})
+	}
+	return a, nil
+}
@@ -0,0 +1,77 @@
+package backup
+
+import (
+	"github.com/go-ocf/step-ca/kvdb"
+	"github.com/pkg/errors"
+	"github.com/smallstep/nosql"
+	"github.com/smallstep/nosql/database"
+)
+
+// Table contains the entries of a database table.
+type Table struct {
+	Name    string
+	Entries []*database.Entry
+}
+
+// DB wraps a nosql database in use to take consistent snapshots of it. A
+// snapshot reads all the tables in a single read-only transaction, so it
+// never contains half of an operation spanning several tables.
+type DB struct {
+	nosql.DB
+}
+
+// NewDB returns the wrapper of the given database.
+func NewDB(db nosql.DB) *DB {
+	return &DB{DB: db}
+}
+
+// ListRange implements the kvdb.Ranger interface.
+func (db *DB) ListRange(bucket, prefix, after []byte, limit int) ([]*database.Entry, error) {
+	return kvdb.ListRange(db.DB, bucket, prefix, after, limit)
+}
+
+// Snapshot returns the entries of the given tables at the same point in
+// time. The database must implement the kvdb.Viewer interface.
+func (db *DB) Snapshot(tables []string) ([]*Table, error) {
+	v, ok := db.DB.(kvdb.Viewer)
+	if !ok {
+		return nil, errors.New("the database does not support snapshots")
+	}
+	var result []*Table
+	err := v.View(func(r kvdb.Reader) error {
+		var err error
+		result, err = ReadTables(r, tables)
+		return err
+	})
+	return result, err
+}
+
+// ReadTables returns the entries of the given tables of a database that is
+// not in use, or of a read-only transaction.
+func ReadTables(db kvdb.Reader, tables []string) ([]*Table, error) {
+	result := make([]*Table, 0, len(tables))
+	for _, name := range tables {
+		entries, err := db.List([]byte(name))
+		if err != nil && !database.IsErrNotFound(err) {
+			return nil, errors.Wrapf(err, "error listing %s", name)
+		}
+		result = append(result, &Table{Name: name, Entries: entries})
+	}
+	return result, nil
+}
+
+// WriteTables stores the entries of the given tables, creating them if
+// necessary.
+func WriteTables(db nosql.DB, tables []*Table) error {
+	for _, t := range tables {
+		if err := db.CreateTable([]byte(t.Name)); err != nil {
+			return errors.Wrapf(err, "error creating table %s", t.Name)
+		}
+		for _, e := range t.Entries {
+			if err := db.Set([]byte(t.Name), e.Key, e.Value); err != nil {
+				return errors.Wrapf(err, "error storing %s in %s", e.Key, t.Name)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package backup
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/go-ocf/step-ca/kvdb"
+	"github.com/go-ocf/step-ca/sqldb"
+	"github.com/go-ocf/step-ca/sqldb/sqldbtest"
+	"github.com/smallstep/nosql"
+	"github.com/smallstep/nosql/database"
+)
+
+func TestSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dbs := make(map[string]nosql.DB)
+	for typ, path := range map[string]string{
+		kvdb.BadgerDriver: filepath.Join(dir, "badger"),
+		kvdb.BoltDriver:   filepath.Join(dir, "bolt.db"),
+	} {
+		db, err := kvdb.New(typ, path, database.WithValueDir(path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		dbs[typ] = db
+	}
+	if dbs[sqldb.PostgreSQL], err = sqldb.NewFromDB(sqldb.PostgreSQL, sqldbtest.NewServer().DB()); err != nil {
+		t.Fatal(err)
+	}
+
+	tables := []string{"records", "index"}
+	for typ, d := range dbs {
+		t.Run(typ, func(t *testing.T) {
+			db := NewDB(d)
+			for _, name := range tables {
+				if err := db.CreateTable([]byte(name)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// Every record is written with its index entry in a single
+			// transaction, so every snapshot has as many of both.
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 50; i++ {
+					key := []byte(fmt.Sprintf("%03d", i))
+					tx := new(database.Tx)
+					tx.Set([]byte("records"), key, key)
+					tx.Set([]byte("index"), key, key)
+					if err := db.Update(tx); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}()
+			for i := 0; i < 20; i++ {
+				result, err := db.Snapshot(tables)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(result[0].Entries) != len(result[1].Entries) {
+					t.Fatalf("Snapshot() has %d records and %d index entries",
+						len(result[0].Entries), len(result[1].Entries))
+				}
+			}
+			wg.Wait()
+
+			result, err := db.Snapshot(tables)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(result[0].Entries) != 50 {
+				t.Errorf("Snapshot() has %d records, want 50", len(result[0].Entries))
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package backup
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"io"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Encrypted archives start with encryptedMagic, followed by the scrypt salt
+// and the AES-256-GCM nonce.
+var encryptedMagic = []byte("STEPCA-BACKUP-ENC1")
+
+const saltSize = 16
+
+// Parameters of the scrypt key derivation.
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// IsEncrypted returns true if the data is an encrypted archive.
+func IsEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, encryptedMagic)
+}
+
+func newAEAD(password, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key(password, salt, scryptN, scryptR, scryptP, 32)
+	if err != nil {
+		return nil, errors.Wrap(err, "error deriving encryption key")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	return aead, errors.WithStack(err)
+}
+
+// Encrypt encrypts an archive with a key derived from the password.
+func Encrypt(data, password []byte) ([]byte, error) {
+	salt := make([]byte, saltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, errors.Wrap(err, "error generating salt")
+	}
+	aead, err := newAEAD(password, salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, errors.Wrap(err, "error generating nonce")
+	}
+	out := append(append(append([]byte{}, encryptedMagic...), salt...), nonce...)
+	// The header is authenticated as additional data.
+	return aead.Seal(out, nonce, data, out), nil
+}
+
+// Decrypt decrypts an archive encrypted with the password.
+func Decrypt(data, password []byte) ([]byte, error) {
+	if !IsEncrypted(data) {
+		return nil, errors.New("archive is not encrypted")
+	}
+	rest := data[len(encryptedMagic):]
+	if len(rest) < saltSize {
+		return nil, errors.New("encrypted archive is truncated")
+	}
+	aead, err := newAEAD(password, rest[:saltSize])
+	if err != nil {
+		return nil, err
+	}
+	headerSize := len(encryptedMagic) + saltSize + aead.NonceSize()
+	if len(data) < headerSize {
+		return nil, errors.New("encrypted archive is truncated")
+	}
+	nonce := data[headerSize-aead.NonceSize() : headerSize]
+	out, err := aead.Open(nil, nonce, data[headerSize:], data[:headerSize])
+	if err != nil {
+		return nil, errors.New("error decrypting archive: invalid password or corrupted archive")
+	}
+	return out, nil
+}
@@ -11,11 +11,15 @@ import (
 	"net/url"
 	"reflect"
 	"strings"
+	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/go-ocf/step-ca/acme"
 	acmeAPI "github.com/go-ocf/step-ca/acme/api"
+	"github.com/go-ocf/step-ca/admin"
 	"github.com/go-ocf/step-ca/authority"
+	"github.com/go-ocf/step-ca/est"
+	"github.com/go-ocf/step-ca/lock"
 	"github.com/pkg/errors"
 	"github.com/smallstep/certificates/api"
 	stepCA "github.com/smallstep/certificates/ca"
@@ -57,6 +61,27 @@ func WithPassword(password []byte) Option {
 	}
 }
 
+// Unused ACME nonces are purged every nonceJobInterval once they are older
+// than nonceMaxAge.
+const (
+	nonceJobInterval = time.Hour
+	nonceMaxAge      = 24 * time.Hour
+)
+
+// The ACME certificates scheduled for revocation are revoked by a job run
+// every revocationJobInterval.
+const revocationJobInterval = 5 * time.Minute
+
+// The CRLs are generated every crlJobInterval, well before they expire.
+const crlJobInterval = time.Hour
+
+// The ACME orders that expired without a certificate are purged every
+// orderJobInterval once they expired more than orderMaxAge ago.
+const (
+	orderJobInterval = time.Hour
+	orderMaxAge      = 7 * 24 * time.Hour
+)
+
 // WithDatabase sets the given authority database to the CA options.
 func WithDatabase(db db.AuthDB) Option {
 	return func(o *options) {
@@ -72,6 +97,11 @@ type CA struct {
 	srv     *server.Server
 	opts    *options
 	renewer *stepCA.TLSRenewer
+	jobs    []*lock.Job
+	// insecureSrv serves the ACME endpoints over plain HTTP, if configured.
+	insecureSrv *insecureServer
+	// estSrv serves the EST-coaps enrollments, if configured.
+	estSrv *est.Server
 }
 
 // New creates and initializes the CA with the given configuration and options.
@@ -148,6 +178,12 @@ func (ca *CA) Init(config *authority.Config) (*CA, error) {
 		routerHandler.Route(r)
 	})
 
+	// Add the CRL endpoints of the intermediates
+	for _, p := range []string{"", "/1.0"} {
+		mux.Get(p+"/crl", crlHandler(auth))
+		mux.Get(p+"/crl/{fingerprint}", crlHandler(auth))
+	}
+
 	//Add ACME api endpoints in /acme and /1.0/acme
 	dns := config.DNSNames[0]
 	u, err := url.Parse("https://" + config.Address)
@@ -160,7 +196,34 @@ func (ca *CA) Init(config *authority.Config) (*CA, error) {
 	}
 
 	prefix := "acme"
-	acmeAuth := acme.NewAuthority(auth.GetDatabase().(nosql.DB), dns, prefix, auth)
+	acmeOpts := []acme.Option{
+		acme.WithAlternateChains(auth.GetAlternateChains()),
+		acme.WithManufacturerRoots(auth.GetManufacturerRoots()),
+		acme.WithEventBus(auth.GetEventBus()),
+	}
+	if config.ACME != nil {
+		validator, err := acme.NewValidator(config.ACME.Validation)
+		if err != nil {
+			return nil, err
+		}
+		nonces, err := acme.NewNonceService(auth.GetDatabase().(nosql.DB), config.ACME.Nonces)
+		if err != nil {
+			return nil, err
+		}
+		acmeOpts = append(acmeOpts,
+			acme.WithProvisionerOptions(config.ACME.Provisioners),
+			acme.WithValidator(validator),
+			acme.WithNonceService(nonces),
+			acme.WithURLOptions(config.ACME.URLs),
+			acme.WithLegacyProvisioner(config.ACME.LegacyProvisioner))
+		if config.ACME.Validation != nil {
+			acmeOpts = append(acmeOpts, acme.WithMaxValidationAttempts(config.ACME.Validation.MaxAttempts))
+		}
+	}
+	acmeAuth, err := acme.NewAuthority(auth.GetDatabase().(nosql.DB), dns, prefix, auth, acmeOpts...)
+	if err != nil {
+		return nil, err
+	}
 	acmeRouterHandler := acmeAPI.New(acmeAuth)
 	mux.Route("/"+prefix, func(r chi.Router) {
 		acmeRouterHandler.Route(r)
@@ -171,6 +234,22 @@ func (ca *CA) Init(config *authority.Config) (*CA, error) {
 		acmeRouterHandler.Route(r)
 	})
 
+	// The insecure listener only serves the ACME endpoints; the admin and
+	// the regular CA endpoints are never exposed over plain HTTP.
+	var insecureHandler http.Handler
+	if config.ACME != nil && len(config.ACME.InsecureAddress) > 0 {
+		insecureHandler = newInsecureHandler(prefix, acmeRouterHandler)
+	}
+
+	// Add the admin api endpoints in /admin if any credentials are configured
+	if config.Admin != nil && (len(config.Admin.Token) > 0 || len(config.Admin.Fingerprints) > 0) {
+		var inv admin.InventoryInterface
+		if i := auth.GetInventory(); i != nil {
+			inv = i
+		}
+		admin.New(acmeAuth, inv, auth, *config.Admin).Route(mux)
+	}
+
 	/*
 		// helpful routine for logging all routes //
 		walkFunc := func(method string, route string, handler http.Handler, middlewares ...func(http.Handler) http.Handler) error {
@@ -189,6 +268,9 @@ func (ca *CA) Init(config *authority.Config) (*CA, error) {
 			return nil, err
 		}
 		handler = m.Middleware(handler)
+		if insecureHandler != nil {
+			insecureHandler = m.Middleware(insecureHandler)
+		}
 	}
 
 	// Add logger if configured
@@ -198,24 +280,85 @@ func (ca *CA) Init(config *authority.Config) (*CA, error) {
 			return nil, err
 		}
 		handler = logger.Middleware(handler)
+		if insecureHandler != nil {
+			insecureHandler = logger.Middleware(insecureHandler)
+		}
+	}
+
+	// Background jobs run in one of the replicas sharing the database.
+	locker, err := lock.New(auth.GetDatabase().(nosql.DB))
+	if err != nil {
+		return nil, err
+	}
+	ca.jobs = []*lock.Job{
+		locker.NewJob("acme-nonce-purge", nonceJobInterval, func() error {
+			return acmeAuth.PurgeNonces(nonceMaxAge)
+		}),
+		locker.NewJob("acme-scheduled-revocations", revocationJobInterval, acmeAuth.RevokeScheduledCertificates),
+		locker.NewJob("acme-order-purge", orderJobInterval, func() error {
+			return acmeAuth.PurgeOrders(orderMaxAge)
+		}),
+		locker.NewJob("crl-generation", crlJobInterval, auth.GenerateCRLs),
+	}
+	for _, j := range ca.jobs {
+		j.Start()
 	}
 
 	ca.auth = auth
 	ca.srv = server.New(config.Address, handler, tlsConfig)
+	if insecureHandler != nil {
+		ca.insecureSrv = newInsecureServer(config.ACME.InsecureAddress, insecureHandler)
+	}
+	if len(estAddress(config)) > 0 {
+		if ca.estSrv, err = est.New(auth, config.EST, estPolicy(config), tlsConfig); err != nil {
+			ca.stopJobs()
+			return nil, err
+		}
+	}
 	return ca, nil
 }
 
-// Run starts the CA calling to the server ListenAndServe method.
+// Run starts the CA calling to the server ListenAndServe method. The
+// insecure ACME listener, if any, is started first.
 func (ca *CA) Run() error {
+	if ca.insecureSrv != nil {
+		ln, err := ca.insecureSrv.listen()
+		if err != nil {
+			return errors.Wrap(err, "error starting the insecure ACME listener")
+		}
+		go ca.insecureSrv.serve(ln)
+	}
+	if ca.estSrv != nil {
+		ln, err := ca.estSrv.Listen()
+		if err != nil {
+			return errors.Wrap(err, "error starting the EST-coaps listener")
+		}
+		go func() {
+			if err := ca.estSrv.Serve(ln); err != nil {
+				log.Printf("error serving EST-coaps: %+v\n", err)
+			}
+		}()
+	}
 	return ca.srv.ListenAndServe()
 }
 
 // Stop stops the CA calling to the server Shutdown method.
 func (ca *CA) Stop() error {
 	ca.renewer.Stop()
+	ca.stopJobs()
 	if err := ca.auth.Shutdown(); err != nil {
 		log.Printf("error stopping ca.Authority: %+v\n", err)
 	}
+	if ca.insecureSrv != nil {
+		if err := ca.insecureSrv.shutdown(); err != nil {
+			log.Printf("error stopping the insecure ACME listener: %+v\n", err)
+		}
+	}
+	if ca.estSrv != nil {
+		if err := ca.estSrv.Shutdown(); err != nil {
+			log.Printf("error stopping the EST-coaps listener: %+v\n", err)
+		}
+	}
 	return ca.srv.Shutdown()
 }
 
@@ -239,6 +382,18 @@ func (ca *CA) Reload() error {
 		return errors.New("error reloading ca: database configuration cannot change")
 	}
 
+	// Do not allow reload if the insecure ACME listener has changed.
+	if insecureAddress(ca.config) != insecureAddress(config) {
+		logContinue("Reload failed because the insecure ACME address has changed.")
+		return errors.New("error reloading ca: insecure ACME address cannot change")
+	}
+
+	// Do not allow reload if the EST-coaps listener has changed.
+	if estAddress(ca.config) != estAddress(config) {
+		logContinue("Reload failed because the EST-coaps address has changed.")
+		return errors.New("error reloading ca: EST-coaps address cannot change")
+	}
+
 	newCA, err := New(config,
 		WithPassword(ca.opts.password),
 		WithConfigFile(ca.opts.configFile),
@@ -250,21 +405,84 @@ func (ca *CA) Reload() error {
 	}
 
 	if err = ca.srv.Reload(newCA.srv); err != nil {
+		newCA.renewer.Stop()
+		newCA.stopJobs()
+		newCA.auth.GetEventBus().Close()
 		logContinue("Reload failed because server could not be replaced.")
 		return errors.Wrap(err, "error reloading server")
 	}
 
-	// 1. Stop previous renewer
+	// 1. Stop previous renewer, background jobs and event delivery
 	// 2. Replace ca properties
 	// Do not replace ca.srv
 	ca.renewer.Stop()
+	ca.stopJobs()
+	ca.auth.GetEventBus().Close()
 	ca.auth = newCA.auth
 	ca.config = newCA.config
 	ca.opts = newCA.opts
 	ca.renewer = newCA.renewer
+	ca.jobs = newCA.jobs
+	if ca.insecureSrv != nil {
+		ca.insecureSrv.setHandler(newCA.insecureSrv.handler)
+	}
+	if ca.estSrv != nil {
+		ca.estSrv.Reload(newCA.estSrv)
+	}
+	return nil
+}
+
+// insecureAddress returns the address of the insecure ACME listener of the
+// configuration, empty if it is disabled.
+func insecureAddress(config *authority.Config) string {
+	if config.ACME == nil {
+		return ""
+	}
+	return config.ACME.InsecureAddress
+}
+
+// estAddress returns the address of the EST-coaps listener of the
+// configuration, empty if it is disabled.
+func estAddress(config *authority.Config) string {
+	if config.EST == nil {
+		return ""
+	}
+	return config.EST.Address
+}
+
+// estPolicy returns the identifier policy of the ACME provisioner of the
+// EST-coaps server, if any.
+func estPolicy(config *authority.Config) *acme.IdentifierPolicy {
+	if config.ACME == nil || config.EST == nil {
+		return nil
+	}
+	if o := config.ACME.Provisioners[config.EST.Provisioner]; o != nil {
+		return o.Policy
+	}
 	return nil
 }
 
+// crlHandler serves the CRL of the intermediate with the fingerprint of the
+// request path, or of the active intermediate.
+func crlHandler(auth *authority.Authority) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		der, err := auth.GetCRL(chi.URLParam(r, "fingerprint"))
+		if err != nil {
+			api.WriteError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/pkix-crl")
+		w.Write(der)
+	}
+}
+
+// stopJobs stops the background jobs of the CA.
+func (ca *CA) stopJobs() {
+	for _, j := range ca.jobs {
+		j.Stop()
+	}
+}
+
 // getTLSConfig returns a TLSConfig for the CA server with a self-renewing
 // server certificate.
 func (ca *CA) getTLSConfig(auth *authority.Authority) (*tls.Config, error) {
@@ -0,0 +1,100 @@
+package ca
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/api"
+	"github.com/smallstep/certificates/server"
+)
+
+// unixPrefix is the prefix of the insecure addresses that are unix sockets.
+const unixPrefix = "unix:"
+
+// insecureServer serves the ACME endpoints over plain HTTP, on a TCP address
+// or a unix socket, for the clients behind a gateway that terminates TLS.
+// Its handler can be replaced on reloads without closing the listener.
+type insecureServer struct {
+	srv     *http.Server
+	mu      sync.RWMutex
+	handler http.Handler
+}
+
+// newInsecureHandler returns the handler of the insecure server. It only
+// routes the ACME endpoints under the given prefix.
+func newInsecureHandler(prefix string, acmeHandler api.RouterHandler) http.Handler {
+	mux := chi.NewRouter()
+	mux.Route("/"+prefix, func(r chi.Router) {
+		acmeHandler.Route(r)
+	})
+	mux.Route("/2.0/"+prefix, func(r chi.Router) {
+		acmeHandler.Route(r)
+	})
+	return mux
+}
+
+// newInsecureServer returns the insecure server listening on the given
+// address.
+func newInsecureServer(addr string, handler http.Handler) *insecureServer {
+	s := &insecureServer{handler: handler}
+	s.srv = &http.Server{
+		Addr:         addr,
+		Handler:      http.HandlerFunc(s.serveHTTP),
+		WriteTimeout: 15 * time.Second,
+		ReadTimeout:  15 * time.Second,
+		IdleTimeout:  15 * time.Second,
+	}
+	return s
+}
+
+func (s *insecureServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	h := s.handler
+	s.mu.RUnlock()
+	h.ServeHTTP(w, r)
+}
+
+// setHandler replaces the handler of the server.
+func (s *insecureServer) setHandler(h http.Handler) {
+	s.mu.Lock()
+	s.handler = h
+	s.mu.Unlock()
+}
+
+// listen opens the listener of the server. A stale unix socket left behind
+// by a previous run is removed first.
+func (s *insecureServer) listen() (net.Listener, error) {
+	if !strings.HasPrefix(s.srv.Addr, unixPrefix) {
+		return net.Listen("tcp", s.srv.Addr)
+	}
+	path := strings.TrimPrefix(s.srv.Addr, unixPrefix)
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, errors.Wrapf(err, "error removing socket %s", path)
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+// serve serves the requests of the listener until the server is shut down.
+func (s *insecureServer) serve(ln net.Listener) {
+	log.Printf("Serving insecure ACME HTTP on %s ...", s.srv.Addr)
+	if err := s.srv.Serve(ln); err != http.ErrServerClosed {
+		log.Println(errors.Wrap(err, "unexpected error serving insecure ACME"))
+	}
+}
+
+// shutdown gracefully shuts down the server.
+func (s *insecureServer) shutdown() error {
+	ctx, cancel := context.WithTimeout(context.Background(), server.ServerShutdownTimeout)
+	defer cancel()
+	return s.srv.Shutdown(ctx)
+}
@@ -0,0 +1,172 @@
+package ca
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-ocf/step-ca/acme"
+	acmeAPI "github.com/go-ocf/step-ca/acme/api"
+	"github.com/go-ocf/step-ca/kvdb"
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/authority/provisioner"
+)
+
+// testSignAuth loads the ACME provisioner named acme.
+type testSignAuth struct {
+	acme.SignAuthority
+}
+
+func (testSignAuth) LoadProvisionerByID(id string) (provisioner.Interface, error) {
+	if id != "acme/acme" {
+		return nil, errors.Errorf("provisioner %s not found", id)
+	}
+	return &provisioner.ACME{Type: "ACME", Name: "acme"}, nil
+}
+
+func TestInsecureHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := kvdb.New(kvdb.BoltDriver, filepath.Join(dir, "acme.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	auth, err := acme.NewAuthority(db, "ca.example.com", "acme", testSignAuth{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(newInsecureHandler("acme", acmeAPI.New(auth)))
+	defer srv.Close()
+
+	tests := []struct {
+		method string
+		path   string
+		status int
+	}{
+		{"GET", "/acme/acme/directory", http.StatusOK},
+		{"GET", "/2.0/acme/acme/directory", http.StatusOK},
+		{"HEAD", "/acme/acme/new-nonce", http.StatusOK},
+		{"GET", "/admin/accounts", http.StatusNotFound},
+		{"GET", "/est/cacerts", http.StatusNotFound},
+		{"GET", "/.well-known/est/cacerts", http.StatusNotFound},
+		{"GET", "/health", http.StatusNotFound},
+		{"GET", "/roots", http.StatusNotFound},
+		{"POST", "/sign", http.StatusNotFound},
+		{"POST", "/1.0/sign", http.StatusNotFound},
+		{"GET", "/provisioners", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, srv.URL+tt.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if res.StatusCode != tt.status {
+				t.Errorf("status = %d, want %d", res.StatusCode, tt.status)
+			}
+		})
+	}
+
+	// The links of the directory are http links to the insecure listener.
+	res, err := http.Get(srv.URL + "/acme/acme/directory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var links map[string]interface{}
+	if err := json.NewDecoder(res.Body).Decode(&links); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"newNonce", "newAccount", "newOrder", "revokeCert", "keyChange"} {
+		link, _ := links[name].(string)
+		if !strings.HasPrefix(link, srv.URL+"/acme/acme/") {
+			t.Errorf("directory %s = %q, want a link under %s/acme/acme/", name, link, srv.URL)
+		}
+	}
+}
+
+func TestInsecureServerListen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	t.Run("tcp", func(t *testing.T) {
+		ln, err := newInsecureServer("127.0.0.1:0", http.NotFoundHandler()).listen()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		if ln.Addr().Network() != "tcp" {
+			t.Errorf("listener network = %s, want tcp", ln.Addr().Network())
+		}
+	})
+
+	t.Run("stale socket", func(t *testing.T) {
+		path := filepath.Join(dir, "stale.sock")
+		stale, err := net.Listen("unix", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// A process that did not shut down cleanly leaves its socket behind.
+		stale.(*net.UnixListener).SetUnlinkOnClose(false)
+		stale.Close()
+		if _, err := os.Stat(path); err != nil {
+			t.Fatal(err)
+		}
+
+		s := newInsecureServer(unixPrefix+path, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusTeapot)
+		}))
+		ln, err := s.listen()
+		if err != nil {
+			t.Fatalf("listen() on a stale socket error = %v", err)
+		}
+		go s.srv.Serve(ln)
+		defer s.shutdown()
+
+		client := &http.Client{Transport: &http.Transport{
+			Dial: func(network, addr string) (net.Conn, error) {
+				return net.Dial("unix", path)
+			},
+		}}
+		res, err := client.Get("http://unix/acme/acme/directory")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusTeapot {
+			t.Errorf("status = %d, want %d", res.StatusCode, http.StatusTeapot)
+		}
+	})
+
+	t.Run("regular file", func(t *testing.T) {
+		path := filepath.Join(dir, "file.sock")
+		if err := ioutil.WriteFile(path, []byte("data"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if ln, err := newInsecureServer(unixPrefix+path, http.NotFoundHandler()).listen(); err == nil {
+			ln.Close()
+			t.Fatal("listen() on a regular file error = nil")
+		}
+		if b, err := ioutil.ReadFile(path); err != nil || string(b) != "data" {
+			t.Errorf("regular file changed by listen(): %q, %v", b, err)
+		}
+	})
+}
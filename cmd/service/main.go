@@ -141,7 +141,8 @@ $ step-ca $STEPPATH/config/ca.json --password-file ./password.txt
 	// All non-successful output should be written to stderr
 	app.Writer = os.Stdout
 	app.ErrWriter = os.Stderr
-	app.Commands = command.Retrieve()
+	app.Commands = append(command.Retrieve(), commands.InventoryCommand, commands.MigrateCommand,
+		commands.BackupCommand, commands.RestoreCommand, commands.PerspectiveCommand)
 
 	// Start the golang debug logger if environment variable is set.
 	// See https://golang.org/pkg/net/http/pprof/
@@ -0,0 +1,540 @@
+package commands
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/go-ocf/step-ca/authority"
+	"github.com/go-ocf/step-ca/backup"
+	"github.com/pkg/errors"
+	"github.com/smallstep/cli/crypto/pemutil"
+	"github.com/smallstep/cli/errs"
+	"github.com/urfave/cli"
+)
+
+// BackupCommand exports the state of a CA to an archive.
+var BackupCommand = cli.Command{
+	Name:   "backup",
+	Usage:  "export the database, certificates and keys of the CA to an archive",
+	Action: backupAction,
+	UsageText: `**step-ca backup** <config> **--out**=<file>
+	[**--password-file**=<file>] [**--no-keys**]
+	[**--ca-url**=<uri> **--root**=<file> **--token**=<token>]`,
+	Description: `**step-ca backup** exports the ACME records and the issued certificate
+records of the CA, with its configuration, certificates and keys, to a
+gzipped tar archive. The archive contains a manifest with the checksum of
+every member. An archive with the keys must be encrypted with
+**--password-file**; use **--no-keys** to leave them out.
+
+The database of a stopped CA is read directly. With **--ca-url** the records
+are a consistent snapshot taken by the running CA through the admin API; the
+configuration, certificates and keys are read from the local files.
+
+## POSITIONAL ARGUMENTS
+
+<config>
+: File that configures the operation of the Step CA.
+
+## EXAMPLES
+
+Back up a stopped CA to an encrypted archive:
+'''
+$ step-ca backup $STEPPATH/config/ca.json --out ca-backup.tar.gz.enc \
+  --password-file ./backup-password.txt
+'''
+
+Back up the records of a running CA, without the keys:
+'''
+$ step-ca backup $STEPPATH/config/ca.json --out ca-backup.tar.gz --no-keys \
+  --ca-url https://ca.example.com --root root_ca.crt --token $ADMIN_TOKEN
+'''`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "out",
+			Usage: "The <file> to write the archive to.",
+		},
+		cli.StringFlag{
+			Name:  "password-file",
+			Usage: "Encrypt the archive with the password in the <file>. Required unless '--no-keys' is used.",
+		},
+		cli.BoolFlag{
+			Name:  "no-keys",
+			Usage: "Do not include the configuration, certificates and keys.",
+		},
+		cli.StringFlag{
+			Name:  "ca-url",
+			Usage: "<URI> of the running Step Certificate Authority to take a snapshot of.",
+		},
+		cli.StringFlag{
+			Name:  "root",
+			Usage: "The path to the PEM <file> used as the root certificate authority.",
+		},
+		cli.StringFlag{
+			Name:   "token",
+			Usage:  "The admin bearer <token>.",
+			EnvVar: "STEP_CA_ADMIN_TOKEN",
+		},
+	},
+}
+
+// RestoreCommand imports the state of a CA from an archive.
+var RestoreCommand = cli.Command{
+	Name:   "restore",
+	Usage:  "import the database, certificates and keys of the CA from an archive",
+	Action: restoreAction,
+	UsageText: `**step-ca restore** <config> <archive>
+	[**--password-file**=<file>] [**--keys**] [**--root**=<file>] [**--force**]`,
+	Description: `**step-ca restore** verifies the checksums of an archive created by
+**step-ca backup**, verifies that it was taken from a CA with the configured
+root and intermediate certificates, and imports its records into the
+configured database. The CA must be stopped.
+
+With **--keys** the certificates of the archive are verified before any file
+is written: its roots must be trusted and its intermediate must chain to one
+of them. The trusted roots are the ones of **--root**, or else the configured
+roots that exist before the restore.
+
+## POSITIONAL ARGUMENTS
+
+<config>
+: File that configures the operation of the Step CA.
+
+<archive>
+: The archive created by **step-ca backup**.
+
+## EXAMPLES
+
+Restore a CA on a new host, with the certificates and keys of the archive:
+'''
+$ step-ca restore $STEPPATH/config/ca.json ca-backup.tar.gz.enc \
+  --password-file ./backup-password.txt --keys --root ./root_ca.crt
+'''`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "password-file",
+			Usage: "Decrypt the archive with the password in the <file>.",
+		},
+		cli.BoolFlag{
+			Name: "keys",
+			Usage: `Write the certificates and keys of the archive to the configured paths
+that do not exist yet.`,
+		},
+		cli.StringFlag{
+			Name: "root",
+			Usage: `The PEM <file> with the root certificates the certificates of the archive
+are verified against. Defaults to the configured roots.`,
+		},
+		cli.BoolFlag{
+			Name:  "force",
+			Usage: "Import the records into a database that is not empty.",
+		},
+	},
+}
+
+// Names of the files in the archives.
+const (
+	backupConfigFile          = "ca.json"
+	backupIntermediateFile    = "intermediate_ca.crt"
+	backupIntermediateKeyFile = "intermediate_ca_key"
+)
+
+func backupRootFile(i int) string {
+	return fmt.Sprintf("root_ca_%d.crt", i)
+}
+
+// isBackupRootFile returns true if the archive file is a root certificate,
+// of the CA or of a named issuer.
+func isBackupRootFile(name string) bool {
+	return strings.HasPrefix(name, "root_ca_") || strings.HasSuffix(name, "_root_ca.crt")
+}
+
+// keyFiles returns the paths of the certificates and keys of the CA, of its
+// rotated intermediates and of its named issuers, by their name in the
+// archives.
+func keyFiles(config *authority.Config) map[string]string {
+	files := map[string]string{
+		backupIntermediateFile:    config.IntermediateCert,
+		backupIntermediateKeyFile: config.IntermediateKey,
+	}
+	for i, fn := range config.Root {
+		files[backupRootFile(i)] = fn
+	}
+	addIntermediates := func(prefix string, ics []*authority.IntermediateConfig) {
+		for i, ic := range ics {
+			if ic == nil {
+				continue
+			}
+			files[fmt.Sprintf("%sintermediate_ca_%d.crt", prefix, i)] = ic.Crt
+			files[fmt.Sprintf("%sintermediate_ca_%d_key", prefix, i)] = ic.Key
+		}
+	}
+	addIntermediates("", config.Intermediates)
+	for name, ic := range config.Issuers {
+		if ic == nil {
+			continue
+		}
+		prefix := "issuer_" + url.PathEscape(name) + "_"
+		files[prefix+"root_ca.crt"] = ic.Root
+		files[prefix+backupIntermediateFile] = ic.Crt
+		files[prefix+backupIntermediateKeyFile] = ic.Key
+		addIntermediates(prefix, ic.Intermediates)
+	}
+	return files
+}
+
+func readPasswordFile(fn string) ([]byte, error) {
+	password, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error reading %s", fn)
+	}
+	return bytes.TrimRightFunc(password, unicode.IsSpace), nil
+}
+
+// caFingerprints returns the fingerprints of the configured root and
+// intermediate certificates, and verifies that the intermediate chains to
+// one of the roots.
+func caFingerprints(config *authority.Config) ([]string, string, error) {
+	pool := x509.NewCertPool()
+	var roots []string
+	for _, fn := range config.Root {
+		crt, err := pemutil.ReadCertificate(fn)
+		if err != nil {
+			return nil, "", err
+		}
+		pool.AddCert(crt)
+		roots = append(roots, backup.Fingerprint(crt))
+	}
+	crt, err := pemutil.ReadCertificate(config.IntermediateCert)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := crt.Verify(x509.VerifyOptions{
+		Roots:     pool,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}); err != nil {
+		return nil, "", errors.Wrapf(err, "error verifying %s", config.IntermediateCert)
+	}
+	return roots, backup.Fingerprint(crt), nil
+}
+
+func backupAction(ctx *cli.Context) error {
+	if err := errs.NumberOfArguments(ctx, 1); err != nil {
+		return err
+	}
+	if len(ctx.String("out")) == 0 {
+		return errs.RequiredFlag(ctx, "out")
+	}
+	if !ctx.Bool("no-keys") && len(ctx.String("password-file")) == 0 {
+		return errors.New("flag '--password-file' is required to back up the keys: " +
+			"use '--no-keys' to leave them out of the archive")
+	}
+	configFile := ctx.Args().Get(0)
+	config, err := authority.LoadConfiguration(configFile)
+	if err != nil {
+		return err
+	}
+
+	var archive *backup.Archive
+	if len(ctx.String("ca-url")) > 0 {
+		for _, f := range []string{"root", "token"} {
+			if len(ctx.String(f)) == 0 {
+				return errs.RequiredFlag(ctx, f)
+			}
+		}
+		if archive, err = getBackup(ctx.String("ca-url"), ctx.String("root"), ctx.String("token")); err != nil {
+			return err
+		}
+	} else {
+		db, err := authority.OpenDatabase(config.DB)
+		if err != nil {
+			return err
+		}
+		tables, err := backup.ReadTables(db, authority.BackupTables())
+		db.Close()
+		if err != nil {
+			return err
+		}
+		roots, intermediate, err := caFingerprints(config)
+		if err != nil {
+			return err
+		}
+		archive = &backup.Archive{
+			Manifest: &backup.Manifest{Roots: roots, Intermediate: intermediate},
+			Tables:   tables,
+		}
+	}
+
+	if !ctx.Bool("no-keys") {
+		files := keyFiles(config)
+		files[backupConfigFile] = configFile
+		for name, fn := range files {
+			b, err := ioutil.ReadFile(fn)
+			if err != nil {
+				return errors.Wrapf(err, "error reading %s", fn)
+			}
+			archive.Files = append(archive.Files, &backup.File{Name: name, Path: fn, Data: b})
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := archive.Write(&buf); err != nil {
+		return err
+	}
+	data := buf.Bytes()
+	if fn := ctx.String("password-file"); len(fn) > 0 {
+		password, err := readPasswordFile(fn)
+		if err != nil {
+			return err
+		}
+		if data, err = backup.Encrypt(data, password); err != nil {
+			return err
+		}
+	}
+	if err := ioutil.WriteFile(ctx.String("out"), data, 0600); err != nil {
+		return errors.Wrapf(err, "error writing %s", ctx.String("out"))
+	}
+
+	var n int
+	for _, t := range archive.Manifest.Tables {
+		n += t.Entries
+	}
+	fmt.Printf("Backed up %d records of %d tables and %d files to %s.\n",
+		n, len(archive.Manifest.Tables), len(archive.Manifest.Files), ctx.String("out"))
+	return nil
+}
+
+// getBackup downloads a snapshot of the running CA.
+func getBackup(caURL, rootFile, token string) (*backup.Archive, error) {
+	client, err := newAdminClient(rootFile)
+	if err != nil {
+		return nil, err
+	}
+	client.Timeout = 10 * time.Minute
+	u := strings.TrimSuffix(caURL, "/") + "/admin/backup"
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error creating request for %s", u)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error querying %s", u)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		var e struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		return nil, errors.Errorf("error taking the snapshot: %s %s", resp.Status, e.Message)
+	}
+	return backup.Read(resp.Body)
+}
+
+func restoreAction(ctx *cli.Context) error {
+	if err := errs.NumberOfArguments(ctx, 2); err != nil {
+		return err
+	}
+	config, err := authority.LoadConfiguration(ctx.Args().Get(0))
+	if err != nil {
+		return err
+	}
+	fn := ctx.Args().Get(1)
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return errors.Wrapf(err, "error reading %s", fn)
+	}
+	if backup.IsEncrypted(data) {
+		if len(ctx.String("password-file")) == 0 {
+			return errors.Errorf("%s is encrypted: flag '--password-file' is required", fn)
+		}
+		password, err := readPasswordFile(ctx.String("password-file"))
+		if err != nil {
+			return err
+		}
+		if data, err = backup.Decrypt(data, password); err != nil {
+			return err
+		}
+	}
+	archive, err := backup.Read(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	if ctx.Bool("keys") {
+		roots, err := trustedRoots(config, ctx.String("root"))
+		if err != nil {
+			return err
+		}
+		if err := verifyArchiveCertificates(archive, roots); err != nil {
+			return errors.Wrapf(err, "error verifying %s", fn)
+		}
+		for name, fn := range keyFiles(config) {
+			f := archive.File(name)
+			if f == nil {
+				continue
+			}
+			if _, err := os.Stat(fn); err == nil || !os.IsNotExist(err) {
+				continue
+			}
+			if err := os.MkdirAll(filepath.Dir(fn), 0700); err != nil {
+				return errors.Wrapf(err, "error creating %s", filepath.Dir(fn))
+			}
+			if err := ioutil.WriteFile(fn, f.Data, 0600); err != nil {
+				return errors.Wrapf(err, "error writing %s", fn)
+			}
+			fmt.Printf("Restored %s.\n", fn)
+		}
+	}
+
+	// The records are only valid for the same CA.
+	roots, intermediate, err := caFingerprints(config)
+	if err != nil {
+		return err
+	}
+	if archive.Manifest.Intermediate != intermediate {
+		return errors.Errorf("%s was not taken from a CA with the intermediate %s", fn, config.IntermediateCert)
+	}
+	for _, r := range archive.Manifest.Roots {
+		if !containsString(roots, r) {
+			return errors.Errorf("%s was taken from a CA with a root that is not configured", fn)
+		}
+	}
+
+	db, err := authority.OpenDatabase(config.DB)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if !ctx.Bool("force") {
+		names := make([]string, len(archive.Tables))
+		for i, t := range archive.Tables {
+			names[i] = t.Name
+		}
+		current, err := backup.ReadTables(db, names)
+		if err != nil {
+			return err
+		}
+		for _, t := range current {
+			if len(t.Entries) > 0 {
+				return errors.Errorf("table %s of the database is not empty: use '--force' to import the records anyway", t.Name)
+			}
+		}
+	}
+	if err := backup.WriteTables(db, archive.Tables); err != nil {
+		return err
+	}
+
+	var n int
+	for _, t := range archive.Tables {
+		n += len(t.Entries)
+	}
+	fmt.Printf("Restored %d records of %d tables from %s, taken %s.\n",
+		n, len(archive.Tables), fn, archive.Manifest.Created.Format(time.RFC3339))
+	return nil
+}
+
+// trustedRoots returns the roots the certificates of an archive are verified
+// against: the ones of the given file, or else the configured roots, of the
+// CA and of its named issuers, that exist before the restore.
+func trustedRoots(config *authority.Config, rootFile string) ([]*x509.Certificate, error) {
+	if len(rootFile) > 0 {
+		return pemutil.ReadCertificateBundle(rootFile)
+	}
+	files := append([]string{}, config.Root...)
+	for _, ic := range config.Issuers {
+		if ic != nil && len(ic.Root) > 0 {
+			files = append(files, ic.Root)
+		}
+	}
+	var roots []*x509.Certificate
+	for _, fn := range files {
+		if _, err := os.Stat(fn); os.IsNotExist(err) {
+			continue
+		}
+		crts, err := pemutil.ReadCertificateBundle(fn)
+		if err != nil {
+			return nil, err
+		}
+		roots = append(roots, crts...)
+	}
+	if len(roots) == 0 {
+		return nil, errors.New("none of the configured roots exists: " +
+			"flag '--root' is required to restore the keys")
+	}
+	return roots, nil
+}
+
+// verifyArchiveCertificates verifies that the roots of the archive are
+// trusted and that its intermediates, of the CA and of its named issuers,
+// chain to one of them.
+func verifyArchiveCertificates(archive *backup.Archive, roots []*x509.Certificate) error {
+	pool := x509.NewCertPool()
+	trusted := make(map[string]bool, len(roots))
+	for _, crt := range roots {
+		pool.AddCert(crt)
+		trusted[backup.Fingerprint(crt)] = true
+	}
+	for _, r := range archive.Manifest.Roots {
+		if !trusted[r] {
+			return errors.Errorf("root %s is not trusted", r)
+		}
+	}
+	for _, f := range archive.Files {
+		if !strings.HasSuffix(f.Name, ".crt") {
+			continue
+		}
+		crt, err := parseCertificate(f.Data)
+		if err != nil {
+			return errors.Wrapf(err, "error parsing %s", f.Name)
+		}
+		switch {
+		case isBackupRootFile(f.Name):
+			if !trusted[backup.Fingerprint(crt)] {
+				return errors.Errorf("%s is not a trusted root", f.Name)
+			}
+		case f.Name == backupIntermediateFile && backup.Fingerprint(crt) != archive.Manifest.Intermediate:
+			return errors.Errorf("%s is not the intermediate of the manifest", f.Name)
+		default:
+			if _, err := crt.Verify(x509.VerifyOptions{
+				Roots:     pool,
+				KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+			}); err != nil {
+				return errors.Wrapf(err, "error verifying %s", f.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// parseCertificate parses a PEM encoded certificate.
+func parseCertificate(b []byte) (*x509.Certificate, error) {
+	v, err := pemutil.Parse(b)
+	if err != nil {
+		return nil, err
+	}
+	crt, ok := v.(*x509.Certificate)
+	if !ok {
+		return nil, errors.Errorf("found %T instead of a certificate", v)
+	}
+	return crt, nil
+}
+
+func containsString(list []string, v string) bool {
+	for _, s := range list {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,189 @@
+package commands
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-ocf/step-ca/authority"
+	"github.com/go-ocf/step-ca/backup"
+	stepAuthority "github.com/smallstep/certificates/authority"
+)
+
+type testCA struct {
+	root, intermediate *x509.Certificate
+}
+
+func newTestCA(t *testing.T) testCA {
+	t.Helper()
+	newCert := func(serial int64, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber:          big.NewInt(serial),
+			Subject:               pkix.Name{CommonName: "test"},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(time.Hour),
+			KeyUsage:              x509.KeyUsageCertSign,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+		}
+		if parent == nil {
+			parent, parentKey = tmpl, key
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, key.Public(), parentKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		crt, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return crt, key
+	}
+	root, rootKey := newCert(1, nil, nil)
+	intermediate, _ := newCert(2, root, rootKey)
+	return testCA{root: root, intermediate: intermediate}
+}
+
+func pemCert(crt *x509.Certificate) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: crt.Raw})
+}
+
+// archive returns the archive of a backup of the CA with its certificates.
+func (ca testCA) archive() *backup.Archive {
+	return &backup.Archive{
+		Manifest: &backup.Manifest{
+			Roots:        []string{backup.Fingerprint(ca.root)},
+			Intermediate: backup.Fingerprint(ca.intermediate),
+		},
+		Files: []*backup.File{
+			{Name: backupRootFile(0), Data: pemCert(ca.root)},
+			{Name: backupIntermediateFile, Data: pemCert(ca.intermediate)},
+		},
+	}
+}
+
+func TestVerifyArchiveCertificates(t *testing.T) {
+	ca, other := newTestCA(t), newTestCA(t)
+
+	forged := ca.archive()
+	forged.Files[0].Data = pemCert(other.root)
+	mixed := ca.archive()
+	mixed.Manifest.Intermediate = backup.Fingerprint(other.intermediate)
+	mixed.Files[1].Data = pemCert(other.intermediate)
+	issuer := ca.archive()
+	issuer.Files = append(issuer.Files,
+		&backup.File{Name: "issuer_ocf_root_ca.crt", Data: pemCert(other.root)},
+		&backup.File{Name: "issuer_ocf_intermediate_ca.crt", Data: pemCert(other.intermediate)},
+	)
+	rotated := ca.archive()
+	rotated.Files = append(rotated.Files, &backup.File{Name: "intermediate_ca_0.crt", Data: pemCert(other.intermediate)})
+
+	tests := []struct {
+		name    string
+		archive *backup.Archive
+		roots   []*x509.Certificate
+		wantErr bool
+	}{
+		{"trusted", ca.archive(), []*x509.Certificate{ca.root}, false},
+		{"untrusted", ca.archive(), []*x509.Certificate{other.root}, true},
+		{"forged root file", forged, []*x509.Certificate{ca.root}, true},
+		{"untrusted intermediate", mixed, []*x509.Certificate{ca.root}, true},
+		{"trusted issuer", issuer, []*x509.Certificate{ca.root, other.root}, false},
+		{"untrusted issuer", issuer, []*x509.Certificate{ca.root}, true},
+		{"untrusted rotated intermediate", rotated, []*x509.Certificate{ca.root}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyArchiveCertificates(tt.archive, tt.roots)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("verifyArchiveCertificates() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTrustedRoots(t *testing.T) {
+	dir, err := ioutil.TempDir("", "restore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := newTestCA(t)
+	rootFile := filepath.Join(dir, "root_ca.crt")
+	config := &authority.Config{Config: &stepAuthority.Config{Root: []string{rootFile}}}
+
+	// The roots restored from the archive are not trusted.
+	if _, err := trustedRoots(config, ""); err == nil {
+		t.Error("trustedRoots() without roots error = nil, want an error")
+	}
+	if err := ioutil.WriteFile(rootFile, pemCert(ca.root), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, flag := range []string{"", rootFile} {
+		roots, err := trustedRoots(config, flag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(roots) != 1 || !roots[0].Equal(ca.root) {
+			t.Errorf("trustedRoots(%q) = %v, want the root", flag, roots)
+		}
+	}
+}
+
+func TestKeyFiles(t *testing.T) {
+	config := &authority.Config{
+		Config: &stepAuthority.Config{
+			Root:             []string{"root.crt"},
+			IntermediateCert: "int.crt",
+			IntermediateKey:  "int.key",
+		},
+		Intermediates: []*authority.IntermediateConfig{{Crt: "next.crt", Key: "next.key"}},
+		Issuers: map[string]*authority.IssuerConfig{
+			"ocf/devices": {
+				Root:          "ocf_root.crt",
+				Crt:           "ocf_int.crt",
+				Key:           "ocf_int.key",
+				Intermediates: []*authority.IntermediateConfig{{Crt: "ocf_next.crt", Key: "ocf_next.key"}},
+			},
+		},
+	}
+	want := map[string]string{
+		"root_ca_0.crt":                              "root.crt",
+		"intermediate_ca.crt":                        "int.crt",
+		"intermediate_ca_key":                        "int.key",
+		"intermediate_ca_0.crt":                      "next.crt",
+		"intermediate_ca_0_key":                      "next.key",
+		"issuer_ocf%2Fdevices_root_ca.crt":           "ocf_root.crt",
+		"issuer_ocf%2Fdevices_intermediate_ca.crt":   "ocf_int.crt",
+		"issuer_ocf%2Fdevices_intermediate_ca_key":   "ocf_int.key",
+		"issuer_ocf%2Fdevices_intermediate_ca_0.crt": "ocf_next.crt",
+		"issuer_ocf%2Fdevices_intermediate_ca_0_key": "ocf_next.key",
+	}
+	got := keyFiles(config)
+	if len(got) != len(want) {
+		t.Errorf("keyFiles() = %v, want %v", got, want)
+	}
+	for name, fn := range want {
+		if got[name] != fn {
+			t.Errorf("keyFiles()[%q] = %q, want %q", name, got[name], fn)
+		}
+	}
+	for name := range want {
+		if isBackupRootFile(name) != (name == "root_ca_0.crt" || name == "issuer_ocf%2Fdevices_root_ca.crt") {
+			t.Errorf("isBackupRootFile(%q) = %v", name, isBackupRootFile(name))
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package commands
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/go-ocf/step-ca/admin"
+	"github.com/go-ocf/step-ca/inventory"
+	"github.com/pkg/errors"
+	"github.com/smallstep/cli/crypto/pemutil"
+	"github.com/smallstep/cli/errs"
+	"github.com/urfave/cli"
+)
+
+// InventoryCommand queries the issued certificate inventory of a running CA
+// through the admin API.
+var InventoryCommand = cli.Command{
+	Name:   "inventory",
+	Usage:  "query the issued certificate inventory",
+	Action: inventoryAction,
+	UsageText: `**step-ca inventory** **--ca-url**=<uri> **--root**=<file> **--token**=<token>
+	[**--device**=<uuid>] [**--subject**=<name>] [**--provisioner**=<name>]
+	[**--account**=<id>] [**--status**=<status>] [**--expires-within**=<duration>]
+	[**--json**]`,
+	Description: `**step-ca inventory** lists the certificates issued by the CA that match
+all the given filters, using the admin API of the running CA.
+
+## EXAMPLES
+
+List the valid certificates of a device:
+'''
+$ step-ca inventory --ca-url https://ca.example.com --root root_ca.crt \
+  --token $ADMIN_TOKEN --device 6a1b8d86-a9ea-4d4b-8b5b-c2c1d7d8a2f0 --status valid
+'''
+
+List the certificates expiring in the next 7 days:
+'''
+$ step-ca inventory --ca-url https://ca.example.com --root root_ca.crt \
+  --token $ADMIN_TOKEN --status valid --expires-within 168h
+'''`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "ca-url",
+			Usage: "<URI> of the targeted Step Certificate Authority.",
+		},
+		cli.StringFlag{
+			Name:  "root",
+			Usage: "The path to the PEM <file> used as the root certificate authority.",
+		},
+		cli.StringFlag{
+			Name:   "token",
+			Usage:  "The admin bearer <token>.",
+			EnvVar: "STEP_CA_ADMIN_TOKEN",
+		},
+		cli.StringFlag{
+			Name:  "device",
+			Usage: "Only list the certificates of the device with the given <uuid>.",
+		},
+		cli.StringFlag{
+			Name:  "subject",
+			Usage: "Only list the certificates with the given subject common <name>.",
+		},
+		cli.StringFlag{
+			Name:  "provisioner",
+			Usage: "Only list the certificates authorized by the provisioner with the given <name>.",
+		},
+		cli.StringFlag{
+			Name:  "account",
+			Usage: "Only list the certificates issued to the ACME account with the given <id>.",
+		},
+		cli.StringFlag{
+			Name:  "status",
+			Usage: "Only list the certificates with the given <status>; valid, expired or revoked.",
+		},
+		cli.DurationFlag{
+			Name:  "expires-within",
+			Usage: "Only list the certificates expiring within the given <duration> from now.",
+		},
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "Print the certificates as JSON.",
+		},
+	},
+}
+
+func inventoryAction(ctx *cli.Context) error {
+	if err := errs.NumberOfArguments(ctx, 0); err != nil {
+		return err
+	}
+	for _, f := range []string{"ca-url", "root", "token"} {
+		if len(ctx.String(f)) == 0 {
+			return errs.RequiredFlag(ctx, f)
+		}
+	}
+
+	client, err := newAdminClient(ctx.String("root"))
+	if err != nil {
+		return err
+	}
+
+	u, err := url.Parse(strings.TrimSuffix(ctx.String("ca-url"), "/") + "/admin/inventory")
+	if err != nil {
+		return errors.Wrapf(err, "error parsing %s", ctx.String("ca-url"))
+	}
+	q := u.Query()
+	for flag, param := range map[string]string{
+		"device":      "device",
+		"subject":     "subject",
+		"provisioner": "provisioner",
+		"account":     "account",
+		"status":      "status",
+	} {
+		if v := ctx.String(flag); len(v) > 0 {
+			q.Set(param, v)
+		}
+	}
+	if d := ctx.Duration("expires-within"); d > 0 {
+		q.Set("expiresWithin", d.String())
+	}
+
+	var certs []*inventory.Certificate
+	for cursor := ""; ; {
+		q.Set("cursor", cursor)
+		u.RawQuery = q.Encode()
+		page, err := getInventoryPage(client, u.String(), ctx.String("token"))
+		if err != nil {
+			return err
+		}
+		certs = append(certs, page.Certificates...)
+		if cursor = page.NextCursor; len(cursor) == 0 {
+			break
+		}
+	}
+
+	if ctx.Bool("json") {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(certs)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "SERIAL\tSUBJECT\tPROVISIONER\tACCOUNT\tNOT AFTER\tSTATUS")
+	for _, c := range certs {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", c.Serial, c.Subject, c.Provisioner,
+			c.AccountID, c.NotAfter.Format(time.RFC3339), c.Status)
+	}
+	return w.Flush()
+}
+
+// newAdminClient returns an HTTP client for the admin API that trusts the
+// roots in the given file.
+func newAdminClient(rootFile string) (*http.Client, error) {
+	roots, err := pemutil.ReadCertificateBundle(rootFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	for _, c := range roots {
+		pool.AddCert(c)
+	}
+	return &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{RootCAs: pool},
+		},
+	}, nil
+}
+
+func getInventoryPage(client *http.Client, u, token string) (*admin.FindInventoryResponse, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error creating request for %s", u)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error querying %s", u)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		var e struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		return nil, errors.Errorf("error querying the inventory: %s %s", resp.Status, e.Message)
+	}
+	page := new(admin.FindInventoryResponse)
+	if err := json.NewDecoder(resp.Body).Decode(page); err != nil {
+		return nil, errors.Wrap(err, "error decoding inventory response")
+	}
+	return page, nil
+}
@@ -0,0 +1,94 @@
+package commands
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/go-ocf/step-ca/acme"
+	"github.com/go-ocf/step-ca/authority"
+	"github.com/smallstep/cli/errs"
+	"github.com/urfave/cli"
+)
+
+// MigrateCommand applies the pending schema migrations to the database of a
+// stopped CA.
+var MigrateCommand = cli.Command{
+	Name:   "migrate",
+	Usage:  "migrate the CA database to the current schema version",
+	Action: migrateAction,
+	UsageText: `**step-ca migrate** <config>
+	[**--dry-run**]`,
+	Description: `**step-ca migrate** applies the pending schema migrations to the database
+of the given configuration. The CA applies them on startup too; this command
+allows to review and apply them beforehand, while the CA is stopped.
+
+The ACME records stored before they were scoped to their provisioner are
+assigned to the provisioner of the "legacyProvisioner" attribute of the ACME
+configuration; the migration fails on them if it is not set.
+
+## POSITIONAL ARGUMENTS
+
+<config>
+: File that configures the operation of the Step CA.
+
+## EXAMPLES
+
+Show the migrations that would be applied:
+'''
+$ step-ca migrate $STEPPATH/config/ca.json --dry-run
+'''
+
+Apply the pending migrations:
+'''
+$ step-ca migrate $STEPPATH/config/ca.json
+'''`,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "Show the pending migrations without applying them.",
+		},
+	},
+}
+
+func migrateAction(ctx *cli.Context) error {
+	if err := errs.NumberOfArguments(ctx, 1); err != nil {
+		return err
+	}
+	config, err := authority.LoadConfiguration(ctx.Args().Get(0))
+	if err != nil {
+		return err
+	}
+	db, err := authority.OpenDatabase(config.DB)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	dryRun := ctx.Bool("dry-run")
+	opts := &acme.MigrateOptions{DryRun: dryRun}
+	if config.ACME != nil {
+		opts.LegacyProvisionerID = config.ACME.LegacyProvisioner
+	}
+	results, err := acme.Migrate(db, opts)
+	// Print the migrations applied before an error too.
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "TABLE\tFROM\tTO\tCHANGES\tDESCRIPTION")
+	for _, r := range results {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%s\n", r.Table, r.From, r.To, r.Changes, r.Description)
+	}
+	w.Flush()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case len(results) == 0:
+		fmt.Println("The database is up to date.")
+	case dryRun:
+		fmt.Printf("%d migrations pending.\n", len(results))
+	default:
+		fmt.Printf("%d migrations applied.\n", len(results))
+	}
+	return nil
+}
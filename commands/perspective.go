@@ -0,0 +1,106 @@
+package commands
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/go-ocf/step-ca/acme"
+	"github.com/pkg/errors"
+	"github.com/smallstep/cli/errs"
+	"github.com/urfave/cli"
+)
+
+// PerspectiveCommand runs a remote validation agent.
+var PerspectiveCommand = cli.Command{
+	Name:   "perspective",
+	Usage:  "run a remote validation agent of the ACME challenges",
+	Action: perspectiveAction,
+	UsageText: `**step-ca perspective** **--address**=<address> **--token-file**=<file>
+	[**--resolver**=<address>] [**--cert**=<file> **--key**=<file>]`,
+	Description: `**step-ca perspective** runs a remote validation agent. The agent makes the
+DNS queries and HTTP requests with which a CA validates the ACME challenges
+from the network it runs in, and returns what it observed. A CA configures
+the agent as a validation perspective with its URL and token; run agents on
+networks other than the one of the CA to corroborate validations from other
+vantage points.
+
+The HTTP requests of the agent are subject to the default egress policy.
+
+## EXAMPLES
+
+Run an agent with TLS, using the system resolvers:
+'''
+$ step-ca perspective --address :8443 --token-file ./agent-token.txt \
+  --cert agent.crt --key agent.key
+'''
+
+Run an agent using the given resolvers:
+'''
+$ step-ca perspective --address :8443 --token-file ./agent-token.txt \
+  --cert agent.crt --key agent.key --resolver 8.8.8.8:53 --resolver 1.1.1.1:53
+'''`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "address",
+			Usage: "The <address> to listen on.",
+		},
+		cli.StringFlag{
+			Name:  "token-file",
+			Usage: "The <file> with the bearer token the CA must present.",
+		},
+		cli.StringSliceFlag{
+			Name:  "resolver",
+			Usage: "The <address>, as host:port, of a recursive resolver; use the flag multiple times for more resolvers.",
+		},
+		cli.StringFlag{
+			Name:  "cert",
+			Usage: "The TLS certificate <file> of the agent.",
+		},
+		cli.StringFlag{
+			Name:  "key",
+			Usage: "The TLS key <file> of the agent.",
+		},
+	},
+}
+
+func perspectiveAction(ctx *cli.Context) error {
+	if err := errs.NumberOfArguments(ctx, 0); err != nil {
+		return err
+	}
+	address := ctx.String("address")
+	if len(address) == 0 {
+		return errs.RequiredFlag(ctx, "address")
+	}
+	tokenFile := ctx.String("token-file")
+	if len(tokenFile) == 0 {
+		return errs.RequiredFlag(ctx, "token-file")
+	}
+	certFile, keyFile := ctx.String("cert"), ctx.String("key")
+	if (len(certFile) == 0) != (len(keyFile) == 0) {
+		return errors.New("flags '--cert' and '--key' must be used together")
+	}
+
+	token, err := readPasswordFile(tokenFile)
+	if err != nil {
+		return err
+	}
+	if len(token) == 0 {
+		return errors.Errorf("%s is empty", tokenFile)
+	}
+	v, err := acme.NewValidator(&acme.ValidationOptions{
+		Resolvers: ctx.StringSlice("resolver"),
+	})
+	if err != nil {
+		return err
+	}
+
+	srv := &http.Server{
+		Addr:    address,
+		Handler: acme.NewPerspectiveAgent(v, string(token)),
+	}
+	log.Printf("Serving validation agent on %s ...", address)
+	if len(certFile) > 0 {
+		return srv.ListenAndServeTLS(certFile, keyFile)
+	}
+	return srv.ListenAndServe()
+}
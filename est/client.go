@@ -0,0 +1,134 @@
+package est
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"net"
+	"sync"
+
+	"github.com/pkg/errors"
+	"go.mozilla.org/pkcs7"
+)
+
+// Client is an EST-coaps client over TLS, e.g. to enroll with the server in
+// process. Its requests are sent one at a time.
+type Client struct {
+	mu    sync.Mutex
+	conn  net.Conn
+	r     *bufio.Reader
+	token uint32
+}
+
+// Dial connects to the EST-coaps server at the given address and exchanges
+// the capabilities and settings messages.
+func Dial(addr string, config *tls.Config) (*Client, error) {
+	config = config.Clone()
+	config.NextProtos = []string{"coap"}
+	conn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{conn: conn, r: bufio.NewReader(conn)}
+	csm := &Message{Code: CSM}
+	csm.setUintOption(optionMaxMessageSize, maxMessageSize)
+	if err := writeMessage(conn, csm); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Close releases the connection.
+func (c *Client) Close() error {
+	writeMessage(c.conn, &Message{Code: Release})
+	return c.conn.Close()
+}
+
+// Do sends a request and returns its response.
+func (c *Client) Do(m *Message) (*Message, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.token++
+	req := *m
+	req.Token = make([]byte, 4)
+	binary.BigEndian.PutUint32(req.Token, c.token)
+	if err := writeMessage(c.conn, &req); err != nil {
+		return nil, err
+	}
+	for {
+		resp, err := ReadMessage(c.r, maxMessageSize)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case resp.Code == Ping:
+			if err := writeMessage(c.conn, &Message{Code: Pong, Token: resp.Token}); err != nil {
+				return nil, err
+			}
+		case resp.Code == Release || resp.Code == Abort:
+			return nil, errors.Errorf("est: connection closed by the server: %s", resp.Payload)
+		case resp.Code.isSignaling():
+		case string(resp.Token) == string(req.Token):
+			return resp, nil
+		}
+	}
+}
+
+// responseError returns an error if the response is not a success.
+func responseError(resp *Message) error {
+	if uint8(resp.Code)>>5 != 2 {
+		return errors.Errorf("est: server returned %s: %s", resp.Code, resp.Payload)
+	}
+	return nil
+}
+
+// CACerts returns the CA certificates of the server.
+func (c *Client) CACerts() ([]*x509.Certificate, error) {
+	req := &Message{Code: GET}
+	req.SetPath(crtsPath)
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := responseError(resp); err != nil {
+		return nil, err
+	}
+	p7, err := pkcs7.Parse(resp.Payload)
+	if err != nil {
+		return nil, errors.Wrap(err, "est: error parsing CA certificates")
+	}
+	return p7.Certificates, nil
+}
+
+// Enroll requests a certificate for the certificate request.
+func (c *Client) Enroll(csr *x509.CertificateRequest) (*x509.Certificate, error) {
+	return c.enroll(senPath, csr)
+}
+
+// Reenroll requests the renewal of the client certificate for the
+// certificate request.
+func (c *Client) Reenroll(csr *x509.CertificateRequest) (*x509.Certificate, error) {
+	return c.enroll(srenPath, csr)
+}
+
+func (c *Client) enroll(path string, csr *x509.CertificateRequest) (*x509.Certificate, error) {
+	req := &Message{Code: POST, Payload: csr.Raw}
+	req.SetPath(path)
+	req.SetContentFormat(FormatPKCS10)
+	req.SetAccept(FormatPKIXCert)
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := responseError(resp); err != nil {
+		return nil, err
+	}
+	crt, err := x509.ParseCertificate(resp.Payload)
+	if err != nil {
+		return nil, errors.Wrap(err, "est: error parsing certificate")
+	}
+	return crt, nil
+}
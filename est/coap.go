@@ -0,0 +1,309 @@
+package est
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Code is a CoAP method, response or signaling code, class.detail encoded
+// in one byte.
+type Code uint8
+
+func code(class, detail uint8) Code {
+	return Code(class<<5 | detail)
+}
+
+// CoAP codes used by EST-coaps (RFC 7252, RFC 8323).
+var (
+	GET                   = code(0, 1)
+	POST                  = code(0, 2)
+	Changed               = code(2, 4)
+	Content               = code(2, 5)
+	BadRequest            = code(4, 0)
+	Unauthorized          = code(4, 1)
+	Forbidden             = code(4, 3)
+	NotFound              = code(4, 4)
+	MethodNotAllowed      = code(4, 5)
+	NotAcceptable         = code(4, 6)
+	RequestEntityTooLarge = code(4, 13)
+	UnsupportedFormat     = code(4, 15)
+	InternalServerError   = code(5, 0)
+	CSM                   = code(7, 1)
+	Ping                  = code(7, 2)
+	Pong                  = code(7, 3)
+	Release               = code(7, 4)
+	Abort                 = code(7, 5)
+)
+
+func (c Code) String() string {
+	return fmt.Sprintf("%d.%02d", uint8(c)>>5, uint8(c)&0x1f)
+}
+
+// isSignaling returns true for the signaling codes of CoAP over TCP.
+func (c Code) isSignaling() bool {
+	return uint8(c)>>5 == 7
+}
+
+// CoAP option numbers.
+const (
+	optionURIPath        = 11
+	optionContentFormat  = 12
+	optionAccept         = 17
+	optionMaxMessageSize = 2 // CSM
+)
+
+// Content formats of EST-coaps (RFC 9148).
+const (
+	FormatLinkFormat = 40
+	FormatPKCS7Certs = 281
+	FormatPKCS10     = 286
+	FormatPKIXCert   = 287
+)
+
+// noFormat is the value returned for an absent content format option.
+const noFormat = -1
+
+// option is a CoAP option.
+type option struct {
+	number uint16
+	value  []byte
+}
+
+// Message is a CoAP over TCP message (RFC 8323, section 3.2). Messages over
+// reliable transports have no type nor message ID.
+type Message struct {
+	Code    Code
+	Token   []byte
+	Payload []byte
+	options []option
+}
+
+// Path returns the URI path of the message.
+func (m *Message) Path() string {
+	var segs []string
+	for _, o := range m.options {
+		if o.number == optionURIPath {
+			segs = append(segs, string(o.value))
+		}
+	}
+	return "/" + strings.Join(segs, "/")
+}
+
+// SetPath sets the URI path of the message.
+func (m *Message) SetPath(path string) {
+	m.removeOption(optionURIPath)
+	for _, s := range strings.Split(strings.Trim(path, "/"), "/") {
+		if s != "" {
+			m.options = append(m.options, option{optionURIPath, []byte(s)})
+		}
+	}
+}
+
+// uintOption returns the value of an uint option, or def if it is absent.
+func (m *Message) uintOption(number uint16, def int) int {
+	for _, o := range m.options {
+		if o.number == number {
+			var v int
+			for _, b := range o.value {
+				v = v<<8 | int(b)
+			}
+			return v
+		}
+	}
+	return def
+}
+
+// setUintOption sets an uint option in its shortest encoding.
+func (m *Message) setUintOption(number uint16, v int) {
+	m.removeOption(number)
+	var b []byte
+	for ; v > 0; v >>= 8 {
+		b = append([]byte{byte(v)}, b...)
+	}
+	m.options = append(m.options, option{number, b})
+}
+
+func (m *Message) removeOption(number uint16) {
+	opts := m.options[:0]
+	for _, o := range m.options {
+		if o.number != number {
+			opts = append(opts, o)
+		}
+	}
+	m.options = opts
+}
+
+// ContentFormat returns the content format of the payload, -1 if absent.
+func (m *Message) ContentFormat() int {
+	return m.uintOption(optionContentFormat, noFormat)
+}
+
+// SetContentFormat sets the content format of the payload.
+func (m *Message) SetContentFormat(f int) {
+	m.setUintOption(optionContentFormat, f)
+}
+
+// Accept returns the content format the response is requested in, -1 if
+// absent.
+func (m *Message) Accept() int {
+	return m.uintOption(optionAccept, noFormat)
+}
+
+// SetAccept sets the content format the response is requested in.
+func (m *Message) SetAccept(f int) {
+	m.setUintOption(optionAccept, f)
+}
+
+// extend returns the 4-bit nibble and the extended bytes encoding v, as
+// used by the option delta, option length and message length fields.
+func extend(v int) (uint8, []byte) {
+	switch {
+	case v < extBase[0]:
+		return uint8(v), nil
+	case v < extBase[1]:
+		return 13, []byte{byte(v - extBase[0])}
+	case v < extBase[2]:
+		b := make([]byte, 2)
+		binary.BigEndian.PutUint16(b, uint16(v-extBase[1]))
+		return 14, b
+	default:
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, uint32(v-extBase[2]))
+		return 15, b
+	}
+}
+
+// extBase are the offsets of the 1, 2 and 4 extended bytes. Options have
+// no 4 byte form; their lengths are bounded by the message size.
+var extBase = [3]int{13, 269, 65805}
+
+// marshalOptions encodes the options, sorted by number, and the payload.
+func (m *Message) marshalOptions() []byte {
+	opts := append([]option{}, m.options...)
+	sort.SliceStable(opts, func(i, j int) bool { return opts[i].number < opts[j].number })
+	var b []byte
+	var prev uint16
+	for _, o := range opts {
+		dn, dx := extend(int(o.number - prev))
+		ln, lx := extend(len(o.value))
+		b = append(b, dn<<4|ln)
+		b = append(b, dx...)
+		b = append(b, lx...)
+		b = append(b, o.value...)
+		prev = o.number
+	}
+	if len(m.Payload) > 0 {
+		b = append(b, 0xff)
+		b = append(b, m.Payload...)
+	}
+	return b
+}
+
+// MarshalBinary encodes the message in the CoAP over TCP framing.
+func (m *Message) MarshalBinary() ([]byte, error) {
+	if len(m.Token) > 8 {
+		return nil, errors.New("coap: token longer than 8 bytes")
+	}
+	body := m.marshalOptions()
+	ln, lx := extend(len(body))
+	b := append([]byte{ln<<4 | uint8(len(m.Token))}, lx...)
+	b = append(b, byte(m.Code))
+	b = append(b, m.Token...)
+	return append(b, body...), nil
+}
+
+// readExtended reads the extended bytes of a nibble.
+func readExtended(r io.Reader, nibble uint8) (int, error) {
+	var b []byte
+	switch nibble {
+	case 13:
+		b = make([]byte, 1)
+	case 14:
+		b = make([]byte, 2)
+	case 15:
+		b = make([]byte, 4)
+	default:
+		return int(nibble), nil
+	}
+	if _, err := io.ReadFull(r, b); err != nil {
+		return 0, err
+	}
+	switch nibble {
+	case 13:
+		return int(b[0]) + extBase[0], nil
+	case 14:
+		return int(binary.BigEndian.Uint16(b)) + extBase[1], nil
+	default:
+		return int(binary.BigEndian.Uint32(b)) + extBase[2], nil
+	}
+}
+
+// ReadMessage reads a CoAP over TCP message. Messages larger than maxSize
+// are rejected.
+func ReadMessage(r *bufio.Reader, maxSize int) (*Message, error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	tkl := int(first & 0x0f)
+	if tkl > 8 {
+		return nil, errors.New("coap: token longer than 8 bytes")
+	}
+	n, err := readExtended(r, first>>4)
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 || n > maxSize {
+		return nil, errors.Errorf("coap: message of %d bytes exceeds the maximum size", n)
+	}
+	b := make([]byte, 1+tkl+n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	m := &Message{Code: Code(b[0]), Token: b[1 : 1+tkl]}
+	if err := m.unmarshalOptions(b[1+tkl:]); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// unmarshalOptions decodes the options and the payload.
+func (m *Message) unmarshalOptions(b []byte) error {
+	var number int
+	for len(b) > 0 {
+		if b[0] == 0xff {
+			if len(b) == 1 {
+				return errors.New("coap: payload marker without payload")
+			}
+			m.Payload = b[1:]
+			return nil
+		}
+		dn, ln := b[0]>>4, b[0]&0x0f
+		if dn == 15 || ln == 15 {
+			return errors.New("coap: invalid option")
+		}
+		rd := strings.NewReader(string(b[1:]))
+		delta, err := readExtended(rd, dn)
+		if err != nil {
+			return errors.New("coap: truncated option")
+		}
+		length, err := readExtended(rd, ln)
+		if err != nil || length > rd.Len() {
+			return errors.New("coap: truncated option")
+		}
+		b = b[len(b)-rd.Len():]
+		number += delta
+		if number > 0xffff {
+			return errors.New("coap: invalid option number")
+		}
+		m.options = append(m.options, option{uint16(number), b[:length]})
+		b = b[length:]
+	}
+	return nil
+}
@@ -0,0 +1,556 @@
+// Package est implements EST-coaps (RFC 9148), the enrollment of
+// certificates over CoAP, for the constrained devices that do not speak
+// HTTPS. The CoAP messages are carried over TLS (RFC 8323); block-wise
+// transfers are not supported, so the clients must accept messages as large
+// as the certificates they enroll.
+package est
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ocf/step-ca/acme"
+	"github.com/go-ocf/step-ca/inventory"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/authority/provisioner"
+	"github.com/smallstep/cli/crypto/pemutil"
+	"go.mozilla.org/pkcs7"
+)
+
+// EST-coaps resources.
+const (
+	wellKnownCore = "/.well-known/core"
+	crtsPath      = "/.well-known/est/crts"
+	senPath       = "/.well-known/est/sen"
+	srenPath      = "/.well-known/est/sren"
+)
+
+const (
+	// maxMessageSize is the largest message the server accepts, advertised
+	// in its capabilities and settings message.
+	maxMessageSize = 16 * 1024
+	// defaultMaxMessageSize is the largest message a peer accepts until it
+	// advertises its own limit (RFC 8323, section 5.3.1).
+	defaultMaxMessageSize = 1152
+	// idleTimeout is the time after which idle connections are closed.
+	idleTimeout = time.Minute
+	// handshakeTimeout bounds the duration of the TLS handshakes.
+	handshakeTimeout = 10 * time.Second
+)
+
+// Authority is the certificate authority the devices enroll with.
+type Authority interface {
+	Sign(cr *x509.CertificateRequest, opts provisioner.Options, signOpts ...provisioner.SignOption) (*x509.Certificate, *x509.Certificate, error)
+	LoadProvisionerByID(string) (provisioner.Interface, error)
+	GetRootCertificates() []*x509.Certificate
+	GetIntermediates() []*x509.Certificate
+}
+
+// Options configures the EST-coaps server.
+type Options struct {
+	// Address is the TCP address of the CoAP over TLS listener, e.g.
+	// ":5684". The server is disabled if it is empty.
+	Address string `json:"address"`
+	// Provisioner is the name of the ACME provisioner authorizing the
+	// enrollments. The certificates of provisioners with the "ocf." prefix
+	// are OCF identity certificates.
+	Provisioner string `json:"provisioner"`
+	// ClientRoots are the PEM files with the roots of the device
+	// certificates allowed to enroll, e.g. the manufacturer certificates.
+	// The devices with a certificate of the CA can always enroll and
+	// re-enroll.
+	ClientRoots []string `json:"clientRoots,omitempty"`
+}
+
+// Server is the EST-coaps server. Its state can be replaced on reloads
+// without closing the listener.
+type Server struct {
+	addr string
+
+	mu          sync.RWMutex
+	auth        Authority
+	prov        provisioner.Interface
+	policy      *acme.IdentifierPolicy
+	tlsConfig   *tls.Config
+	caRoots     *x509.CertPool
+	clientRoots *x509.CertPool
+
+	connMu sync.Mutex
+	ln     net.Listener
+	conns  map[net.Conn]struct{}
+	closed bool
+}
+
+// New returns the EST-coaps server of the given options. The policy, the one
+// of the ACME provisioner if any, restricts the names of the certificate
+// requests. The TLS configuration is the one of the CA; the client
+// certificates are requested from the devices.
+func New(auth Authority, opts *Options, policy *acme.IdentifierPolicy, tlsConfig *tls.Config) (*Server, error) {
+	if opts == nil || len(opts.Address) == 0 {
+		return nil, errors.New("est: address is required")
+	}
+	if policy != nil {
+		if err := policy.Validate(); err != nil {
+			return nil, errors.Wrap(err, "est: invalid policy")
+		}
+	}
+	p, err := auth.LoadProvisionerByID("acme/" + opts.Provisioner)
+	if err != nil {
+		return nil, errors.Wrapf(err, "est: error loading provisioner %s", opts.Provisioner)
+	}
+	if p.GetType() != provisioner.TypeACME {
+		return nil, errors.Errorf("est: provisioner %s must be of type ACME", opts.Provisioner)
+	}
+
+	s := &Server{
+		addr:        opts.Address,
+		auth:        auth,
+		prov:        p,
+		policy:      policy,
+		caRoots:     x509.NewCertPool(),
+		clientRoots: x509.NewCertPool(),
+		conns:       make(map[net.Conn]struct{}),
+	}
+	clientCAs := x509.NewCertPool()
+	for _, crt := range auth.GetRootCertificates() {
+		s.caRoots.AddCert(crt)
+		clientCAs.AddCert(crt)
+	}
+	for _, fn := range opts.ClientRoots {
+		certs, err := pemutil.ReadCertificateBundle(fn)
+		if err != nil {
+			return nil, errors.Wrapf(err, "est: error reading client roots %s", fn)
+		}
+		for _, crt := range certs {
+			s.clientRoots.AddCert(crt)
+			clientCAs.AddCert(crt)
+		}
+	}
+	s.tlsConfig = tlsConfig.Clone()
+	s.tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	s.tlsConfig.ClientCAs = clientCAs
+	s.tlsConfig.NextProtos = []string{"coap"}
+	return s, nil
+}
+
+// Reload replaces the state of the server with the one of the given server,
+// created from the reloaded configuration.
+func (s *Server) Reload(ns *Server) {
+	ns.mu.RLock()
+	defer ns.mu.RUnlock()
+	s.mu.Lock()
+	s.auth, s.prov, s.policy, s.tlsConfig = ns.auth, ns.prov, ns.policy, ns.tlsConfig
+	s.caRoots, s.clientRoots = ns.caRoots, ns.clientRoots
+	s.mu.Unlock()
+}
+
+// Listen opens the TLS listener of the server.
+func (s *Server) Listen() (net.Listener, error) {
+	ln, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(ln, &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			s.mu.RLock()
+			defer s.mu.RUnlock()
+			return s.tlsConfig, nil
+		},
+	}), nil
+}
+
+// Serve serves the connections of the listener until the server is shut
+// down.
+func (s *Server) Serve(ln net.Listener) error {
+	s.connMu.Lock()
+	if s.closed {
+		s.connMu.Unlock()
+		ln.Close()
+		return errors.New("est: server closed")
+	}
+	s.ln = ln
+	s.connMu.Unlock()
+
+	log.Printf("Serving EST-coaps on %s ...", s.addr)
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			s.connMu.Lock()
+			closed := s.closed
+			s.connMu.Unlock()
+			if closed {
+				return nil
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		if !s.track(c, true) {
+			c.Close()
+			return nil
+		}
+		go s.serveConn(c)
+	}
+}
+
+// Shutdown closes the listener and the open connections.
+func (s *Server) Shutdown() error {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+	s.closed = true
+	for c := range s.conns {
+		c.Close()
+	}
+	if s.ln != nil {
+		return s.ln.Close()
+	}
+	return nil
+}
+
+// track adds or removes an open connection. It returns false if the server
+// is shut down.
+func (s *Server) track(c net.Conn, add bool) bool {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+	if !add {
+		delete(s.conns, c)
+		return true
+	}
+	if s.closed {
+		return false
+	}
+	s.conns[c] = struct{}{}
+	return true
+}
+
+// serveConn serves the CoAP requests of a connection.
+func (s *Server) serveConn(c net.Conn) {
+	defer s.track(c, false)
+	defer c.Close()
+
+	tc, ok := c.(*tls.Conn)
+	if !ok {
+		return
+	}
+	tc.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := tc.Handshake(); err != nil {
+		log.Printf("est: TLS handshake with %s failed: %v", c.RemoteAddr(), err)
+		return
+	}
+	peers := tc.ConnectionState().PeerCertificates
+
+	csm := &Message{Code: CSM}
+	csm.setUintOption(optionMaxMessageSize, maxMessageSize)
+	if err := writeMessage(c, csm); err != nil {
+		return
+	}
+
+	peerMax := defaultMaxMessageSize
+	r := bufio.NewReader(c)
+	for {
+		c.SetDeadline(time.Now().Add(idleTimeout))
+		m, err := ReadMessage(r, maxMessageSize)
+		if err != nil {
+			if err != io.EOF {
+				writeMessage(c, &Message{Code: Abort, Payload: []byte(err.Error())})
+			}
+			return
+		}
+		switch m.Code {
+		case CSM:
+			peerMax = m.uintOption(optionMaxMessageSize, peerMax)
+			continue
+		case Ping:
+			if err := writeMessage(c, &Message{Code: Pong, Token: m.Token}); err != nil {
+				return
+			}
+			continue
+		case Release, Abort:
+			return
+		}
+		if m.Code.isSignaling() {
+			continue
+		}
+
+		resp := s.handle(m, peers)
+		resp.Token = m.Token
+		if b, err := resp.MarshalBinary(); err != nil || len(b) > peerMax {
+			resp = diagnostic(InternalServerError, "response exceeds the maximum message size of the client")
+			resp.Token = m.Token
+		}
+		if err := writeMessage(c, resp); err != nil {
+			return
+		}
+	}
+}
+
+// writeMessage writes a message to the connection.
+func writeMessage(w io.Writer, m *Message) error {
+	b, err := m.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// diagnostic returns an error response with a diagnostic payload.
+func diagnostic(c Code, msg string) *Message {
+	return &Message{Code: c, Payload: []byte(msg)}
+}
+
+// handle returns the response to a request of a client with the given
+// certificates.
+func (s *Server) handle(m *Message, peers []*x509.Certificate) *Message {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	path := m.Path()
+	switch path {
+	case wellKnownCore:
+		if m.Code != GET {
+			return diagnostic(MethodNotAllowed, "method not allowed")
+		}
+		resp := &Message{Code: Content, Payload: []byte(
+			`<` + crtsPath + `>;rt="ace.est.crts";ct="281 287",` +
+				`<` + senPath + `>;rt="ace.est.sen";ct="281 287",` +
+				`<` + srenPath + `>;rt="ace.est.sren";ct="281 287"`)}
+		resp.SetContentFormat(FormatLinkFormat)
+		return resp
+	case crtsPath:
+		if m.Code != GET {
+			return diagnostic(MethodNotAllowed, "method not allowed")
+		}
+		return s.caCerts(m)
+	case senPath, srenPath:
+		if m.Code != POST {
+			return diagnostic(MethodNotAllowed, "method not allowed")
+		}
+		return s.enroll(m, peers, path == srenPath)
+	default:
+		return diagnostic(NotFound, "resource not found")
+	}
+}
+
+// caCerts returns the CA certificates: the roots and the intermediates in a
+// certs-only PKCS#7, or the first root.
+func (s *Server) caCerts(m *Message) *Message {
+	roots := s.auth.GetRootCertificates()
+	var resp *Message
+	switch m.Accept() {
+	case noFormat, FormatPKCS7Certs:
+		var raw []byte
+		for _, crt := range append(roots, s.auth.GetIntermediates()...) {
+			raw = append(raw, crt.Raw...)
+		}
+		b, err := pkcs7.DegenerateCertificate(raw)
+		if err != nil {
+			return diagnostic(InternalServerError, "error encoding the CA certificates")
+		}
+		resp = &Message{Code: Content, Payload: b}
+		resp.SetContentFormat(FormatPKCS7Certs)
+	case FormatPKIXCert:
+		resp = &Message{Code: Content, Payload: roots[0].Raw}
+		resp.SetContentFormat(FormatPKIXCert)
+	default:
+		return diagnostic(NotAcceptable, "unsupported accept format")
+	}
+	return resp
+}
+
+// enroll signs the PKCS#10 request of a simple enrollment or
+// re-enrollment. Enrollments require a client certificate of the CA or of
+// one of the client roots proving the identity of the request.
+// Re-enrollments require a certificate of the CA with the subject and the
+// names of the request. The names must be permitted by the policy.
+func (s *Server) enroll(m *Message, peers []*x509.Certificate, reenroll bool) *Message {
+	accept := m.Accept()
+	if accept != noFormat && accept != FormatPKCS7Certs && accept != FormatPKIXCert {
+		return diagnostic(NotAcceptable, "unsupported accept format")
+	}
+	if m.ContentFormat() != FormatPKCS10 {
+		return diagnostic(UnsupportedFormat, "the request must be an application/pkcs10")
+	}
+	csr, err := x509.ParseCertificateRequest(m.Payload)
+	if err != nil {
+		return diagnostic(BadRequest, "error parsing certificate request")
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return diagnostic(BadRequest, "invalid certificate request signature")
+	}
+
+	if len(peers) == 0 {
+		return diagnostic(Unauthorized, "client certificate required")
+	}
+	issuedByCA := s.verify(peers, s.caRoots)
+	switch {
+	case reenroll && !issuedByCA:
+		return diagnostic(Unauthorized, "re-enrollment requires a certificate of the CA")
+	case !issuedByCA && !s.verify(peers, s.clientRoots):
+		return diagnostic(Unauthorized, "client certificate not authorized to enroll")
+	}
+	if err := checkIdentity(csr, peers[0], reenroll); err != nil {
+		return diagnostic(Forbidden, err.Error())
+	}
+	if err := s.policy.CheckCSR(csr); err != nil {
+		log.Printf("est: certificate request for %s rejected: %v", csr.Subject, err)
+		return diagnostic(Forbidden, "the request names an identifier not allowed by policy")
+	}
+
+	ctx := provisioner.NewContextWithMethod(context.Background(), provisioner.SignMethod)
+	signOps, err := s.prov.AuthorizeSign(ctx, "")
+	if err != nil {
+		log.Printf("est: error authorizing enrollment: %v", err)
+		return diagnostic(InternalServerError, "error authorizing enrollment")
+	}
+	signOps = append(signOps, inventory.Provisioner(s.prov.GetName()))
+	leaf, _, err := s.auth.Sign(csr, provisioner.Options{}, signOps...)
+	if err != nil {
+		log.Printf("est: error signing certificate for %s: %v", csr.Subject, err)
+		return diagnostic(signErrorCode(err), "error signing certificate")
+	}
+
+	if accept == FormatPKIXCert {
+		resp := &Message{Code: Changed, Payload: leaf.Raw}
+		resp.SetContentFormat(FormatPKIXCert)
+		return resp
+	}
+	b, err := pkcs7.DegenerateCertificate(leaf.Raw)
+	if err != nil {
+		return diagnostic(InternalServerError, "error encoding certificate")
+	}
+	resp := &Message{Code: Changed, Payload: b}
+	resp.SetContentFormat(FormatPKCS7Certs)
+	return resp
+}
+
+// checkIdentity returns an error if the certificate request names an
+// identity the client certificate does not prove. The OCF device UUID of
+// the common name must be the one of the client certificate, and the other
+// common names and the subject alternative names must be names of the
+// client certificate. A re-enrollment must request the subject and the
+// names of the client certificate.
+func checkIdentity(csr *x509.CertificateRequest, peer *x509.Certificate, reenroll bool) error {
+	peerNames := make(map[string]bool)
+	for _, n := range certNames(peer.DNSNames, peer.IPAddresses, peer.URIs, peer.EmailAddresses) {
+		peerNames[n] = true
+	}
+	names := certNames(csr.DNSNames, csr.IPAddresses, csr.URIs, csr.EmailAddresses)
+	if reenroll {
+		if peer.Subject.String() != csr.Subject.String() {
+			return errors.New("the subject of the request does not match the client certificate")
+		}
+		if len(names) != len(peerNames) {
+			return errors.New("the names of the request do not match the client certificate")
+		}
+	}
+	for _, n := range names {
+		if !peerNames[n] {
+			return errors.Errorf("the name %s of the request is not a name of the client certificate", n)
+		}
+	}
+
+	cn := csr.Subject.CommonName
+	if id, ok := deviceUUID(cn); ok {
+		if peerID, ok := deviceUUID(peer.Subject.CommonName); !ok || peerID != id {
+			return errors.New("the device UUID of the request does not match the client certificate")
+		}
+		return nil
+	}
+	if len(cn) > 0 && cn != peer.Subject.CommonName && !peerNames["dns:"+strings.ToLower(cn)] {
+		return errors.Errorf("the common name %s of the request is not a name of the client certificate", cn)
+	}
+	return nil
+}
+
+// certNames returns the distinct subject alternative names of a
+// certificate or request, prefixed by their type.
+func certNames(dnsNames []string, ips []net.IP, uris []*url.URL, emails []string) []string {
+	seen := make(map[string]bool)
+	var names []string
+	add := func(n string) {
+		if !seen[n] {
+			seen[n] = true
+			names = append(names, n)
+		}
+	}
+	for _, n := range dnsNames {
+		add("dns:" + strings.ToLower(n))
+	}
+	for _, ip := range ips {
+		add("ip:" + ip.String())
+	}
+	for _, u := range uris {
+		add("uri:" + u.String())
+	}
+	for _, e := range emails {
+		add("email:" + strings.ToLower(e))
+	}
+	return names
+}
+
+// deviceUUID returns the canonical UUID of an OCF device common name,
+// uuid:<UUID>.
+func deviceUUID(cn string) (string, bool) {
+	if !strings.HasPrefix(strings.ToLower(cn), "uuid:") {
+		return "", false
+	}
+	id, err := uuid.Parse(cn[len("uuid:"):])
+	if err != nil {
+		return "", false
+	}
+	return id.String(), true
+}
+
+// verify returns true if the client certificate chains to one of the roots.
+func (s *Server) verify(peers []*x509.Certificate, roots *x509.CertPool) bool {
+	intermediates := x509.NewCertPool()
+	for _, crt := range peers[1:] {
+		intermediates.AddCert(crt)
+	}
+	for _, crt := range s.auth.GetIntermediates() {
+		intermediates.AddCert(crt)
+	}
+	_, err := peers[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	return err == nil
+}
+
+// signErrorCode returns the CoAP response code of a signing error.
+func signErrorCode(err error) Code {
+	type statusCoder interface {
+		StatusCode() int
+	}
+	sc, ok := err.(statusCoder)
+	if !ok {
+		if sc, ok = errors.Cause(err).(statusCoder); !ok {
+			return InternalServerError
+		}
+	}
+	switch sc.StatusCode() {
+	case http.StatusBadRequest:
+		return BadRequest
+	case http.StatusUnauthorized:
+		return Unauthorized
+	case http.StatusForbidden:
+		return Forbidden
+	default:
+		return InternalServerError
+	}
+}
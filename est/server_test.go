@@ -0,0 +1,424 @@
+package est
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-ocf/step-ca/acme"
+	"github.com/go-ocf/step-ca/inventory"
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/authority/provisioner"
+)
+
+const (
+	testDeviceID = "uuid:9f2c3e4a-7b1d-4c5e-8f6a-0b1c2d3e4f50"
+	otherDevice  = "uuid:1d2c3b4a-0000-4c5e-8f6a-0b1c2d3e4f50"
+)
+
+type testIdentity struct {
+	crt *x509.Certificate
+	key *ecdsa.PrivateKey
+	// intermediate is sent with the certificate, if any.
+	intermediate *x509.Certificate
+}
+
+// newTestIdentity returns a certificate with the template signed by the
+// parent, or self signed if the parent is nil.
+func newTestIdentity(t *testing.T, tmpl *x509.Certificate, parent *testIdentity) *testIdentity {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl.SerialNumber = serial
+	tmpl.NotBefore = time.Now().Add(-time.Minute)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	issuer, signer := tmpl, key
+	if parent != nil {
+		issuer, signer = parent.crt, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, issuer, key.Public(), signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crt, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testIdentity{crt: crt, key: key}
+}
+
+func newTestCA(t *testing.T, name string) *testIdentity {
+	return newTestIdentity(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: name},
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}, nil)
+}
+
+func newTestLeaf(t *testing.T, cn string, parent *testIdentity) *testIdentity {
+	return newTestIdentity(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: cn},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+	}, parent)
+}
+
+func (id *testIdentity) tlsCertificate() tls.Certificate {
+	crt := tls.Certificate{Certificate: [][]byte{id.crt.Raw}, PrivateKey: id.key}
+	if id.intermediate != nil {
+		crt.Certificate = append(crt.Certificate, id.intermediate.Raw)
+	}
+	return crt
+}
+
+// testAuthority signs the requests with its intermediate.
+type testAuthority struct {
+	root, intermediate *testIdentity
+
+	mu           sync.Mutex
+	provisioners []inventory.Provisioner
+}
+
+func (a *testAuthority) Sign(cr *x509.CertificateRequest, opts provisioner.Options, signOpts ...provisioner.SignOption) (*x509.Certificate, *x509.Certificate, error) {
+	for _, o := range signOpts {
+		if p, ok := o.(inventory.Provisioner); ok {
+			a.mu.Lock()
+			a.provisioners = append(a.provisioners, p)
+			a.mu.Unlock()
+		}
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      cr.Subject,
+		DNSNames:     cr.DNSNames,
+		IPAddresses:  cr.IPAddresses,
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, a.intermediate.crt, cr.PublicKey, a.intermediate.key)
+	if err != nil {
+		return nil, nil, err
+	}
+	crt, err := x509.ParseCertificate(der)
+	return crt, a.intermediate.crt, err
+}
+
+func (a *testAuthority) LoadProvisionerByID(id string) (provisioner.Interface, error) {
+	if id != "acme/ocf.devices" {
+		return nil, errors.Errorf("provisioner %s not found", id)
+	}
+	d := func(v time.Duration) *provisioner.Duration { return &provisioner.Duration{Duration: v} }
+	disable := false
+	p := &provisioner.ACME{Type: "ACME", Name: "ocf.devices"}
+	err := p.Init(provisioner.Config{Claims: provisioner.Claims{
+		MinTLSDur:      d(time.Minute),
+		MaxTLSDur:      d(24 * time.Hour),
+		DefaultTLSDur:  d(time.Hour),
+		DisableRenewal: &disable,
+	}})
+	return p, err
+}
+
+func (a *testAuthority) GetRootCertificates() []*x509.Certificate {
+	return []*x509.Certificate{a.root.crt}
+}
+
+func (a *testAuthority) GetIntermediates() []*x509.Certificate {
+	return []*x509.Certificate{a.intermediate.crt}
+}
+
+type testServer struct {
+	addr         string
+	auth         *testAuthority
+	manufacturer *testIdentity
+	roots        *x509.CertPool
+}
+
+// newTestServer starts an EST-coaps server accepting the devices of a test
+// manufacturer.
+func newTestServer(t *testing.T, policy *acme.IdentifierPolicy) (*testServer, func()) {
+	t.Helper()
+	root := newTestCA(t, "root")
+	intermediate := newTestIdentity(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "intermediate"},
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}, root)
+	auth := &testAuthority{root: root, intermediate: intermediate}
+	serverCrt := newTestLeaf(t, "ca", intermediate)
+	serverCrt.intermediate = intermediate.crt
+	manufacturer := newTestCA(t, "manufacturer")
+
+	dir, err := ioutil.TempDir("", "est")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn := filepath.Join(dir, "manufacturer.crt")
+	if err := ioutil.WriteFile(fn, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: manufacturer.crt.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	srv, err := New(auth, &Options{
+		Address:     "127.0.0.1:0",
+		Provisioner: "ocf.devices",
+		ClientRoots: []string{fn},
+	}, policy, &tls.Config{
+		Certificates: []tls.Certificate{serverCrt.tlsCertificate()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := srv.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(ln)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(root.crt)
+	return &testServer{addr: ln.Addr().String(), auth: auth, manufacturer: manufacturer, roots: roots}, func() {
+		srv.Shutdown()
+		os.RemoveAll(dir)
+	}
+}
+
+// dial connects to the server with the given client certificate, if any.
+func (s *testServer) dial(t *testing.T, id *testIdentity) *Client {
+	t.Helper()
+	config := &tls.Config{RootCAs: s.roots}
+	if id != nil {
+		config.Certificates = []tls.Certificate{id.tlsCertificate()}
+	}
+	c, err := Dial(s.addr, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// newTestCSR returns a certificate request with the given common name and
+// DNS names.
+func newTestCSR(t *testing.T, cn string, dnsNames ...string) *x509.CertificateRequest {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newTestCSRWithKey(t, key, cn, dnsNames...)
+}
+
+// newTestCSRWithKey returns a certificate request of the key with the given
+// common name and DNS names.
+func newTestCSRWithKey(t *testing.T, key *ecdsa.PrivateKey, cn string, dnsNames ...string) *x509.CertificateRequest {
+	t.Helper()
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: cn},
+		DNSNames: dnsNames,
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return csr
+}
+
+func TestServerCACerts(t *testing.T) {
+	s, cleanup := newTestServer(t, nil)
+	defer cleanup()
+	c := s.dial(t, nil)
+	defer c.Close()
+
+	certs, err := c.CACerts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 2 || !certs[0].Equal(s.auth.root.crt) || !certs[1].Equal(s.auth.intermediate.crt) {
+		t.Errorf("CACerts() = %d certificates, want the root and the intermediate", len(certs))
+	}
+}
+
+func TestServerEnroll(t *testing.T) {
+	policy := &acme.IdentifierPolicy{Deny: &acme.IdentifierRules{DNS: []string{"denied.example.com"}}}
+	s, cleanup := newTestServer(t, policy)
+	defer cleanup()
+
+	device := newTestLeaf(t, testDeviceID, s.manufacturer)
+	named := newTestIdentity(t, &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "gateway"},
+		DNSNames: []string{"gw.example.com", "denied.example.com"},
+	}, s.manufacturer)
+	tests := []struct {
+		name     string
+		peer     *testIdentity
+		csr      *x509.CertificateRequest
+		wantCode string
+	}{
+		{"device", device, newTestCSR(t, testDeviceID), ""},
+		{"other device", device, newTestCSR(t, otherDevice), Forbidden.String()},
+		{"name of another device", device, newTestCSR(t, testDeviceID, "gw.example.com"), Forbidden.String()},
+		{"names of the peer", named, newTestCSR(t, "gw.example.com", "gw.example.com"), ""},
+		{"name denied by policy", named, newTestCSR(t, "gateway", "denied.example.com"), Forbidden.String()},
+		{"common name of another peer", named, newTestCSR(t, "other.example.com"), Forbidden.String()},
+		{"without client certificate", nil, newTestCSR(t, testDeviceID), Unauthorized.String()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := s.dial(t, tt.peer)
+			defer c.Close()
+			crt, err := c.Enroll(tt.csr)
+			if tt.wantCode != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantCode) {
+					t.Fatalf("Enroll() error = %v, want %s", err, tt.wantCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Enroll() error = %v", err)
+			}
+			if crt.Subject.CommonName != tt.csr.Subject.CommonName {
+				t.Errorf("Enroll() subject = %s, want %s", crt.Subject, tt.csr.Subject)
+			}
+		})
+	}
+
+	s.auth.mu.Lock()
+	defer s.auth.mu.Unlock()
+	for _, p := range s.auth.provisioners {
+		if p != "ocf.devices" {
+			t.Errorf("Sign() provisioner = %q, want ocf.devices", p)
+		}
+	}
+}
+
+func TestServerReenroll(t *testing.T) {
+	s, cleanup := newTestServer(t, nil)
+	defer cleanup()
+
+	// Enroll with the manufacturer certificate first.
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := s.dial(t, newTestLeaf(t, testDeviceID, s.manufacturer))
+	crt, err := c.Enroll(newTestCSRWithKey(t, key, testDeviceID))
+	c.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	enrolled := &testIdentity{crt: crt, key: key, intermediate: s.auth.intermediate.crt}
+	renewal := newTestCSR(t, testDeviceID)
+
+	tests := []struct {
+		name     string
+		peer     *testIdentity
+		csr      *x509.CertificateRequest
+		wantCode string
+	}{
+		{"certificate of the CA", enrolled, renewal, ""},
+		{"other subject", enrolled, newTestCSR(t, otherDevice), Forbidden.String()},
+		{"additional names", enrolled, newTestCSR(t, testDeviceID, "gw.example.com"), Forbidden.String()},
+		{"manufacturer certificate", newTestLeaf(t, testDeviceID, s.manufacturer), renewal, Unauthorized.String()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := s.dial(t, tt.peer)
+			defer c.Close()
+			_, err := c.Reenroll(tt.csr)
+			if tt.wantCode == "" && err != nil {
+				t.Fatalf("Reenroll() error = %v", err)
+			}
+			if tt.wantCode != "" && (err == nil || !strings.Contains(err.Error(), tt.wantCode)) {
+				t.Fatalf("Reenroll() error = %v, want %s", err, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestServerUnauthorizedPeer(t *testing.T) {
+	s, cleanup := newTestServer(t, nil)
+	defer cleanup()
+
+	// A certificate of an unknown manufacturer fails the handshake.
+	untrusted := newTestLeaf(t, testDeviceID, newTestCA(t, "unknown"))
+	c, err := Dial(s.addr, &tls.Config{
+		RootCAs:      s.roots,
+		Certificates: []tls.Certificate{untrusted.tlsCertificate()},
+	})
+	if err == nil {
+		defer c.Close()
+		if _, err = c.Enroll(newTestCSR(t, testDeviceID)); err == nil {
+			t.Fatal("Enroll() with an untrusted client certificate error = nil, want an error")
+		}
+	}
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+	}{
+		{"empty", nil},
+		{"short", []byte("payload")},
+		{"one byte length", bytes.Repeat([]byte{1}, 200)},
+		{"two bytes length", bytes.Repeat([]byte{2}, 1000)},
+		{"four bytes length", bytes.Repeat([]byte{3}, 70000)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &Message{Code: POST, Token: []byte{1, 2, 3, 4}, Payload: tt.payload}
+			m.SetPath(senPath)
+			m.SetContentFormat(FormatPKCS10)
+			m.SetAccept(FormatPKIXCert)
+			b, err := m.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ReadMessage(bufio.NewReader(bytes.NewReader(b)), len(b))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Code != m.Code || !bytes.Equal(got.Token, m.Token) || !bytes.Equal(got.Payload, m.Payload) {
+				t.Errorf("ReadMessage() = %v %x, want %v %x", got.Code, got.Token, m.Code, m.Token)
+			}
+			if got.Path() != senPath || got.ContentFormat() != FormatPKCS10 || got.Accept() != FormatPKIXCert {
+				t.Errorf("ReadMessage() options = %s %d %d", got.Path(), got.ContentFormat(), got.Accept())
+			}
+			if !reflect.DeepEqual(got.options, m.options) {
+				t.Errorf("ReadMessage() options = %v, want %v", got.options, m.options)
+			}
+			// The maximum size bounds the options and the payload.
+			if _, err := ReadMessage(bufio.NewReader(bytes.NewReader(b)), len(tt.payload)); err == nil {
+				t.Error("ReadMessage() of a message larger than the maximum size error = nil, want an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,194 @@
+// Package events implements the bus the CA publishes issuance lifecycle
+// events to, and the sinks that deliver them.
+package events
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/smallstep/cli/crypto/randutil"
+)
+
+// Type is the type of an event.
+type Type string
+
+// Event types.
+const (
+	AccountCreated  Type = "account.created"
+	OrderFinalized  Type = "order.finalized"
+	CertIssued      Type = "cert.issued"
+	CertRevoked     Type = "cert.revoked"
+	ChallengeFailed Type = "challenge.failed"
+)
+
+// Event is an event published to the bus. Data is one of the data types of
+// this package, depending on the event type.
+type Event struct {
+	ID   string      `json:"id"`
+	Type Type        `json:"type"`
+	Time time.Time   `json:"time"`
+	Data interface{} `json:"data"`
+}
+
+// AccountData is the data of the account.created event.
+type AccountData struct {
+	ID          string   `json:"id"`
+	Contact     []string `json:"contact,omitempty"`
+	Provisioner string   `json:"provisioner"`
+}
+
+// OrderData is the data of the order.finalized event.
+type OrderData struct {
+	ID            string   `json:"id"`
+	AccountID     string   `json:"accountID"`
+	Identifiers   []string `json:"identifiers"`
+	CertificateID string   `json:"certificateID"`
+	Provisioner   string   `json:"provisioner"`
+}
+
+// CertificateData is the data of the cert.issued event.
+type CertificateData struct {
+	Serial    string    `json:"serial"`
+	Subject   string    `json:"subject"`
+	DNSNames  []string  `json:"dnsNames,omitempty"`
+	NotBefore time.Time `json:"notBefore"`
+	NotAfter  time.Time `json:"notAfter"`
+	AccountID string    `json:"accountID,omitempty"`
+}
+
+// RevocationData is the data of the cert.revoked event.
+type RevocationData struct {
+	Serial     string `json:"serial"`
+	Reason     string `json:"reason,omitempty"`
+	ReasonCode int    `json:"reasonCode"`
+}
+
+// ChallengeData is the data of the challenge.failed event.
+type ChallengeData struct {
+	ID          string      `json:"id"`
+	AuthzID     string      `json:"authzID"`
+	AccountID   string      `json:"accountID"`
+	Type        string      `json:"type"`
+	Identifier  string      `json:"identifier"`
+	Status      string      `json:"status"`
+	Error       interface{} `json:"error,omitempty"`
+	Provisioner string      `json:"provisioner"`
+}
+
+// Sink receives the events published to a bus. Send is called from a
+// goroutine dedicated to the sink, one event at a time. The context is
+// cancelled when the bus gives up on the queued events on close.
+type Sink interface {
+	Send(context.Context, *Event) error
+}
+
+// queueSize is the number of events buffered per sink. Events published
+// while the queue of a sink is full are dropped for that sink.
+const queueSize = 1024
+
+// closeTimeout is how long Close waits for the sinks to deliver the queued
+// events.
+var closeTimeout = 10 * time.Second
+
+// Bus delivers the published events to its sinks asynchronously. A nil bus
+// discards all events.
+type Bus struct {
+	mu     sync.RWMutex
+	queues []chan *Event
+	wg     sync.WaitGroup
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewBus returns a bus delivering events to the given sinks.
+func NewBus(sinks ...Sink) *Bus {
+	b := &Bus{}
+	b.ctx, b.cancel = context.WithCancel(context.Background())
+	for _, s := range sinks {
+		q := make(chan *Event, queueSize)
+		b.queues = append(b.queues, q)
+		b.wg.Add(1)
+		go func(s Sink) {
+			defer b.wg.Done()
+			var dropped int
+			for e := range q {
+				if b.ctx.Err() != nil {
+					dropped++
+					continue
+				}
+				if err := s.Send(b.ctx, e); err != nil {
+					log.Printf("error sending event %s %s: %v", e.Type, e.ID, err)
+				}
+			}
+			if dropped > 0 {
+				log.Printf("error sending events: %d queued events dropped on close", dropped)
+			}
+		}(s)
+	}
+	return b
+}
+
+// Publish publishes an event with the given type and data.
+func (b *Bus) Publish(typ Type, data interface{}) {
+	if b == nil {
+		return
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if len(b.queues) == 0 {
+		return
+	}
+	id, err := randutil.Alphanumeric(32)
+	if err != nil {
+		log.Printf("error generating event ID: %v", err)
+		return
+	}
+	e := &Event{ID: id, Type: typ, Time: time.Now().UTC(), Data: data}
+	for _, q := range b.queues {
+		select {
+		case q <- e:
+		default:
+			log.Printf("error sending event %s %s: queue is full", e.Type, e.ID)
+		}
+	}
+}
+
+// Close stops accepting events and waits until the sinks have processed the
+// queued ones, for at most closeTimeout. The deliveries in progress are then
+// cancelled and the events left in the queues are dropped. Events published
+// after Close are discarded.
+func (b *Bus) Close() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	for _, q := range b.queues {
+		close(q)
+	}
+	b.queues = nil
+	b.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		b.wg.Wait()
+		close(done)
+	}()
+	t := time.NewTimer(closeTimeout)
+	defer t.Stop()
+	select {
+	case <-done:
+	case <-t.C:
+		log.Printf("error closing the event bus: events not delivered after %s are dropped", closeTimeout)
+	}
+	b.cancel()
+}
+
+// SinkFunc is an adapter to use a function as a sink.
+type SinkFunc func(context.Context, *Event) error
+
+// Send calls f(ctx, e).
+func (f SinkFunc) Send(ctx context.Context, e *Event) error {
+	return f(ctx, e)
+}
@@ -0,0 +1,136 @@
+package events
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recorder is a sink recording the events it receives.
+type recorder struct {
+	mu     sync.Mutex
+	events []*Event
+}
+
+func (r *recorder) Send(ctx context.Context, e *Event) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, e)
+	return nil
+}
+
+func (r *recorder) len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.events)
+}
+
+func TestBusFanOut(t *testing.T) {
+	r1, r2 := new(recorder), new(recorder)
+	var (
+		mu    sync.Mutex
+		types []Type
+	)
+	b := NewBus(r1, r2, SinkFunc(func(ctx context.Context, e *Event) error {
+		mu.Lock()
+		defer mu.Unlock()
+		types = append(types, e.Type)
+		return nil
+	}))
+	published := []Type{AccountCreated, OrderFinalized, CertIssued}
+	for _, typ := range published {
+		b.Publish(typ, &AccountData{ID: "acc1"})
+	}
+	b.Close()
+
+	for i, r := range []*recorder{r1, r2} {
+		if len(r.events) != len(published) {
+			t.Fatalf("sink %d received %d events, want %d", i, len(r.events), len(published))
+		}
+		for j, e := range r.events {
+			if e.Type != published[j] || e.ID == "" || e.Time.IsZero() {
+				t.Errorf("sink %d event %d = %+v", i, j, e)
+			}
+			if e != r1.events[j] {
+				t.Errorf("sink %d event %d differs from the one of sink 0", i, j)
+			}
+		}
+	}
+	if len(types) != len(published) {
+		t.Errorf("SinkFunc received %v, want %v", types, published)
+	}
+
+	// Events published after Close are discarded.
+	b.Publish(CertRevoked, &RevocationData{Serial: "1"})
+	if r1.len() != len(published) {
+		t.Errorf("sink received %d events after Close, want %d", r1.len(), len(published))
+	}
+}
+
+func TestBusQueueFull(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	r := new(recorder)
+	b := NewBus(SinkFunc(func(ctx context.Context, e *Event) error {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-release
+		return r.Send(ctx, e)
+	}))
+
+	// The first event is being sent while the others fill the queue; the
+	// events that do not fit are dropped.
+	b.Publish(CertIssued, nil)
+	<-started
+	for i := 0; i < queueSize+10; i++ {
+		b.Publish(CertIssued, nil)
+	}
+	close(release)
+	b.Close()
+	if got := r.len(); got != queueSize+1 {
+		t.Errorf("sink received %d events, want %d", got, queueSize+1)
+	}
+}
+
+func TestBusClose(t *testing.T) {
+	defer func(d time.Duration) { closeTimeout = d }(closeTimeout)
+	closeTimeout = 50 * time.Millisecond
+
+	// A sink that does not deliver holds up Close until the timeout only;
+	// its delivery is cancelled and the queued events are dropped.
+	var (
+		mu        sync.Mutex
+		calls     int
+		cancelled error
+	)
+	b := NewBus(SinkFunc(func(ctx context.Context, e *Event) error {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		<-ctx.Done()
+		mu.Lock()
+		cancelled = ctx.Err()
+		mu.Unlock()
+		return ctx.Err()
+	}))
+	for i := 0; i < 5; i++ {
+		b.Publish(CertIssued, nil)
+	}
+	start := time.Now()
+	b.Close()
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Close() took %s", d)
+	}
+	b.wg.Wait()
+	if calls != 1 || cancelled != context.Canceled {
+		t.Errorf("sink called %d times, context error %v; want 1 cancelled call", calls, cancelled)
+	}
+
+	// A nil bus discards the events.
+	var nilBus *Bus
+	nilBus.Publish(CertIssued, nil)
+	nilBus.Close()
+}
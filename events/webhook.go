@@ -0,0 +1,172 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/certificates/authority/provisioner"
+)
+
+// Webhook request headers.
+const (
+	// SignatureHeader is the hex encoded HMAC-SHA256, keyed with the webhook
+	// secret, of the timestamp header, a dot and the body.
+	SignatureHeader = "X-Step-Signature"
+	TimestampHeader = "X-Step-Timestamp"
+	EventHeader     = "X-Step-Event"
+)
+
+// Webhook defaults.
+const (
+	defaultWebhookTimeout    = 10 * time.Second
+	defaultWebhookMaxRetries = 5
+	webhookMinBackoff        = time.Second
+	webhookMaxBackoff        = 5 * time.Minute
+)
+
+// WebhookOptions configure a webhook the events are posted to.
+type WebhookOptions struct {
+	URL string `json:"url"`
+	// Secret is the key of the HMAC signature of the requests.
+	Secret string `json:"secret"`
+	// Events are the event types posted; all by default.
+	Events []Type `json:"events,omitempty"`
+	// Timeout is the timeout of each request; 10s by default.
+	Timeout *provisioner.Duration `json:"timeout,omitempty"`
+	// MaxRetries is the number of times a failed request is retried; 5 by
+	// default.
+	MaxRetries *int `json:"maxRetries,omitempty"`
+}
+
+// Webhook is a sink posting the events as JSON to an URL. Requests failing
+// with network errors, 429 or 5xx status codes are retried with exponential
+// backoff.
+type Webhook struct {
+	url        string
+	secret     []byte
+	events     map[Type]bool
+	maxRetries int
+	client     *http.Client
+	sleep      func(context.Context, time.Duration) error
+}
+
+// NewWebhook returns a new webhook sink.
+func NewWebhook(o *WebhookOptions) (*Webhook, error) {
+	if len(o.URL) == 0 {
+		return nil, errors.New("webhook url cannot be empty")
+	}
+	if len(o.Secret) == 0 {
+		return nil, errors.Errorf("webhook %s secret cannot be empty", o.URL)
+	}
+	w := &Webhook{
+		url:        o.URL,
+		secret:     []byte(o.Secret),
+		maxRetries: defaultWebhookMaxRetries,
+		client:     &http.Client{Timeout: defaultWebhookTimeout},
+		sleep:      sleep,
+	}
+	if o.Timeout != nil {
+		w.client.Timeout = o.Timeout.Duration
+	}
+	if o.MaxRetries != nil {
+		w.maxRetries = *o.MaxRetries
+	}
+	if len(o.Events) > 0 {
+		w.events = make(map[Type]bool)
+		for _, t := range o.Events {
+			w.events[t] = true
+		}
+	}
+	return w, nil
+}
+
+// Sign returns the signature of a webhook request.
+func Sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	io.WriteString(mac, timestamp)
+	io.WriteString(mac, ".")
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// sleep waits for the given duration, or until the context is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Send posts the event to the webhook, retrying on temporary failures until
+// the context is done.
+func (w *Webhook) Send(ctx context.Context, e *Event) error {
+	if w.events != nil && !w.events[e.Type] {
+		return nil
+	}
+	body, err := json.Marshal(e)
+	if err != nil {
+		return errors.Wrap(err, "error marshaling event")
+	}
+
+	backoff := webhookMinBackoff
+	for attempt := 0; ; attempt++ {
+		retry, err := w.post(ctx, e, body)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt >= w.maxRetries {
+			return errors.Wrapf(err, "error posting event to %s", w.url)
+		}
+		if err := w.sleep(ctx, backoff); err != nil {
+			return errors.Wrapf(err, "error posting event to %s; retries cancelled", w.url)
+		}
+		if backoff *= 2; backoff > webhookMaxBackoff {
+			backoff = webhookMaxBackoff
+		}
+	}
+}
+
+// post posts the event once. It returns whether a failed request can be
+// retried.
+func (w *Webhook) post(ctx context.Context, e *Event, body []byte) (bool, error) {
+	req, err := http.NewRequest("POST", w.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(ctx)
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, string(e.Type))
+	req.Header.Set(TimestampHeader, ts)
+	req.Header.Set(SignatureHeader, "sha256="+Sign(w.secret, ts, body))
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return ctx.Err() == nil, err
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("unexpected status %s", resp.Status)
+	default:
+		return false, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+}
@@ -0,0 +1,171 @@
+package events
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testServer answers the webhook requests with the given status codes, the
+// last one repeated, and records the requests.
+type testServer struct {
+	mu       sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (s *testServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := s.statuses[len(s.statuses)-1]
+	if n := len(s.requests); n < len(s.statuses) {
+		status = s.statuses[n]
+	}
+	s.requests = append(s.requests, r)
+	s.bodies = append(s.bodies, body)
+	w.WriteHeader(status)
+}
+
+func TestWebhookSignature(t *testing.T) {
+	s := &testServer{statuses: []int{http.StatusNoContent}}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	w, err := NewWebhook(&WebhookOptions{URL: srv.URL, Secret: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &Event{ID: "id1", Type: CertIssued, Time: time.Now().UTC(), Data: &CertificateData{Serial: "1"}}
+	if err := w.Send(context.Background(), e); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s.requests) != 1 {
+		t.Fatalf("server received %d requests, want 1", len(s.requests))
+	}
+	r, body := s.requests[0], s.bodies[0]
+	if r.Header.Get(EventHeader) != string(CertIssued) || r.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("request headers = %v", r.Header)
+	}
+	ts := r.Header.Get(TimestampHeader)
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(ts + "." + string(body)))
+	want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if got := r.Header.Get(SignatureHeader); got != want {
+		t.Errorf("%s = %s, want %s", SignatureHeader, got, want)
+	}
+	if got := Sign([]byte("other"), ts, body); "sha256="+got == want {
+		t.Error("Sign() with another secret matches the signature")
+	}
+	var got Event
+	if err := json.Unmarshal(body, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != e.ID || got.Type != e.Type {
+		t.Errorf("posted event = %+v, want %+v", got, e)
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	s := time.Second
+	tests := []struct {
+		name       string
+		statuses   []int
+		maxRetries int
+		requests   int
+		backoff    []time.Duration
+		ok         bool
+	}{
+		{"ok", []int{200}, 5, 1, nil, true},
+		{"server errors", []int{500, 503, 200}, 5, 3, []time.Duration{s, 2 * s}, true},
+		{"too many requests", []int{429, 200}, 5, 2, []time.Duration{s}, true},
+		{"bad request", []int{400}, 5, 1, nil, false},
+		{"unauthorized", []int{401, 200}, 5, 1, nil, false},
+		{"no retries", []int{500}, 0, 1, nil, false},
+		{"retries exhausted", []int{500}, 5, 6, []time.Duration{s, 2 * s, 4 * s, 8 * s, 16 * s}, false},
+		{"max backoff", []int{503}, 10, 11, []time.Duration{s, 2 * s, 4 * s, 8 * s, 16 * s, 32 * s, 64 * s, 128 * s, 256 * s, 5 * time.Minute}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := &testServer{statuses: tt.statuses}
+			ts := httptest.NewServer(srv)
+			defer ts.Close()
+			w, err := NewWebhook(&WebhookOptions{URL: ts.URL, Secret: "secret", MaxRetries: &tt.maxRetries})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var backoff []time.Duration
+			w.sleep = func(ctx context.Context, d time.Duration) error {
+				backoff = append(backoff, d)
+				return nil
+			}
+			err = w.Send(context.Background(), &Event{ID: "id1", Type: CertIssued})
+			if (err == nil) != tt.ok {
+				t.Errorf("Send() error = %v, want ok %v", err, tt.ok)
+			}
+			if len(srv.requests) != tt.requests {
+				t.Errorf("server received %d requests, want %d", len(srv.requests), tt.requests)
+			}
+			if fmt.Sprint(backoff) != fmt.Sprint(tt.backoff) {
+				t.Errorf("backoff = %v, want %v", backoff, tt.backoff)
+			}
+		})
+	}
+}
+
+func TestWebhookCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cancel()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	w, err := NewWebhook(&WebhookOptions{URL: srv.URL, Secret: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The backoff is interrupted by the cancellation.
+	start := time.Now()
+	if err := w.Send(ctx, &Event{ID: "id1", Type: CertIssued}); err == nil {
+		t.Error("Send() of a cancelled delivery error = nil")
+	}
+	if d := time.Since(start); d >= webhookMinBackoff {
+		t.Errorf("Send() took %s after the cancellation", d)
+	}
+}
+
+func TestWebhookEvents(t *testing.T) {
+	s := &testServer{statuses: []int{http.StatusOK}}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	w, err := NewWebhook(&WebhookOptions{URL: srv.URL, Secret: "secret", Events: []Type{CertRevoked}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, typ := range []Type{CertIssued, CertRevoked, AccountCreated} {
+		if err := w.Send(context.Background(), &Event{ID: "id1", Type: typ}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(s.requests) != 1 || s.requests[0].Header.Get(EventHeader) != string(CertRevoked) {
+		t.Errorf("server received %d requests, want the cert.revoked event only", len(s.requests))
+	}
+
+	if _, err := NewWebhook(&WebhookOptions{URL: srv.URL}); err == nil {
+		t.Error("NewWebhook() without a secret error = nil")
+	}
+	if _, err := NewWebhook(&WebhookOptions{Secret: "secret"}); err == nil {
+		t.Error("NewWebhook() without a url error = nil")
+	}
+}
@@ -3,10 +3,14 @@ module github.com/go-ocf/step-ca
 go 1.13
 
 require (
+	github.com/dgraph-io/badger v1.5.3
 	github.com/go-chi/chi v4.0.3+incompatible
+	github.com/go-sql-driver/mysql v1.4.1
 	github.com/google/uuid v1.1.1
 	github.com/hashicorp/go-retryablehttp v0.6.4
+	github.com/lib/pq v1.3.0
 	github.com/manifoldco/promptui v0.7.0 // indirect
+	github.com/miekg/dns v1.1.29
 	github.com/newrelic/go-agent v3.1.0+incompatible // indirect
 	github.com/pkg/errors v0.9.1
 	github.com/rs/xid v1.2.1 // indirect
@@ -16,6 +20,8 @@ require (
 	github.com/smallstep/cli v0.13.3
 	github.com/smallstep/nosql v0.2.0
 	github.com/urfave/cli v1.22.2
+	go.etcd.io/bbolt v1.3.2
+	go.mozilla.org/pkcs7 v0.9.0
 	golang.org/x/crypto v0.0.0-20200117160349-530e935923ad
-	gopkg.in/square/go-jose.v2 v2.4.1 // indirect
+	gopkg.in/square/go-jose.v2 v2.4.1
 )
@@ -0,0 +1,376 @@
+// Package inventory keeps an index of the issued certificates, by device,
+// provisioner, account, expiration and revocation status.
+package inventory
+
+import (
+	"bytes"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-ocf/step-ca/kvdb"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/smallstep/nosql"
+	"github.com/smallstep/nosql/database"
+)
+
+// Pagination limits of the inventory queries.
+const (
+	DefaultLimit = 20
+	MaxLimit     = 100
+)
+
+// Certificate status values.
+const (
+	StatusValid   = "valid"
+	StatusExpired = "expired"
+	StatusRevoked = "revoked"
+)
+
+var (
+	certTable          = []byte("inventory-certs")
+	bySubjectTable     = []byte("inventory-subject-index")
+	byProvisionerTable = []byte("inventory-provisioner-index")
+	byAccountTable     = []byte("inventory-account-index")
+	byNotAfterTable    = []byte("inventory-notafter-index")
+	revokedTable       = []byte("inventory-revoked-index")
+)
+
+// Tables returns the names of the tables of the inventory.
+func Tables() []string {
+	return []string{string(certTable), string(bySubjectTable),
+		string(byProvisionerTable), string(byAccountTable),
+		string(byNotAfterTable), string(revokedTable)}
+}
+
+// OIDProvisioner is the OID of the extension with the provisioner that
+// authorized a certificate.
+var OIDProvisioner = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 37476, 9000, 64, 1}
+
+// ProvisionerExtension is the value of the provisioner extension.
+type ProvisionerExtension struct {
+	Type          int
+	Name          []byte
+	CredentialID  []byte
+	KeyValuePairs []string `asn1:"optional,omitempty"`
+}
+
+// AccountID is a sign option with the ID of the ACME account a certificate
+// is issued to. It is consumed by the CA and never reaches the provisioners.
+type AccountID string
+
+// Provisioner is a sign option with the name of the provisioner that
+// authorized a certificate. It is consumed by the CA and never reaches the
+// provisioners.
+type Provisioner string
+
+// Certificate is the inventory record of an issued certificate.
+type Certificate struct {
+	Serial           string    `json:"serial"`
+	Subject          string    `json:"subject"`
+	DeviceID         string    `json:"deviceID,omitempty"`
+	Provisioner      string    `json:"provisioner,omitempty"`
+	AccountID        string    `json:"accountID,omitempty"`
+	NotBefore        time.Time `json:"notBefore"`
+	NotAfter         time.Time `json:"notAfter"`
+	Revoked          time.Time `json:"revoked,omitempty"`
+	RevocationReason string    `json:"revocationReason,omitempty"`
+	// Status is the status of the certificate at the time of the query. It
+	// is not stored.
+	Status string `json:"status,omitempty"`
+}
+
+// statusAt returns the status of the certificate at the given time.
+func (c *Certificate) statusAt(now time.Time) string {
+	switch {
+	case !c.Revoked.IsZero():
+		return StatusRevoked
+	case now.After(c.NotAfter):
+		return StatusExpired
+	default:
+		return StatusValid
+	}
+}
+
+// Query selects the certificates to return. Empty fields match all.
+type Query struct {
+	// Subject is the subject common name.
+	Subject string
+	// DeviceID is the UUID of the device, in OCF identity certificates
+	// the common name uuid:<DeviceID>.
+	DeviceID      string
+	Provisioner   string
+	AccountID     string
+	ExpiresAfter  time.Time
+	ExpiresBefore time.Time
+	Status        string
+}
+
+// Store is the certificate inventory.
+type Store struct {
+	db nosql.DB
+}
+
+// New returns the inventory kept in the given database.
+func New(db nosql.DB) (*Store, error) {
+	tables := [][]byte{certTable, bySubjectTable, byProvisionerTable,
+		byAccountTable, byNotAfterTable, revokedTable}
+	for _, t := range tables {
+		if err := db.CreateTable(t); err != nil {
+			return nil, errors.Wrapf(err, "error creating table %s", string(t))
+		}
+	}
+	return &Store{db: db}, nil
+}
+
+// indexKey returns the key of a certificate in an index; the indexed value
+// followed by the serial, so that keys sort by value.
+func indexKey(value, serial string) string {
+	return strings.ToLower(value) + "/" + serial
+}
+
+func notAfterKey(t time.Time, serial string) string {
+	return fmt.Sprintf("%020d/%s", t.Unix(), serial)
+}
+
+// deviceID returns the device UUID of an OCF identity common name, if any.
+func deviceID(cn string) string {
+	if !strings.HasPrefix(strings.ToLower(cn), "uuid:") {
+		return ""
+	}
+	id, err := uuid.Parse(cn[len("uuid:"):])
+	if err != nil {
+		return ""
+	}
+	return id.String()
+}
+
+// ProvisionerName returns the name of the provisioner in the provisioner
+// extension of the certificate, or of the certificate template, if any.
+func ProvisionerName(cert *x509.Certificate) string {
+	for _, exts := range [][]pkix.Extension{cert.ExtraExtensions, cert.Extensions} {
+		for _, ext := range exts {
+			if !ext.Id.Equal(OIDProvisioner) {
+				continue
+			}
+			var val ProvisionerExtension
+			if _, err := asn1.Unmarshal(ext.Value, &val); err == nil {
+				return string(val.Name)
+			}
+		}
+	}
+	return ""
+}
+
+// Add adds an issued certificate to the inventory.
+func (s *Store) Add(cert *x509.Certificate, accountID string) error {
+	c := &Certificate{
+		Serial:      cert.SerialNumber.String(),
+		Subject:     cert.Subject.CommonName,
+		DeviceID:    deviceID(cert.Subject.CommonName),
+		Provisioner: ProvisionerName(cert),
+		AccountID:   accountID,
+		NotBefore:   cert.NotBefore,
+		NotAfter:    cert.NotAfter,
+	}
+	b, err := json.Marshal(c)
+	if err != nil {
+		return errors.Wrap(err, "error marshaling inventory certificate")
+	}
+
+	tx := new(database.Tx)
+	tx.Set(certTable, []byte(c.Serial), b)
+	if len(c.Subject) > 0 {
+		tx.Set(bySubjectTable, []byte(indexKey(c.Subject, c.Serial)), []byte(c.Serial))
+	}
+	if len(c.Provisioner) > 0 {
+		tx.Set(byProvisionerTable, []byte(indexKey(c.Provisioner, c.Serial)), []byte(c.Serial))
+	}
+	if len(c.AccountID) > 0 {
+		tx.Set(byAccountTable, []byte(indexKey(c.AccountID, c.Serial)), []byte(c.Serial))
+	}
+	tx.Set(byNotAfterTable, []byte(notAfterKey(c.NotAfter, c.Serial)), []byte(c.Serial))
+	if err := s.db.Update(tx); err != nil {
+		return errors.Wrap(err, "error storing inventory certificate")
+	}
+	return nil
+}
+
+// Get returns the certificate with the given serial number.
+func (s *Store) Get(serial string) (*Certificate, error) {
+	c, err := s.get(serial)
+	if err != nil {
+		return nil, err
+	}
+	c.Status = c.statusAt(time.Now())
+	return c, nil
+}
+
+func (s *Store) get(serial string) (*Certificate, error) {
+	b, err := s.db.Get(certTable, []byte(serial))
+	if err != nil {
+		if nosql.IsErrNotFound(err) {
+			return nil, errors.Wrapf(err, "certificate %s not found", serial)
+		}
+		return nil, errors.Wrap(err, "error loading inventory certificate")
+	}
+	c := new(Certificate)
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, errors.Wrap(err, "error unmarshaling inventory certificate")
+	}
+	return c, nil
+}
+
+// Revoke records the revocation of the certificate with the given serial
+// number. Certificates issued before the inventory existed are ignored.
+func (s *Store) Revoke(serial, reason string) error {
+	old, err := s.db.Get(certTable, []byte(serial))
+	if err != nil {
+		if nosql.IsErrNotFound(err) {
+			return nil
+		}
+		return errors.Wrap(err, "error loading inventory certificate")
+	}
+	c := new(Certificate)
+	if err := json.Unmarshal(old, c); err != nil {
+		return errors.Wrap(err, "error unmarshaling inventory certificate")
+	}
+	c.Revoked = time.Now().UTC()
+	c.RevocationReason = reason
+	b, err := json.Marshal(c)
+	if err != nil {
+		return errors.Wrap(err, "error marshaling inventory certificate")
+	}
+
+	_, swapped, err := s.db.CmpAndSwap(certTable, []byte(serial), old, b)
+	switch {
+	case err != nil:
+		return errors.Wrap(err, "error storing inventory certificate")
+	case !swapped:
+		return errors.New("error storing inventory certificate; value has changed since last read")
+	}
+	if err := s.db.Set(revokedTable, []byte(serial), []byte(serial)); err != nil {
+		return errors.Wrap(err, "error storing inventory revocation index")
+	}
+	return nil
+}
+
+// scan returns the index to scan for the query, the prefix of the keys of
+// the matching certificates in it and the range of those keys; the first
+// key is greater than from and the last one less than to.
+func (q *Query) scan() (table []byte, prefix, from, to string) {
+	switch {
+	case len(q.DeviceID) > 0:
+		return bySubjectTable, indexKey("uuid:"+q.DeviceID, ""), "", ""
+	case len(q.Subject) > 0:
+		return bySubjectTable, indexKey(q.Subject, ""), "", ""
+	case len(q.AccountID) > 0:
+		return byAccountTable, indexKey(q.AccountID, ""), "", ""
+	case len(q.Provisioner) > 0:
+		return byProvisionerTable, indexKey(q.Provisioner, ""), "", ""
+	case q.Status == StatusRevoked:
+		return revokedTable, "", "", ""
+	case !q.ExpiresAfter.IsZero() || !q.ExpiresBefore.IsZero():
+		// The keys of a time are greater than the key of the time
+		// without serial.
+		if !q.ExpiresAfter.IsZero() {
+			from = notAfterKey(q.ExpiresAfter, "")
+		}
+		if !q.ExpiresBefore.IsZero() {
+			to = notAfterKey(q.ExpiresBefore, "")
+		}
+		return byNotAfterTable, "", from, to
+	default:
+		return certTable, "", "", ""
+	}
+}
+
+// matches returns true if the certificate satisfies all the conditions of
+// the query.
+func (q *Query) matches(c *Certificate, now time.Time) bool {
+	switch {
+	case len(q.DeviceID) > 0 && !strings.EqualFold(c.DeviceID, q.DeviceID):
+		return false
+	case len(q.Subject) > 0 && !strings.EqualFold(c.Subject, q.Subject):
+		return false
+	case len(q.AccountID) > 0 && !strings.EqualFold(c.AccountID, q.AccountID):
+		return false
+	case len(q.Provisioner) > 0 && !strings.EqualFold(c.Provisioner, q.Provisioner):
+		return false
+	case !q.ExpiresAfter.IsZero() && c.NotAfter.Before(q.ExpiresAfter):
+		return false
+	case !q.ExpiresBefore.IsZero() && !c.NotAfter.Before(q.ExpiresBefore):
+		return false
+	case len(q.Status) > 0 && c.statusAt(now) != q.Status:
+		return false
+	default:
+		return true
+	}
+}
+
+// Find returns a page of the certificates matching the query, and the cursor
+// of the next page, empty if there are no more.
+func (s *Store) Find(q Query, cursor string, limit int) ([]*Certificate, string, error) {
+	switch {
+	case limit <= 0:
+		limit = DefaultLimit
+	case limit > MaxLimit:
+		limit = MaxLimit
+	}
+	if len(q.DeviceID) > 0 {
+		id, err := uuid.Parse(q.DeviceID)
+		if err != nil {
+			return nil, "", errors.Wrapf(err, "invalid device ID %s", q.DeviceID)
+		}
+		q.DeviceID = id.String()
+	}
+
+	table, prefix, after, to := q.scan()
+	if cursor > after {
+		after = cursor
+	}
+
+	// Read the index in ranges of a page.
+	now := time.Now()
+	var certs []*Certificate
+	for {
+		entries, err := kvdb.ListRange(s.db, table, []byte(prefix), []byte(after), limit+1)
+		if err != nil {
+			if nosql.IsErrNotFound(err) {
+				return nil, "", nil
+			}
+			return nil, "", errors.Wrap(err, "error listing inventory")
+		}
+		for _, e := range entries {
+			key := string(e.Key)
+			if len(to) > 0 && key >= to {
+				return certs, "", nil
+			}
+			if len(certs) == limit {
+				return certs, cursor, nil
+			}
+			c := new(Certificate)
+			if bytes.Equal(table, certTable) {
+				if err := json.Unmarshal(e.Value, c); err != nil {
+					return nil, "", errors.Wrap(err, "error unmarshaling inventory certificate")
+				}
+			} else if c, err = s.get(string(e.Value)); err != nil {
+				return nil, "", err
+			}
+			if q.matches(c, now) {
+				c.Status = c.statusAt(now)
+				certs = append(certs, c)
+			}
+			cursor = key
+		}
+		if len(entries) <= limit {
+			return certs, "", nil
+		}
+		after = cursor
+	}
+}
@@ -0,0 +1,140 @@
+package inventory
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-ocf/step-ca/kvdb"
+)
+
+func newTestStore(t *testing.T) (*Store, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "inventory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := kvdb.New(kvdb.BoltDriver, filepath.Join(dir, "inventory.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	s, err := New(db)
+	if err != nil {
+		db.Close()
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return s, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func provisionerExtension(t *testing.T, name string) pkix.Extension {
+	t.Helper()
+	b, err := asn1.Marshal(ProvisionerExtension{Type: 1, Name: []byte(name)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pkix.Extension{Id: OIDProvisioner, Value: b}
+}
+
+func TestProvisionerName(t *testing.T) {
+	ext := provisionerExtension(t, "acme")
+	if got := ProvisionerName(&x509.Certificate{Extensions: []pkix.Extension{ext}}); got != "acme" {
+		t.Errorf("ProvisionerName() of a certificate = %q, want acme", got)
+	}
+	if got := ProvisionerName(&x509.Certificate{ExtraExtensions: []pkix.Extension{ext}}); got != "acme" {
+		t.Errorf("ProvisionerName() of a template = %q, want acme", got)
+	}
+	if got := ProvisionerName(&x509.Certificate{}); got != "" {
+		t.Errorf("ProvisionerName() without extension = %q, want empty", got)
+	}
+}
+
+func TestFind(t *testing.T) {
+	s, cleanup := newTestStore(t)
+	defer cleanup()
+
+	const device = "9f2c3e4a-7b1d-4c5e-8f6a-0b1c2d3e4f50"
+	now := time.Now().Truncate(time.Second)
+	for i := 0; i < 30; i++ {
+		cn := fmt.Sprintf("host%d.example.com", i%5)
+		if i%10 == 0 {
+			cn = "uuid:" + device
+		}
+		account := "acc1"
+		if i%2 == 0 {
+			account = "acc2"
+		}
+		cert := &x509.Certificate{
+			SerialNumber: big.NewInt(int64(1000 + i)),
+			Subject:      pkix.Name{CommonName: cn},
+			NotBefore:    now.Add(-time.Hour),
+			NotAfter:     now.Add(time.Duration(i+1) * time.Hour),
+			Extensions:   []pkix.Extension{provisionerExtension(t, "acme")},
+		}
+		if err := s.Add(cert, account); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Revoke("1003", "keyCompromise"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		query Query
+		want  int
+	}{
+		{"all", Query{}, 30},
+		{"subject", Query{Subject: "HOST1.example.com"}, 6},
+		{"device", Query{DeviceID: device}, 3},
+		{"account", Query{AccountID: "acc1"}, 15},
+		{"provisioner", Query{Provisioner: "acme"}, 30},
+		{"revoked", Query{Status: StatusRevoked}, 1},
+		{"expires before", Query{ExpiresBefore: now.Add(10*time.Hour + time.Minute)}, 10},
+		{"expires between", Query{ExpiresAfter: now.Add(5 * time.Hour), ExpiresBefore: now.Add(7*time.Hour + time.Minute)}, 3},
+		{"account and subject", Query{AccountID: "acc2", Subject: "host2.example.com"}, 3},
+		{"unknown subject", Query{Subject: "other.example.com"}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seen := make(map[string]bool)
+			var cursor string
+			for pages := 0; ; pages++ {
+				if pages > 30 {
+					t.Fatal("too many pages")
+				}
+				certs, next, err := s.Find(tt.query, cursor, 4)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(certs) > 4 {
+					t.Fatalf("page of %d certificates, limit 4", len(certs))
+				}
+				for _, c := range certs {
+					if seen[c.Serial] {
+						t.Fatalf("certificate %s found twice", c.Serial)
+					}
+					seen[c.Serial] = true
+				}
+				if next == "" {
+					break
+				}
+				cursor = next
+			}
+			if len(seen) != tt.want {
+				t.Errorf("found %d certificates, want %d", len(seen), tt.want)
+			}
+		})
+	}
+}
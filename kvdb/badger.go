@@ -0,0 +1,373 @@
+package kvdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+
+	"github.com/dgraph-io/badger"
+	"github.com/pkg/errors"
+	"github.com/smallstep/nosql/database"
+)
+
+// Badger is a database stored in Badger. The keys are the length prefixed
+// table name followed by the length prefixed key; a table is created by
+// storing its prefix alone.
+type Badger struct {
+	db *badger.DB
+}
+
+// Open opens or creates the database in the given directory.
+func (db *Badger) Open(dir string, opt ...database.Option) error {
+	opts := new(database.Options)
+	for _, o := range opt {
+		if err := o(opts); err != nil {
+			return err
+		}
+	}
+	bo := badger.DefaultOptions
+	bo.Dir, bo.ValueDir = dir, dir
+	if opts.ValueDir != "" {
+		bo.ValueDir = opts.ValueDir
+	}
+	var err error
+	if db.db, err = badger.Open(bo); err != nil {
+		return errors.Wrap(err, "error opening Badger database")
+	}
+	return nil
+}
+
+// Close closes the database.
+func (db *Badger) Close() error {
+	return errors.Wrap(db.db.Close(), "error closing Badger database")
+}
+
+// encodeSection returns the length prefixed value.
+func encodeSection(v []byte) ([]byte, error) {
+	switch {
+	case len(v) == 0:
+		return nil, errors.New("input cannot be empty")
+	case len(v) > 0xffff:
+		return nil, errors.New("length of input cannot be greater than 65535")
+	}
+	b := make([]byte, 2, 2+len(v))
+	binary.LittleEndian.PutUint16(b, uint16(len(v)))
+	return append(b, v...), nil
+}
+
+// badgerKey returns the key of the value stored in bucket/key.
+func badgerKey(bucket, key []byte) ([]byte, error) {
+	prefix, err := encodeSection(bucket)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid table %s", bucket)
+	}
+	k, err := encodeSection(key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid key %s/%s", bucket, key)
+	}
+	return append(prefix, k...), nil
+}
+
+func badgerGet(txn *badger.Txn, bucket, key []byte) ([]byte, error) {
+	bk, err := badgerKey(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	item, err := txn.Get(bk)
+	switch {
+	case err == badger.ErrKeyNotFound:
+		return nil, errors.Wrapf(database.ErrNotFound, "%s/%s not found", bucket, key)
+	case err != nil:
+		return nil, errors.Wrapf(err, "failed to get %s/%s", bucket, key)
+	}
+	v, err := item.Value()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get %s/%s", bucket, key)
+	}
+	return cloneBytes(v), nil
+}
+
+func badgerList(txn *badger.Txn, bucket []byte) ([]*database.Entry, error) {
+	prefix, err := encodeSection(bucket)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid table %s", bucket)
+	}
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+
+	var entries []*database.Entry
+	exists := false
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		exists = true
+		item := it.Item()
+		rest := item.Key()[len(prefix):]
+		if len(rest) == 0 {
+			// Table marker.
+			continue
+		}
+		if len(rest) < 2 || int(binary.LittleEndian.Uint16(rest))+2 != len(rest) {
+			return nil, errors.Errorf("invalid key %x in table %s", item.Key(), bucket)
+		}
+		v, err := item.Value()
+		if err != nil {
+			return nil, errors.Wrapf(err, "error reading %s/%s", bucket, rest[2:])
+		}
+		entries = append(entries, &database.Entry{
+			Bucket: bucket,
+			Key:    cloneBytes(rest[2:]),
+			Value:  cloneBytes(v),
+		})
+	}
+	if !exists {
+		return nil, errors.Wrapf(database.ErrNotFound, "table %s does not exist", bucket)
+	}
+	return entries, nil
+}
+
+// badgerListRange implements ListRange. The keys of a table are stored by
+// length, not in key order, so all of them are read, without their values,
+// and only the values of the range are.
+func badgerListRange(txn *badger.Txn, bucket, prefix, after []byte, limit int) ([]*database.Entry, error) {
+	tp, err := encodeSection(bucket)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid table %s", bucket)
+	}
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	var keys [][]byte
+	exists := false
+	for it.Seek(tp); it.ValidForPrefix(tp); it.Next() {
+		exists = true
+		rest := it.Item().Key()[len(tp):]
+		if len(rest) == 0 {
+			// Table marker.
+			continue
+		}
+		if len(rest) < 2 || int(binary.LittleEndian.Uint16(rest))+2 != len(rest) {
+			return nil, errors.Errorf("invalid key %x in table %s", it.Item().Key(), bucket)
+		}
+		if inRange(rest[2:], prefix, after) {
+			keys = append(keys, cloneBytes(rest[2:]))
+		}
+	}
+	if !exists {
+		return nil, errors.Wrapf(database.ErrNotFound, "table %s does not exist", bucket)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return bytes.Compare(keys[i], keys[j]) < 0
+	})
+	if limit > 0 && len(keys) > limit {
+		keys = keys[:limit]
+	}
+	entries := make([]*database.Entry, len(keys))
+	for i, k := range keys {
+		v, err := badgerGet(txn, bucket, k)
+		if err != nil {
+			return nil, err
+		}
+		entries[i] = &database.Entry{Bucket: bucket, Key: k, Value: v}
+	}
+	return entries, nil
+}
+
+func badgerCmpAndSwap(txn *badger.Txn, bucket, key, oldValue, newValue []byte) ([]byte, bool, error) {
+	current, err := badgerGet(txn, bucket, key)
+	if err != nil && !database.IsErrNotFound(err) {
+		return nil, false, err
+	}
+	if !bytes.Equal(current, oldValue) {
+		return current, false, nil
+	}
+	bk, err := badgerKey(bucket, key)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := txn.Set(bk, newValue); err != nil {
+		return nil, false, errors.Wrapf(err, "failed to set %s/%s", bucket, key)
+	}
+	return newValue, true, nil
+}
+
+// update runs fn in a read-write transaction, replacing the conflicts with
+// concurrent transactions by ErrConflict.
+func (db *Badger) update(fn func(*badger.Txn) error) error {
+	err := db.db.Update(fn)
+	if errors.Cause(err) == badger.ErrConflict {
+		return errors.Wrap(ErrConflict, err.Error())
+	}
+	return err
+}
+
+// Get returns the value stored in the given table and key.
+func (db *Badger) Get(bucket, key []byte) (v []byte, err error) {
+	err = db.db.View(func(txn *badger.Txn) error {
+		v, err = badgerGet(txn, bucket, key)
+		return err
+	})
+	return
+}
+
+// Set stores the value in the given table and key.
+func (db *Badger) Set(bucket, key, value []byte) error {
+	bk, err := badgerKey(bucket, key)
+	if err != nil {
+		return err
+	}
+	return db.update(func(txn *badger.Txn) error {
+		return errors.Wrapf(txn.Set(bk, value), "failed to set %s/%s", bucket, key)
+	})
+}
+
+// Del deletes the value in the given table and key.
+func (db *Badger) Del(bucket, key []byte) error {
+	bk, err := badgerKey(bucket, key)
+	if err != nil {
+		return err
+	}
+	return db.update(func(txn *badger.Txn) error {
+		return errors.Wrapf(txn.Delete(bk), "failed to delete %s/%s", bucket, key)
+	})
+}
+
+// List returns all the entries of a table.
+func (db *Badger) List(bucket []byte) (entries []*database.Entry, err error) {
+	err = db.db.View(func(txn *badger.Txn) error {
+		entries, err = badgerList(txn, bucket)
+		return err
+	})
+	return
+}
+
+// ListRange implements the Ranger interface.
+func (db *Badger) ListRange(bucket, prefix, after []byte, limit int) (entries []*database.Entry, err error) {
+	err = db.db.View(func(txn *badger.Txn) error {
+		entries, err = badgerListRange(txn, bucket, prefix, after, limit)
+		return err
+	})
+	return
+}
+
+// CmpAndSwap sets the new value if the current value is the old one. A nil
+// old value means that the key must not exist.
+func (db *Badger) CmpAndSwap(bucket, key, oldValue, newValue []byte) (val []byte, swapped bool, err error) {
+	err = db.update(func(txn *badger.Txn) error {
+		val, swapped, err = badgerCmpAndSwap(txn, bucket, key, oldValue, newValue)
+		if err == nil && !swapped {
+			// Nothing to commit.
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return val, swapped, nil
+}
+
+// Update runs the operations in a transaction. The transaction is rolled
+// back if a CmpAndSwap operation does not swap.
+func (db *Badger) Update(tx *database.Tx) error {
+	return db.update(func(txn *badger.Txn) error {
+		for _, q := range tx.Operations {
+			var err error
+			switch q.Cmd {
+			case database.CreateTable:
+				err = badgerCreateTable(txn, q.Bucket)
+			case database.DeleteTable:
+				err = badgerDeleteTable(txn, q.Bucket)
+			case database.Get:
+				q.Result, err = badgerGet(txn, q.Bucket, q.Key)
+			case database.Set:
+				var bk []byte
+				if bk, err = badgerKey(q.Bucket, q.Key); err == nil {
+					err = errors.Wrapf(txn.Set(bk, q.Value), "failed to set %s/%s", q.Bucket, q.Key)
+				}
+			case database.Delete:
+				var bk []byte
+				if bk, err = badgerKey(q.Bucket, q.Key); err == nil {
+					err = errors.Wrapf(txn.Delete(bk), "failed to delete %s/%s", q.Bucket, q.Key)
+				}
+			case database.CmpAndSwap:
+				q.Result, q.Swapped, err = badgerCmpAndSwap(txn, q.Bucket, q.Key, q.CmpValue, q.Value)
+				if err == nil && !q.Swapped {
+					err = swapFailed(q.Bucket, q.Key)
+				}
+			default:
+				err = database.ErrOpNotSupported
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func badgerCreateTable(txn *badger.Txn, bucket []byte) error {
+	prefix, err := encodeSection(bucket)
+	if err != nil {
+		return errors.Wrapf(err, "invalid table %s", bucket)
+	}
+	return errors.Wrapf(txn.Set(prefix, []byte{}), "failed to create table %s", bucket)
+}
+
+func badgerDeleteTable(txn *badger.Txn, bucket []byte) error {
+	prefix, err := encodeSection(bucket)
+	if err != nil {
+		return errors.Wrapf(err, "invalid table %s", bucket)
+	}
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	var keys [][]byte
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		keys = append(keys, it.Item().KeyCopy(nil))
+	}
+	it.Close()
+	if len(keys) == 0 {
+		return errors.Wrapf(database.ErrNotFound, "table %s does not exist", bucket)
+	}
+	for _, k := range keys {
+		if err := txn.Delete(k); err != nil {
+			return errors.Wrapf(err, "failed to delete table %s", bucket)
+		}
+	}
+	return nil
+}
+
+// CreateTable creates a table if it does not exist.
+func (db *Badger) CreateTable(bucket []byte) error {
+	return db.update(func(txn *badger.Txn) error {
+		return badgerCreateTable(txn, bucket)
+	})
+}
+
+// DeleteTable deletes a table and its entries.
+func (db *Badger) DeleteTable(bucket []byte) error {
+	return db.update(func(txn *badger.Txn) error {
+		return badgerDeleteTable(txn, bucket)
+	})
+}
+
+// badgerReader reads a Badger read-only transaction.
+type badgerReader struct {
+	txn *badger.Txn
+}
+
+func (r badgerReader) Get(bucket, key []byte) ([]byte, error) {
+	return badgerGet(r.txn, bucket, key)
+}
+
+func (r badgerReader) List(bucket []byte) ([]*database.Entry, error) {
+	return badgerList(r.txn, bucket)
+}
+
+// View implements the Viewer interface.
+func (db *Badger) View(fn func(Reader) error) error {
+	return db.db.View(func(txn *badger.Txn) error {
+		return fn(badgerReader{txn})
+	})
+}
@@ -0,0 +1,291 @@
+package kvdb
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/nosql/database"
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltSep separates the names of the nested buckets of a table name.
+var boltSep = []byte("/")
+
+// Bolt is a database stored in BoltDB. Tables are buckets; a table name
+// with slashes is a nested bucket.
+type Bolt struct {
+	db *bolt.DB
+}
+
+// Open opens or creates the database in the given file.
+func (db *Bolt) Open(path string, opt ...database.Option) error {
+	var err error
+	if db.db, err = bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second}); err != nil {
+		return errors.Wrap(err, "error opening BoltDB database")
+	}
+	return nil
+}
+
+// Close closes the database.
+func (db *Bolt) Close() error {
+	return errors.Wrap(db.db.Close(), "error closing BoltDB database")
+}
+
+func boltBucket(tx *bolt.Tx, name []byte) (*bolt.Bucket, error) {
+	var b *bolt.Bucket
+	for i, n := range bytes.Split(name, boltSep) {
+		if i == 0 {
+			b = tx.Bucket(n)
+		} else {
+			b = b.Bucket(n)
+		}
+		if b == nil {
+			return nil, errors.Wrapf(database.ErrNotFound, "table %s does not exist", name)
+		}
+	}
+	return b, nil
+}
+
+func boltGet(tx *bolt.Tx, bucket, key []byte) ([]byte, error) {
+	b, err := boltBucket(tx, bucket)
+	if err != nil {
+		return nil, err
+	}
+	v := b.Get(key)
+	if v == nil {
+		return nil, errors.Wrapf(database.ErrNotFound, "%s/%s not found", bucket, key)
+	}
+	return cloneBytes(v), nil
+}
+
+func boltList(tx *bolt.Tx, bucket []byte) ([]*database.Entry, error) {
+	b, err := boltBucket(tx, bucket)
+	if err != nil {
+		return nil, err
+	}
+	var entries []*database.Entry
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		if v == nil {
+			// Nested bucket.
+			continue
+		}
+		entries = append(entries, &database.Entry{
+			Bucket: bucket,
+			Key:    cloneBytes(k),
+			Value:  cloneBytes(v),
+		})
+	}
+	return entries, nil
+}
+
+func boltListRange(tx *bolt.Tx, bucket, prefix, after []byte, limit int) ([]*database.Entry, error) {
+	b, err := boltBucket(tx, bucket)
+	if err != nil {
+		return nil, err
+	}
+	start := prefix
+	if bytes.Compare(after, start) > 0 {
+		start = after
+	}
+	var entries []*database.Entry
+	c := b.Cursor()
+	for k, v := c.Seek(start); k != nil && (limit <= 0 || len(entries) < limit); k, v = c.Next() {
+		if !bytes.HasPrefix(k, prefix) {
+			break
+		}
+		if v == nil || !inRange(k, prefix, after) {
+			// Nested bucket or the after key.
+			continue
+		}
+		entries = append(entries, &database.Entry{
+			Bucket: bucket,
+			Key:    cloneBytes(k),
+			Value:  cloneBytes(v),
+		})
+	}
+	return entries, nil
+}
+
+func boltCmpAndSwap(tx *bolt.Tx, bucket, key, oldValue, newValue []byte) ([]byte, bool, error) {
+	b, err := boltBucket(tx, bucket)
+	if err != nil {
+		return nil, false, err
+	}
+	if current := b.Get(key); !bytes.Equal(current, oldValue) {
+		return cloneBytes(current), false, nil
+	}
+	if err := b.Put(key, newValue); err != nil {
+		return nil, false, errors.Wrapf(err, "failed to set %s/%s", bucket, key)
+	}
+	return newValue, true, nil
+}
+
+func boltCreateTable(tx *bolt.Tx, bucket []byte) error {
+	var b *bolt.Bucket
+	var err error
+	for i, n := range bytes.Split(bucket, boltSep) {
+		if i == 0 {
+			b, err = tx.CreateBucketIfNotExists(n)
+		} else {
+			b, err = b.CreateBucketIfNotExists(n)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed to create table %s", bucket)
+		}
+	}
+	return nil
+}
+
+func boltDeleteTable(tx *bolt.Tx, bucket []byte) error {
+	var err error
+	if i := bytes.LastIndex(bucket, boltSep); i < 0 {
+		err = tx.DeleteBucket(bucket)
+	} else {
+		var parent *bolt.Bucket
+		if parent, err = boltBucket(tx, bucket[:i]); err != nil {
+			return err
+		}
+		err = parent.DeleteBucket(bucket[i+1:])
+	}
+	if err == bolt.ErrBucketNotFound {
+		return errors.Wrapf(database.ErrNotFound, "table %s does not exist", bucket)
+	}
+	return errors.Wrapf(err, "failed to delete table %s", bucket)
+}
+
+// Get returns the value stored in the given table and key.
+func (db *Bolt) Get(bucket, key []byte) (v []byte, err error) {
+	err = db.db.View(func(tx *bolt.Tx) error {
+		v, err = boltGet(tx, bucket, key)
+		return err
+	})
+	return
+}
+
+// Set stores the value in the given table and key.
+func (db *Bolt) Set(bucket, key, value []byte) error {
+	return db.db.Update(func(tx *bolt.Tx) error {
+		b, err := boltBucket(tx, bucket)
+		if err != nil {
+			return err
+		}
+		return errors.Wrapf(b.Put(key, value), "failed to set %s/%s", bucket, key)
+	})
+}
+
+// Del deletes the value in the given table and key.
+func (db *Bolt) Del(bucket, key []byte) error {
+	return db.db.Update(func(tx *bolt.Tx) error {
+		b, err := boltBucket(tx, bucket)
+		if err != nil {
+			return err
+		}
+		return errors.Wrapf(b.Delete(key), "failed to delete %s/%s", bucket, key)
+	})
+}
+
+// List returns all the entries of a table.
+func (db *Bolt) List(bucket []byte) (entries []*database.Entry, err error) {
+	err = db.db.View(func(tx *bolt.Tx) error {
+		entries, err = boltList(tx, bucket)
+		return err
+	})
+	return
+}
+
+// ListRange implements the Ranger interface.
+func (db *Bolt) ListRange(bucket, prefix, after []byte, limit int) (entries []*database.Entry, err error) {
+	err = db.db.View(func(tx *bolt.Tx) error {
+		entries, err = boltListRange(tx, bucket, prefix, after, limit)
+		return err
+	})
+	return
+}
+
+// CmpAndSwap sets the new value if the current value is the old one. A nil
+// old value means that the key must not exist.
+func (db *Bolt) CmpAndSwap(bucket, key, oldValue, newValue []byte) (val []byte, swapped bool, err error) {
+	err = db.db.Update(func(tx *bolt.Tx) error {
+		val, swapped, err = boltCmpAndSwap(tx, bucket, key, oldValue, newValue)
+		return err
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return val, swapped, nil
+}
+
+// Update runs the operations in a transaction. The transaction is rolled
+// back if a CmpAndSwap operation does not swap.
+func (db *Bolt) Update(tx *database.Tx) error {
+	return db.db.Update(func(btx *bolt.Tx) error {
+		for _, q := range tx.Operations {
+			var err error
+			switch q.Cmd {
+			case database.CreateTable:
+				err = boltCreateTable(btx, q.Bucket)
+			case database.DeleteTable:
+				err = boltDeleteTable(btx, q.Bucket)
+			case database.Get:
+				q.Result, err = boltGet(btx, q.Bucket, q.Key)
+			case database.Set, database.Delete:
+				var b *bolt.Bucket
+				if b, err = boltBucket(btx, q.Bucket); err != nil {
+					break
+				}
+				if q.Cmd == database.Set {
+					err = errors.Wrapf(b.Put(q.Key, q.Value), "failed to set %s/%s", q.Bucket, q.Key)
+				} else {
+					err = errors.Wrapf(b.Delete(q.Key), "failed to delete %s/%s", q.Bucket, q.Key)
+				}
+			case database.CmpAndSwap:
+				q.Result, q.Swapped, err = boltCmpAndSwap(btx, q.Bucket, q.Key, q.CmpValue, q.Value)
+				if err == nil && !q.Swapped {
+					err = swapFailed(q.Bucket, q.Key)
+				}
+			default:
+				err = database.ErrOpNotSupported
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// CreateTable creates a table if it does not exist.
+func (db *Bolt) CreateTable(bucket []byte) error {
+	return db.db.Update(func(tx *bolt.Tx) error {
+		return boltCreateTable(tx, bucket)
+	})
+}
+
+// DeleteTable deletes a table and its entries.
+func (db *Bolt) DeleteTable(bucket []byte) error {
+	return db.db.Update(func(tx *bolt.Tx) error {
+		return boltDeleteTable(tx, bucket)
+	})
+}
+
+// boltReader reads a Bolt read-only transaction.
+type boltReader struct {
+	tx *bolt.Tx
+}
+
+func (r boltReader) Get(bucket, key []byte) ([]byte, error) {
+	return boltGet(r.tx, bucket, key)
+}
+
+func (r boltReader) List(bucket []byte) ([]*database.Entry, error) {
+	return boltList(r.tx, bucket)
+}
+
+// View implements the Viewer interface.
+func (db *Bolt) View(fn func(Reader) error) error {
+	return db.db.View(func(tx *bolt.Tx) error {
+		return fn(boltReader{tx})
+	})
+}
@@ -0,0 +1,67 @@
+// Package kvdb implements the embedded databases of the CA, Badger and
+// BoltDB, and defines what all the database backends share.
+//
+// The databases have the same layout as the ones of the nosql drivers, so
+// they are opened as is. Unlike those drivers, a transaction is rolled back
+// if one of its compare-and-swap operations does not swap.
+package kvdb
+
+import (
+	"github.com/pkg/errors"
+	"github.com/smallstep/nosql"
+	"github.com/smallstep/nosql/database"
+)
+
+// Supported embedded databases.
+const (
+	BadgerDriver = "badger"
+	BoltDriver   = "bbolt"
+)
+
+// ErrConflict is the cause of the errors of the operations that lost a race
+// against a concurrent one: a transaction aborted by the database to resolve
+// a conflict, or one with a compare-and-swap that found a changed value.
+// Such operations have not been applied and can be retried.
+var ErrConflict = errors.New("transaction conflict")
+
+// IsConflict returns true if the cause of the error is ErrConflict.
+func IsConflict(err error) bool {
+	return err != nil && errors.Cause(err) == ErrConflict
+}
+
+// Supports returns true if the database type is an embedded database of
+// this package.
+func Supports(typ string) bool {
+	return typ == BadgerDriver || typ == BoltDriver
+}
+
+// New opens the embedded database of the given type. The data source name
+// is its path.
+func New(typ, dataSourceName string, opt ...database.Option) (nosql.DB, error) {
+	var db nosql.DB
+	switch typ {
+	case BadgerDriver:
+		db = new(Badger)
+	case BoltDriver:
+		db = new(Bolt)
+	default:
+		return nil, errors.Errorf("unsupported database type %s", typ)
+	}
+	if err := db.Open(dataSourceName, opt...); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// swapFailed returns the error rolling back a transaction because of a
+// compare-and-swap that did not swap.
+func swapFailed(bucket, key []byte) error {
+	return errors.Wrapf(ErrConflict, "failed to CmpAndSwap %s/%s; value has changed", bucket, key)
+}
+
+// cloneBytes returns a copy of a slice only valid during a transaction.
+func cloneBytes(v []byte) []byte {
+	c := make([]byte, len(v))
+	copy(c, v)
+	return c
+}
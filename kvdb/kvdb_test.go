@@ -0,0 +1,146 @@
+package kvdb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/nosql"
+	nosqlBadger "github.com/smallstep/nosql/badger"
+	nosqlBolt "github.com/smallstep/nosql/bolt"
+	"github.com/smallstep/nosql/database"
+)
+
+// cmpAndSwap returns a transaction that sets key and swaps index from
+// oldValue to newValue. An empty old value means that index must not exist.
+func cmpAndSwap(bucket []byte, key, oldValue, newValue string) *database.Tx {
+	var cmp []byte
+	if oldValue != "" {
+		cmp = []byte(oldValue)
+	}
+	tx := new(database.Tx)
+	tx.Set(bucket, []byte(key), []byte("v"+key))
+	tx.Operations = append(tx.Operations, &database.TxEntry{
+		Bucket:   bucket,
+		Key:      []byte("index"),
+		CmpValue: cmp,
+		Value:    []byte(newValue),
+		Cmd:      database.CmpAndSwap,
+	})
+	return tx
+}
+
+func TestUpdateRollback(t *testing.T) {
+	dbs, cleanup := openTestDBs(t)
+	defer cleanup()
+
+	bucket := []byte("update")
+	for _, typ := range []string{BadgerDriver, BoltDriver} {
+		db := dbs[typ]
+		t.Run(typ, func(t *testing.T) {
+			if err := db.CreateTable(bucket); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Set(bucket, []byte("index"), []byte("a")); err != nil {
+				t.Fatal(err)
+			}
+
+			// A compare-and-swap that does not swap rolls back the
+			// whole transaction.
+			if err := db.Update(cmpAndSwap(bucket, "stale", "b", "b,stale")); !IsConflict(err) {
+				t.Fatalf("Update() error = %v, want a conflict", err)
+			}
+			if _, err := db.Get(bucket, []byte("stale")); !database.IsErrNotFound(errors.Cause(err)) {
+				t.Errorf("Get() of a rolled back entry error = %v, want not found", err)
+			}
+
+			// An existing index does not swap as a new one.
+			if err := db.Update(cmpAndSwap(bucket, "new", "", "new")); !IsConflict(err) {
+				t.Fatalf("Update() of an existing key error = %v, want a conflict", err)
+			}
+			if _, err := db.Get(bucket, []byte("new")); !database.IsErrNotFound(errors.Cause(err)) {
+				t.Errorf("Get() of a rolled back entry error = %v, want not found", err)
+			}
+
+			if err := db.Update(cmpAndSwap(bucket, "fresh", "a", "a,fresh")); err != nil {
+				t.Fatal(err)
+			}
+			for k, want := range map[string]string{"fresh": "vfresh", "index": "a,fresh"} {
+				v, err := db.Get(bucket, []byte(k))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(v) != want {
+					t.Errorf("Get(%s) = %s, want %s", k, v, want)
+				}
+			}
+		})
+	}
+}
+
+func TestNosqlLayout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	bucket := []byte("legacy")
+	entries := map[string]string{"a": "1", "b/1": "2", "c": "3"}
+	tests := []struct {
+		typ    string
+		path   string
+		legacy nosql.DB
+	}{
+		{BadgerDriver, filepath.Join(dir, "badger"), new(nosqlBadger.DB)},
+		{BoltDriver, filepath.Join(dir, "bolt.db"), new(nosqlBolt.DB)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.typ, func(t *testing.T) {
+			// Write the database with the nosql driver.
+			if err := tt.legacy.Open(tt.path, database.WithValueDir(tt.path)); err != nil {
+				t.Fatal(err)
+			}
+			if err := tt.legacy.CreateTable(bucket); err != nil {
+				t.Fatal(err)
+			}
+			for k, v := range entries {
+				if err := tt.legacy.Set(bucket, []byte(k), []byte(v)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := tt.legacy.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			db, err := New(tt.typ, tt.path, database.WithValueDir(tt.path))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			for k, want := range entries {
+				v, err := db.Get(bucket, []byte(k))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(v) != want {
+					t.Errorf("Get(%s) = %s, want %s", k, v, want)
+				}
+			}
+			list, err := db.List(bucket)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(list) != len(entries) {
+				t.Errorf("List() returned %d entries, want %d", len(list), len(entries))
+			}
+			for _, e := range list {
+				if string(e.Bucket) != string(bucket) || entries[string(e.Key)] != string(e.Value) {
+					t.Errorf("List() entry %s/%s = %s", e.Bucket, e.Key, e.Value)
+				}
+			}
+		})
+	}
+}
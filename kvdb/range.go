@@ -0,0 +1,63 @@
+package kvdb
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/smallstep/nosql"
+	"github.com/smallstep/nosql/database"
+)
+
+// Ranger is implemented by the databases that read a range of a table
+// without loading all of it.
+type Ranger interface {
+	// ListRange returns, in key order, up to limit entries of the table
+	// with a key starting with prefix and greater than after. An empty
+	// prefix matches all keys, an empty after starts at the first one and a
+	// limit of zero or less returns the whole range.
+	ListRange(bucket, prefix, after []byte, limit int) ([]*database.Entry, error)
+}
+
+// ListRange returns the range of the table of the given database, see
+// Ranger. The whole table is listed if the database is not a Ranger.
+func ListRange(db nosql.DB, bucket, prefix, after []byte, limit int) ([]*database.Entry, error) {
+	if r, ok := db.(Ranger); ok {
+		return r.ListRange(bucket, prefix, after, limit)
+	}
+	entries, err := db.List(bucket)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i].Key, entries[j].Key) < 0
+	})
+	var ret []*database.Entry
+	for _, e := range entries {
+		if limit > 0 && len(ret) == limit {
+			break
+		}
+		if inRange(e.Key, prefix, after) {
+			ret = append(ret, e)
+		}
+	}
+	return ret, nil
+}
+
+// inRange returns true if the key starts with prefix and is greater than
+// after.
+func inRange(key, prefix, after []byte) bool {
+	return bytes.HasPrefix(key, prefix) && bytes.Compare(key, after) > 0
+}
+
+// PrefixEnd returns the first key greater than all the keys starting with
+// the prefix, or nil if there is none.
+func PrefixEnd(prefix []byte) []byte {
+	end := cloneBytes(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
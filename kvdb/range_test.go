@@ -0,0 +1,122 @@
+package kvdb
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/smallstep/nosql"
+	"github.com/smallstep/nosql/database"
+)
+
+// listOnly hides the Ranger implementation of a database.
+type listOnly struct {
+	nosql.DB
+}
+
+// openTestDBs returns a database of every embedded type, in a temporary
+// directory removed by the returned function.
+func openTestDBs(t *testing.T) (map[string]nosql.DB, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "kvdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dbs := make(map[string]nosql.DB)
+	for typ, path := range map[string]string{
+		BadgerDriver: filepath.Join(dir, "badger"),
+		BoltDriver:   filepath.Join(dir, "bolt.db"),
+	} {
+		db, err := New(typ, path, database.WithValueDir(path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		dbs[typ] = db
+	}
+	dbs["fallback"] = listOnly{dbs[BoltDriver]}
+	return dbs, func() {
+		dbs[BadgerDriver].Close()
+		dbs[BoltDriver].Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestListRange(t *testing.T) {
+	dbs, cleanup := openTestDBs(t)
+	defer cleanup()
+
+	bucket := []byte("range")
+	keys := []string{"a", "b/1", "b/2", "b/10", "bb", "c", "c/1"}
+	for typ, db := range dbs {
+		if typ == "fallback" {
+			continue
+		}
+		if err := db.CreateTable(bucket); err != nil {
+			t.Fatal(err)
+		}
+		for _, k := range keys {
+			if err := db.Set(bucket, []byte(k), []byte("v"+k)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	tests := []struct {
+		name   string
+		prefix string
+		after  string
+		limit  int
+		want   []string
+	}{
+		{"all", "", "", 0, []string{"a", "b/1", "b/10", "b/2", "bb", "c", "c/1"}},
+		{"limit", "", "", 3, []string{"a", "b/1", "b/10"}},
+		{"after", "", "b/10", 2, []string{"b/2", "bb"}},
+		{"prefix", "b/", "", 0, []string{"b/1", "b/10", "b/2"}},
+		{"prefix after", "b/", "b/1", 1, []string{"b/10"}},
+		{"after before prefix", "c", "a", 0, []string{"c", "c/1"}},
+		{"no match", "d", "", 0, nil},
+	}
+	for typ, db := range dbs {
+		for _, tt := range tests {
+			t.Run(typ+"/"+tt.name, func(t *testing.T) {
+				entries, err := ListRange(db, bucket, []byte(tt.prefix), []byte(tt.after), tt.limit)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var got []string
+				for _, e := range entries {
+					if string(e.Value) != "v"+string(e.Key) {
+						t.Errorf("value of %s = %s", e.Key, e.Value)
+					}
+					got = append(got, string(e.Key))
+				}
+				if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+					t.Errorf("ListRange() = %v, want %v", got, tt.want)
+				}
+			})
+		}
+	}
+
+	for typ, db := range dbs {
+		if _, err := ListRange(db, []byte("missing"), nil, nil, 0); !database.IsErrNotFound(err) {
+			t.Errorf("%s: ListRange() of a missing table error = %v, want not found", typ, err)
+		}
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	tests := []struct {
+		prefix, want []byte
+	}{
+		{[]byte("ab"), []byte("ac")},
+		{[]byte{'a', 0xff}, []byte("b")},
+		{[]byte{0xff, 0xff}, nil},
+	}
+	for _, tt := range tests {
+		if got := PrefixEnd(tt.prefix); string(got) != string(tt.want) {
+			t.Errorf("PrefixEnd(%x) = %x, want %x", tt.prefix, got, tt.want)
+		}
+	}
+}
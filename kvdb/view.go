@@ -0,0 +1,16 @@
+package kvdb
+
+import "github.com/smallstep/nosql/database"
+
+// Reader reads the tables of a database.
+type Reader interface {
+	Get(bucket, key []byte) ([]byte, error)
+	List(bucket []byte) ([]*database.Entry, error)
+}
+
+// Viewer is implemented by the databases reading several tables in a single
+// read-only transaction, that sees the state of the database at the time it
+// started.
+type Viewer interface {
+	View(fn func(Reader) error) error
+}
@@ -0,0 +1,179 @@
+// Package lock implements lease based locks over the CA database, so only
+// one of the replicas sharing the database runs the singleton background
+// jobs.
+package lock
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/smallstep/cli/crypto/randutil"
+	"github.com/smallstep/nosql"
+	"github.com/smallstep/nosql/database"
+)
+
+var lockTable = []byte("distributed-locks")
+
+type lease struct {
+	Owner   string    `json:"owner"`
+	Expires time.Time `json:"expires"`
+}
+
+// Locker acquires the locks of one replica.
+type Locker struct {
+	db    nosql.DB
+	owner string
+}
+
+// New returns a locker with a unique owner identifier for the replica.
+func New(db nosql.DB) (*Locker, error) {
+	if err := db.CreateTable(lockTable); err != nil {
+		return nil, errors.Wrap(err, "error creating distributed-locks table")
+	}
+	id, err := randutil.Alphanumeric(16)
+	if err != nil {
+		return nil, errors.Wrap(err, "error generating lock owner")
+	}
+	if host, err := os.Hostname(); err == nil {
+		id = host + "-" + id
+	}
+	return &Locker{db: db, owner: id}, nil
+}
+
+// Owner returns the identifier of the replica holding the locks.
+func (l *Locker) Owner() string {
+	return l.owner
+}
+
+// TryLock acquires or extends the lease of the named lock for the given
+// duration. It returns false if another replica holds an unexpired lease.
+func (l *Locker) TryLock(name string, ttl time.Duration) (bool, error) {
+	old, err := l.db.Get(lockTable, []byte(name))
+	switch {
+	case database.IsErrNotFound(err):
+		old = nil
+	case err != nil:
+		return false, errors.Wrapf(err, "error loading lock %s", name)
+	default:
+		var cur lease
+		if err := json.Unmarshal(old, &cur); err != nil {
+			return false, errors.Wrapf(err, "error unmarshaling lock %s", name)
+		}
+		if cur.Owner != l.owner && time.Now().Before(cur.Expires) {
+			return false, nil
+		}
+	}
+
+	b, err := json.Marshal(lease{Owner: l.owner, Expires: time.Now().Add(ttl)})
+	if err != nil {
+		return false, errors.Wrapf(err, "error marshaling lock %s", name)
+	}
+	_, swapped, err := l.db.CmpAndSwap(lockTable, []byte(name), old, b)
+	if err != nil {
+		return false, errors.Wrapf(err, "error storing lock %s", name)
+	}
+	// Not swapped if another replica took the lock concurrently.
+	return swapped, nil
+}
+
+// Unlock releases the named lock if it is held by this replica.
+func (l *Locker) Unlock(name string) error {
+	old, err := l.db.Get(lockTable, []byte(name))
+	switch {
+	case database.IsErrNotFound(err):
+		return nil
+	case err != nil:
+		return errors.Wrapf(err, "error loading lock %s", name)
+	}
+	var cur lease
+	if err := json.Unmarshal(old, &cur); err != nil {
+		return errors.Wrapf(err, "error unmarshaling lock %s", name)
+	}
+	if cur.Owner != l.owner {
+		return nil
+	}
+	// An expired lease is released without a delete, that cannot be
+	// compared with the current value.
+	b, err := json.Marshal(lease{Owner: l.owner})
+	if err != nil {
+		return errors.Wrapf(err, "error marshaling lock %s", name)
+	}
+	if _, _, err := l.db.CmpAndSwap(lockTable, []byte(name), old, b); err != nil {
+		return errors.Wrapf(err, "error releasing lock %s", name)
+	}
+	return nil
+}
+
+// Job is a background job run by a single replica at a time.
+type Job struct {
+	locker   *Locker
+	name     string
+	interval time.Duration
+	fn       func() error
+	stop     chan struct{}
+	done     chan struct{}
+	once     sync.Once
+}
+
+// NewJob returns a job that runs fn every interval while holding the named
+// lock. The lease lasts two intervals, so the replica running the job keeps
+// it unless it stops or fails to renew it.
+func (l *Locker) NewJob(name string, interval time.Duration, fn func() error) *Job {
+	return &Job{
+		locker:   l,
+		name:     name,
+		interval: interval,
+		fn:       fn,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Start starts running the job in the background.
+func (j *Job) Start() {
+	go j.run()
+}
+
+func (j *Job) run() {
+	defer close(j.done)
+	t := time.NewTicker(j.interval)
+	defer t.Stop()
+	for {
+		j.tick()
+		select {
+		case <-t.C:
+		case <-j.stop:
+			if err := j.locker.Unlock(j.name); err != nil {
+				log.Printf("error releasing job %s: %v", j.name, err)
+			}
+			return
+		}
+	}
+}
+
+func (j *Job) tick() {
+	ok, err := j.locker.TryLock(j.name, 2*j.interval)
+	if err != nil {
+		log.Printf("error locking job %s: %v", j.name, err)
+		return
+	}
+	if !ok {
+		return
+	}
+	if err := j.fn(); err != nil {
+		log.Printf("error running job %s: %v", j.name, err)
+	}
+}
+
+// Stop stops the job and releases its lock. It waits for a running
+// iteration to finish.
+func (j *Job) Stop() {
+	j.once.Do(func() {
+		close(j.stop)
+	})
+	<-j.done
+}
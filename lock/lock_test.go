@@ -0,0 +1,135 @@
+package lock
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-ocf/step-ca/sqldb"
+	"github.com/go-ocf/step-ca/sqldb/sqldbtest"
+)
+
+// newTestLockers returns n lockers, as the ones of n replicas sharing an
+// in-memory stand-in of PostgreSQL.
+func newTestLockers(t *testing.T, n int) []*Locker {
+	t.Helper()
+	db, err := sqldb.NewFromDB(sqldb.PostgreSQL, sqldbtest.NewServer().DB())
+	if err != nil {
+		t.Fatal(err)
+	}
+	lockers := make([]*Locker, n)
+	for i := range lockers {
+		if lockers[i], err = New(db); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return lockers
+}
+
+func tryLock(t *testing.T, l *Locker, name string, ttl time.Duration) bool {
+	t.Helper()
+	ok, err := l.TryLock(name, ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ok
+}
+
+func TestTryLock(t *testing.T) {
+	l := newTestLockers(t, 2)
+	a, b := l[0], l[1]
+	const ttl = 50 * time.Millisecond
+
+	if !tryLock(t, a, "job", ttl) {
+		t.Fatal("TryLock() of a free lock = false")
+	}
+	if tryLock(t, b, "job", ttl) {
+		t.Error("TryLock() of a held lock = true")
+	}
+	if !tryLock(t, a, "job", ttl) {
+		t.Error("TryLock() by the owner = false, want the lease extended")
+	}
+	if !tryLock(t, b, "other", ttl) {
+		t.Error("TryLock() of another lock = false")
+	}
+
+	// The lease expires unless extended, and can be taken over.
+	time.Sleep(2 * ttl)
+	if !tryLock(t, b, "job", ttl) {
+		t.Fatal("TryLock() of an expired lease = false")
+	}
+	if tryLock(t, a, "job", ttl) {
+		t.Error("TryLock() by the previous owner = true")
+	}
+
+	// Unlock only releases the leases of the owner.
+	if err := a.Unlock("job"); err != nil {
+		t.Fatal(err)
+	}
+	if tryLock(t, a, "job", ttl) {
+		t.Error("TryLock() after an Unlock by another replica = true")
+	}
+	if err := b.Unlock("job"); err != nil {
+		t.Fatal(err)
+	}
+	if !tryLock(t, a, "job", ttl) {
+		t.Error("TryLock() of a released lock = false")
+	}
+}
+
+func TestTryLockConcurrent(t *testing.T) {
+	lockers := newTestLockers(t, 10)
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		owners int
+	)
+	for _, l := range lockers {
+		wg.Add(1)
+		go func(l *Locker) {
+			defer wg.Done()
+			ok, err := l.TryLock("job", time.Minute)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if ok {
+				mu.Lock()
+				owners++
+				mu.Unlock()
+			}
+		}(l)
+	}
+	wg.Wait()
+	if owners != 1 {
+		t.Errorf("%d replicas hold the lock, want 1", owners)
+	}
+}
+
+func TestJob(t *testing.T) {
+	l := newTestLockers(t, 2)
+	var (
+		mu   sync.Mutex
+		runs [2]int
+	)
+	jobs := make([]*Job, 2)
+	for i := range jobs {
+		i := i
+		jobs[i] = l[i].NewJob("job", 20*time.Millisecond, func() error {
+			mu.Lock()
+			runs[i]++
+			mu.Unlock()
+			return nil
+		})
+		jobs[i].Start()
+	}
+	time.Sleep(150 * time.Millisecond)
+	jobs[0].Stop()
+	jobs[1].Stop()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if (runs[0] == 0) == (runs[1] == 0) {
+		t.Errorf("jobs ran %v times, want a single replica running them", runs)
+	}
+}
@@ -0,0 +1,453 @@
+// Package sqldb implements the nosql database interface on top of MySQL and
+// PostgreSQL, with the row locking required by several CA replicas sharing
+// the same database.
+//
+// Tables have the same layout as the ones of the nosql mysql driver, a
+// binary key and value, so databases created by it can be shared as is.
+package sqldb
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/go-ocf/step-ca/kvdb"
+	// Register the database/sql drivers.
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	"github.com/pkg/errors"
+	"github.com/smallstep/nosql/database"
+)
+
+// Supported dialects.
+const (
+	MySQL      = "mysql"
+	PostgreSQL = "postgresql"
+)
+
+// Supports returns true if the database type is supported by this package.
+func Supports(typ string) bool {
+	return typ == MySQL || typ == PostgreSQL
+}
+
+// ErrConflict is the cause of the errors of the operations aborted by the
+// database to resolve a deadlock or serialization failure with a concurrent
+// transaction, or by a compare-and-swap that did not swap. Such operations
+// have not been applied and can be retried.
+var ErrConflict = kvdb.ErrConflict
+
+// dialect contains the statements that differ between the databases.
+type dialect struct {
+	driver      string
+	quote       func(table []byte) string
+	placeholder func(n int) string
+	createTable string
+	upsert      string
+	isDuplicate func(error) bool
+	isNoTable   func(error) bool
+	isConflict  func(error) bool
+}
+
+var dialects = map[string]*dialect{
+	MySQL: {
+		driver:      "mysql",
+		quote:       func(t []byte) string { return "`" + strings.Replace(string(t), "`", "``", -1) + "`" },
+		placeholder: func(int) string { return "?" },
+		createTable: "CREATE TABLE IF NOT EXISTS %s(nkey VARBINARY(255), nvalue BLOB, PRIMARY KEY (nkey))",
+		upsert:      "INSERT INTO %s(nkey, nvalue) VALUES(?, ?) ON DUPLICATE KEY UPDATE nvalue = VALUES(nvalue)",
+		isDuplicate: func(err error) bool { return strings.HasPrefix(err.Error(), "Error 1062:") },
+		isNoTable:   func(err error) bool { return strings.HasPrefix(err.Error(), "Error 1146:") },
+		isConflict:  func(err error) bool { return strings.HasPrefix(err.Error(), "Error 1213:") },
+	},
+	PostgreSQL: {
+		driver:      "postgres",
+		quote:       func(t []byte) string { return `"` + strings.Replace(string(t), `"`, `""`, -1) + `"` },
+		placeholder: func(n int) string { return fmt.Sprintf("$%d", n) },
+		createTable: "CREATE TABLE IF NOT EXISTS %s(nkey BYTEA, nvalue BYTEA, PRIMARY KEY (nkey))",
+		upsert:      "INSERT INTO %s(nkey, nvalue) VALUES($1, $2) ON CONFLICT (nkey) DO UPDATE SET nvalue = EXCLUDED.nvalue",
+		isDuplicate: func(err error) bool { return strings.Contains(err.Error(), "duplicate key value") },
+		isNoTable:   func(err error) bool { return strings.Contains(err.Error(), "does not exist") },
+		isConflict: func(err error) bool {
+			return strings.Contains(err.Error(), "deadlock detected") ||
+				strings.Contains(err.Error(), "could not serialize access")
+		},
+	},
+}
+
+// DB is a nosql database stored in MySQL or PostgreSQL.
+type DB struct {
+	db *sql.DB
+	d  *dialect
+}
+
+// New returns a new database of the given type; mysql or postgresql. The
+// data source name is the one of the database/sql driver.
+func New(typ, dataSourceName string) (*DB, error) {
+	d, ok := dialects[typ]
+	if !ok {
+		return nil, errors.Errorf("unsupported database type %s", typ)
+	}
+	db := &DB{d: d}
+	if err := db.Open(dataSourceName); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// NewFromDB returns a database of the given type using the connections of
+// an open database/sql database.
+func NewFromDB(typ string, sqlDB *sql.DB) (*DB, error) {
+	d, ok := dialects[typ]
+	if !ok {
+		return nil, errors.Errorf("unsupported database type %s", typ)
+	}
+	return &DB{db: sqlDB, d: d}, nil
+}
+
+// Open connects to the database.
+func (db *DB) Open(dataSourceName string, opt ...database.Option) error {
+	if db.d == nil {
+		return errors.New("database dialect is not set")
+	}
+	sqlDB, err := sql.Open(db.d.driver, dataSourceName)
+	if err != nil {
+		return errors.Wrapf(err, "error opening %s database", db.d.driver)
+	}
+	if err := sqlDB.Ping(); err != nil {
+		sqlDB.Close()
+		return errors.Wrapf(err, "error connecting to %s database", db.d.driver)
+	}
+	db.db = sqlDB
+	return nil
+}
+
+// Close closes the connections to the database.
+func (db *DB) Close() error {
+	return errors.WithStack(db.db.Close())
+}
+
+func (db *DB) getQry(bucket []byte, forUpdate bool) string {
+	q := fmt.Sprintf("SELECT nvalue FROM %s WHERE nkey = %s", db.d.quote(bucket), db.d.placeholder(1))
+	if forUpdate {
+		q += " FOR UPDATE"
+	}
+	return q
+}
+
+func (db *DB) insertQry(bucket []byte) string {
+	return fmt.Sprintf("INSERT INTO %s(nkey, nvalue) VALUES(%s, %s)", db.d.quote(bucket),
+		db.d.placeholder(1), db.d.placeholder(2))
+}
+
+func (db *DB) updateQry(bucket []byte) string {
+	return fmt.Sprintf("UPDATE %s SET nvalue = %s WHERE nkey = %s", db.d.quote(bucket),
+		db.d.placeholder(1), db.d.placeholder(2))
+}
+
+func (db *DB) upsertQry(bucket []byte) string {
+	return fmt.Sprintf(db.d.upsert, db.d.quote(bucket))
+}
+
+func (db *DB) delQry(bucket []byte) string {
+	return fmt.Sprintf("DELETE FROM %s WHERE nkey = %s", db.d.quote(bucket), db.d.placeholder(1))
+}
+
+// querier is implemented by *sql.DB and *sql.Tx.
+type querier interface {
+	Query(string, ...interface{}) (*sql.Rows, error)
+	QueryRow(string, ...interface{}) *sql.Row
+	Exec(string, ...interface{}) (sql.Result, error)
+}
+
+func (db *DB) get(q querier, bucket, key []byte, forUpdate bool) ([]byte, error) {
+	var val []byte
+	err := q.QueryRow(db.getQry(bucket, forUpdate), key).Scan(&val)
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, errors.Wrapf(database.ErrNotFound, "%s/%s not found", bucket, key)
+	case err != nil && db.d.isNoTable(err):
+		return nil, errors.Wrap(database.ErrNotFound, err.Error())
+	case err != nil:
+		return nil, errors.Wrapf(err, "failed to get %s/%s", bucket, key)
+	default:
+		return val, nil
+	}
+}
+
+// Get returns the value stored in the given table and key.
+func (db *DB) Get(bucket, key []byte) ([]byte, error) {
+	return db.get(db.db, bucket, key, false)
+}
+
+// Set stores the value in the given table and key.
+func (db *DB) Set(bucket, key, value []byte) error {
+	if _, err := db.db.Exec(db.upsertQry(bucket), key, value); err != nil {
+		return errors.Wrapf(err, "failed to set %s/%s", bucket, key)
+	}
+	return nil
+}
+
+// Del deletes the value in the given table and key.
+func (db *DB) Del(bucket, key []byte) error {
+	if _, err := db.db.Exec(db.delQry(bucket), key); err != nil {
+		return errors.Wrapf(err, "failed to delete %s/%s", bucket, key)
+	}
+	return nil
+}
+
+// List returns all the entries of a table.
+func (db *DB) List(bucket []byte) ([]*database.Entry, error) {
+	return db.list(db.db, bucket)
+}
+
+func (db *DB) list(q querier, bucket []byte) ([]*database.Entry, error) {
+	rows, err := q.Query(fmt.Sprintf("SELECT nkey, nvalue FROM %s", db.d.quote(bucket)))
+	if err != nil {
+		if db.d.isNoTable(err) {
+			return nil, errors.Wrap(database.ErrNotFound, err.Error())
+		}
+		return nil, errors.Wrapf(err, "error querying table %s", bucket)
+	}
+	defer rows.Close()
+	var entries []*database.Entry
+	for rows.Next() {
+		var key, value []byte
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, errors.Wrap(err, "error getting key and value from row")
+		}
+		entries = append(entries, &database.Entry{
+			Bucket: bucket,
+			Key:    key,
+			Value:  value,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "error accessing row")
+	}
+	return entries, nil
+}
+
+// ListRange implements the kvdb.Ranger interface with a range query on the
+// primary key.
+func (db *DB) ListRange(bucket, prefix, after []byte, limit int) ([]*database.Entry, error) {
+	var (
+		conds []string
+		args  []interface{}
+	)
+	cond := func(op string, v []byte) {
+		args = append(args, v)
+		conds = append(conds, fmt.Sprintf("nkey %s %s", op, db.d.placeholder(len(args))))
+	}
+	if len(prefix) > 0 {
+		cond(">=", prefix)
+		if end := kvdb.PrefixEnd(prefix); end != nil {
+			cond("<", end)
+		}
+	}
+	if len(after) > 0 {
+		cond(">", after)
+	}
+	q := fmt.Sprintf("SELECT nkey, nvalue FROM %s", db.d.quote(bucket))
+	if len(conds) > 0 {
+		q += " WHERE " + strings.Join(conds, " AND ")
+	}
+	q += " ORDER BY nkey"
+	if limit > 0 {
+		q += fmt.Sprintf(" LIMIT %d", limit)
+	}
+	rows, err := db.db.Query(q, args...)
+	if err != nil {
+		if db.d.isNoTable(err) {
+			return nil, errors.Wrap(database.ErrNotFound, err.Error())
+		}
+		return nil, errors.Wrapf(err, "error querying table %s", bucket)
+	}
+	defer rows.Close()
+	var entries []*database.Entry
+	for rows.Next() {
+		var key, value []byte
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, errors.Wrap(err, "error getting key and value from row")
+		}
+		entries = append(entries, &database.Entry{
+			Bucket: bucket,
+			Key:    key,
+			Value:  value,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Wrap(err, "error accessing row")
+	}
+	return entries, nil
+}
+
+// reader reads a read-only transaction.
+type reader struct {
+	db *DB
+	tx *sql.Tx
+}
+
+func (r reader) Get(bucket, key []byte) ([]byte, error) {
+	return r.db.get(r.tx, bucket, key, false)
+}
+
+func (r reader) List(bucket []byte) ([]*database.Entry, error) {
+	return r.db.list(r.tx, bucket)
+}
+
+// View implements the kvdb.Viewer interface with a read-only repeatable
+// read transaction, that reads a snapshot of the database taken by its
+// first query.
+func (db *DB) View(fn func(kvdb.Reader) error) error {
+	tx, err := db.db.BeginTx(context.Background(), &sql.TxOptions{
+		Isolation: sql.LevelRepeatableRead,
+		ReadOnly:  true,
+	})
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer tx.Rollback()
+	return fn(reader{db: db, tx: tx})
+}
+
+// cmpAndSwap swaps the value if the current one, locked for the rest of the
+// transaction, is the old one. A nil old value means that the key must not
+// exist; concurrent inserts of the same key fail on the primary key.
+func (db *DB) cmpAndSwap(tx *sql.Tx, bucket, key, oldValue, newValue []byte) ([]byte, bool, error) {
+	current, err := db.get(tx, bucket, key, true)
+	switch {
+	case database.IsErrNotFound(errors.Cause(err)):
+		if oldValue != nil {
+			return nil, false, nil
+		}
+		if _, err := tx.Exec(db.insertQry(bucket), key, newValue); err != nil {
+			if db.d.isDuplicate(err) {
+				return nil, false, nil
+			}
+			return nil, false, errors.Wrapf(err, "failed to insert %s/%s", bucket, key)
+		}
+		return newValue, true, nil
+	case err != nil:
+		return nil, false, err
+	case oldValue == nil || !bytes.Equal(current, oldValue):
+		return current, false, nil
+	}
+	if _, err := tx.Exec(db.updateQry(bucket), newValue, key); err != nil {
+		return nil, false, errors.Wrapf(err, "failed to update %s/%s", bucket, key)
+	}
+	return newValue, true, nil
+}
+
+// conflict replaces the errors caused by a conflict with a concurrent
+// transaction by ErrConflict.
+func (db *DB) conflict(err error) error {
+	if err != nil && db.d.isConflict(errors.Cause(err)) {
+		return errors.Wrap(ErrConflict, err.Error())
+	}
+	return err
+}
+
+// CmpAndSwap sets the new value if the current value is the old one. A nil
+// old value means that the key must not exist.
+func (db *DB) CmpAndSwap(bucket, key, oldValue, newValue []byte) ([]byte, bool, error) {
+	val, swapped, err := db.cmpAndSwapTx(bucket, key, oldValue, newValue)
+	return val, swapped, db.conflict(err)
+}
+
+func (db *DB) cmpAndSwapTx(bucket, key, oldValue, newValue []byte) ([]byte, bool, error) {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return nil, false, errors.WithStack(err)
+	}
+	val, swapped, err := db.cmpAndSwap(tx, bucket, key, oldValue, newValue)
+	if err != nil || !swapped {
+		if rerr := tx.Rollback(); rerr != nil && err == nil {
+			err = errors.Wrapf(rerr, "failed to rollback CmpAndSwap on %s/%s", bucket, key)
+		}
+		return val, false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, false, errors.Wrapf(err, "failed to commit CmpAndSwap on %s/%s", bucket, key)
+	}
+	return val, true, nil
+}
+
+// Update runs the operations in a transaction. Rows read with Get are locked
+// until the transaction ends, so a Get followed by a Delete consumes a key
+// only once across replicas. The transaction is rolled back if a
+// CmpAndSwap operation does not swap.
+func (db *DB) Update(tx *database.Tx) error {
+	return db.conflict(db.update(tx))
+}
+
+func (db *DB) update(tx *database.Tx) error {
+	sqlTx, err := db.db.Begin()
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	rollback := func(err error) error {
+		if rerr := sqlTx.Rollback(); rerr != nil {
+			return errors.Wrap(err, "UPDATE failed, unable to rollback transaction")
+		}
+		return errors.Wrap(err, "UPDATE failed")
+	}
+	for _, q := range tx.Operations {
+		switch q.Cmd {
+		case database.CreateTable:
+			if _, err := sqlTx.Exec(fmt.Sprintf(db.d.createTable, db.d.quote(q.Bucket))); err != nil {
+				return rollback(errors.Wrapf(err, "failed to create table %s", q.Bucket))
+			}
+		case database.DeleteTable:
+			if _, err := sqlTx.Exec("DROP TABLE " + db.d.quote(q.Bucket)); err != nil {
+				return rollback(errors.Wrapf(err, "failed to delete table %s", q.Bucket))
+			}
+		case database.Get:
+			if q.Result, err = db.get(sqlTx, q.Bucket, q.Key, true); err != nil {
+				return rollback(err)
+			}
+		case database.Set:
+			if _, err := sqlTx.Exec(db.upsertQry(q.Bucket), q.Key, q.Value); err != nil {
+				return rollback(errors.Wrapf(err, "failed to set %s/%s", q.Bucket, q.Key))
+			}
+		case database.Delete:
+			if _, err := sqlTx.Exec(db.delQry(q.Bucket), q.Key); err != nil {
+				return rollback(errors.Wrapf(err, "failed to delete %s/%s", q.Bucket, q.Key))
+			}
+		case database.CmpAndSwap:
+			q.Result, q.Swapped, err = db.cmpAndSwap(sqlTx, q.Bucket, q.Key, q.CmpValue, q.Value)
+			if err != nil {
+				return rollback(errors.Wrapf(err, "failed to load-or-store %s/%s", q.Bucket, q.Key))
+			}
+			if !q.Swapped {
+				return rollback(errors.Wrapf(ErrConflict, "failed to load-or-store %s/%s; value has changed", q.Bucket, q.Key))
+			}
+		default:
+			return rollback(database.ErrOpNotSupported)
+		}
+	}
+	if err := sqlTx.Commit(); err != nil {
+		return errors.Wrap(err, "UPDATE failed")
+	}
+	return nil
+}
+
+// CreateTable creates a table if it does not exist.
+func (db *DB) CreateTable(bucket []byte) error {
+	if _, err := db.db.Exec(fmt.Sprintf(db.d.createTable, db.d.quote(bucket))); err != nil {
+		return errors.Wrapf(err, "failed to create table %s", bucket)
+	}
+	return nil
+}
+
+// DeleteTable deletes a table.
+func (db *DB) DeleteTable(bucket []byte) error {
+	if _, err := db.db.Exec("DROP TABLE " + db.d.quote(bucket)); err != nil {
+		if db.d.isNoTable(err) {
+			return errors.Wrapf(database.ErrNotFound, "table %s does not exist", bucket)
+		}
+		return errors.Wrapf(err, "failed to delete table %s", bucket)
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+package sqldb
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/go-ocf/step-ca/kvdb"
+	"github.com/go-ocf/step-ca/sqldb/sqldbtest"
+	"github.com/pkg/errors"
+	"github.com/smallstep/nosql/database"
+)
+
+var testTable = []byte("test")
+
+// newTestDB returns a database with the test table, on an in-memory
+// stand-in of PostgreSQL.
+func newTestDB(t *testing.T) (*DB, *sqldbtest.Server) {
+	t.Helper()
+	s := sqldbtest.NewServer()
+	db, err := NewFromDB(PostgreSQL, s.DB())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateTable(testTable); err != nil {
+		t.Fatal(err)
+	}
+	return db, s
+}
+
+func TestCmpAndSwap(t *testing.T) {
+	db, _ := newTestDB(t)
+	key := []byte("key")
+
+	tests := []struct {
+		name        string
+		old, new    string
+		wantSwapped bool
+		wantValue   string
+	}{
+		{"insert", "", "v1", true, "v1"},
+		{"insert existing", "", "v2", false, "v1"},
+		{"swap", "v1", "v2", true, "v2"},
+		{"stale value", "v1", "v3", false, "v2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var old []byte
+			if len(tt.old) > 0 {
+				old = []byte(tt.old)
+			}
+			_, swapped, err := db.CmpAndSwap(testTable, key, old, []byte(tt.new))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if swapped != tt.wantSwapped {
+				t.Errorf("CmpAndSwap() swapped = %v, want %v", swapped, tt.wantSwapped)
+			}
+			v, err := db.Get(testTable, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(v) != tt.wantValue {
+				t.Errorf("Get() = %s, want %s", v, tt.wantValue)
+			}
+		})
+	}
+}
+
+func TestCmpAndSwapConcurrent(t *testing.T) {
+	db, _ := newTestDB(t)
+	key := []byte("key")
+	if err := db.Set(testTable, key, []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 10
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		swapped int
+	)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, ok, err := db.CmpAndSwap(testTable, key, []byte("old"), []byte{byte(i)})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if ok {
+				mu.Lock()
+				swapped++
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	if swapped != 1 {
+		t.Errorf("%d concurrent CmpAndSwap swapped, want 1", swapped)
+	}
+}
+
+func TestConflict(t *testing.T) {
+	db, s := newTestDB(t)
+
+	s.FailNext(errors.New("pq: deadlock detected"))
+	if _, _, err := db.CmpAndSwap(testTable, []byte("key"), nil, []byte("v")); !kvdb.IsConflict(err) {
+		t.Errorf("CmpAndSwap() error = %v, want a conflict", err)
+	}
+
+	s.FailNext(errors.New("pq: could not serialize access due to concurrent update"))
+	tx := new(database.Tx)
+	tx.Set(testTable, []byte("key"), []byte("v"))
+	if err := db.Update(tx); !kvdb.IsConflict(err) {
+		t.Errorf("Update() error = %v, want a conflict", err)
+	}
+
+	s.FailNext(errors.New("pq: connection refused"))
+	if _, _, err := db.CmpAndSwap(testTable, []byte("key"), nil, []byte("v")); err == nil || kvdb.IsConflict(err) {
+		t.Errorf("CmpAndSwap() error = %v, want another error", err)
+	}
+}
+
+func TestUpdateRollback(t *testing.T) {
+	db, _ := newTestDB(t)
+	if err := db.Set(testTable, []byte("index"), []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	// A compare-and-swap that does not swap rolls back the whole
+	// transaction.
+	tx := new(database.Tx)
+	tx.Set(testTable, []byte("record"), []byte("r"))
+	tx.Operations = append(tx.Operations, &database.TxEntry{
+		Bucket:   testTable,
+		Key:      []byte("index"),
+		CmpValue: []byte("stale"),
+		Value:    []byte("a,r"),
+		Cmd:      database.CmpAndSwap,
+	})
+	if err := db.Update(tx); !kvdb.IsConflict(err) {
+		t.Fatalf("Update() error = %v, want a conflict", err)
+	}
+	if _, err := db.Get(testTable, []byte("record")); !database.IsErrNotFound(errors.Cause(err)) {
+		t.Errorf("Get() of a rolled back record error = %v, want not found", err)
+	}
+
+	tx = new(database.Tx)
+	tx.Set(testTable, []byte("record"), []byte("r"))
+	tx.Operations = append(tx.Operations, &database.TxEntry{
+		Bucket:   testTable,
+		Key:      []byte("index"),
+		CmpValue: []byte("a"),
+		Value:    []byte("a,r"),
+		Cmd:      database.CmpAndSwap,
+	})
+	if err := db.Update(tx); err != nil {
+		t.Fatal(err)
+	}
+	for k, want := range map[string]string{"record": "r", "index": "a,r"} {
+		v, err := db.Get(testTable, []byte(k))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(v) != want {
+			t.Errorf("Get(%s) = %s, want %s", k, v, want)
+		}
+	}
+}
+
+func TestListRange(t *testing.T) {
+	db, _ := newTestDB(t)
+	for _, k := range []string{"a", "b/1", "b/2", "bb", "c"} {
+		if err := db.Set(testTable, []byte(k), []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		prefix, after string
+		limit         int
+		want          []string
+	}{
+		{"", "", 0, []string{"a", "b/1", "b/2", "bb", "c"}},
+		{"b/", "", 0, []string{"b/1", "b/2"}},
+		{"b", "b/1", 2, []string{"b/2", "bb"}},
+		{"", "bb", 0, []string{"c"}},
+	}
+	for _, tt := range tests {
+		entries, err := db.ListRange(testTable, []byte(tt.prefix), []byte(tt.after), tt.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, e := range entries {
+			got = append(got, string(e.Key))
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("ListRange(%q, %q, %d) = %v, want %v", tt.prefix, tt.after, tt.limit, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("ListRange(%q, %q, %d) = %v, want %v", tt.prefix, tt.after, tt.limit, got, tt.want)
+				break
+			}
+		}
+	}
+}
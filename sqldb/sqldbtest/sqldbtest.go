@@ -0,0 +1,384 @@
+// Package sqldbtest implements an in-memory stand-in for the PostgreSQL
+// server of package sqldb, to test the packages using it without a
+// database server.
+//
+// It only understands the statements of the postgresql dialect of package
+// sqldb. Transactions are serialized, as if every row were locked, and are
+// applied on commit.
+package sqldbtest
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const name = `"((?:[^"]|"")+)"`
+
+var (
+	createRe = regexp.MustCompile(`^CREATE TABLE IF NOT EXISTS ` + name + `\(`)
+	dropRe   = regexp.MustCompile(`^DROP TABLE ` + name + `$`)
+	getRe    = regexp.MustCompile(`^SELECT nvalue FROM ` + name + ` WHERE nkey = \$1( FOR UPDATE)?$`)
+	insertRe = regexp.MustCompile(`^INSERT INTO ` + name + `\(nkey, nvalue\) VALUES\(\$1, \$2\)( ON CONFLICT .*)?$`)
+	updateRe = regexp.MustCompile(`^UPDATE ` + name + ` SET nvalue = \$1 WHERE nkey = \$2$`)
+	deleteRe = regexp.MustCompile(`^DELETE FROM ` + name + ` WHERE nkey = \$1$`)
+	listRe   = regexp.MustCompile(`^SELECT nkey, nvalue FROM ` + name + `(?: WHERE (.+?))?(?: ORDER BY nkey)?(?: LIMIT (\d+))?$`)
+	condRe   = regexp.MustCompile(`^nkey (>=|<|>) \$(\d+)$`)
+)
+
+type tables map[string]map[string][]byte
+
+func (t tables) clone() tables {
+	c := make(tables, len(t))
+	for name, rows := range t {
+		c[name] = make(map[string][]byte, len(rows))
+		for k, v := range rows {
+			c[name][k] = v
+		}
+	}
+	return c
+}
+
+// Server is an in-memory database.
+type Server struct {
+	// tx is held by the transactions and the statements run outside of
+	// them.
+	tx     sync.Mutex
+	mu     sync.Mutex
+	tables tables
+	fail   error
+}
+
+// NewServer returns an empty database.
+func NewServer() *Server {
+	return &Server{tables: make(tables)}
+}
+
+// DB returns a connection pool to the database.
+func (s *Server) DB() *sql.DB {
+	return sql.OpenDB(connector{s})
+}
+
+// FailNext makes the next statement fail with the given error, e.g. the
+// one of a deadlock or a serialization failure.
+func (s *Server) FailNext(err error) {
+	s.mu.Lock()
+	s.fail = err
+	s.mu.Unlock()
+}
+
+func (s *Server) takeFailure() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.fail
+	s.fail = nil
+	return err
+}
+
+type connector struct {
+	s *Server
+}
+
+func (c connector) Connect(context.Context) (driver.Conn, error) {
+	return &conn{s: c.s}, nil
+}
+
+func (c connector) Driver() driver.Driver {
+	return drv(c)
+}
+
+type drv struct {
+	s *Server
+}
+
+func (d drv) Open(string) (driver.Conn, error) {
+	return &conn{s: d.s}, nil
+}
+
+type conn struct {
+	s  *Server
+	tx tables
+}
+
+func (c *conn) Prepare(query string) (driver.Stmt, error) {
+	return &stmt{c: c, query: query}, nil
+}
+
+func (c *conn) Close() error {
+	if c.tx != nil {
+		c.tx = nil
+		c.s.tx.Unlock()
+	}
+	return nil
+}
+
+func (c *conn) Begin() (driver.Tx, error) {
+	if c.tx != nil {
+		return nil, errors.New("sqldbtest: transaction already started")
+	}
+	c.s.tx.Lock()
+	c.tx = c.s.tables.clone()
+	return c, nil
+}
+
+// BeginTx starts a transaction; all of them are serializable.
+func (c *conn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	return c.Begin()
+}
+
+func (c *conn) Commit() error {
+	c.s.tables = c.tx
+	c.tx = nil
+	c.s.tx.Unlock()
+	return nil
+}
+
+func (c *conn) Rollback() error {
+	c.tx = nil
+	c.s.tx.Unlock()
+	return nil
+}
+
+// run runs the statement in the transaction of the connection, if any.
+func (c *conn) run(query string, args []driver.Value) (int64, *rows, error) {
+	if err := c.s.takeFailure(); err != nil {
+		return 0, nil, err
+	}
+	t := c.tx
+	if t == nil {
+		c.s.tx.Lock()
+		defer c.s.tx.Unlock()
+		t = c.s.tables
+	}
+	return execute(t, query, args)
+}
+
+type stmt struct {
+	c     *conn
+	query string
+}
+
+func (s *stmt) Close() error  { return nil }
+func (s *stmt) NumInput() int { return -1 }
+
+func (s *stmt) Exec(args []driver.Value) (driver.Result, error) {
+	n, _, err := s.c.run(s.query, args)
+	if err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(n), nil
+}
+
+func (s *stmt) Query(args []driver.Value) (driver.Rows, error) {
+	_, r, err := s.c.run(s.query, args)
+	if err != nil {
+		return nil, err
+	}
+	if r == nil {
+		return nil, errors.Errorf("sqldbtest: statement %q does not return rows", s.query)
+	}
+	return r, nil
+}
+
+func unquote(s string) string {
+	return strings.Replace(s, `""`, `"`, -1)
+}
+
+func arg(args []driver.Value, n int) ([]byte, error) {
+	if n < 1 || n > len(args) {
+		return nil, errors.Errorf("sqldbtest: missing argument $%d", n)
+	}
+	switch v := args[n-1].(type) {
+	case []byte:
+		return v, nil
+	case string:
+		return []byte(v), nil
+	default:
+		return nil, errors.Errorf("sqldbtest: unsupported argument type %T", v)
+	}
+}
+
+func table(t tables, name string) (map[string][]byte, error) {
+	rows, ok := t[name]
+	if !ok {
+		return nil, errors.Errorf(`pq: relation "%s" does not exist`, name)
+	}
+	return rows, nil
+}
+
+// execute runs the statement on the tables, returning the number of
+// affected rows or the rows selected.
+func execute(t tables, query string, args []driver.Value) (int64, *rows, error) {
+	if m := createRe.FindStringSubmatch(query); m != nil {
+		if _, ok := t[unquote(m[1])]; !ok {
+			t[unquote(m[1])] = make(map[string][]byte)
+		}
+		return 0, nil, nil
+	}
+	if m := dropRe.FindStringSubmatch(query); m != nil {
+		if _, err := table(t, unquote(m[1])); err != nil {
+			return 0, nil, err
+		}
+		delete(t, unquote(m[1]))
+		return 0, nil, nil
+	}
+	if m := getRe.FindStringSubmatch(query); m != nil {
+		rs, err := table(t, unquote(m[1]))
+		if err != nil {
+			return 0, nil, err
+		}
+		key, err := arg(args, 1)
+		if err != nil {
+			return 0, nil, err
+		}
+		r := &rows{columns: []string{"nvalue"}}
+		if v, ok := rs[string(key)]; ok {
+			r.values = append(r.values, [][]byte{v})
+		}
+		return 0, r, nil
+	}
+	if m := insertRe.FindStringSubmatch(query); m != nil {
+		rs, err := table(t, unquote(m[1]))
+		if err != nil {
+			return 0, nil, err
+		}
+		key, err := arg(args, 1)
+		if err != nil {
+			return 0, nil, err
+		}
+		value, err := arg(args, 2)
+		if err != nil {
+			return 0, nil, err
+		}
+		if _, ok := rs[string(key)]; ok && len(m[2]) == 0 {
+			return 0, nil, errors.New(`pq: duplicate key value violates unique constraint`)
+		}
+		rs[string(key)] = append([]byte{}, value...)
+		return 1, nil, nil
+	}
+	if m := updateRe.FindStringSubmatch(query); m != nil {
+		rs, err := table(t, unquote(m[1]))
+		if err != nil {
+			return 0, nil, err
+		}
+		value, err := arg(args, 1)
+		if err != nil {
+			return 0, nil, err
+		}
+		key, err := arg(args, 2)
+		if err != nil {
+			return 0, nil, err
+		}
+		if _, ok := rs[string(key)]; !ok {
+			return 0, nil, nil
+		}
+		rs[string(key)] = append([]byte{}, value...)
+		return 1, nil, nil
+	}
+	if m := deleteRe.FindStringSubmatch(query); m != nil {
+		rs, err := table(t, unquote(m[1]))
+		if err != nil {
+			return 0, nil, err
+		}
+		key, err := arg(args, 1)
+		if err != nil {
+			return 0, nil, err
+		}
+		if _, ok := rs[string(key)]; !ok {
+			return 0, nil, nil
+		}
+		delete(rs, string(key))
+		return 1, nil, nil
+	}
+	if m := listRe.FindStringSubmatch(query); m != nil {
+		return list(t, m, args)
+	}
+	return 0, nil, errors.Errorf("sqldbtest: unsupported statement %q", query)
+}
+
+// list runs a select of the keys and values of a table.
+func list(t tables, m []string, args []driver.Value) (int64, *rows, error) {
+	rs, err := table(t, unquote(m[1]))
+	if err != nil {
+		return 0, nil, err
+	}
+	type cond struct {
+		op  string
+		val []byte
+	}
+	var conds []cond
+	if len(m[2]) > 0 {
+		for _, s := range strings.Split(m[2], " AND ") {
+			cm := condRe.FindStringSubmatch(s)
+			if cm == nil {
+				return 0, nil, errors.Errorf("sqldbtest: unsupported condition %q", s)
+			}
+			n, _ := strconv.Atoi(cm[2])
+			v, err := arg(args, n)
+			if err != nil {
+				return 0, nil, err
+			}
+			conds = append(conds, cond{cm[1], v})
+		}
+	}
+	limit := -1
+	if len(m[3]) > 0 {
+		limit, _ = strconv.Atoi(m[3])
+	}
+
+	keys := make([]string, 0, len(rs))
+	for k := range rs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	r := &rows{columns: []string{"nkey", "nvalue"}}
+	for _, k := range keys {
+		if limit >= 0 && len(r.values) == limit {
+			break
+		}
+		ok := true
+		for _, c := range conds {
+			cmp := bytes.Compare([]byte(k), c.val)
+			switch c.op {
+			case ">=":
+				ok = ok && cmp >= 0
+			case ">":
+				ok = ok && cmp > 0
+			case "<":
+				ok = ok && cmp < 0
+			}
+		}
+		if ok {
+			r.values = append(r.values, [][]byte{[]byte(k), rs[k]})
+		}
+	}
+	return 0, r, nil
+}
+
+type rows struct {
+	columns []string
+	values  [][][]byte
+}
+
+func (r *rows) Columns() []string { return r.columns }
+func (r *rows) Close() error      { return nil }
+
+func (r *rows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	for i, v := range r.values[0] {
+		dest[i] = append([]byte{}, v...)
+	}
+	r.values = r.values[1:]
+	return nil
+}